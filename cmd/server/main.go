@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/8thgencore/valchemy/internal/app"
 )
@@ -20,8 +23,12 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Stop the application on SIGINT and SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Run application
-	if err := application.Run(); err != nil {
+	if err := application.Run(ctx); err != nil {
 		log.Printf("Application error: %v", err)
 		os.Exit(1)
 	}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/8thgencore/valchemy/internal/vfs"
+	"github.com/8thgencore/valchemy/internal/wal"
+	"github.com/8thgencore/valchemy/internal/wal/inspect"
+	"github.com/8thgencore/valchemy/internal/wal/segment"
+	"github.com/alecthomas/kong"
+)
+
+// Globals are the flags shared by all commands
+type Globals struct {
+	Dir string `help:"WAL data directory." default:"./data/wal" short:"d" type:"path"`
+}
+
+// CLI commands
+var cli struct {
+	Globals
+
+	List     ListCmd     `cmd:"" help:"List the segments with their sizes and entry counts."`
+	Dump     DumpCmd     `cmd:"" help:"Print the entries as JSON lines."`
+	Verify   VerifyCmd   `cmd:"" help:"Verify the framing and the checksums of the records."`
+	Truncate TruncateCmd `cmd:"" help:"Cut a segment at its last good record. The server must be stopped."`
+	Restore  RestoreCmd  `cmd:"" help:"Rebuild an empty WAL data directory from the archived segments."`
+}
+
+// ListCmd lists the segments
+type ListCmd struct{}
+
+// Run runs the list command
+func (c *ListCmd) Run(g *Globals) error {
+	stats, err := inspect.Stat(g.Dir)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SEGMENT\tSIZE\tENTRIES\tFIRST LSN\tLAST LSN\tSTATUS")
+	for _, stat := range stats {
+		status := "ok"
+		if stat.Err != nil {
+			status = "corrupt"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%s\n",
+			stat.Name, stat.Size, stat.Entries, stat.FirstLSN, stat.LastLSN, status)
+	}
+
+	return w.Flush()
+}
+
+// DumpCmd prints the entries
+type DumpCmd struct {
+	Prefix    string `help:"Only print the entries of the keys with this prefix."`
+	Operation string `help:"Only print the entries of this operation (SET, DELETE, CLEAR, EXPIRE, BATCH)." short:"o"`
+}
+
+// Run runs the dump command
+func (c *DumpCmd) Run(g *Globals) error {
+	filter := inspect.Filter{KeyPrefix: c.Prefix}
+	if c.Operation != "" {
+		op, err := inspect.ParseOperation(c.Operation)
+		if err != nil {
+			return err
+		}
+		filter.Operation = op
+	}
+
+	return inspect.Dump(g.Dir, filter, os.Stdout)
+}
+
+// VerifyCmd verifies the segments
+type VerifyCmd struct{}
+
+// Run runs the verify command
+func (c *VerifyCmd) Run(g *Globals) error {
+	stats, err := inspect.Stat(g.Dir)
+	if err != nil {
+		return err
+	}
+
+	corrupt := 0
+	for _, stat := range stats {
+		if stat.Err == nil {
+			fmt.Printf("%s: ok, %d entries\n", stat.Name, stat.Entries)
+			continue
+		}
+		corrupt++
+		fmt.Println(stat.Err)
+
+		var corruption *segment.CorruptionError
+		if errors.As(stat.Err, &corruption) && corruption.Torn {
+			fmt.Printf("%s: the incomplete record can be removed with truncate\n", stat.Name)
+		}
+	}
+
+	if corrupt > 0 {
+		return fmt.Errorf("%d of %d segments are corrupt", corrupt, len(stats))
+	}
+
+	return nil
+}
+
+// TruncateCmd truncates a segment
+type TruncateCmd struct {
+	Segment string `arg:"" help:"Name of the segment file, e.g. wal-1.log."`
+	Force   bool   `help:"Also cut a segment whose corrupt record is followed by other data."`
+}
+
+// Run runs the truncate command
+func (c *TruncateCmd) Run(g *Globals) error {
+	removed, err := inspect.Truncate(g.Dir, c.Segment, c.Force)
+	if err != nil {
+		return err
+	}
+
+	if removed == 0 {
+		fmt.Printf("%s is intact\n", c.Segment)
+	} else {
+		fmt.Printf("%s truncated, %d bytes removed\n", c.Segment, removed)
+	}
+
+	return nil
+}
+
+// RestoreCmd restores the WAL from the archive
+type RestoreCmd struct {
+	Archive string    `help:"WAL archive directory." required:"" type:"existingdir"`
+	LSN     uint64    `help:"Restore the entries up to this LSN." name:"lsn"`
+	Time    time.Time `help:"Restore the entries accepted up to this time (RFC 3339)."`
+}
+
+// Run runs the restore command
+func (c *RestoreCmd) Run(g *Globals) error {
+	result, err := wal.Restore(vfs.OS, c.Archive, g.Dir, wal.RestoreTarget{LSN: c.LSN, Time: c.Time})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Restored %d entries from %d segments to %s\n", result.Entries, result.Segments, g.Dir)
+	if result.LastTimestamp != 0 {
+		fmt.Printf("Last entry: LSN %d at %s\n",
+			result.LastLSN, time.Unix(0, result.LastTimestamp).UTC().Format(time.RFC3339Nano))
+	} else {
+		fmt.Printf("Last entry: LSN %d\n", result.LastLSN)
+	}
+	fmt.Println("Start the server on an empty storage engine and with a new archive directory")
+
+	return nil
+}
+
+func main() {
+	ctx := kong.Parse(&cli,
+		kong.Name("valchemy-wal"),
+		kong.Description("Inspect, verify and repair the WAL segments of a stopped server."),
+		kong.UsageOnError(),
+	)
+
+	err := ctx.Run(&cli.Globals)
+	ctx.FatalIfErrorf(err)
+}
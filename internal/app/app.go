@@ -1,6 +1,8 @@
 package app
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 
@@ -9,8 +11,11 @@ import (
 	"github.com/8thgencore/valchemy/internal/replication"
 	"github.com/8thgencore/valchemy/internal/server"
 	"github.com/8thgencore/valchemy/internal/storage"
+	"github.com/8thgencore/valchemy/internal/storage/snapshot"
+	"github.com/8thgencore/valchemy/internal/vfs"
 	"github.com/8thgencore/valchemy/internal/wal"
 	"github.com/8thgencore/valchemy/pkg/logger"
+	"github.com/8thgencore/valchemy/pkg/logger/sl"
 )
 
 // App represents the main application
@@ -19,6 +24,8 @@ type App struct {
 	log        *slog.Logger
 	server     *server.Server
 	replicator *replication.Manager
+	engine     storage.Storage
+	wal        wal.WAL
 }
 
 // New creates a new instance of the application
@@ -33,19 +40,36 @@ func New(configPath string) (*App, error) {
 	log := logger.New(cfg.Env)
 
 	// Initialize WAL
-	w, err := wal.New(cfg.WAL)
+	walService, err := wal.New(cfg.WAL, vfs.OS, log)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create WAL: %w", err)
 	}
+	var (
+		w      wal.WAL
+		source replication.Source
+	)
+	if walService != nil {
+		w = walService
+		source = walService
+	}
+
+	// Initialize storage engine
+	engine, err := newStorage(cfg, log, w)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage engine: %w", err)
+	}
 
 	// Initialize replication manager
-	replicator := replication.New(cfg.Replication, log, cfg.WAL.DataDirectory)
+	replicator := replication.New(cfg.Replication, log, vfs.OS, cfg.WAL.DataDirectory, source, engine)
 
-	// Initialize storage engine
-	engine := storage.NewEngine(log, w)
+	// With semi-synchronous replication the writes wait for the replicas.
+	// A replica may be promoted, so the waiter is set whatever the role.
+	if w != nil && cfg.Replication.MinSyncReplicas > 0 {
+		engine.SetReplicaWaiter(replicator)
+	}
 
 	// Initialize command handler
-	handler := compute.NewHandler(log, engine, cfg.Replication.ReplicaType)
+	handler := compute.NewHandler(log, engine, cfg.Replication.ReplicaType, replicator)
 
 	// Initialize server
 	srv := server.NewServer(log, &cfg.Network, handler)
@@ -55,17 +79,88 @@ func New(configPath string) (*App, error) {
 		log:        log,
 		server:     srv,
 		replicator: replicator,
+		engine:     engine,
+		wal:        w,
 	}, nil
 }
 
-// Run starts the application
-func (a *App) Run() error {
+// newStorage creates the storage engine selected in the configuration
+func newStorage(cfg *config.Config, log *slog.Logger, w wal.WAL) (storage.Storage, error) {
+	// The WAL is truncated at its checkpoints only on the master: replicas
+	// keep the segments received from it, but for those an on-disk engine
+	// has flushed. The replication switches the truncation when the role of
+	// the node changes.
+	isMaster := cfg.Replication.ReplicaType == config.Master
+
+	switch cfg.Engine.Type {
+	case config.InMemory:
+		// A replica loads the snapshots too: it may have been a master
+		// whose snapshot covers the segments it truncated
+		engine, err := storage.NewEngine(log, w, snapshot.New(cfg.WAL))
+		if err != nil {
+			return nil, err
+		}
+		engine.SetWALTruncation(isMaster)
+		return engine, nil
+	case config.OnDisk:
+		return storage.NewDiskEngine(log, w, cfg.Engine, isMaster)
+	default:
+		return nil, fmt.Errorf("unknown engine type: %s", cfg.Engine.Type)
+	}
+}
+
+// Run starts the application and blocks until the context is canceled or
+// the server fails, then shuts the application down
+func (a *App) Run(ctx context.Context) error {
 	a.log.Info("Starting application", "env", a.cfg.Env)
 
 	// Start replication if enabled
 	if err := a.replicator.Start(); err != nil {
+		a.shutdown()
 		return fmt.Errorf("failed to start replication: %w", err)
 	}
 
-	return a.server.Start()
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- a.server.Start()
+	}()
+
+	var err error
+	select {
+	case <-ctx.Done():
+		a.log.Info("Shutting down application")
+	case err = <-serverErr:
+		if err == nil {
+			err = errors.New("server stopped unexpectedly")
+		}
+	}
+
+	a.shutdown()
+
+	return err
+}
+
+// shutdown stops accepting clients, drains the open connections, stops
+// replication and the storage and finally flushes and closes the WAL
+func (a *App) shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), a.cfg.Network.ShutdownTimeout)
+	defer cancel()
+
+	if err := a.server.Shutdown(ctx); err != nil {
+		a.log.Error("Failed to drain connections", sl.Err(err))
+	}
+
+	a.replicator.Stop()
+
+	if err := a.engine.Close(); err != nil {
+		a.log.Error("Failed to close storage engine", sl.Err(err))
+	}
+
+	if a.wal != nil {
+		if err := a.wal.Close(); err != nil {
+			a.log.Error("Failed to close WAL", sl.Err(err))
+		}
+	}
+
+	a.log.Info("Application stopped")
 }
@@ -1,86 +1,335 @@
 package compute
 
 import (
+	"fmt"
 	"log/slog"
+	"strings"
+	"time"
 
 	"github.com/8thgencore/valchemy/internal/config"
+	"github.com/8thgencore/valchemy/internal/replication"
 	"github.com/8thgencore/valchemy/internal/storage"
 )
 
+// Replication reports the replication state of the node and changes its role
+type Replication interface {
+	Info() replication.Info
+	Role() config.ReplicationType
+	Fenced() bool
+	Promote() error
+	ReplicaOf(host, port string) error
+	// BeginWrite holds off the role changes until end is called
+	BeginWrite() (end func())
+}
+
 // Handler is a struct that handles commands
 type Handler struct {
 	log         *slog.Logger
-	engine      *storage.Engine
+	engine      storage.Storage
 	replicaType config.ReplicationType
+	replication Replication
 }
 
-// NewHandler creates a new Handler
-func NewHandler(log *slog.Logger, engine *storage.Engine, replicaType config.ReplicationType) *Handler {
-	return &Handler{
+// NewHandler creates a new Handler. The replication may be nil, in which
+// case INFO only reports the role of the node and its role cannot change.
+// Otherwise the writes of the engine check the role as they reach the WAL.
+func NewHandler(
+	log *slog.Logger,
+	engine storage.Storage,
+	replicaType config.ReplicationType,
+	replication Replication,
+) *Handler {
+	h := &Handler{
 		log:         log,
 		engine:      engine,
 		replicaType: replicaType,
+		replication: replication,
+	}
+	if replication != nil {
+		engine.SetWriteGate(h.beginWrite)
+	}
+
+	return h
+}
+
+// ReplicaType returns the current replication role of the node
+func (h *Handler) ReplicaType() config.ReplicationType {
+	if h.replication == nil {
+		return h.replicaType
 	}
+
+	return h.replication.Role()
 }
 
 // Handle handles a command string
 func (h *Handler) Handle(input string) (string, error) {
+	args, err := Tokenize(input)
+	if err != nil {
+		return "", err
+	}
+
+	return h.HandleArgs(args)
+}
+
+// HandleArgs handles a command given as its name followed by the arguments
+func (h *Handler) HandleArgs(args []string) (string, error) {
 	// If input is empty, do nothing
-	if input == "" {
+	if len(args) == 0 {
 		return "", nil
 	}
 
-	h.log.Debug("Handling command: " + input)
+	h.log.Debug("Handling command", "command", args[0], "args", len(args)-1)
 
-	cmd, err := ParseCommand(input)
+	cmd, err := NewCommand(args)
 	if err != nil {
 		return "", err
 	}
 
-	return h.handleCommand(cmd)
+	reply, err := h.Execute(cmd)
+	if err != nil {
+		return "", err
+	}
+
+	return reply.String(), nil
 }
 
-// handleCommand handles a parsed command (exported for testing)
-func (h *Handler) handleCommand(cmd Command) (string, error) {
-	// Check if we're on replica and command is not allowed
-	if h.replicaType == config.Replica {
-		switch cmd.Type {
-		case CommandHelp, CommandGet:
-			// These commands are allowed
-		default:
-			return "", ErrReadOnlyReplica
+// Execute executes a parsed command and returns its typed reply
+func (h *Handler) Execute(cmd Command) (Reply, error) {
+	if readOnly(cmd.Type) {
+		return h.execute(cmd)
+	}
+
+	// Replicas and fenced masters only accept the read-only commands. The
+	// engine checks the role again when a write reaches the WAL.
+	if err := h.writeError(); err != nil {
+		return Reply{}, err
+	}
+
+	// Writes are rejected while the WAL cannot persist them
+	if err := h.engine.WALError(); err != nil {
+		return Reply{}, fmt.Errorf("%w: %v", ErrWALUnavailable, err)
+	}
+	reply, err := h.execute(cmd)
+	if err != nil {
+		// The write may have been the one that put the WAL in the failed state
+		if walErr := h.engine.WALError(); walErr != nil {
+			return Reply{}, fmt.Errorf("%w: %v", ErrWALUnavailable, walErr)
 		}
 	}
 
+	return reply, err
+}
+
+// writeError returns the error a write is rejected with in the current role
+// of the node, nil if the node accepts writes
+func (h *Handler) writeError() error {
+	if h.ReplicaType() == config.Replica {
+		return ErrReadOnlyReplica
+	}
+	if h.replication != nil && h.replication.Fenced() {
+		return ErrFencedMaster
+	}
+
+	return nil
+}
+
+// beginWrite holds off the role changes while a write reaches the WAL and
+// rejects the write unless the node accepts writes. The write waits for the
+// replicas after end, so that slow replicas do not hold off a role change.
+func (h *Handler) beginWrite() (end func(), err error) {
+	end = h.replication.BeginWrite()
+	if err = h.writeError(); err != nil {
+		end()
+		return nil, err
+	}
+
+	return end, nil
+}
+
+// readOnly reports whether a command leaves the data unchanged
+func readOnly(cmdType string) bool {
+	switch cmdType {
+	case CommandHelp, CommandGet, CommandMGet, CommandTTL, CommandWAL, CommandInfo, CommandReplicas,
+		CommandPromote, CommandReplicaOf:
+		return true
+	}
+
+	return false
+}
+
+// execute runs a command on the engine
+func (h *Handler) execute(cmd Command) (Reply, error) {
 	switch cmd.Type {
 	case CommandHelp:
-		return HelpMessage, nil
+		return StatusReply(HelpMessage), nil
 
 	case CommandSet:
+		if len(cmd.Args) == 4 {
+			ttl, err := ParseSeconds(cmd.Args[3])
+			if err != nil {
+				return Reply{}, err
+			}
+			if err := h.engine.SetEx(cmd.Args[0], cmd.Args[1], ttl); err != nil {
+				return Reply{}, err
+			}
+			return StatusReply(ResponseOK), nil
+		}
 		if err := h.engine.Set(cmd.Args[0], cmd.Args[1]); err != nil {
-			return "", err
+			return Reply{}, err
 		}
-		return ResponseOK, nil
+		return StatusReply(ResponseOK), nil
 
 	case CommandGet:
 		value, ok := h.engine.Get(cmd.Args[0])
 		if !ok {
-			return "", ErrKeyNotFound
+			return Reply{}, ErrKeyNotFound
 		}
-		return value, nil
+		return BulkReply(value), nil
 
 	case CommandDel:
-		if err := h.engine.Delete(cmd.Args[0]); err != nil {
-			return "", err
+		var deleted int
+		if len(cmd.Args) == 1 {
+			ok, err := h.engine.Delete(cmd.Args[0])
+			if err != nil {
+				return Reply{}, err
+			}
+			if ok {
+				deleted = 1
+			}
+		} else {
+			var err error
+			if deleted, err = h.engine.MDelete(cmd.Args); err != nil {
+				return Reply{}, err
+			}
+		}
+		// The number of keys deleted is only reported by the RESP front-end
+		reply := StatusReply(ResponseOK)
+		reply.Int = int64(deleted)
+		return reply, nil
+
+	case CommandMSet:
+		pairs := make([]storage.KeyValue, 0, len(cmd.Args)/2)
+		for i := 0; i < len(cmd.Args); i += 2 {
+			pairs = append(pairs, storage.KeyValue{Key: cmd.Args[i], Value: cmd.Args[i+1]})
+		}
+		if err := h.engine.MSet(pairs); err != nil {
+			return Reply{}, err
 		}
-		return ResponseOK, nil
+		return StatusReply(ResponseOK), nil
+
+	case CommandMGet:
+		values, found := h.engine.MGet(cmd.Args)
+		elems := make([]Reply, len(values))
+		for i, value := range values {
+			if found[i] {
+				elems[i] = BulkReply(value)
+			} else {
+				elems[i] = NilReply()
+			}
+		}
+		return ArrayReply(elems), nil
+
+	case CommandMDel:
+		if _, err := h.engine.MDelete(cmd.Args); err != nil {
+			return Reply{}, err
+		}
+		return StatusReply(ResponseOK), nil
+
+	case CommandExpire:
+		ttl, err := ParseSeconds(cmd.Args[1])
+		if err != nil {
+			return Reply{}, err
+		}
+		ok, err := h.engine.Expire(cmd.Args[0], ttl)
+		if err != nil {
+			return Reply{}, err
+		}
+		if !ok {
+			return Reply{}, ErrKeyNotFound
+		}
+		return StatusReply(ResponseOK), nil
+
+	case CommandPersist:
+		ok, err := h.engine.Persist(cmd.Args[0])
+		if err != nil {
+			return Reply{}, err
+		}
+		if !ok {
+			return Reply{}, ErrKeyNotFound
+		}
+		return StatusReply(ResponseOK), nil
+
+	case CommandTTL:
+		ttl, ok := h.engine.TTL(cmd.Args[0])
+		if !ok {
+			return Reply{}, ErrKeyNotFound
+		}
+		if ttl == storage.NoExpiration {
+			return IntegerReply(-1), nil
+		}
+		// Round to the nearest second like Redis does
+		return IntegerReply(int64((ttl + time.Second/2) / time.Second)), nil
 
 	case CommandClear:
 		if err := h.engine.Clear(); err != nil {
-			return "", err
+			return Reply{}, err
+		}
+		return StatusReply(ResponseOK), nil
+
+	case CommandSnapshot:
+		if err := h.engine.Snapshot(); err != nil {
+			return Reply{}, err
+		}
+		return StatusReply(ResponseOK), nil
+
+	case CommandWAL:
+		if strings.ToUpper(cmd.Args[0]) == SubcommandResume {
+			if err := h.engine.ResumeWAL(); err != nil {
+				return Reply{}, err
+			}
+			return StatusReply(ResponseOK), nil
+		}
+		if err := h.engine.WALError(); err != nil {
+			return StatusReply(WALStatusReadOnly + ": " + err.Error()), nil
+		}
+		return StatusReply(WALStatusWritable), nil
+
+	case CommandInfo:
+		return BulkReply(formatInfo(h.replicationInfo(), time.Now())), nil
+
+	case CommandReplicas:
+		replicas := h.replicationInfo().Replicas
+		now := time.Now()
+		elems := make([]Reply, len(replicas))
+		for i, r := range replicas {
+			elems[i] = BulkReply(formatReplica(r, now))
+		}
+		return ArrayReply(elems), nil
+
+	case CommandPromote:
+		if h.replication == nil {
+			return Reply{}, ErrNoReplication
+		}
+		if err := h.replication.Promote(); err != nil {
+			return Reply{}, err
+		}
+		return StatusReply(ResponseOK), nil
+
+	case CommandReplicaOf:
+		if h.replication == nil {
+			return Reply{}, ErrNoReplication
+		}
+		var err error
+		if strings.EqualFold(cmd.Args[0], ArgumentNo) {
+			err = h.replication.Promote()
+		} else {
+			err = h.replication.ReplicaOf(cmd.Args[0], cmd.Args[1])
+		}
+		if err != nil {
+			return Reply{}, err
 		}
-		return ResponseOK, nil
+		return StatusReply(ResponseOK), nil
 	}
 
-	return "", ErrUnknownCommand
+	return Reply{}, ErrUnknownCommand
 }
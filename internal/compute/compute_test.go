@@ -4,20 +4,25 @@ import (
 	"errors"
 	"log/slog"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/8thgencore/valchemy/internal/config"
+	"github.com/8thgencore/valchemy/internal/replication"
 	"github.com/8thgencore/valchemy/internal/storage"
 	"github.com/8thgencore/valchemy/internal/wal/mocks"
+	"github.com/8thgencore/valchemy/internal/wal/segment"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
-func setupTest(_ *testing.T) (*Handler, *storage.Engine, *mocks.MockWAL) {
+func setupTest(t *testing.T) (*Handler, *storage.Engine, *mocks.MockWAL) {
 	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
 	mockWAL := mocks.NewMockWAL()
-	engine := storage.NewEngine(logger, mockWAL)
-	handler := NewHandler(logger, engine, config.Master)
+	engine, err := storage.NewEngine(logger, mockWAL, nil)
+	require.NoError(t, err)
+	handler := NewHandler(logger, engine, config.Master, nil)
 
 	return handler, engine, mockWAL
 }
@@ -25,8 +30,9 @@ func setupTest(_ *testing.T) (*Handler, *storage.Engine, *mocks.MockWAL) {
 func TestReplicaHandler(t *testing.T) {
 	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
 	mockWAL := mocks.NewMockWAL()
-	engine := storage.NewEngine(logger, mockWAL)
-	handler := NewHandler(logger, engine, config.Replica)
+	engine, err := storage.NewEngine(logger, mockWAL, nil)
+	require.NoError(t, err)
+	handler := NewHandler(logger, engine, config.Replica, nil)
 
 	t.Run("Allowed commands on replica", func(t *testing.T) {
 		// Test GET command
@@ -35,10 +41,25 @@ func TestReplicaHandler(t *testing.T) {
 		require.NoError(t, err)
 		assert.Equal(t, "value1", result)
 
+		// Test MGET command
+		result, err = handler.Handle("MGET key1")
+		require.NoError(t, err)
+		assert.Equal(t, `"value1"`, result)
+
+		// Test TTL command
+		result, err = handler.Handle("TTL key1")
+		require.NoError(t, err)
+		assert.Equal(t, "-1", result)
+
 		// Test HELP command
 		result, err = handler.Handle("HELP")
 		require.NoError(t, err)
 		assert.Equal(t, HelpMessage, result)
+
+		// Test INFO command
+		result, err = handler.Handle("INFO")
+		require.NoError(t, err)
+		assert.Contains(t, result, "role:replica")
 	})
 
 	t.Run("Forbidden commands on replica", func(t *testing.T) {
@@ -46,12 +67,19 @@ func TestReplicaHandler(t *testing.T) {
 			"SET key1 value1",
 			"DEL key1",
 			"CLEAR",
+			"SNAPSHOT",
+			"EXPIRE key1 10",
+			"PERSIST key1",
+			"MSET key1 value1",
+			"MDEL key1",
 		}
 
 		for _, cmd := range testCases {
 			result, err := handler.Handle(cmd)
 			assert.Error(t, err)
-			assert.Equal(t, "replica is read-only: only GET and HELP commands are allowed", err.Error())
+			assert.Equal(t,
+				"replica is read-only: only GET, MGET, TTL, WAL, INFO, REPLICAS, PROMOTE, REPLICAOF and HELP commands are allowed",
+				err.Error())
 			assert.Empty(t, result)
 		}
 	})
@@ -115,6 +143,16 @@ func TestHandler(t *testing.T) {
 		// Check that the value is actually deleted
 		_, exists := engine.Get("key1")
 		assert.False(t, exists)
+
+		// Several keys are deleted at once; the reply carries the number of
+		// keys that existed for the RESP front-end
+		require.NoError(t, engine.MSet([]storage.KeyValue{{Key: "key1", Value: "1"}, {Key: "key2", Value: "2"}}))
+		reply, err := handler.Execute(Command{Type: CommandDel, Args: []string{"key1", "missing", "key2"}})
+		require.NoError(t, err)
+		assert.Equal(t, "OK", reply.String())
+		assert.Equal(t, int64(2), reply.Int)
+		_, exists = engine.Get("key2")
+		assert.False(t, exists)
 	})
 
 	t.Run("DEL command with WAL error", func(t *testing.T) {
@@ -133,6 +171,49 @@ func TestHandler(t *testing.T) {
 		assert.Empty(t, result)
 	})
 
+	t.Run("Multi-key commands", func(t *testing.T) {
+		handler, engine, mockWAL := setupTest(t)
+
+		result, err := handler.Handle("MSET key1 value1 key2 \"value 2\"")
+		require.NoError(t, err)
+		assert.Equal(t, "OK", result)
+
+		result, err = handler.Handle("MGET key1 missing key2")
+		require.NoError(t, err)
+		assert.Equal(t, "\"value1\"\n(nil)\n\"value 2\"", result)
+
+		// A line break in a value and a value looking like a missing one
+		// are told apart from the other elements
+		result, err = handler.Handle(`MSET multi "line1\nline2" fake "(nil)" raw "a\"b\\c\x01"`)
+		require.NoError(t, err)
+		assert.Equal(t, "OK", result)
+		result, err = handler.Handle("MGET multi fake missing raw")
+		require.NoError(t, err)
+		assert.Equal(t, `"line1\nline2"`+"\n"+`"(nil)"`+"\n(nil)\n"+`"a\"b\\c\x01"`, result)
+		lines := strings.Split(result, "\n")
+		require.Len(t, lines, 4)
+		values, err := Tokenize(strings.Join([]string{lines[0], lines[1], lines[3]}, " "))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"line1\nline2", "(nil)", "a\"b\\c\x01"}, values)
+
+		result, err = handler.Handle("MDEL multi fake raw")
+		require.NoError(t, err)
+		assert.Equal(t, "OK", result)
+
+		result, err = handler.Handle("MDEL key1 key2")
+		require.NoError(t, err)
+		assert.Equal(t, "OK", result)
+
+		_, exists := engine.Get("key2")
+		assert.False(t, exists)
+		require.Len(t, mockWAL.Entries, 4)
+
+		_, err = handler.Handle("MSET key1")
+		assert.ErrorIs(t, err, ErrInvalidMSetFormat)
+		_, err = handler.Handle("MGET")
+		assert.ErrorIs(t, err, ErrInvalidFormat)
+	})
+
 	t.Run("GET nonexistent key", func(t *testing.T) {
 		handler, _, _ := setupTest(t)
 
@@ -174,6 +255,55 @@ func TestHandler(t *testing.T) {
 		assert.Empty(t, result)
 	})
 
+	t.Run("Expiration commands", func(t *testing.T) {
+		handler, engine, mockWAL := setupTest(t)
+
+		result, err := handler.Handle("SET key1 value1 EX 100")
+		require.NoError(t, err)
+		assert.Equal(t, "OK", result)
+		assert.NotZero(t, mockWAL.Entries[0].ExpiresAt)
+
+		result, err = handler.Handle("TTL key1")
+		require.NoError(t, err)
+		assert.Equal(t, "100", result)
+
+		result, err = handler.Handle("PERSIST key1")
+		require.NoError(t, err)
+		assert.Equal(t, "OK", result)
+
+		result, err = handler.Handle("TTL key1")
+		require.NoError(t, err)
+		assert.Equal(t, "-1", result)
+
+		result, err = handler.Handle("EXPIRE key1 50")
+		require.NoError(t, err)
+		assert.Equal(t, "OK", result)
+
+		result, err = handler.Handle("TTL key1")
+		require.NoError(t, err)
+		assert.Equal(t, "50", result)
+
+		// A non-positive time to live deletes the key
+		result, err = handler.Handle("EXPIRE key1 -1")
+		require.NoError(t, err)
+		assert.Equal(t, "OK", result)
+		_, exists := engine.Get("key1")
+		assert.False(t, exists)
+
+		for _, cmd := range []string{"TTL key1", "EXPIRE key1 10", "PERSIST key1"} {
+			_, err = handler.Handle(cmd)
+			assert.ErrorIs(t, err, ErrKeyNotFound, cmd)
+		}
+	})
+
+	t.Run("SNAPSHOT command without snapshots", func(t *testing.T) {
+		handler, _, _ := setupTest(t)
+
+		result, err := handler.Handle("SNAPSHOT")
+		assert.ErrorIs(t, err, storage.ErrSnapshotsDisabled)
+		assert.Empty(t, result)
+	})
+
 	t.Run("Invalid commands", func(t *testing.T) {
 		handler, _, _ := setupTest(t)
 
@@ -186,6 +316,7 @@ func TestHandler(t *testing.T) {
 			{"SET without value", "SET key1", ErrInvalidSetFormat},
 			{"GET without key", "GET", ErrInvalidFormat},
 			{"DEL without key", "DEL", ErrInvalidFormat},
+			{"SNAPSHOT with arguments", "SNAPSHOT now", ErrInvalidFormat},
 		}
 
 		for _, tc := range testCases {
@@ -228,3 +359,264 @@ func TestHandler(t *testing.T) {
 		assert.Empty(t, result)
 	})
 }
+
+func TestHandler_WALFailure(t *testing.T) {
+	handler, engine, mockWAL := setupTest(t)
+	require.NoError(t, engine.Set("key1", "value1"))
+
+	result, err := handler.Handle("WAL STATUS")
+	require.NoError(t, err)
+	assert.Equal(t, WALStatusWritable, result)
+
+	mockWAL.Failure = errors.New("no space left on device")
+
+	t.Run("writes are rejected", func(t *testing.T) {
+		for _, cmd := range []string{"SET key2 value2", "DEL key1", "MSET key2 value2", "EXPIRE key1 10", "CLEAR"} {
+			_, err := handler.Handle(cmd)
+			assert.ErrorIs(t, err, ErrWALUnavailable, cmd)
+			assert.ErrorContains(t, err, "no space left on device")
+		}
+		assert.Len(t, mockWAL.Entries, 1)
+	})
+
+	t.Run("reads are served", func(t *testing.T) {
+		result, err := handler.Handle("GET key1")
+		require.NoError(t, err)
+		assert.Equal(t, "value1", result)
+
+		result, err = handler.Handle("wal status")
+		require.NoError(t, err)
+		assert.Equal(t, "read-only: no space left on device", result)
+	})
+
+	t.Run("resume", func(t *testing.T) {
+		mockWAL.ResumeErr = errors.New("still full")
+		_, err := handler.Handle("WAL RESUME")
+		assert.EqualError(t, err, "still full")
+
+		mockWAL.ResumeErr = nil
+		result, err := handler.Handle("WAL RESUME")
+		require.NoError(t, err)
+		assert.Equal(t, ResponseOK, result)
+
+		result, err = handler.Handle("SET key2 value2")
+		require.NoError(t, err)
+		assert.Equal(t, ResponseOK, result)
+	})
+}
+
+type stubReplication struct {
+	info       replication.Info
+	promoteErr error
+	masterAddr string
+	// writes counts the writes that began, ended the ones that ended
+	writes, ended int
+	// beginWrite is called when a write begins
+	beginWrite func()
+}
+
+func (r *stubReplication) Info() replication.Info {
+	return r.info
+}
+
+func (r *stubReplication) Role() config.ReplicationType {
+	return r.info.Role
+}
+
+func (r *stubReplication) Fenced() bool {
+	return r.info.Fenced
+}
+
+func (r *stubReplication) Promote() error {
+	if r.promoteErr != nil {
+		return r.promoteErr
+	}
+	r.info.Role = config.Master
+	r.info.Fenced = false
+	r.info.Epoch++
+
+	return nil
+}
+
+func (r *stubReplication) ReplicaOf(host, port string) error {
+	r.info.Role = config.Replica
+	r.masterAddr = host + ":" + port
+
+	return nil
+}
+
+func (r *stubReplication) BeginWrite() func() {
+	r.writes++
+	if r.beginWrite != nil {
+		r.beginWrite()
+	}
+	return func() { r.ended++ }
+}
+
+func TestHandler_Replication(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	engine, err := storage.NewEngine(logger, mocks.NewMockWAL(), nil)
+	require.NoError(t, err)
+
+	t.Run("master", func(t *testing.T) {
+		handler := NewHandler(logger, engine, config.Master, &stubReplication{info: replication.Info{
+			Role:      config.Master,
+			NodeID:    "node-1",
+			ClusterID: "valchemy",
+			Epoch:     3,
+			LSN:       42,
+			Position:  segment.Position{SegmentID: 40, Offset: 300},
+			Replicas: []replication.ReplicaInfo{{
+				ID:          "node-2",
+				Address:     "10.0.0.2:51000",
+				Acked:       segment.Position{SegmentID: 40, Offset: 100},
+				AckedLSN:    40,
+				LastSeen:    time.Now().Add(-1500 * time.Millisecond),
+				BytesBehind: 200,
+			}},
+			MinSyncReplicas: 1,
+			SyncDegraded:    true,
+		}})
+
+		result, err := handler.Handle("info replication")
+		require.NoError(t, err)
+		assert.Contains(t, result, "# Replication\nrole:master\nnode_id:node-1\ncluster_id:valchemy\nepoch:3\nlsn:42\n")
+		assert.Contains(t, result, "min_sync_replicas:1\nsync_degraded:true\nfenced:false\n")
+		assert.Contains(t, result, "connected_replicas:1\n"+
+			"replica0:id=node-2,address=10.0.0.2:51000,lsn=40,segment=40,offset=100,bytes_behind=200,last_seen=")
+
+		result, err = handler.Handle("REPLICAS")
+		require.NoError(t, err)
+		assert.Regexp(t, `^"id=node-2,address=10.0.0.2:51000,lsn=40,.*,bytes_behind=200,last_seen=1\.5\d*s"$`, result)
+	})
+
+	t.Run("replica", func(t *testing.T) {
+		handler := NewHandler(logger, engine, config.Replica, &stubReplication{info: replication.Info{
+			Role:          config.Replica,
+			NodeID:        "node-2",
+			MasterAddress: "10.0.0.1:3233",
+			Connected:     true,
+			Applied:       segment.Position{SegmentID: 40, Offset: 100},
+			AppliedLSN:    40,
+		}})
+
+		result, err := handler.Handle("INFO")
+		require.NoError(t, err)
+		assert.Contains(t, result, "role:replica\n")
+		assert.Contains(t, result, "master_address:10.0.0.1:3233\nmaster_link:up\napplied_lsn:40\n")
+
+		result, err = handler.Handle("REPLICAS")
+		require.NoError(t, err)
+		assert.Empty(t, result)
+
+		result, err = handler.Handle("WAL STATUS")
+		require.NoError(t, err)
+		assert.Equal(t, WALStatusWritable, result)
+	})
+}
+
+func TestHandler_RoleChange(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	engine, err := storage.NewEngine(logger, mocks.NewMockWAL(), nil)
+	require.NoError(t, err)
+
+	t.Run("promote a replica", func(t *testing.T) {
+		repl := &stubReplication{info: replication.Info{Role: config.Replica}}
+		handler := NewHandler(logger, engine, config.Replica, repl)
+
+		_, err := handler.Handle("SET key1 value1")
+		assert.ErrorIs(t, err, ErrReadOnlyReplica)
+
+		result, err := handler.Handle("PROMOTE")
+		require.NoError(t, err)
+		assert.Equal(t, ResponseOK, result)
+		assert.Equal(t, config.Master, handler.ReplicaType())
+
+		result, err = handler.Handle("SET key1 value1")
+		require.NoError(t, err)
+		assert.Equal(t, ResponseOK, result)
+	})
+
+	t.Run("make a master a replica", func(t *testing.T) {
+		repl := &stubReplication{info: replication.Info{Role: config.Master}}
+		handler := NewHandler(logger, engine, config.Master, repl)
+
+		result, err := handler.Handle("REPLICAOF 10.0.0.2 3233")
+		require.NoError(t, err)
+		assert.Equal(t, ResponseOK, result)
+		assert.Equal(t, "10.0.0.2:3233", repl.masterAddr)
+		assert.Equal(t, config.Replica, handler.ReplicaType())
+
+		_, err = handler.Handle("DEL key1")
+		assert.ErrorIs(t, err, ErrReadOnlyReplica)
+
+		result, err = handler.Handle("REPLICAOF NO ONE")
+		require.NoError(t, err)
+		assert.Equal(t, ResponseOK, result)
+		assert.Equal(t, config.Master, handler.ReplicaType())
+	})
+
+	t.Run("writes hold off role changes", func(t *testing.T) {
+		repl := &stubReplication{info: replication.Info{Role: config.Master}}
+		handler := NewHandler(logger, engine, config.Master, repl)
+
+		_, err := handler.Handle("SET key1 value1")
+		require.NoError(t, err)
+		_, err = handler.Handle("GET key1")
+		require.NoError(t, err)
+		assert.Equal(t, 1, repl.writes)
+
+		// The role changes after the write was checked, before it reaches the WAL
+		repl.beginWrite = func() { repl.info.Role = config.Replica }
+		_, err = handler.Handle("SET key1 value2")
+		assert.ErrorIs(t, err, ErrReadOnlyReplica)
+		value, err := handler.Handle("GET key1")
+		require.NoError(t, err)
+		assert.Equal(t, "value1", value)
+
+		// A replica rejects the writes before they reach the engine
+		_, err = handler.Handle("SET key1 value3")
+		assert.ErrorIs(t, err, ErrReadOnlyReplica)
+
+		// Only the writes that reach the engine hold off the role changes
+		assert.Equal(t, 2, repl.writes)
+		assert.Equal(t, repl.writes, repl.ended)
+	})
+
+	t.Run("fenced master", func(t *testing.T) {
+		repl := &stubReplication{info: replication.Info{Role: config.Master, Fenced: true}}
+		handler := NewHandler(logger, engine, config.Master, repl)
+
+		_, err := handler.Handle("SET key1 value2")
+		assert.ErrorIs(t, err, ErrFencedMaster)
+		result, err := handler.Handle("GET key1")
+		require.NoError(t, err)
+		assert.Equal(t, "value1", result)
+		result, err = handler.Handle("INFO")
+		require.NoError(t, err)
+		assert.Contains(t, result, "fenced:true\n")
+		result, err = handler.Handle("WAL STATUS")
+		require.NoError(t, err)
+		assert.Equal(t, WALStatusWritable, result)
+
+		repl.promoteErr = errors.New("failed to reopen WAL")
+		_, err = handler.Handle("PROMOTE")
+		assert.EqualError(t, err, "failed to reopen WAL")
+
+		repl.promoteErr = nil
+		_, err = handler.Handle("PROMOTE")
+		require.NoError(t, err)
+		result, err = handler.Handle("SET key1 value2")
+		require.NoError(t, err)
+		assert.Equal(t, ResponseOK, result)
+	})
+
+	t.Run("without replication", func(t *testing.T) {
+		handler := NewHandler(logger, engine, config.Master, nil)
+
+		_, err := handler.Handle("PROMOTE")
+		assert.ErrorIs(t, err, ErrNoReplication)
+		_, err = handler.Handle("REPLICAOF NO ONE")
+		assert.ErrorIs(t, err, ErrNoReplication)
+	})
+}
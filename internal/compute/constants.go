@@ -7,20 +7,70 @@ const (
 	CommandDel   = "DEL"
 	CommandHelp  = "HELP"
 	CommandClear = "CLEAR"
+
+	CommandMSet = "MSET"
+	CommandMGet = "MGET"
+	CommandMDel = "MDEL"
+
+	CommandExpire  = "EXPIRE"
+	CommandTTL     = "TTL"
+	CommandPersist = "PERSIST"
+
+	CommandSnapshot = "SNAPSHOT"
+	CommandWAL      = "WAL"
+
+	CommandInfo      = "INFO"
+	CommandReplicas  = "REPLICAS"
+	CommandPromote   = "PROMOTE"
+	CommandReplicaOf = "REPLICAOF"
+)
+
+// REPLICAOF NO ONE arguments
+const (
+	ArgumentNo  = "NO"
+	ArgumentOne = "ONE"
+)
+
+// WAL subcommands
+const (
+	SubcommandStatus = "STATUS"
+	SubcommandResume = "RESUME"
 )
 
+// SectionReplication is the INFO section describing the replication
+const SectionReplication = "REPLICATION"
+
 // Response messages
 const (
 	ResponseOK = "OK"
+
+	// WALStatusWritable and WALStatusReadOnly are the states reported by WAL STATUS
+	WALStatusWritable = "writable"
+	WALStatusReadOnly = "read-only"
 )
 
 // Help messages
 const (
 	HelpMessage = "Available commands:\n" +
-		"  SET <key> <value>  - Set the value of a key\n" +
+		"  SET <key> <value> [EX <seconds>] - Set the value of a key, optionally with a time to live\n" +
 		"  GET <key>         - Get the value of a key\n" +
-		"  DEL <key>         - Delete a key\n" +
+		"  DEL <key> [<key> ...] - Delete one or more keys\n" +
+		"  MSET <key> <value> [<key> <value> ...] - Set several keys at once\n" +
+		"  MGET <key> [<key> ...] - Get the values of several keys, quoted, (nil) for missing ones\n" +
+		"  MDEL <key> [<key> ...] - Delete several keys at once\n" +
+		"  EXPIRE <key> <seconds> - Set the time to live of a key\n" +
+		"  TTL <key>         - Get the remaining time to live of a key in seconds (-1 if none)\n" +
+		"  PERSIST <key>     - Remove the time to live of a key\n" +
 		"  CLEAR             - Remove all keys\n" +
+		"  SNAPSHOT          - Save a snapshot and truncate the WAL\n" +
+		"  WAL STATUS        - Show whether the WAL accepts writes or why the node is read-only\n" +
+		"  WAL RESUME        - Accept writes again once the cause of a WAL failure is fixed\n" +
+		"  INFO [REPLICATION] - Show the replication role and position of the node and its replicas\n" +
+		"  REPLICAS          - List the replicas connected to the master and how far behind they are\n" +
+		"  PROMOTE           - Make the node a writable master in a new epoch\n" +
+		"  REPLICAOF <host> <port> - Make the node a replica of the master at the replication address\n" +
+		"  REPLICAOF NO ONE  - Same as PROMOTE\n" +
 		"  help, ?           - Show this help message\n" +
-		"  exit              - Exit the client"
+		"  exit              - Exit the client\n" +
+		"Arguments with spaces can be quoted: SET greeting \"hello\\nworld\""
 )
@@ -14,5 +14,34 @@ var ErrUnknownCommand = errors.New("unknown command")
 // ErrInvalidSetFormat is an error that occurs when the SET command format is invalid
 var ErrInvalidSetFormat = errors.New("invalid SET command format")
 
+// ErrInvalidMSetFormat is an error that occurs when the MSET command has no pairs or an odd number of arguments
+var ErrInvalidMSetFormat = errors.New("invalid MSET command format")
+
+// ErrInvalidExpireTime is an error that occurs when the time to live is not a valid number of seconds
+var ErrInvalidExpireTime = errors.New("invalid expire time")
+
 // ErrReadOnlyReplica is an error that occurs when the replica is read-only
-var ErrReadOnlyReplica = errors.New("replica is read-only: only GET and HELP commands are allowed")
+var ErrReadOnlyReplica = errors.New(
+	"replica is read-only: only GET, MGET, TTL, WAL, INFO, REPLICAS, PROMOTE, REPLICAOF and HELP commands are allowed",
+)
+
+// ErrFencedMaster is an error that occurs when a write reaches a master after a newer master was promoted
+var ErrFencedMaster = errors.New("master is fenced: a newer master exists, use PROMOTE or REPLICAOF")
+
+// ErrNoReplication is an error that occurs when the role of a node without replication is changed
+var ErrNoReplication = errors.New("replication is not configured")
+
+// ErrInvalidPort is an error that occurs when the port of a REPLICAOF command is not a valid port number
+var ErrInvalidPort = errors.New("invalid port")
+
+// ErrWALUnavailable is an error that occurs when a write is rejected because the WAL failed
+var ErrWALUnavailable = errors.New("read-only: WAL unavailable")
+
+// ErrUnbalancedQuotes is an error that occurs when a quoted argument is not closed
+var ErrUnbalancedQuotes = errors.New("unbalanced quotes in command")
+
+// ErrInvalidLiteral is an error that occurs when the length of a literal argument is invalid
+var ErrInvalidLiteral = errors.New("invalid literal length")
+
+// ErrMessageTooLarge is an error that occurs when a command exceeds the maximum message size
+var ErrMessageTooLarge = errors.New("message too large")
@@ -0,0 +1,65 @@
+package compute
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/8thgencore/valchemy/internal/config"
+	"github.com/8thgencore/valchemy/internal/replication"
+)
+
+// replicationInfo returns the replication state of the node
+func (h *Handler) replicationInfo() replication.Info {
+	if h.replication == nil {
+		return replication.Info{Role: h.replicaType}
+	}
+
+	return h.replication.Info()
+}
+
+// formatInfo renders the replication state as "field:value" lines, like the
+// replication section of the Redis INFO command
+func formatInfo(info replication.Info, now time.Time) string {
+	var b strings.Builder
+	b.WriteString("# Replication\n")
+	fmt.Fprintf(&b, "role:%s\n", info.Role)
+	fmt.Fprintf(&b, "node_id:%s\n", info.NodeID)
+	fmt.Fprintf(&b, "cluster_id:%s\n", info.ClusterID)
+	fmt.Fprintf(&b, "epoch:%d\n", info.Epoch)
+
+	if info.Role == config.Replica {
+		link := "down"
+		if info.Connected {
+			link = "up"
+		}
+		fmt.Fprintf(&b, "master_address:%s\n", info.MasterAddress)
+		fmt.Fprintf(&b, "master_link:%s\n", link)
+		fmt.Fprintf(&b, "applied_lsn:%d\n", info.AppliedLSN)
+		fmt.Fprintf(&b, "applied_segment:%d\n", info.Applied.SegmentID)
+		fmt.Fprintf(&b, "applied_offset:%d", info.Applied.Offset)
+
+		return b.String()
+	}
+
+	fmt.Fprintf(&b, "lsn:%d\n", info.LSN)
+	fmt.Fprintf(&b, "segment:%d\n", info.Position.SegmentID)
+	fmt.Fprintf(&b, "offset:%d\n", info.Position.Offset)
+	fmt.Fprintf(&b, "min_sync_replicas:%d\n", info.MinSyncReplicas)
+	fmt.Fprintf(&b, "sync_degraded:%t\n", info.SyncDegraded)
+	fmt.Fprintf(&b, "fenced:%t\n", info.Fenced)
+	fmt.Fprintf(&b, "connected_replicas:%d", len(info.Replicas))
+	for i, r := range info.Replicas {
+		fmt.Fprintf(&b, "\nreplica%d:%s", i, formatReplica(r, now))
+	}
+
+	return b.String()
+}
+
+// formatReplica renders a replica connected to the master as a list of
+// "field=value" pairs
+func formatReplica(r replication.ReplicaInfo, now time.Time) string {
+	return fmt.Sprintf("id=%s,address=%s,lsn=%d,segment=%d,offset=%d,bytes_behind=%d,last_seen=%s",
+		r.ID, r.Address, r.AckedLSN, r.Acked.SegmentID, r.Acked.Offset, r.BytesBehind,
+		now.Sub(r.LastSeen).Round(time.Millisecond))
+}
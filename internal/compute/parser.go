@@ -1,9 +1,15 @@
 package compute
 
 import (
+	"math"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// OptionEx is the SET option that sets the time to live in seconds
+const OptionEx = "EX"
+
 // Command is a struct that represents a command
 type Command struct {
 	Type string
@@ -12,7 +18,17 @@ type Command struct {
 
 // ParseCommand parses a command string into a Command struct
 func ParseCommand(input string) (Command, error) {
-	parts := strings.Fields(input)
+	parts, err := Tokenize(input)
+	if err != nil {
+		return Command{}, err
+	}
+
+	return NewCommand(parts)
+}
+
+// NewCommand builds a Command from the command name followed by its
+// arguments, as received from protocols that transfer arguments separately
+func NewCommand(parts []string) (Command, error) {
 	if len(parts) == 0 {
 		return Command{}, ErrInvalidFormat
 	}
@@ -41,14 +57,68 @@ func ParseCommand(input string) (Command, error) {
 func validateCommand(cmd Command) error {
 	switch cmd.Type {
 	case CommandSet:
-		if len(cmd.Args) != 2 {
+		switch len(cmd.Args) {
+		case 2:
+		case 4:
+			if !strings.EqualFold(cmd.Args[2], OptionEx) {
+				return ErrInvalidSetFormat
+			}
+			ttl, err := ParseSeconds(cmd.Args[3])
+			if err != nil {
+				return err
+			}
+			if ttl <= 0 {
+				return ErrInvalidExpireTime
+			}
+		default:
 			return ErrInvalidSetFormat
 		}
-	case CommandGet, CommandDel:
+	case CommandExpire:
+		if len(cmd.Args) != 2 {
+			return ErrInvalidFormat
+		}
+		if _, err := ParseSeconds(cmd.Args[1]); err != nil {
+			return err
+		}
+	case CommandGet, CommandTTL, CommandPersist:
+		if len(cmd.Args) != 1 {
+			return ErrInvalidFormat
+		}
+	case CommandMSet:
+		if len(cmd.Args) == 0 || len(cmd.Args)%2 != 0 {
+			return ErrInvalidMSetFormat
+		}
+	case CommandDel, CommandMGet, CommandMDel:
+		if len(cmd.Args) == 0 {
+			return ErrInvalidFormat
+		}
+	case CommandWAL:
 		if len(cmd.Args) != 1 {
 			return ErrInvalidFormat
 		}
-	case CommandClear, CommandHelp, "?":
+		switch strings.ToUpper(cmd.Args[0]) {
+		case SubcommandStatus, SubcommandResume:
+		default:
+			return ErrInvalidFormat
+		}
+	case CommandInfo:
+		if len(cmd.Args) > 1 || (len(cmd.Args) == 1 && strings.ToUpper(cmd.Args[0]) != SectionReplication) {
+			return ErrInvalidFormat
+		}
+	case CommandReplicaOf:
+		if len(cmd.Args) != 2 {
+			return ErrInvalidFormat
+		}
+		if strings.EqualFold(cmd.Args[0], ArgumentNo) {
+			if !strings.EqualFold(cmd.Args[1], ArgumentOne) {
+				return ErrInvalidFormat
+			}
+			break
+		}
+		if port, err := strconv.ParseUint(cmd.Args[1], 10, 16); err != nil || port == 0 {
+			return ErrInvalidPort
+		}
+	case CommandClear, CommandSnapshot, CommandReplicas, CommandPromote, CommandHelp, "?":
 		if len(cmd.Args) != 0 {
 			return ErrInvalidFormat
 		}
@@ -58,3 +128,13 @@ func validateCommand(cmd Command) error {
 
 	return nil
 }
+
+// ParseSeconds parses a time to live given in whole seconds
+func ParseSeconds(arg string) (time.Duration, error) {
+	seconds, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || seconds > math.MaxInt64/int64(time.Second) || seconds < math.MinInt64/int64(time.Second) {
+		return 0, ErrInvalidExpireTime
+	}
+
+	return time.Duration(seconds) * time.Second, nil
+}
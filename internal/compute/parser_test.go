@@ -23,6 +23,73 @@ func TestParseCommand(t *testing.T) {
 			input:   "GET",
 			wantErr: ErrInvalidFormat,
 		},
+		{
+			name:  "Valid WAL command",
+			input: "WAL status",
+			wantCmd: Command{
+				Type: "WAL",
+				Args: []string{"status"},
+			},
+		},
+		{
+			name:    "WAL command with unknown subcommand",
+			input:   "WAL FLUSH",
+			wantErr: ErrInvalidFormat,
+		},
+		{
+			name:  "Valid INFO command",
+			input: "INFO replication",
+			wantCmd: Command{
+				Type: "INFO",
+				Args: []string{"replication"},
+			},
+		},
+		{
+			name:    "INFO command with unknown section",
+			input:   "INFO memory",
+			wantErr: ErrInvalidFormat,
+		},
+		{
+			name:    "REPLICAS command with arguments",
+			input:   "REPLICAS all",
+			wantErr: ErrInvalidFormat,
+		},
+		{
+			name:    "PROMOTE command with arguments",
+			input:   "PROMOTE now",
+			wantErr: ErrInvalidFormat,
+		},
+		{
+			name:  "Valid REPLICAOF command",
+			input: "REPLICAOF 10.0.0.1 3233",
+			wantCmd: Command{
+				Type: "REPLICAOF",
+				Args: []string{"10.0.0.1", "3233"},
+			},
+		},
+		{
+			name:  "Valid REPLICAOF NO ONE command",
+			input: "replicaof no one",
+			wantCmd: Command{
+				Type: "REPLICAOF",
+				Args: []string{"no", "one"},
+			},
+		},
+		{
+			name:    "REPLICAOF command with invalid port",
+			input:   "REPLICAOF 10.0.0.1 65536",
+			wantErr: ErrInvalidPort,
+		},
+		{
+			name:    "REPLICAOF command without port",
+			input:   "REPLICAOF 10.0.0.1",
+			wantErr: ErrInvalidFormat,
+		},
+		{
+			name:    "REPLICAOF NO with another argument",
+			input:   "REPLICAOF NO TWO",
+			wantErr: ErrInvalidFormat,
+		},
 		{
 			name:  "Valid GET command",
 			input: "GET key1",
@@ -44,6 +111,42 @@ func TestParseCommand(t *testing.T) {
 			input:   "SET key1",
 			wantErr: ErrInvalidSetFormat,
 		},
+		{
+			name:  "Valid SET command with EX",
+			input: "SET key1 value1 ex 10",
+			wantCmd: Command{
+				Type: "SET",
+				Args: []string{"key1", "value1", "ex", "10"},
+			},
+		},
+		{
+			name:    "SET command with unknown option",
+			input:   "SET key1 value1 PX 10",
+			wantErr: ErrInvalidSetFormat,
+		},
+		{
+			name:    "SET command with non-positive EX",
+			input:   "SET key1 value1 EX 0",
+			wantErr: ErrInvalidExpireTime,
+		},
+		{
+			name:  "Valid EXPIRE command",
+			input: "EXPIRE key1 10",
+			wantCmd: Command{
+				Type: "EXPIRE",
+				Args: []string{"key1", "10"},
+			},
+		},
+		{
+			name:    "EXPIRE command with invalid seconds",
+			input:   "EXPIRE key1 soon",
+			wantErr: ErrInvalidExpireTime,
+		},
+		{
+			name:    "TTL command without key",
+			input:   "TTL",
+			wantErr: ErrInvalidFormat,
+		},
 		{
 			name:  "Valid DEL command",
 			input: "DEL key1",
@@ -52,6 +155,32 @@ func TestParseCommand(t *testing.T) {
 				Args: []string{"key1"},
 			},
 		},
+		{
+			name:  "DEL command with several keys",
+			input: "DEL key1 key2",
+			wantCmd: Command{
+				Type: "DEL",
+				Args: []string{"key1", "key2"},
+			},
+		},
+		{
+			name:  "Valid MSET command",
+			input: "MSET key1 value1 key2 value2",
+			wantCmd: Command{
+				Type: "MSET",
+				Args: []string{"key1", "value1", "key2", "value2"},
+			},
+		},
+		{
+			name:    "MSET command with odd arguments",
+			input:   "MSET key1 value1 key2",
+			wantErr: ErrInvalidMSetFormat,
+		},
+		{
+			name:    "MDEL command without keys",
+			input:   "MDEL",
+			wantErr: ErrInvalidFormat,
+		},
 		{
 			name:    "Unknown command",
 			input:   "UNKNOWN key1",
@@ -0,0 +1,117 @@
+package compute
+
+import (
+	"strconv"
+	"strings"
+)
+
+// nilValue is the line protocol rendering of a missing value in an array reply
+const nilValue = "(nil)"
+
+// ReplyKind is the type of a command reply
+type ReplyKind int
+
+const (
+	// ReplyStatus is a status message such as OK
+	ReplyStatus ReplyKind = iota
+	// ReplyBulk is a stored value
+	ReplyBulk
+	// ReplyInteger is a number
+	ReplyInteger
+	// ReplyNil is a missing value
+	ReplyNil
+	// ReplyArray is a list of replies
+	ReplyArray
+)
+
+// Reply is the typed result of a command, rendered by the protocol that
+// received the command
+type Reply struct {
+	Kind  ReplyKind
+	Str   string
+	Int   int64
+	Elems []Reply
+}
+
+// StatusReply creates a status reply
+func StatusReply(status string) Reply {
+	return Reply{Kind: ReplyStatus, Str: status}
+}
+
+// BulkReply creates a value reply
+func BulkReply(value string) Reply {
+	return Reply{Kind: ReplyBulk, Str: value}
+}
+
+// IntegerReply creates a number reply
+func IntegerReply(n int64) Reply {
+	return Reply{Kind: ReplyInteger, Int: n}
+}
+
+// NilReply creates a missing value reply
+func NilReply() Reply {
+	return Reply{Kind: ReplyNil}
+}
+
+// ArrayReply creates a list reply
+func ArrayReply(elems []Reply) Reply {
+	return Reply{Kind: ReplyArray, Elems: elems}
+}
+
+// String renders the reply for the line protocol, an array as one line per
+// element. The values of an array are double-quoted with the escape sequences
+// of Tokenize, so that a value holding a line break or the nil marker cannot
+// be mistaken for other elements.
+func (r Reply) String() string {
+	switch r.Kind {
+	case ReplyInteger:
+		return strconv.FormatInt(r.Int, 10)
+	case ReplyNil:
+		return nilValue
+	case ReplyArray:
+		lines := make([]string, len(r.Elems))
+		for i, elem := range r.Elems {
+			if elem.Kind == ReplyBulk {
+				lines[i] = quote(elem.Str)
+			} else {
+				lines[i] = elem.String()
+			}
+		}
+		return strings.Join(lines, "\n")
+	}
+
+	return r.Str
+}
+
+// quote returns the value as a double-quoted argument that Tokenize reads back
+func quote(value string) string {
+	const hex = "0123456789abcdef"
+
+	var b strings.Builder
+	b.Grow(len(value) + 2)
+	b.WriteByte('"')
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '"', '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			if c < ' ' || c == 0x7f {
+				b.WriteString(`\x`)
+				b.WriteByte(hex[c>>4])
+				b.WriteByte(hex[c&0xf])
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	}
+	b.WriteByte('"')
+
+	return b.String()
+}
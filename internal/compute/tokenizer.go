@@ -0,0 +1,264 @@
+package compute
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// maxLiteralLength is the largest length-prefixed argument accepted
+const maxLiteralLength = 512 << 20
+
+// token is an argument of a command line
+type token struct {
+	value  string
+	quoted bool
+}
+
+// Tokenize splits a command line into arguments. Arguments are separated by
+// whitespace; an argument starting with a double quote may contain
+// whitespace and the escape sequences \n, \r, \t, \b, \a, \\, \" and \xHH,
+// an argument starting with a single quote is taken literally except for \'.
+func Tokenize(line string) ([]string, error) {
+	tokens, err := tokenize(line)
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, len(tokens))
+	for i, t := range tokens {
+		args[i] = t.value
+	}
+
+	return args, nil
+}
+
+func tokenize(line string) ([]token, error) {
+	var tokens []token
+
+	for i := 0; ; {
+		// Skip the separators
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return tokens, nil
+		}
+
+		var (
+			t   token
+			err error
+		)
+		switch line[i] {
+		case '"':
+			t.value, i, err = readDoubleQuoted(line, i+1)
+			t.quoted = true
+		case '\'':
+			t.value, i, err = readSingleQuoted(line, i+1)
+			t.quoted = true
+		default:
+			start := i
+			for i < len(line) && !isSpace(line[i]) {
+				i++
+			}
+			t.value = line[start:i]
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// A closing quote must end the argument
+		if t.quoted && i < len(line) && !isSpace(line[i]) {
+			return nil, ErrUnbalancedQuotes
+		}
+		tokens = append(tokens, t)
+	}
+}
+
+// readDoubleQuoted reads an argument after its opening double quote and
+// returns it with the position following the closing quote
+func readDoubleQuoted(line string, i int) (string, int, error) {
+	var b strings.Builder
+	for ; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '"':
+			return b.String(), i + 1, nil
+		case c == '\\' && i+1 < len(line):
+			i++
+			switch line[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case 'b':
+				b.WriteByte('\b')
+			case 'a':
+				b.WriteByte('\a')
+			case 'x':
+				if i+2 < len(line) {
+					if v, err := strconv.ParseUint(line[i+1:i+3], 16, 8); err == nil {
+						b.WriteByte(byte(v))
+						i += 2
+						continue
+					}
+				}
+				b.WriteByte('x')
+			default:
+				// \\, \" and unknown sequences stand for the character itself
+				b.WriteByte(line[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return "", i, ErrUnbalancedQuotes
+}
+
+// readSingleQuoted reads an argument after its opening single quote and
+// returns it with the position following the closing quote
+func readSingleQuoted(line string, i int) (string, int, error) {
+	var b strings.Builder
+	for ; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\'':
+			return b.String(), i + 1, nil
+		case c == '\\' && i+1 < len(line) && line[i+1] == '\'':
+			b.WriteByte('\'')
+			i++
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return "", i, ErrUnbalancedQuotes
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\v' || c == '\f'
+}
+
+// ReadCommand reads the arguments of one command. A command is a line of
+// arguments (see Tokenize); an unquoted {N} as the last argument of a line,
+// N being decimal digits, announces a literal: the N bytes following the line break are taken as an
+// argument as is, and the command continues with the rest of the line after
+// them. Literals allow arguments with any bytes, including line breaks.
+//
+// A command whose lines and literals together exceed maxSize bytes fails with
+// ErrMessageTooLarge without being read to the end; zero means no limit.
+//
+// Syntax errors (see IsSyntaxError) are returned after the whole line is
+// consumed, so the reader can be used for the next command; other errors
+// come from the reader.
+func ReadCommand(r *bufio.Reader, maxSize int) ([]string, error) {
+	remaining := -1
+	if maxSize > 0 {
+		remaining = maxSize
+	}
+
+	var args []string
+	for {
+		line, err := readLine(r, remaining)
+		if err != nil && (err != io.EOF || line == "") {
+			if err == io.EOF && len(args) > 0 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if remaining >= 0 {
+			remaining -= len(line)
+		}
+
+		tokens, err := tokenize(line)
+		if err != nil {
+			return nil, err
+		}
+
+		n, ok, err := literalLength(tokens)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			for _, t := range tokens {
+				args = append(args, t.value)
+			}
+			return args, nil
+		}
+
+		if remaining >= 0 {
+			if n > remaining {
+				return nil, ErrMessageTooLarge
+			}
+			remaining -= n
+		}
+
+		for _, t := range tokens[:len(tokens)-1] {
+			args = append(args, t.value)
+		}
+		literal := make([]byte, n)
+		if _, err := io.ReadFull(r, literal); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		args = append(args, string(literal))
+	}
+}
+
+// readLine reads up to and including the next line break like ReadString,
+// failing with ErrMessageTooLarge as soon as the line is longer than limit
+// bytes; a negative limit means no limit
+func readLine(r *bufio.Reader, limit int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if limit >= 0 && len(line)+len(chunk) > limit {
+			return "", ErrMessageTooLarge
+		}
+		line = append(line, chunk...)
+		if err != bufio.ErrBufferFull {
+			return string(line), err
+		}
+	}
+}
+
+// literalLength reports whether the line ends with a literal announcement
+// and returns the announced length. Other arguments in braces, such as JSON
+// objects, are plain arguments.
+func literalLength(tokens []token) (int, bool, error) {
+	if len(tokens) == 0 {
+		return 0, false, nil
+	}
+
+	last := tokens[len(tokens)-1]
+	if last.quoted || len(last.value) < 3 || last.value[0] != '{' || last.value[len(last.value)-1] != '}' {
+		return 0, false, nil
+	}
+	digits := last.value[1 : len(last.value)-1]
+	for i := 0; i < len(digits); i++ {
+		if digits[i] < '0' || digits[i] > '9' {
+			return 0, false, nil
+		}
+	}
+
+	n, err := strconv.Atoi(digits)
+	if err != nil || n > maxLiteralLength {
+		return 0, false, fmt.Errorf("%w: invalid literal %s", ErrInvalidLiteral, last.value)
+	}
+
+	return n, true, nil
+}
+
+// IsSyntaxError reports whether a ReadCommand error concerns the command
+// syntax, after which the connection can be used further
+func IsSyntaxError(err error) bool {
+	return errors.Is(err, ErrUnbalancedQuotes) || errors.Is(err, ErrInvalidLiteral)
+}
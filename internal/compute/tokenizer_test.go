@@ -0,0 +1,119 @@
+package compute
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected []string
+		wantErr  error
+	}{
+		{"Empty line", "   ", []string{}, nil},
+		{"Plain arguments", "SET  key\tvalue", []string{"SET", "key", "value"}, nil},
+		{"Double quotes", `SET greeting "hello world"`, []string{"SET", "greeting", "hello world"}, nil},
+		{"Escape sequences", `SET k "a\nb\t\"c\"\\\x41"`, []string{"SET", "k", "a\nb\t\"c\"\\A"}, nil},
+		{"Single quotes", `SET k 'it\'s \n raw'`, []string{"SET", "k", `it's \n raw`}, nil},
+		{"Empty quoted argument", `SET k ""`, []string{"SET", "k", ""}, nil},
+		{"Quote inside argument", `SET k ab"c`, []string{"SET", "k", `ab"c`}, nil},
+		{"Unclosed quote", `SET k "value`, nil, ErrUnbalancedQuotes},
+		{"Text after closing quote", `SET k "a"b`, nil, ErrUnbalancedQuotes},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args, err := Tokenize(tt.input)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, args)
+		})
+	}
+}
+
+func TestReadCommand(t *testing.T) {
+	t.Run("Lines", func(t *testing.T) {
+		r := bufio.NewReader(strings.NewReader("SET k \"a b\"\r\nGET k"))
+
+		args, err := ReadCommand(r, 0)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"SET", "k", "a b"}, args)
+
+		args, err = ReadCommand(r, 0)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"GET", "k"}, args)
+
+		_, err = ReadCommand(r, 0)
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("Literals", func(t *testing.T) {
+		r := bufio.NewReader(strings.NewReader("SET {3}\nk\x00y {11}\nhello\nworld\nGET '{3}'\n"))
+
+		args, err := ReadCommand(r, 0)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"SET", "k\x00y", "hello\nworld"}, args)
+
+		// A quoted {N} is a plain argument
+		args, err = ReadCommand(r, 0)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"GET", "{3}"}, args)
+	})
+
+	t.Run("Braces without a length are plain arguments", func(t *testing.T) {
+		r := bufio.NewReader(strings.NewReader("SET k {\"a\":1}\nSET k {}\nSET k {abc}\nSET k {-1}\n"))
+
+		for _, value := range []string{`{"a":1}`, "{}", "{abc}", "{-1}"} {
+			args, err := ReadCommand(r, 0)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"SET", "k", value}, args)
+		}
+	})
+
+	t.Run("Syntax errors keep the reader usable", func(t *testing.T) {
+		r := bufio.NewReader(strings.NewReader("SET k \"oops\nSET k {99999999999}\nGET k\n"))
+
+		_, err := ReadCommand(r, 0)
+		assert.True(t, IsSyntaxError(err))
+		_, err = ReadCommand(r, 0)
+		assert.True(t, IsSyntaxError(err))
+
+		args, err := ReadCommand(r, 0)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"GET", "k"}, args)
+	})
+
+	t.Run("Message size limit", func(t *testing.T) {
+		r := bufio.NewReader(strings.NewReader("SET k v\n"))
+		args, err := ReadCommand(r, 8)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"SET", "k", "v"}, args)
+
+		r = bufio.NewReader(strings.NewReader("SET k " + strings.Repeat("v", 8192) + "\n"))
+		_, err = ReadCommand(r, 4096)
+		assert.ErrorIs(t, err, ErrMessageTooLarge)
+
+		// A literal counts against the limit before it is read
+		r = bufio.NewReader(strings.NewReader("SET k {100}\n"))
+		_, err = ReadCommand(r, 50)
+		assert.ErrorIs(t, err, ErrMessageTooLarge)
+		assert.False(t, IsSyntaxError(err))
+	})
+
+	t.Run("Incomplete literal", func(t *testing.T) {
+		r := bufio.NewReader(strings.NewReader("SET k {10}\nshort"))
+
+		_, err := ReadCommand(r, 0)
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	})
+}
@@ -27,17 +27,36 @@ type Config struct {
 	Replication ReplicationConfig
 }
 
+// EngineType defines the type of storage engine
+type EngineType string
+
+const (
+	// InMemory is the engine that keeps all data in memory
+	InMemory EngineType = "in_memory"
+	// OnDisk is the engine that keeps data in an LSM tree on disk
+	OnDisk EngineType = "on_disk"
+)
+
 // EngineConfig is the configuration for the engine
 type EngineConfig struct {
-	Type string `yaml:"type" env-default:"in_memory"`
+	Type              EngineType `yaml:"type" env-default:"in_memory"`
+	DataDirectory     string     `yaml:"data_directory" env-default:"./data/engine"`
+	MemtableSize      string     `yaml:"memtable_size" env-default:"4MB"`
+	MemtableSizeBytes uint64     `yaml:"-"` // calculated field
 }
 
 // NetworkConfig is the configuration for the network
 type NetworkConfig struct {
-	Address        string        `yaml:"address" env-default:"127.0.0.1:3223"`
+	Address string `yaml:"address" env-default:"127.0.0.1:3223"`
+	// RESPAddress is the address of the Redis protocol listener, empty to disable it
+	RESPAddress    string        `yaml:"resp_address" env-default:""`
 	MaxConnections int           `yaml:"max_connections" env-default:"100"`
 	MaxMessageSize string        `yaml:"max_message_size" env-default:"4KB"`
 	IdleTimeout    time.Duration `yaml:"idle_timeout" env-default:"5m"`
+	// MaxMessageSizeBytes is the parsed MaxMessageSize, zero means unlimited
+	MaxMessageSizeBytes uint64 `yaml:"-"` // calculated field
+	// ShutdownTimeout bounds the time given to open connections to finish on shutdown
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env-default:"10s"`
 }
 
 // LoggingConfig is the configuration for the logging
@@ -49,14 +68,43 @@ type LoggingConfig struct {
 
 // WALConfig configures the Write-Ahead Logging (WAL)
 type WALConfig struct {
-	Enabled              bool          `yaml:"enabled" env-default:"false"`
-	FlushingBatchSize    int           `yaml:"flushing_batch_size" env-default:"100"`
-	FlushingBatchTimeout time.Duration `yaml:"flushing_batch_timeout" env-default:"10ms"`
-	MaxSegmentSize       string        `yaml:"max_segment_size" env-default:"10MB"`
-	MaxSegmentSizeBytes  uint64        `yaml:"-"` // calculated field
-	DataDirectory        string        `yaml:"data_directory" env-default:"./data/wal"`
+	Enabled              bool           `yaml:"enabled" env-default:"false"`
+	Durability           DurabilityMode `yaml:"durability" env-default:"async"`
+	Compression          Compression    `yaml:"compression" env-default:"none"`
+	FlushingBatchSize    int            `yaml:"flushing_batch_size" env-default:"100"`
+	FlushingBatchTimeout time.Duration  `yaml:"flushing_batch_timeout" env-default:"10ms"`
+	MaxSegmentSize       string         `yaml:"max_segment_size" env-default:"10MB"`
+	MaxSegmentSizeBytes  uint64         `yaml:"-"` // calculated field
+	DataDirectory        string         `yaml:"data_directory" env-default:"./data/wal"`
+	// ArchiveDirectory receives a copy of every completed segment, empty to disable archiving
+	ArchiveDirectory string        `yaml:"archive_directory"`
+	SnapshotInterval time.Duration `yaml:"snapshot_interval" env-default:"0s"`
 }
 
+// DurabilityMode defines when a write recorded in the WAL is acknowledged
+type DurabilityMode string
+
+const (
+	// DurabilityAlways syncs the WAL after every write before acknowledging it
+	DurabilityAlways DurabilityMode = "always"
+	// DurabilityGroup collects writes into batches and acknowledges every
+	// write of a batch once the batch is synced, reporting its errors
+	DurabilityGroup DurabilityMode = "group"
+	// DurabilityAsync acknowledges writes before they are synced: a crash
+	// loses the batch being collected and its flush errors are only logged
+	DurabilityAsync DurabilityMode = "async"
+)
+
+// Compression defines how the WAL compresses the flushed batches
+type Compression string
+
+const (
+	// CompressionNone writes every entry as a plain record
+	CompressionNone Compression = "none"
+	// CompressionFlate writes every flushed batch as a single flate-compressed record
+	CompressionFlate Compression = "flate"
+)
+
 // ReplicationType defines the type of replication node
 type ReplicationType string
 
@@ -76,8 +124,31 @@ type ReplicationConfig struct {
 	SyncRetryDelay  time.Duration   `yaml:"sync_retry_delay" env-default:"500ms"`
 	SyncRetryCount  int             `yaml:"sync_retry_count" env-default:"3"`
 	ReadTimeout     time.Duration   `yaml:"read_timeout" env-default:"10s"`
+	// ClusterID identifies the replication cluster, the master and its replicas must agree on it
+	ClusterID string `yaml:"cluster_id" env-default:"valchemy"`
+	// NodeID identifies the node to its peers, the host name if empty
+	NodeID string `yaml:"node_id"`
+	// MinSyncReplicas is the number of replicas that must acknowledge a write
+	// before it returns on the master, 0 replicates asynchronously
+	MinSyncReplicas int `yaml:"min_sync_replicas"`
+	// SyncReplicasTimeout bounds the wait for the acknowledgements of the replicas
+	SyncReplicasTimeout time.Duration `yaml:"sync_replicas_timeout" env-default:"1s"`
+	// SyncTimeoutPolicy is what happens to a write that times out waiting for the replicas
+	SyncTimeoutPolicy SyncTimeoutPolicy `yaml:"sync_timeout_policy" env-default:"degrade"`
 }
 
+// SyncTimeoutPolicy defines the outcome of a write that is not acknowledged by
+// enough replicas in time. The write is applied on the master either way.
+type SyncTimeoutPolicy string
+
+const (
+	// SyncTimeoutDegrade returns the write and replicates asynchronously until
+	// enough replicas catch up with the master
+	SyncTimeoutDegrade SyncTimeoutPolicy = "degrade"
+	// SyncTimeoutFail returns an error for the write
+	SyncTimeoutFail SyncTimeoutPolicy = "fail"
+)
+
 // NewConfig creates a new instance of Config.
 func NewConfig(path string) (*Config, error) {
 	cfg := &Config{}
@@ -99,5 +170,19 @@ func NewConfig(path string) (*Config, error) {
 	}
 	cfg.WAL.MaxSegmentSizeBytes = maxSegmentSizeBytes
 
+	// Calculate MaxMessageSizeBytes
+	maxMessageSizeBytes, err := parseSize(cfg.Network.MaxMessageSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse max message size: %w", err)
+	}
+	cfg.Network.MaxMessageSizeBytes = maxMessageSizeBytes
+
+	// Calculate MemtableSizeBytes
+	memtableSizeBytes, err := parseSize(cfg.Engine.MemtableSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse memtable size: %w", err)
+	}
+	cfg.Engine.MemtableSizeBytes = memtableSizeBytes
+
 	return cfg, nil
 }
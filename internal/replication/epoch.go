@@ -0,0 +1,92 @@
+package replication
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+
+	"github.com/8thgencore/valchemy/internal/vfs"
+)
+
+// epochFileName is the file of the WAL directory holding the epoch history
+const epochFileName = "epochs.json"
+
+// epochStart records the start of an epoch: the entries up to LSN were
+// written in earlier epochs
+type epochStart struct {
+	Epoch uint64 `json:"epoch"`
+	LSN   uint64 `json:"lsn"`
+}
+
+// epochHistory lists the epochs known to a node, oldest first. A new epoch
+// starts with every promotion, so the epoch of a node orders its master
+// against the other masters of the cluster.
+type epochHistory []epochStart
+
+// current returns the latest epoch, zero before the first promotion
+func (h epochHistory) current() uint64 {
+	if len(h) == 0 {
+		return 0
+	}
+
+	return h[len(h)-1].Epoch
+}
+
+// next returns the history with a new epoch after the given one, started
+// after the entry of the given LSN
+func (h epochHistory) next(after, lsn uint64) epochHistory {
+	next := make(epochHistory, len(h), len(h)+1)
+	copy(next, h)
+
+	return append(next, epochStart{Epoch: max(after, h.current()) + 1, LSN: lsn})
+}
+
+// diverged reports whether a node of the given epoch holding the entries up
+// to lsn has entries that the epochs after its own do not have, written by
+// a master that kept accepting writes after it was replaced
+func (h epochHistory) diverged(epoch, lsn uint64) bool {
+	for _, e := range h {
+		if e.Epoch > epoch {
+			return lsn > e.LSN
+		}
+	}
+
+	return false
+}
+
+// loadEpochs reads the epoch history of the node from the WAL directory
+func loadEpochs(fsys vfs.FS, walDir string) (epochHistory, error) {
+	data, err := vfs.ReadFile(fsys, filepath.Join(walDir, epochFileName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read epochs: %w", err)
+	}
+
+	var h epochHistory
+	if err := json.Unmarshal(data, &h); err != nil {
+		return nil, fmt.Errorf("failed to parse epochs: %w", err)
+	}
+
+	return h, nil
+}
+
+// saveEpochs replaces the epoch history of the node in the WAL directory
+func saveEpochs(fsys vfs.FS, walDir string, h epochHistory) error {
+	data, err := json.Marshal(h)
+	if err != nil {
+		return fmt.Errorf("failed to encode epochs: %w", err)
+	}
+
+	if err := fsys.MkdirAll(walDir, 0o750); err != nil {
+		return fmt.Errorf("failed to create WAL directory: %w", err)
+	}
+	if err := replaceFile(fsys, filepath.Join(walDir, epochFileName), data); err != nil {
+		return fmt.Errorf("failed to write epochs: %w", err)
+	}
+
+	return nil
+}
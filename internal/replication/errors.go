@@ -0,0 +1,35 @@
+package replication
+
+import "errors"
+
+var (
+	// ErrProtocol returned when a peer sends a message that does not follow the replication protocol
+	ErrProtocol = errors.New("replication protocol error")
+
+	// ErrChecksumMismatch returned when a replication frame does not match its checksum
+	ErrChecksumMismatch = errors.New("replication frame checksum mismatch")
+
+	// ErrHandshake returned when the master and the replica cannot agree on a replication stream
+	ErrHandshake = errors.New("replication handshake failed")
+
+	// ErrPeer returned when the peer reports an error and closes the stream
+	ErrPeer = errors.New("replication peer error")
+
+	// ErrStaleEpoch returned when a master of an older epoch than its replica is rejected
+	ErrStaleEpoch = errors.New("stale replication epoch")
+
+	// ErrDiverged returned when a replica holds entries that are not part of the history of the master
+	ErrDiverged = errors.New("replica diverged from the master")
+
+	// ErrMissingData returned when the master no longer has the WAL data a replica needs, such as after a snapshot
+	ErrMissingData = errors.New("master no longer has the WAL data of the replica")
+
+	// ErrStopped returned when the role of the node is changed after the replication was stopped
+	ErrStopped = errors.New("replication stopped")
+
+	// ErrSyncReplicasTimeout returned when a write is not acknowledged by enough replicas in time
+	ErrSyncReplicasTimeout = errors.New("write not acknowledged by enough replicas in time")
+
+	// ErrSyncTimeoutPolicy returned when the configured sync timeout policy is not supported
+	ErrSyncTimeoutPolicy = errors.New("unknown sync timeout policy")
+)
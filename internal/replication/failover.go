@@ -0,0 +1,200 @@
+package replication
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/8thgencore/valchemy/internal/config"
+	"github.com/8thgencore/valchemy/pkg/logger/sl"
+)
+
+// Role returns the current replication role of the node
+func (m *Manager) Role() config.ReplicationType {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+
+	return m.role
+}
+
+// Fenced reports whether the node is a master that learned of a newer epoch
+// from a replica. A fenced master must not accept writes until it is
+// promoted again or made a replica.
+func (m *Manager) Fenced() bool {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+
+	return m.fencedEpoch > 0
+}
+
+// BeginWrite holds off the role changes until the returned function is
+// called. A client write checks the role and reaches the WAL in between, so
+// that the role does not change under it, and waits for the replicas after.
+func (m *Manager) BeginWrite() (end func()) {
+	m.writeGate.RLock()
+	return m.writeGate.RUnlock
+}
+
+// Promote makes the node a writable master in a new epoch. A replica stops
+// following its master, continues its WAL after the data received and starts
+// accepting replicas; a fenced master accepts writes again. Promoting a
+// master that is not fenced does nothing.
+func (m *Manager) Promote() error {
+	m.roleMu.Lock()
+	defer m.roleMu.Unlock()
+
+	if m.shutdown {
+		return ErrStopped
+	}
+
+	m.stateMu.Lock()
+	wasReplica, fencedEpoch, epochs := m.role == config.Replica, m.fencedEpoch, m.epochs
+	m.stateMu.Unlock()
+	if !wasReplica && fencedEpoch == 0 {
+		return nil
+	}
+
+	if wasReplica {
+		m.halt()
+	}
+	// The writes in progress complete before the WAL is reopened
+	m.writeGate.Lock()
+	epochs, err := m.startEpoch(epochs, fencedEpoch)
+	if err != nil {
+		m.writeGate.Unlock()
+		if wasReplica {
+			m.rearm()
+			if startErr := m.startReplica(); startErr != nil {
+				m.log.Error("Failed to restart replica replication", sl.Err(startErr))
+			}
+		}
+		return err
+	}
+
+	m.stateMu.Lock()
+	m.role = config.Master
+	m.masterAddress = ""
+	m.epochs = epochs
+	m.fencedEpoch = 0
+	m.degraded = false
+	m.stateMu.Unlock()
+	m.setWALTruncation(true)
+	m.writeGate.Unlock()
+
+	m.log.Info("Promoted to master", "epoch", epochs.current(), "lsn", epochs[len(epochs)-1].LSN)
+
+	if wasReplica {
+		m.rearm()
+		if err := m.startMaster(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// startEpoch flushes the WAL and records a new epoch that starts after its
+// last entry
+func (m *Manager) startEpoch(epochs epochHistory, fencedEpoch uint64) (epochHistory, error) {
+	var lsn uint64
+	if m.source != nil {
+		if err := m.source.Reopen(); err != nil {
+			return nil, fmt.Errorf("failed to reopen WAL: %w", err)
+		}
+		lsn = m.source.Synced().LSN
+	}
+
+	next := epochs.next(fencedEpoch, lsn)
+	if err := saveEpochs(m.fsys, m.walDir, next); err != nil {
+		return nil, err
+	}
+
+	return next, nil
+}
+
+// ReplicaOf makes the node a replica of the master at host:port. A master
+// stops accepting writes and flushes its WAL before the streams of its
+// replicas are closed. The node then streams the data of the new master from
+// the end of its local WAL and takes the epoch of the new master, which
+// rejects a node holding entries that are not part of its history.
+func (m *Manager) ReplicaOf(host, port string) error {
+	m.roleMu.Lock()
+	defer m.roleMu.Unlock()
+
+	if m.shutdown {
+		return ErrStopped
+	}
+
+	// The writes in progress complete before the role changes
+	m.writeGate.Lock()
+	m.stateMu.Lock()
+	prevRole, prevAddress, prevFenced := m.role, m.masterAddress, m.fencedEpoch
+	m.role = config.Replica
+	m.masterAddress = net.JoinHostPort(host, port)
+	m.fencedEpoch = 0
+	m.degraded = false
+	m.stateMu.Unlock()
+
+	// The writes accepted so far reach the WAL while the node still streams
+	// it to its replicas
+	if prevRole == config.Master {
+		m.setWALTruncation(false)
+	}
+	if prevRole == config.Master && m.source != nil {
+		if err := m.source.Reopen(); err != nil {
+			m.stateMu.Lock()
+			m.role, m.masterAddress, m.fencedEpoch = prevRole, prevAddress, prevFenced
+			m.stateMu.Unlock()
+			m.setWALTruncation(true)
+			m.writeGate.Unlock()
+			return fmt.Errorf("failed to reopen WAL: %w", err)
+		}
+	}
+	m.writeGate.Unlock()
+
+	m.halt()
+	m.rearm()
+
+	m.log.Info("Following a new master", "address", m.masterAddr(), "previous_role", prevRole)
+
+	return m.startReplica()
+}
+
+// setWALTruncation lets the storage truncate its WAL on a master only
+func (m *Manager) setWALTruncation(enabled bool) {
+	if m.applier != nil {
+		m.applier.SetWALTruncation(enabled)
+	}
+}
+
+// fence stops a master from accepting writes once a replica reports a newer
+// epoch: another node was promoted after it
+func (m *Manager) fence(epoch uint64) {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+
+	if m.role != config.Master || epoch <= m.fencedEpoch {
+		return
+	}
+	if m.fencedEpoch == 0 {
+		m.log.Error("A newer master exists, writes are rejected until the node is promoted or made a replica",
+			"epoch", m.epochs.current(),
+			"newer_epoch", epoch)
+	}
+	m.fencedEpoch = epoch
+}
+
+// masterAddr returns the replication address of the master of a replica
+func (m *Manager) masterAddr() string {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+
+	return m.masterAddress
+}
+
+// epochHistory returns the epochs known to the node
+func (m *Manager) epochHistory() epochHistory {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+
+	return m.epochs
+}
@@ -2,19 +2,23 @@ package replication
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+
+	"github.com/8thgencore/valchemy/internal/vfs"
 )
 
-// safeReadSegment safely reads a WAL segment file after path validation
-func safeReadSegment(walDir, segName string) ([]byte, error) {
+// safeReadSegment safely reads the data of a WAL segment file between the
+// offsets from and to after path validation
+func safeReadSegment(fsys vfs.FS, walDir, segName string, from, to int64) ([]byte, error) {
 	// Clean and normalize paths
 	walDir = filepath.Clean(walDir)
 	fullPath := filepath.Join(walDir, segName)
 	fullPath = filepath.Clean(fullPath)
 
 	// Open file with explicit read-only mode
-	file, err := os.OpenFile(fullPath, os.O_RDONLY, 0)
+	file, err := vfs.Open(fsys, fullPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open file: %w", err)
 	}
@@ -24,18 +28,42 @@ func safeReadSegment(walDir, segName string) ([]byte, error) {
 		}
 	}()
 
-	// Get file info for size
-	info, err := file.Stat()
+	// Read the range of the file
+	data := make([]byte, to-from)
+	_, err = io.ReadFull(io.NewSectionReader(file, from, to-from), data)
 	if err != nil {
-		return nil, fmt.Errorf("failed to stat file: %w", err)
+		return nil, fmt.Errorf("failed to read file: %w", err)
 	}
 
-	// Read the file content
-	data := make([]byte, info.Size())
-	_, err = file.Read(data)
+	return data, nil
+}
+
+// appendFile opens the named file with the given flags and writes and syncs
+// data to it, so that the data is durable once acknowledged to the master
+func appendFile(fsys vfs.FS, name string, flag int, data []byte) error {
+	file, err := fsys.OpenFile(name, flag, 0o600)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read file: %w", err)
+		return err
 	}
 
-	return data, nil
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// replaceFile replaces the content of the named file atomically: data is
+// written and synced to a temporary file renamed over it
+func replaceFile(fsys vfs.FS, name string, data []byte) error {
+	tmpName := name + ".tmp"
+	if err := appendFile(fsys, tmpName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, data); err != nil {
+		return err
+	}
+
+	return fsys.Rename(tmpName, name)
 }
@@ -0,0 +1,208 @@
+package replication
+
+import (
+	"net"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/8thgencore/valchemy/internal/config"
+	"github.com/8thgencore/valchemy/internal/wal/segment"
+	"github.com/8thgencore/valchemy/pkg/logger/sl"
+)
+
+// Info describes the replication state of the node
+type Info struct {
+	Role      config.ReplicationType
+	NodeID    string
+	ClusterID string
+	// Epoch is the latest epoch known to the node, incremented by every
+	// promotion of a node of the cluster
+	Epoch uint64
+
+	// LSN and Position are the end of the data synced to the WAL of the
+	// master (master only)
+	LSN      uint64
+	Position segment.Position
+	// Replicas are the replicas connected to the master, sorted by ID
+	Replicas []ReplicaInfo
+	// MinSyncReplicas is the number of replicas a write waits for (master only)
+	MinSyncReplicas int
+	// SyncDegraded reports whether writes stopped waiting for the replicas
+	// after a timeout (master only)
+	SyncDegraded bool
+	// Fenced reports whether the master learned of a newer epoch and rejects
+	// writes (master only)
+	Fenced bool
+
+	// MasterAddress is the replication address of the master (replica only)
+	MasterAddress string
+	// Connected reports whether the stream from the master is open (replica only)
+	Connected bool
+	// Applied is the position of the data applied by the replica (replica only)
+	Applied segment.Position
+	// AppliedLSN is the sequence number of the last entry applied by the
+	// replica (replica only)
+	AppliedLSN uint64
+}
+
+// ReplicaInfo describes a replica connected to the master
+type ReplicaInfo struct {
+	ID      string
+	Address string
+	// Acked is the position of the data the replica reported as applied
+	Acked segment.Position
+	// AckedLSN is the sequence number of the last entry the replica applied
+	AckedLSN uint64
+	// LastSeen is the time of the last message of the replica
+	LastSeen time.Time
+	// BytesBehind is the size of the WAL data synced on the master that the
+	// replica has not applied yet
+	BytesBehind int64
+}
+
+// replicaState is the registry entry of a replica connected to the master
+type replicaState struct {
+	id       string
+	address  string
+	acked    ackMessage
+	lastSeen time.Time
+}
+
+// registerReplica adds a replica that completed the handshake to the registry
+func (m *Manager) registerReplica(conn net.Conn, hello handshake) {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+
+	m.replicas[conn] = &replicaState{
+		id:       hello.nodeID,
+		address:  conn.RemoteAddr().String(),
+		acked:    ackMessage{pos: hello.pos},
+		lastSeen: time.Now(),
+	}
+}
+
+// unregisterReplica removes a disconnected replica from the registry
+func (m *Manager) unregisterReplica(conn net.Conn) {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+
+	delete(m.replicas, conn)
+}
+
+// recordAck records the position acknowledged by a replica
+func (m *Manager) recordAck(conn net.Conn, ack ackMessage) {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+
+	r, ok := m.replicas[conn]
+	if !ok {
+		return
+	}
+	r.acked = ack
+	r.lastSeen = time.Now()
+
+	m.replicasAcked()
+}
+
+// Info returns the replication state of the node
+func (m *Manager) Info() Info {
+	info := Info{
+		NodeID:    m.nodeID,
+		ClusterID: m.cfg.ClusterID,
+	}
+
+	m.stateMu.Lock()
+	info.Role = m.role
+	info.Epoch = m.epochs.current()
+	if info.Role == config.Replica {
+		info.MasterAddress = m.masterAddress
+		info.Connected = m.connected
+		info.Applied = m.lastAck.pos
+		info.AppliedLSN = m.lastAck.lsn
+		m.stateMu.Unlock()
+
+		return info
+	}
+	info.Fenced = m.fencedEpoch > 0
+	m.stateMu.Unlock()
+
+	if m.source != nil {
+		synced := m.source.Synced()
+		info.LSN = synced.LSN
+		info.Position = synced.Position
+	}
+
+	info.MinSyncReplicas = max(m.cfg.MinSyncReplicas, 0)
+
+	m.stateMu.Lock()
+	info.SyncDegraded = m.degraded
+	for _, r := range m.replicas {
+		info.Replicas = append(info.Replicas, ReplicaInfo{
+			ID:       r.id,
+			Address:  r.address,
+			Acked:    r.acked.pos,
+			AckedLSN: r.acked.lsn,
+			LastSeen: r.lastSeen,
+		})
+	}
+	m.stateMu.Unlock()
+
+	sort.Slice(info.Replicas, func(i, j int) bool {
+		if info.Replicas[i].ID != info.Replicas[j].ID {
+			return info.Replicas[i].ID < info.Replicas[j].ID
+		}
+		return info.Replicas[i].Address < info.Replicas[j].Address
+	})
+
+	if len(info.Replicas) > 0 {
+		sizes := m.segmentSizes()
+		for i := range info.Replicas {
+			info.Replicas[i].BytesBehind = bytesBetween(sizes, info.Replicas[i].Acked, info.Position)
+		}
+	}
+
+	return info
+}
+
+// segmentSizes returns the size of every local WAL segment by ID
+func (m *Manager) segmentSizes() map[int64]int64 {
+	sizes := make(map[int64]int64)
+
+	segments, err := segment.ListSegments(m.fsys, m.walDir)
+	if err != nil {
+		m.log.Error("Failed to list segments", sl.Err(err))
+		return sizes
+	}
+	for _, s := range segments {
+		if info, err := m.fsys.Stat(filepath.Join(m.walDir, s.Name)); err == nil {
+			sizes[s.ID] = info.Size()
+		}
+	}
+
+	return sizes
+}
+
+// bytesBetween returns the size of the WAL data between two positions,
+// given the sizes of the segments. The segments before the one of to are
+// counted up to their end.
+func bytesBetween(sizes map[int64]int64, from, to segment.Position) int64 {
+	if from.SegmentID == to.SegmentID {
+		return max(to.Offset-from.Offset, 0)
+	}
+	if from.SegmentID > to.SegmentID {
+		return 0
+	}
+
+	total := to.Offset
+	for id, size := range sizes {
+		switch {
+		case id == from.SegmentID:
+			total += max(size-from.Offset, 0)
+		case id > from.SegmentID && id < to.SegmentID:
+			total += size
+		}
+	}
+
+	return total
+}
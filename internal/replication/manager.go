@@ -1,38 +1,272 @@
 package replication
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/8thgencore/valchemy/internal/config"
+	"github.com/8thgencore/valchemy/internal/vfs"
+	"github.com/8thgencore/valchemy/internal/wal"
+	"github.com/8thgencore/valchemy/internal/wal/entry"
+	"github.com/8thgencore/valchemy/internal/wal/segment"
+	"github.com/8thgencore/valchemy/pkg/logger/sl"
 )
 
+// chunkSize is the maximum size of the segment data sent in one update,
+// which bounds the memory a replica needs to receive it
+const chunkSize = 1 << 20
+
+// Applier applies replicated WAL entries to the local storage
+type Applier interface {
+	// ApplyEntries applies the entries that end at pos in the local WAL
+	ApplyEntries(entries []*entry.Entry, pos segment.Position)
+	// SetWALTruncation lets the storage truncate its WAL at its own
+	// checkpoints, which a replica does not do: it only removes the segments
+	// before the one it receives from its master
+	SetWALTruncation(enabled bool)
+}
+
+// Source notifies the master of the data synced to its WAL
+type Source interface {
+	Subscribe() (<-chan wal.Synced, func())
+	// Synced returns the end of the data synced to the WAL
+	Synced() wal.Synced
+	// Reopen flushes the WAL and continues it after the last entry of its
+	// directory, when the node changes its role
+	Reopen() error
+}
+
 // Manager handles replication logic for both master and replica nodes
 type Manager struct {
-	cfg    config.ReplicationConfig
-	log    *slog.Logger
-	walDir string
-	conn   net.Conn
+	cfg     config.ReplicationConfig
+	log     *slog.Logger
+	nodeID  string
+	fsys    vfs.FS
+	walDir  string
+	source  Source
+	applier Applier
+
+	// Position of the last entry applied to the local storage and its
+	// sequence number (replica only)
+	appliedSegmentID int64
+	appliedOffset    int64
+	appliedLSN       uint64
+
+	// mu guards the network resources closed by Stop and on role changes.
+	// The connection to the master is replaced only under mu by the replica
+	// goroutine.
+	mu           sync.Mutex
+	conn         net.Conn
+	listener     net.Listener
+	replicaConns map[net.Conn]struct{}
+
+	// stateMu guards the role of the node, the registry of the replicas
+	// connected to the master and the state of the stream of the replica, as
+	// reported by Info
+	stateMu sync.Mutex
+	role    config.ReplicationType
+	// masterAddress is the replication address of the master (replica only)
+	masterAddress string
+	epochs        epochHistory
+	// fencedEpoch is the newer epoch a master learned of from a replica,
+	// zero unless the master is fenced
+	fencedEpoch uint64
+	replicas    map[net.Conn]*replicaState
+	connected   bool
+	lastAck     ackMessage
+	// acked is closed and replaced whenever a replica acknowledges data,
+	// waking the writes waiting for the replicas (master only)
+	acked chan struct{}
+	// degraded is set while writes do not wait for the replicas after a
+	// timeout, until enough replicas catch up (master only)
+	degraded bool
+
+	// roleMu serializes the role changes, Start and Stop
+	roleMu   sync.Mutex
+	shutdown bool
+	// writeGate is held for reading by the client writes and exclusively
+	// while the role changes, so that the writes in progress reach the WAL
+	// before it is reopened and the new ones see the new role
+	writeGate sync.RWMutex
+
+	// stop is closed when the goroutines of the current role must exit. On a
+	// role change it is replaced once they did.
+	stopMu sync.Mutex
+	stop   chan struct{}
+	// wg tracks the goroutines of the current role
+	wg sync.WaitGroup
 }
 
-// New creates a new replication manager
-func New(cfg config.ReplicationConfig, log *slog.Logger, walDir string) *Manager {
+// New creates a new replication manager for the WAL segments stored in the
+// walDir directory of fsys. The master streams the data source reports as
+// synced; the replica applies the data it receives with applier.
+func New(
+	cfg config.ReplicationConfig,
+	log *slog.Logger,
+	fsys vfs.FS,
+	walDir string,
+	source Source,
+	applier Applier,
+) *Manager {
+	nodeID := cfg.NodeID
+	if nodeID == "" {
+		nodeID, _ = os.Hostname()
+	}
+
+	var masterAddress string
+	if cfg.ReplicaType == config.Replica {
+		masterAddress = net.JoinHostPort(cfg.MasterHost, cfg.ReplicationPort)
+	}
+
 	return &Manager{
-		cfg:    cfg,
-		log:    log,
-		walDir: walDir,
+		cfg:     cfg,
+		log:     log,
+		nodeID:  nodeID,
+		fsys:    fsys,
+		walDir:  walDir,
+		source:  source,
+		applier: applier,
+
+		role:          cfg.ReplicaType,
+		masterAddress: masterAddress,
+
+		replicaConns: make(map[net.Conn]struct{}),
+		replicas:     make(map[net.Conn]*replicaState),
+		acked:        make(chan struct{}),
+		stop:         make(chan struct{}),
 	}
 }
 
-// Start starts the replication manager
+// Start loads the epoch history and starts the replication of the role of
+// the node
 func (m *Manager) Start() error {
-	switch m.cfg.ReplicaType {
+	m.roleMu.Lock()
+	defer m.roleMu.Unlock()
+
+	if m.shutdown {
+		return nil
+	}
+
+	epochs, err := loadEpochs(m.fsys, m.walDir)
+	if err != nil {
+		return err
+	}
+	m.stateMu.Lock()
+	m.epochs = epochs
+	m.stateMu.Unlock()
+
+	return m.startRole()
+}
+
+// startRole starts the replication of the current role
+func (m *Manager) startRole() error {
+	switch role := m.Role(); role {
 	case config.Master:
 		return m.startMaster()
 	case config.Replica:
 		return m.startReplica()
 	default:
-		return fmt.Errorf("unknown replica type: %s", m.cfg.ReplicaType)
+		return fmt.Errorf("unknown replica type: %s", role)
 	}
 }
+
+// Stop closes the replication listener and connections and waits for the
+// replication goroutines to exit
+func (m *Manager) Stop() {
+	m.roleMu.Lock()
+	defer m.roleMu.Unlock()
+
+	m.shutdown = true
+	m.halt()
+	m.log.Info("Replication stopped")
+}
+
+// halt closes the listener and the connections of the current role and
+// waits for its goroutines to exit
+func (m *Manager) halt() {
+	m.stopMu.Lock()
+	select {
+	case <-m.stop:
+	default:
+		close(m.stop)
+	}
+	m.stopMu.Unlock()
+
+	m.mu.Lock()
+	if m.listener != nil {
+		closeQuietly(m.log, m.listener)
+		m.listener = nil
+	}
+	if m.conn != nil {
+		closeQuietly(m.log, m.conn)
+	}
+	for conn := range m.replicaConns {
+		closeQuietly(m.log, conn)
+	}
+	m.mu.Unlock()
+
+	m.wg.Wait()
+}
+
+// rearm replaces the stop channel closed by halt, before the goroutines of
+// a new role are started
+func (m *Manager) rearm() {
+	m.stopMu.Lock()
+	m.stop = make(chan struct{})
+	m.stopMu.Unlock()
+}
+
+// done returns the channel closed when the goroutines of the current role
+// must exit
+func (m *Manager) done() <-chan struct{} {
+	m.stopMu.Lock()
+	defer m.stopMu.Unlock()
+
+	return m.stop
+}
+
+// stopped reports whether the goroutines of the current role must exit
+func (m *Manager) stopped() bool {
+	select {
+	case <-m.done():
+		return true
+	default:
+		return false
+	}
+}
+
+// wait pauses for the given duration and reports false if the manager was
+// stopped meanwhile
+func (m *Manager) wait(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-m.done():
+		return false
+	}
+}
+
+// closeQuietly closes a network resource, ignoring an already closed one
+func closeQuietly(log *slog.Logger, c interface{ Close() error }) {
+	if err := c.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Error("Failed to close connection", sl.Err(err))
+	}
+}
+
+// reject reports an error to the peer before the stream is closed and
+// returns it
+func (m *Manager) reject(conn net.Conn, err error) error {
+	if writeErr := writeFrame(conn, msgError, []byte(err.Error())); writeErr != nil {
+		m.log.Debug("Failed to report replication error to peer", sl.Err(writeErr))
+	}
+
+	return err
+}
@@ -3,24 +3,41 @@ package replication
 import (
 	"errors"
 	"fmt"
+	"io"
 	"net"
-	"os"
 	"path/filepath"
 	"time"
 
+	"github.com/8thgencore/valchemy/internal/config"
+	"github.com/8thgencore/valchemy/internal/vfs"
 	"github.com/8thgencore/valchemy/internal/wal/segment"
 	"github.com/8thgencore/valchemy/pkg/logger/sl"
 )
 
 // startMaster starts the master replication service
 func (m *Manager) startMaster() error {
-	if m.cfg.MasterHost == "" {
+	switch m.cfg.SyncTimeoutPolicy {
+	case "", config.SyncTimeoutDegrade, config.SyncTimeoutFail:
+	default:
+		return fmt.Errorf("%w: %q", ErrSyncTimeoutPolicy, m.cfg.SyncTimeoutPolicy)
+	}
+
+	// A promoted replica listens on every interface: the master host of its
+	// configuration is the address of its former master
+	host := m.cfg.MasterHost
+	if m.cfg.ReplicaType != config.Master {
+		host = ""
+	} else if host == "" {
 		m.log.Info("Master host is not set, skipping master replication service")
 		return nil
 	}
+	if m.source == nil {
+		m.log.Info("WAL is disabled, skipping master replication service")
+		return nil
+	}
 
 	// Start TCP server for replicas to connect on the replication port
-	replicationAddress := fmt.Sprintf("%s:%s", m.cfg.MasterHost, m.cfg.ReplicationPort)
+	replicationAddress := net.JoinHostPort(host, m.cfg.ReplicationPort)
 	listener, err := net.Listen("tcp", replicationAddress)
 	if err != nil {
 		return fmt.Errorf("failed to start master replication listener: %w", err)
@@ -28,18 +45,35 @@ func (m *Manager) startMaster() error {
 
 	m.log.Info(
 		"Started master replication service",
-		"master_host", m.cfg.MasterHost,
+		"master_host", host,
 		"replication_port", m.cfg.ReplicationPort,
 	)
 
+	m.mu.Lock()
+	m.listener = listener
+	m.mu.Unlock()
+	if m.stopped() {
+		closeQuietly(m.log, listener)
+		return nil
+	}
+
+	m.wg.Add(1)
 	go func() {
+		defer m.wg.Done()
 		for {
 			conn, err := listener.Accept()
 			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
 				m.log.Error("Failed to accept replica connection", sl.Err(err))
 				continue
 			}
 
+			if !m.trackReplicaConnection(conn) {
+				closeQuietly(m.log, conn)
+				return
+			}
 			go m.handleReplicaConnection(conn)
 		}
 	}()
@@ -47,157 +81,285 @@ func (m *Manager) startMaster() error {
 	return nil
 }
 
-// handleReplicaConnection handles incoming replica connections
+// trackReplicaConnection registers a replica connection to be closed by Stop.
+// Returns false if the manager is already stopped.
+func (m *Manager) trackReplicaConnection(conn net.Conn) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stopped() {
+		return false
+	}
+	m.replicaConns[conn] = struct{}{}
+	m.wg.Add(1)
+
+	return true
+}
+
+// handleReplicaConnection streams the WAL to a replica. The replica opens
+// the stream with a handshake holding the position of its local WAL; from
+// there the master sends the data synced to its WAL as soon as a flush is
+// reported by the source.
 func (m *Manager) handleReplicaConnection(conn net.Conn) {
 	defer func() {
-		if err := conn.Close(); err != nil {
-			m.log.Error("Failed to close connection", sl.Err(err))
-		}
+		m.mu.Lock()
+		delete(m.replicaConns, conn)
+		m.mu.Unlock()
+		closeQuietly(m.log, conn)
+		m.wg.Done()
 	}()
 
 	m.log.Info("New replica connected", "address", conn.RemoteAddr())
-	changes := m.startWALMonitor()
 
-	var lastSegmentID, lastSegmentSize int64 = -1, 0
-	for {
-		if err := m.processReplicaSync(conn, changes, &lastSegmentID, &lastSegmentSize); err != nil {
-			return
-		}
-	}
-}
+	stop := m.done()
 
-func (m *Manager) startWALMonitor() chan struct{} {
-	changes := make(chan struct{}, 1)
-	go m.monitorWALChanges(changes)
+	synced, cancel := m.source.Subscribe()
+	defer cancel()
 
-	return changes
-}
+	hello, err := m.acceptHandshake(conn)
+	if err != nil {
+		m.log.Error("Replica handshake failed", "address", conn.RemoteAddr(), sl.Err(err))
+		return
+	}
+	m.log.Info("Replica handshake completed",
+		"address", conn.RemoteAddr(),
+		"replica_id", hello.nodeID,
+		"segment_id", hello.pos.SegmentID,
+		"offset", hello.pos.Offset)
+
+	m.registerReplica(conn, hello)
+	defer m.unregisterReplica(conn)
+
+	// The messages of the replica are read until the connection is closed
+	disconnected := make(chan struct{})
+	var readErr error
+	go func() {
+		defer close(disconnected)
+		readErr = m.readReplicaMessages(conn)
+	}()
+	defer func() {
+		closeQuietly(m.log, conn)
+		<-disconnected
+	}()
 
-func (m *Manager) monitorWALChanges(changes chan struct{}) {
-	var lastSize int64
+	var heartbeats <-chan time.Time
+	if m.cfg.SyncInterval > 0 {
+		ticker := time.NewTicker(m.cfg.SyncInterval)
+		defer ticker.Stop()
+		heartbeats = ticker.C
+	}
+
+	s := &stream{m: m, conn: conn, pos: hello.pos}
 	for {
-		if size := m.getCurrentWALSize(); size > lastSize {
-			lastSize = size
-			select {
-			case changes <- struct{}{}:
-			default:
+		select {
+		case target := <-synced:
+			err = s.sendUpTo(target.Position)
+		case <-heartbeats:
+			err = writeFrame(conn, msgHeartbeat, nil)
+		case <-disconnected:
+			if errors.Is(readErr, io.EOF) || errors.Is(readErr, net.ErrClosed) {
+				m.log.Info("Replica disconnected", "address", conn.RemoteAddr())
+			} else {
+				m.log.Error("Replica stream failed", "address", conn.RemoteAddr(), sl.Err(readErr))
 			}
+			return
+		case <-stop:
+			return
+		}
+		if err != nil {
+			m.log.Error("Failed to stream WAL to replica", "address", conn.RemoteAddr(), sl.Err(err))
+			return
 		}
-		// TODO: Make this configurable
-		time.Sleep(100 * time.Millisecond)
 	}
 }
 
-func (m *Manager) getCurrentWALSize() int64 {
-	segments, err := segment.ListSegments(m.walDir)
-	if err != nil {
-		m.log.Error("Failed to list segments", sl.Err(err))
-		return 0
-	}
-
-	if len(segments) > 0 {
-		lastSegment := segments[len(segments)-1]
-		segPath := filepath.Join(m.walDir, lastSegment.Name)
-		if info, err := os.Stat(segPath); err == nil {
-			return info.Size()
+// acceptHandshake reads the handshake of a replica and answers it. A replica
+// of another protocol version or cluster is told why it is rejected, as is a
+// replica holding entries the epochs of the master do not have or needing
+// entries the master has truncated. A replica of a newer epoch fences the
+// master.
+func (m *Manager) acceptHandshake(conn net.Conn) (handshake, error) {
+	if m.cfg.ReadTimeout > 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(m.cfg.ReadTimeout)); err != nil {
+			return handshake{}, fmt.Errorf("failed to set read deadline: %w", err)
 		}
 	}
 
-	return 0
-}
+	f, err := readFrame(conn)
+	if err != nil {
+		return handshake{}, fmt.Errorf("failed to read handshake: %w", err)
+	}
+	if f.typ != msgHandshake {
+		return handshake{}, m.reject(conn, fmt.Errorf("%w: expected a handshake, got message type %d", ErrProtocol, f.typ))
+	}
+	hello, err := unmarshalHandshake(f.payload)
+	if err != nil {
+		return handshake{}, m.reject(conn, err)
+	}
 
-func (m *Manager) processReplicaSync(
-	conn net.Conn,
-	changes chan struct{},
-	lastSegmentID,
-	lastSegmentSize *int64,
-) error {
-	select {
-	case <-changes:
-	default:
-		if err := m.readReplicaState(conn, lastSegmentID, lastSegmentSize); err != nil {
-			return err
-		}
+	epochs := m.epochHistory()
+	switch {
+	case hello.version != protocolVersion:
+		return handshake{}, m.reject(conn, fmt.Errorf("%w: unsupported protocol version %d, expected %d",
+			ErrHandshake, hello.version, protocolVersion))
+	case hello.clusterID != m.cfg.ClusterID:
+		return handshake{}, m.reject(conn, fmt.Errorf("%w: cluster %q does not match the cluster %q of the master",
+			ErrHandshake, hello.clusterID, m.cfg.ClusterID))
+	case hello.epochs.current() > epochs.current():
+		m.fence(hello.epochs.current())
+		return handshake{}, m.reject(conn, fmt.Errorf("%w: master of epoch %d, the replica knows epoch %d",
+			ErrStaleEpoch, epochs.current(), hello.epochs.current()))
+	case epochs.diverged(hello.epochs.current(), hello.lsn):
+		return handshake{}, m.reject(conn, fmt.Errorf(
+			"%w: replica of epoch %d holds entries up to LSN %d, which later epochs do not have",
+			ErrDiverged, hello.epochs.current(), hello.lsn))
+	}
+	if err := m.checkRetained(hello); err != nil {
+		return handshake{}, m.reject(conn, err)
 	}
 
-	return m.sendUpdatedSegments(conn, lastSegmentID, lastSegmentSize)
-}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return handshake{}, fmt.Errorf("failed to clear read deadline: %w", err)
+	}
 
-func (m *Manager) readReplicaState(conn net.Conn, lastSegmentID, lastSegmentSize *int64) error {
-	if _, err := fmt.Fscanf(conn, "%d %d\n", lastSegmentID, lastSegmentSize); err != nil {
-		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-			return nil
-		}
-		m.log.Info("Replica disconnected", "address", conn.RemoteAddr())
-		return errors.New("connection closed")
+	reply := handshake{
+		version:   protocolVersion,
+		clusterID: m.cfg.ClusterID,
+		nodeID:    m.nodeID,
+		pos:       hello.pos,
+		epochs:    epochs,
+	}
+	if m.source != nil {
+		reply.lsn = m.source.Synced().LSN
+	}
+	if err := writeFrame(conn, msgHandshake, reply.marshal()); err != nil {
+		return handshake{}, fmt.Errorf("failed to send handshake: %w", err)
 	}
 
-	return nil
+	return hello, nil
 }
 
-func (m *Manager) sendUpdatedSegments(conn net.Conn, lastSegmentID, lastSegmentSize *int64) error {
-	segments, err := segment.ListSegments(m.walDir)
+// checkRetained checks that the master can stream the data of a replica
+// from its position: the master must hold the segment of the replica or,
+// past it, a segment starting with the entry after the last one of the
+// replica. Segments truncated after a snapshot leave a gap otherwise.
+func (m *Manager) checkRetained(hello handshake) error {
+	segments, err := segment.ListSegments(m.fsys, m.walDir)
 	if err != nil {
-		m.log.Error("Failed to list segments", sl.Err(err))
-		return nil
+		return fmt.Errorf("failed to list segments: %w", err)
 	}
 
 	for _, seg := range segments {
-		if err := m.processSingleSegment(conn, seg, lastSegmentID, lastSegmentSize); err != nil {
-			return err
+		if seg.ID < hello.pos.SegmentID {
+			continue
 		}
+		if seg.ID != hello.pos.SegmentID && uint64(seg.ID) != hello.lsn+1 {
+			return fmt.Errorf("%w: the replica needs the entries after LSN %d, the oldest segment left starts at LSN %d",
+				ErrMissingData, hello.lsn, seg.ID)
+		}
+		break
 	}
 
 	return nil
 }
 
-func (m *Manager) processSingleSegment(conn net.Conn, seg segment.Info, lastSegmentID, lastSegmentSize *int64) error {
-	// Safe read segment
-	data, err := safeReadSegment(m.walDir, seg.Name)
-	if err != nil {
-		m.log.Error("Failed to read segment", sl.Err(err))
-		return nil
+// readReplicaMessages reads the messages of a replica until the stream
+// fails or is closed
+func (m *Manager) readReplicaMessages(conn net.Conn) error {
+	for {
+		f, err := readFrame(conn)
+		if err != nil {
+			return err
+		}
+
+		switch f.typ {
+		case msgAck:
+			ack, err := unmarshalAck(f.payload)
+			if err != nil {
+				return err
+			}
+			m.recordAck(conn, ack)
+		case msgError:
+			return fmt.Errorf("%w: %s", ErrPeer, f.payload)
+		default:
+			return fmt.Errorf("%w: unexpected message type %d from replica", ErrProtocol, f.typ)
+		}
 	}
+}
 
-	if seg.ID < *lastSegmentID {
+// stream sends the WAL of the master to one replica
+type stream struct {
+	m    *Manager
+	conn net.Conn
+	// pos is the end of the data the replica has
+	pos segment.Position
+}
+
+// sendUpTo sends the data between the position of the replica and target.
+// The segments before the one of target are complete, so they are sent up
+// to their end; segments the replica has moved past are skipped.
+func (s *stream) sendUpTo(target segment.Position) error {
+	if target.SegmentID < s.pos.SegmentID {
 		return nil
 	}
 
-	if seg.ID == *lastSegmentID {
-		if int64(len(data)) <= *lastSegmentSize {
-			return nil
+	// The segments are listed only when the replica is behind by a rotation
+	if target.SegmentID > s.pos.SegmentID {
+		segments, err := segment.ListSegments(s.m.fsys, s.m.walDir)
+		if err != nil {
+			return fmt.Errorf("failed to list segments: %w", err)
 		}
-		data = data[*lastSegmentSize:]
 
-		if err := m.sendSegment(conn, seg, data); err != nil {
-			m.log.Error("Failed to send segment update", sl.Err(err))
-			return err
-		}
+		for _, seg := range segments {
+			if seg.ID < s.pos.SegmentID {
+				continue
+			}
+			if seg.ID >= target.SegmentID {
+				break
+			}
 
-		*lastSegmentSize += int64(len(data))
-	} else {
-		if err := m.sendSegment(conn, seg, data); err != nil {
-			m.log.Error("Failed to send new segment", sl.Err(err))
-			return err
+			info, err := s.m.fsys.Stat(filepath.Join(s.m.walDir, seg.Name))
+			if err != nil {
+				return fmt.Errorf("failed to stat segment: %w", err)
+			}
+			if err := s.send(seg.ID, info.Size()); err != nil {
+				return err
+			}
 		}
-
-		*lastSegmentID = seg.ID
-		*lastSegmentSize = int64(len(data))
 	}
 
-	return nil
+	return s.send(target.SegmentID, target.Offset)
 }
 
-// sendSegment sends a WAL segment to a replica
-func (m *Manager) sendSegment(conn net.Conn, segInfo segment.Info, data []byte) error {
-	// Send segment ID and size
-	if _, err := fmt.Fprintf(conn, "%d %d\n", segInfo.ID, len(data)); err != nil {
-		return fmt.Errorf("failed to send segment header: %w", err)
+// send sends the data of a segment up to end, from the position of the
+// replica if it is in this segment, in chunks of at most chunkSize bytes
+func (s *stream) send(segmentID, end int64) error {
+	var start int64
+	if segmentID == s.pos.SegmentID {
+		start = s.pos.Offset
+	}
+	if start >= end {
+		return nil
+	}
+
+	file, err := vfs.Open(s.m.fsys, filepath.Join(s.m.walDir, segment.FileName(segmentID)))
+	if err != nil {
+		return fmt.Errorf("failed to open segment: %w", err)
 	}
+	defer file.Close()
+
+	for start < end {
+		n := min(end-start, chunkSize)
+		msg := dataMessage{pos: segment.Position{SegmentID: segmentID, Offset: start}, data: make([]byte, n)}
+		if _, err := file.ReadAt(msg.data, start); err != nil {
+			return fmt.Errorf("failed to read segment: %w", err)
+		}
+		if err := writeFrame(s.conn, msgData, msg.marshal()); err != nil {
+			return fmt.Errorf("failed to send segment data: %w", err)
+		}
 
-	// Send segment data
-	if _, err := conn.Write(data); err != nil {
-		return fmt.Errorf("failed to send segment data: %w", err)
+		start += n
+		s.pos = segment.Position{SegmentID: segmentID, Offset: start}
 	}
 
 	return nil
@@ -0,0 +1,290 @@
+package replication
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+
+	"github.com/8thgencore/valchemy/internal/wal/segment"
+)
+
+// protocolVersion is the version of the replication protocol spoken by
+// this build. The master rejects replicas of another version.
+const protocolVersion = 2
+
+// Message types of the replication protocol. The replica opens the stream
+// with a handshake, which the master answers with its own handshake or an
+// error. The master then sends data and heartbeats and the replica sends
+// acknowledgements. Either side may send an error before closing the stream.
+const (
+	msgHandshake byte = iota + 1
+	msgData
+	msgHeartbeat
+	msgAck
+	msgError
+)
+
+const (
+	// frameHeaderSize is the size of the header of a frame: the message
+	// type, the size of the payload and the CRC32 of the type and payload
+	frameHeaderSize = 9
+	// maxFrameSize bounds the payload of a frame: a chunk of segment data
+	// and its position
+	maxFrameSize = chunkSize + 64
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// frame is a message of the replication protocol
+type frame struct {
+	typ     byte
+	payload []byte
+}
+
+// writeFrame writes a message with a single write, so that frames written
+// by different goroutines do not interleave
+func writeFrame(w io.Writer, typ byte, payload []byte) error {
+	if len(payload) > maxFrameSize {
+		return fmt.Errorf("%w: frame of %d bytes exceeds the limit of %d", ErrProtocol, len(payload), maxFrameSize)
+	}
+
+	buf := make([]byte, frameHeaderSize, frameHeaderSize+len(payload))
+	buf[0] = typ
+	binary.LittleEndian.PutUint32(buf[1:5], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[5:9], frameChecksum(typ, payload))
+	buf = append(buf, payload...)
+
+	_, err := w.Write(buf)
+
+	return err
+}
+
+// readFrame reads a message and verifies its checksum
+func readFrame(r io.Reader) (frame, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return frame{}, err
+	}
+
+	f := frame{typ: header[0]}
+	size := binary.LittleEndian.Uint32(header[1:5])
+	if size > maxFrameSize {
+		return frame{}, fmt.Errorf("%w: frame of %d bytes exceeds the limit of %d", ErrProtocol, size, maxFrameSize)
+	}
+
+	f.payload = make([]byte, size)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return frame{}, fmt.Errorf("failed to read frame payload: %w", err)
+	}
+
+	if binary.LittleEndian.Uint32(header[5:9]) != frameChecksum(f.typ, f.payload) {
+		return frame{}, ErrChecksumMismatch
+	}
+
+	return f, nil
+}
+
+func frameChecksum(typ byte, payload []byte) uint32 {
+	return crc32.Update(crc32.Checksum([]byte{typ}, crcTable), crcTable, payload)
+}
+
+// handshake opens a replication stream. The replica sends the position and
+// the last sequence number of its local WAL; the master answers with the
+// position it streams from. Both send their epoch history.
+type handshake struct {
+	version   uint32
+	clusterID string
+	nodeID    string
+	lsn       uint64
+	pos       segment.Position
+	epochs    epochHistory
+}
+
+func (h handshake) marshal() []byte {
+	buf := binary.LittleEndian.AppendUint32(nil, h.version)
+	buf = appendString(buf, h.clusterID)
+	buf = appendString(buf, h.nodeID)
+	buf = binary.LittleEndian.AppendUint64(buf, h.lsn)
+	buf = appendPosition(buf, h.pos)
+
+	return appendEpochs(buf, h.epochs)
+}
+
+// unmarshalHandshake decodes a handshake. Only the version of a handshake of
+// another protocol version is decoded, so that the peer can be told why it
+// is rejected.
+func unmarshalHandshake(payload []byte) (handshake, error) {
+	d := decoder{buf: payload}
+	h := handshake{version: d.uint32()}
+	if d.err == nil && h.version != protocolVersion {
+		return h, nil
+	}
+
+	h.clusterID = d.string()
+	h.nodeID = d.string()
+	h.lsn = d.uint64()
+	h.pos = d.position()
+	h.epochs = d.epochs()
+
+	return h, d.finish("handshake")
+}
+
+// dataMessage carries segment data of the master starting at pos
+type dataMessage struct {
+	pos  segment.Position
+	data []byte
+}
+
+func (m dataMessage) marshal() []byte {
+	buf := make([]byte, 0, 16+len(m.data))
+	buf = appendPosition(buf, m.pos)
+
+	return append(buf, m.data...)
+}
+
+func unmarshalData(payload []byte) (dataMessage, error) {
+	d := decoder{buf: payload}
+	m := dataMessage{pos: d.position()}
+	if d.err != nil {
+		return dataMessage{}, d.finish("data")
+	}
+	m.data = d.buf
+
+	return m, nil
+}
+
+// ackMessage is the position of the data applied by a replica and the
+// sequence number of the last entry applied
+type ackMessage struct {
+	pos segment.Position
+	lsn uint64
+}
+
+func (m ackMessage) marshal() []byte {
+	return binary.LittleEndian.AppendUint64(appendPosition(nil, m.pos), m.lsn)
+}
+
+func unmarshalAck(payload []byte) (ackMessage, error) {
+	d := decoder{buf: payload}
+	m := ackMessage{pos: d.position(), lsn: d.uint64()}
+
+	return m, d.finish("ack")
+}
+
+// appendString appends a string of at most math.MaxUint16 bytes, longer
+// ones are cut
+func appendString(buf []byte, s string) []byte {
+	if len(s) > math.MaxUint16 {
+		s = s[:math.MaxUint16]
+	}
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(len(s)))
+
+	return append(buf, s...)
+}
+
+func appendPosition(buf []byte, pos segment.Position) []byte {
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(pos.SegmentID))
+	return binary.LittleEndian.AppendUint64(buf, uint64(pos.Offset))
+}
+
+// appendEpochs appends at most math.MaxUint16 epochs, the latest ones
+func appendEpochs(buf []byte, h epochHistory) []byte {
+	if len(h) > math.MaxUint16 {
+		h = h[len(h)-math.MaxUint16:]
+	}
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(len(h)))
+	for _, e := range h {
+		buf = binary.LittleEndian.AppendUint64(buf, e.Epoch)
+		buf = binary.LittleEndian.AppendUint64(buf, e.LSN)
+	}
+
+	return buf
+}
+
+// decoder reads the fields of a payload, remembering the first error
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.buf) < n {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+
+	return b
+}
+
+func (d *decoder) uint32() uint32 {
+	if b := d.next(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+
+	return 0
+}
+
+func (d *decoder) uint64() uint64 {
+	if b := d.next(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+
+	return 0
+}
+
+func (d *decoder) int64() int64 {
+	return int64(d.uint64())
+}
+
+func (d *decoder) string() string {
+	b := d.next(2)
+	if b == nil {
+		return ""
+	}
+
+	return string(d.next(int(binary.LittleEndian.Uint16(b))))
+}
+
+func (d *decoder) position() segment.Position {
+	return segment.Position{SegmentID: d.int64(), Offset: d.int64()}
+}
+
+func (d *decoder) epochs() epochHistory {
+	b := d.next(2)
+	if b == nil {
+		return nil
+	}
+
+	n := int(binary.LittleEndian.Uint16(b))
+	if len(d.buf) < 16*n {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	var h epochHistory
+	for range n {
+		h = append(h, epochStart{Epoch: d.uint64(), LSN: d.uint64()})
+	}
+
+	return h
+}
+
+// finish returns the error of the decoding of a message, if any, or if
+// bytes are left over
+func (d *decoder) finish(message string) error {
+	if d.err == nil && len(d.buf) > 0 {
+		d.err = fmt.Errorf("%d trailing bytes", len(d.buf))
+	}
+	if d.err != nil {
+		return fmt.Errorf("%w: malformed %s message: %v", ErrProtocol, message, d.err)
+	}
+
+	return nil
+}
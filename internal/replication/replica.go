@@ -1,6 +1,7 @@
 package replication
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -9,21 +10,35 @@ import (
 	"path/filepath"
 	"time"
 
+	"github.com/8thgencore/valchemy/internal/wal/entry"
 	"github.com/8thgencore/valchemy/internal/wal/segment"
 	"github.com/8thgencore/valchemy/pkg/logger/sl"
 )
 
-var errTimeout = errors.New("timeout")
-
 // startReplica starts the replica replication service
 func (m *Manager) startReplica() error {
-	m.log.Info("Starting replica replication service", "master", m.cfg.MasterHost)
+	m.log.Info("Starting replica replication service", "master", m.masterAddr())
 
+	// Local segments have already been applied to the storage during recovery,
+	// so only data received after startup needs to be applied
+	if err := m.updateLastSegmentInfo(&m.appliedSegmentID, &m.appliedOffset); err != nil {
+		return err
+	}
+	lsn, err := m.lastLocalLSN()
+	if err != nil {
+		return err
+	}
+	m.appliedLSN = lsn
+
+	m.wg.Add(1)
 	go func() {
-		for {
-			if err := m.maintainMasterConnection(); err != nil {
+		defer m.wg.Done()
+		defer m.setConn(nil)
+
+		for !m.stopped() {
+			if err := m.maintainMasterConnection(); err != nil && !m.stopped() {
 				m.log.Error("Failed to maintain master connection", sl.Err(err))
-				time.Sleep(m.cfg.SyncRetryDelay)
+				m.wait(m.cfg.SyncRetryDelay)
 			}
 		}
 	}()
@@ -31,24 +46,39 @@ func (m *Manager) startReplica() error {
 	return nil
 }
 
-// maintainMasterConnection establishes and maintains a connection to the master
-func (m *Manager) maintainMasterConnection() error {
+// setConn replaces the connection to the master, closing the previous one.
+// A connection set after Stop is closed at once.
+func (m *Manager) setConn(conn net.Conn) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	if m.conn != nil {
-		if err := m.conn.Close(); err != nil {
-			m.log.Error("Failed to close connection", sl.Err(err))
-		}
-		m.conn = nil
+		closeQuietly(m.log, m.conn)
+	}
+	m.conn = conn
+	if conn != nil && m.stopped() {
+		closeQuietly(m.log, conn)
+		return false
 	}
 
-	replicationAddress := fmt.Sprintf("%s:%s", m.cfg.MasterHost, m.cfg.ReplicationPort)
+	return true
+}
+
+// maintainMasterConnection establishes and maintains a connection to the master
+func (m *Manager) maintainMasterConnection() error {
+	m.setConn(nil)
+
+	replicationAddress := m.masterAddr()
 
-	var err error
 	retryCount := m.cfg.SyncRetryCount
 
 	// Try connecting with retries
 	for {
-		m.conn, err = net.Dial("tcp", replicationAddress)
+		conn, err := net.Dial("tcp", replicationAddress)
 		if err == nil {
+			if !m.setConn(conn) {
+				return nil
+			}
 			m.log.Info("Connected to master", "address", replicationAddress)
 			break
 		}
@@ -60,151 +90,333 @@ func (m *Manager) maintainMasterConnection() error {
 		} else {
 			return fmt.Errorf("failed to connect to master after %d retries: %w", m.cfg.SyncRetryCount, err)
 		}
-		time.Sleep(m.cfg.SyncRetryDelay)
+		if !m.wait(m.cfg.SyncRetryDelay) {
+			return nil
+		}
 	}
 
 	return m.syncWithMaster()
 }
 
-// syncWithMaster synchronizes WAL segments with the master
+// syncWithMaster opens a stream with a handshake holding the position of the
+// local WAL, then writes and applies the data the master streams from there
 func (m *Manager) syncWithMaster() error {
 	if m.conn == nil {
 		return errors.New("no active connection to master")
 	}
 
-	var lastSegmentID int64 = -1
-	var lastSegmentSize int64
+	pos := segment.Position{SegmentID: -1}
+	if err := m.updateLastSegmentInfo(&pos.SegmentID, &pos.Offset); err != nil {
+		return err
+	}
 
-	if err := m.conn.SetReadDeadline(time.Now().Add(m.cfg.SyncInterval)); err != nil {
-		return fmt.Errorf("failed to set read deadline: %w", err)
+	lsn, err := m.lastLocalLSN()
+	if err != nil {
+		return err
 	}
 
-	for {
-		m.log.Debug("Starting sync cycle with master")
+	if err := m.handshake(pos, lsn); err != nil {
+		return err
+	}
 
-		if err := m.updateLastSegmentInfo(&lastSegmentID, &lastSegmentSize); err != nil {
-			return err
+	m.setConnected(true)
+	defer m.setConnected(false)
+
+	if err := m.sendAck(); err != nil {
+		return err
+	}
+
+	for !m.stopped() {
+		// The master sends heartbeats while it has no data, so a silent
+		// connection is dead
+		if m.cfg.ReadTimeout > 0 {
+			if err := m.conn.SetReadDeadline(time.Now().Add(m.cfg.ReadTimeout)); err != nil {
+				return fmt.Errorf("failed to update read deadline: %w", err)
+			}
 		}
 
-		if err := m.sendSegmentInfo(lastSegmentID, lastSegmentSize); err != nil {
+		f, err := m.readMasterFrame()
+		if err != nil {
 			return err
 		}
 
-		if err := m.receiveAndProcessSegments(&lastSegmentID, &lastSegmentSize); err != nil {
+		switch f.typ {
+		case msgData:
+			msg, err := unmarshalData(f.payload)
+			if err == nil {
+				err = m.processReceivedSegment(msg, &pos)
+			}
+			if err != nil {
+				return m.reject(m.conn, err)
+			}
+		case msgHeartbeat:
+		case msgError:
+			return fmt.Errorf("%w: %s", ErrPeer, f.payload)
+		default:
+			return m.reject(m.conn, fmt.Errorf("%w: unexpected message type %d from master", ErrProtocol, f.typ))
+		}
+
+		// The applied position is acknowledged after every update and
+		// heartbeat, which also tells the master the replica is alive
+		if err := m.sendAck(); err != nil {
 			return err
 		}
 	}
+
+	return nil
 }
 
-func (m *Manager) updateLastSegmentInfo(lastSegmentID, lastSegmentSize *int64) error {
-	segments, err := segment.ListSegments(m.walDir)
-	if err != nil {
-		return fmt.Errorf("failed to list local segments: %w", err)
+// sendAck reports the position of the data applied to the local storage to
+// the master
+func (m *Manager) sendAck() error {
+	ack := ackMessage{
+		pos: segment.Position{SegmentID: m.appliedSegmentID, Offset: m.appliedOffset},
+		lsn: m.appliedLSN,
 	}
-
-	if len(segments) > 0 {
-		lastSegment := segments[len(segments)-1]
-		*lastSegmentID = lastSegment.ID
-		if info, err := os.Stat(filepath.Join(m.walDir, lastSegment.Name)); err == nil {
-			*lastSegmentSize = info.Size()
-		}
+	if err := writeFrame(m.conn, msgAck, ack.marshal()); err != nil {
+		return fmt.Errorf("failed to send ack: %w", err)
 	}
 
+	m.stateMu.Lock()
+	m.lastAck = ack
+	m.stateMu.Unlock()
+
 	return nil
 }
 
-func (m *Manager) sendSegmentInfo(lastSegmentID, lastSegmentSize int64) error {
-	m.log.Debug("Sending segment info to master",
-		"last_segment_id", lastSegmentID,
-		"last_segment_size", lastSegmentSize)
+// setConnected records whether the stream from the master is open
+func (m *Manager) setConnected(connected bool) {
+	m.stateMu.Lock()
+	m.connected = connected
+	m.stateMu.Unlock()
+}
 
-	if _, err := fmt.Fprintf(m.conn, "%d %d\n", lastSegmentID, lastSegmentSize); err != nil {
-		return fmt.Errorf("failed to send segment info: %w", err)
+// handshake opens the replication stream from the given position, after
+// the entry of the given LSN, and checks the answer of the master. The
+// replica takes the epoch history of a master of a newer epoch.
+func (m *Manager) handshake(pos segment.Position, lsn uint64) error {
+	m.log.Debug("Sending handshake to master",
+		"last_segment_id", pos.SegmentID,
+		"last_segment_size", pos.Offset,
+		"lsn", lsn)
+
+	epochs := m.epochHistory()
+	hello := handshake{
+		version:   protocolVersion,
+		clusterID: m.cfg.ClusterID,
+		nodeID:    m.nodeID,
+		lsn:       lsn,
+		pos:       pos,
+		epochs:    epochs,
+	}
+	if err := writeFrame(m.conn, msgHandshake, hello.marshal()); err != nil {
+		return fmt.Errorf("failed to send handshake: %w", err)
 	}
 
-	return nil
-}
-
-func (m *Manager) receiveAndProcessSegments(lastSegmentID, lastSegmentSize *int64) error {
-	receivedData := false
-	for {
-		if err := m.conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
-			return fmt.Errorf("failed to update read deadline: %w", err)
+	if m.cfg.ReadTimeout > 0 {
+		if err := m.conn.SetReadDeadline(time.Now().Add(m.cfg.ReadTimeout)); err != nil {
+			return fmt.Errorf("failed to set read deadline: %w", err)
 		}
+	}
 
-		segmentID, size, err := m.readSegmentHeader()
-		if err != nil {
-			if err == errTimeout || err == io.EOF {
-				break
-			}
-			return err
-		}
+	f, err := m.readMasterFrame()
+	if err != nil {
+		return err
+	}
+	switch f.typ {
+	case msgHandshake:
+	case msgError:
+		return fmt.Errorf("%w: rejected by master: %s", ErrHandshake, f.payload)
+	default:
+		return m.reject(m.conn, fmt.Errorf("%w: expected a handshake, got message type %d", ErrProtocol, f.typ))
+	}
+
+	reply, err := unmarshalHandshake(f.payload)
+	if err != nil {
+		return m.reject(m.conn, err)
+	}
+	switch {
+	case reply.version != protocolVersion:
+		return fmt.Errorf("%w: master speaks protocol version %d, expected %d",
+			ErrHandshake, reply.version, protocolVersion)
+	case reply.clusterID != m.cfg.ClusterID:
+		return fmt.Errorf("%w: master belongs to cluster %q, expected %q", ErrHandshake, reply.clusterID, m.cfg.ClusterID)
+	case reply.pos != pos:
+		return fmt.Errorf("%w: master streams from segment %d offset %d, expected segment %d offset %d",
+			ErrHandshake, reply.pos.SegmentID, reply.pos.Offset, pos.SegmentID, pos.Offset)
+	case reply.epochs.current() < epochs.current():
+		return m.reject(m.conn, fmt.Errorf("%w: master of epoch %d, the replica knows epoch %d",
+			ErrStaleEpoch, reply.epochs.current(), epochs.current()))
+	}
 
-		if err := m.processReceivedSegment(segmentID, size, lastSegmentID, lastSegmentSize); err != nil {
+	if reply.epochs.current() > epochs.current() {
+		if err := saveEpochs(m.fsys, m.walDir, reply.epochs); err != nil {
 			return err
 		}
-		receivedData = true
+		m.stateMu.Lock()
+		m.epochs = reply.epochs
+		m.stateMu.Unlock()
+		m.log.Info("Following a master of a newer epoch", "epoch", reply.epochs.current())
 	}
 
-	if !receivedData {
-		time.Sleep(m.cfg.SyncInterval)
-	}
+	m.log.Info("Replication stream opened", "master_id", reply.nodeID)
 
 	return nil
 }
 
-func (m *Manager) readSegmentHeader() (int64, int64, error) {
-	var segmentID, size int64
-	if _, err := fmt.Fscanf(m.conn, "%d %d\n", &segmentID, &size); err != nil {
+// readMasterFrame reads a message of the master. A corrupted frame is
+// reported to the master before the stream is closed.
+func (m *Manager) readMasterFrame() (frame, error) {
+	f, err := readFrame(m.conn)
+	if err != nil {
 		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-			return 0, 0, errTimeout
+			return frame{}, fmt.Errorf("no data from master within %s", m.cfg.ReadTimeout)
 		}
-		if err.Error() == "EOF" {
-			return 0, 0, io.EOF
+		if errors.Is(err, ErrChecksumMismatch) || errors.Is(err, ErrProtocol) {
+			return frame{}, m.reject(m.conn, err)
 		}
 
-		return 0, 0, fmt.Errorf("failed to read segment header: %w", err)
+		return frame{}, fmt.Errorf("failed to read from master: %w", err)
 	}
 
-	return segmentID, size, nil
+	return f, nil
 }
 
-func (m *Manager) processReceivedSegment(segmentID, size int64, lastSegmentID, lastSegmentSize *int64) error {
-	segName := fmt.Sprintf("wal-%d.log", segmentID)
+// lastLocalLSN returns the sequence number of the last entry of the local
+// WAL, zero if there is none
+func (m *Manager) lastLocalLSN() (uint64, error) {
+	segments, err := segment.ListSegments(m.fsys, m.walDir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list local segments: %w", err)
+	}
 
-	// Read segment data
-	data := make([]byte, size)
-	if _, err := m.conn.Read(data); err != nil {
-		return fmt.Errorf("failed to read segment data: %w", err)
+	var lsn uint64
+	for i := len(segments) - 1; i >= 0 && lsn == 0; i-- {
+		// A torn tail is cut off, the entries before it count
+		err := segment.ReplaySegment(m.fsys, m.walDir, segments[i].Name, 0, func(e *entry.Entry) error {
+			lsn = max(lsn, e.LSN)
+			return nil
+		})
+		var corruption *segment.CorruptionError
+		if err != nil && !errors.As(err, &corruption) {
+			return 0, fmt.Errorf("failed to read local segment: %w", err)
+		}
 	}
 
-	if segmentID == *lastSegmentID {
-		// Safe reading of existing file
-		existingData, err := safeReadSegment(m.walDir, segName)
-		if err == nil {
-			// Combine existing data with new data
-			combinedData := make([]byte, len(existingData)+len(data))
-			copy(combinedData, existingData)
-			copy(combinedData[len(existingData):], data)
-			data = combinedData
+	return lsn, nil
+}
+
+func (m *Manager) updateLastSegmentInfo(lastSegmentID, lastSegmentSize *int64) error {
+	segments, err := segment.ListSegments(m.fsys, m.walDir)
+	if err != nil {
+		return fmt.Errorf("failed to list local segments: %w", err)
+	}
+
+	if len(segments) > 0 {
+		lastSegment := segments[len(segments)-1]
+		*lastSegmentID = lastSegment.ID
+		if info, err := m.fsys.Stat(filepath.Join(m.walDir, lastSegment.Name)); err == nil {
+			*lastSegmentSize = info.Size()
 		}
 	}
 
-	fullPath := filepath.Join(m.walDir, segName)
+	return nil
+}
+
+// processReceivedSegment writes data received for a segment to the local
+// WAL and applies it. Data must continue the segment at pos or start the
+// segment of the entry after the last one applied, as a segment is named
+// after its first entry; anything else means the streams of the master and
+// the replica diverged or entries are missing.
+func (m *Manager) processReceivedSegment(msg dataMessage, pos *segment.Position) error {
+	size := int64(len(msg.data))
+	isUpdate := msg.pos.SegmentID == pos.SegmentID
+	switch {
+	case isUpdate && msg.pos.Offset != pos.Offset:
+		return fmt.Errorf("%w: data for segment %d at offset %d, expected offset %d",
+			ErrProtocol, msg.pos.SegmentID, msg.pos.Offset, pos.Offset)
+	case !isUpdate && (msg.pos.SegmentID < pos.SegmentID || msg.pos.Offset != 0):
+		return fmt.Errorf("%w: data for segment %d at offset %d, expected segment %d offset %d or a new segment",
+			ErrProtocol, msg.pos.SegmentID, msg.pos.Offset, pos.SegmentID, pos.Offset)
+	case !isUpdate && uint64(msg.pos.SegmentID) != m.appliedLSN+1:
+		return fmt.Errorf("%w: segment %d does not follow the last entry applied, of LSN %d",
+			ErrMissingData, msg.pos.SegmentID, m.appliedLSN)
+	}
+
+	flag := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if !isUpdate {
+		flag |= os.O_TRUNC
+		*pos = segment.Position{SegmentID: msg.pos.SegmentID}
+	}
 
-	// Write data to disk
-	if err := os.WriteFile(fullPath, data, 0o600); err != nil {
+	fullPath := filepath.Join(m.walDir, segment.FileName(msg.pos.SegmentID))
+	if err := appendFile(m.fsys, fullPath, flag, msg.data); err != nil {
 		return fmt.Errorf("failed to write segment file: %w", err)
 	}
 
-	m.log.Info("Received segment from master",
-		"segment_id", segmentID,
+	m.log.Debug("Received segment from master",
+		"segment_id", msg.pos.SegmentID,
 		"new_data_size", size,
-		"total_size", len(data),
-		"is_update", segmentID == *lastSegmentID)
+		"total_size", pos.Offset+size,
+		"is_update", isUpdate)
+
+	pos.Offset += size
+
+	return m.applySegmentData(msg.pos.SegmentID, msg.pos.Offset, msg.data)
+}
+
+// applySegmentData decodes the entries of a segment that have not been applied
+// yet and applies them to the local storage. data holds the segment from the
+// given offset; the start of a record received earlier is read back from the
+// local segment. A trailing partial entry is left for the next update of the
+// same segment.
+func (m *Manager) applySegmentData(segmentID, offset int64, data []byte) error {
+	if m.applier == nil {
+		return nil
+	}
+
+	if segmentID != m.appliedSegmentID {
+		if m.appliedSegmentID > segmentID {
+			return nil
+		}
+		m.appliedSegmentID = segmentID
+		m.appliedOffset = 0
+	}
+
+	if m.appliedOffset >= offset+int64(len(data)) {
+		return nil
+	}
 
-	*lastSegmentID = segmentID
-	*lastSegmentSize = int64(len(data))
+	if m.appliedOffset < offset {
+		head, err := safeReadSegment(m.fsys, m.walDir, segment.FileName(segmentID), m.appliedOffset, offset)
+		if err != nil {
+			return fmt.Errorf("failed to read partial entry of segment %d: %w", segmentID, err)
+		}
+		data = append(head, data...)
+		offset = m.appliedOffset
+	}
+
+	reader := entry.NewReader(bytes.NewReader(data[m.appliedOffset-offset:]))
+	var entries []*entry.Entry
+	for {
+		e, n, err := reader.Next()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to decode entry from segment %d: %w", segmentID, err)
+		}
+		entries = append(entries, e)
+		m.appliedOffset += n
+		m.appliedLSN = max(m.appliedLSN, e.LSN)
+	}
+
+	m.applier.ApplyEntries(entries, segment.Position{SegmentID: segmentID, Offset: m.appliedOffset})
+
+	m.log.Debug("Applied replicated entries",
+		"segment_id", segmentID,
+		"entries", len(entries),
+		"applied_offset", m.appliedOffset)
 
 	return nil
 }
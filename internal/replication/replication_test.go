@@ -4,13 +4,23 @@
 package replication
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
 	"log/slog"
 	"net"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/8thgencore/valchemy/internal/config"
+	"github.com/8thgencore/valchemy/internal/vfs"
+	"github.com/8thgencore/valchemy/internal/wal"
+	"github.com/8thgencore/valchemy/internal/wal/entry"
+	"github.com/8thgencore/valchemy/internal/wal/segment"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -21,6 +31,7 @@ func TestSafeReadSegment(t *testing.T) {
 		walDir      string
 		segName     string
 		content     string
+		from        int64
 		expectError bool
 	}{
 		{
@@ -30,6 +41,14 @@ func TestSafeReadSegment(t *testing.T) {
 			content:     "test content",
 			expectError: false,
 		},
+		{
+			name:        "Range of a segment",
+			walDir:      t.TempDir(),
+			segName:     "wal-123.log",
+			content:     "test content",
+			from:        5,
+			expectError: false,
+		},
 		{
 			name:        "Invalid segment name format",
 			walDir:      t.TempDir(),
@@ -57,13 +76,13 @@ func TestSafeReadSegment(t *testing.T) {
 				require.NoError(t, err)
 			}
 
-			data, err := safeReadSegment(tt.walDir, tt.segName)
+			data, err := safeReadSegment(vfs.OS, tt.walDir, tt.segName, tt.from, int64(len(tt.content)))
 			if tt.expectError {
 				assert.Error(t, err)
 				assert.Nil(t, data)
 			} else {
 				assert.NoError(t, err)
-				assert.Equal(t, tt.content, string(data))
+				assert.Equal(t, tt.content[tt.from:], string(data))
 			}
 		})
 	}
@@ -76,21 +95,782 @@ func TestMasterReplication(t *testing.T) {
 	cfg := config.ReplicationConfig{
 		ReplicaType:     config.Master,
 		MasterHost:      "127.0.0.1",
-		ReplicationPort: "13234",
+		ReplicationPort: freePort(t),
 	}
 
 	log := slog.New(slog.NewTextHandler(os.Stdout, nil))
-	master := New(cfg, log, segDir)
+	master := New(cfg, log, vfs.OS, segDir, newTestWAL(t, segDir), nil)
 
 	// Start master
 	err := master.Start()
 	require.NoError(t, err)
+	t.Cleanup(master.Stop)
 
 	// Try to connect as a client
-	conn, err := net.Dial("tcp", "127.0.0.1:13234")
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", cfg.ReplicationPort))
 	require.NoError(t, err)
 	defer conn.Close()
 
 	// Verify connection
 	assert.NotNil(t, conn)
 }
+
+func TestStop(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	t.Run("master", func(t *testing.T) {
+		cfg := config.ReplicationConfig{
+			ReplicaType:     config.Master,
+			MasterHost:      "127.0.0.1",
+			ReplicationPort: "13235",
+		}
+		dir := t.TempDir()
+		master := New(cfg, log, vfs.OS, dir, newTestWAL(t, dir), nil)
+		require.NoError(t, master.Start())
+
+		conn, err := net.Dial("tcp", "127.0.0.1:13235")
+		require.NoError(t, err)
+		defer conn.Close()
+
+		stopped := make(chan struct{})
+		go func() {
+			master.Stop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(2 * time.Second):
+			t.Fatal("master did not stop")
+		}
+
+		_, err = net.Dial("tcp", "127.0.0.1:13235")
+		assert.Error(t, err)
+	})
+
+	t.Run("replica waiting for master", func(t *testing.T) {
+		cfg := config.ReplicationConfig{
+			ReplicaType:     config.Replica,
+			MasterHost:      "127.0.0.1",
+			ReplicationPort: "13236",
+			SyncRetryDelay:  time.Hour,
+			SyncRetryCount:  3,
+		}
+		replica := New(cfg, log, vfs.OS, t.TempDir(), nil, nil)
+		require.NoError(t, replica.Start())
+
+		stopped := make(chan struct{})
+		go func() {
+			replica.Stop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(2 * time.Second):
+			t.Fatal("replica did not stop")
+		}
+	})
+}
+
+type testApplier struct {
+	mu      sync.Mutex
+	entries []*entry.Entry
+	// pos is the end of the last entries applied
+	pos         segment.Position
+	truncateWAL bool
+}
+
+func (a *testApplier) ApplyEntries(entries []*entry.Entry, pos segment.Position) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.entries = append(a.entries, entries...)
+	a.pos = pos
+}
+
+func (a *testApplier) SetWALTruncation(enabled bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.truncateWAL = enabled
+}
+
+func (a *testApplier) truncates() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.truncateWAL
+}
+
+func (a *testApplier) count() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.entries)
+}
+
+// freePort returns a TCP port that is free on the loopback interface
+func freePort(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	require.NoError(t, err)
+
+	return port
+}
+
+// newTestWAL opens a WAL in dir that is closed at the end of the test
+func newTestWAL(t *testing.T, dir string) *wal.Service {
+	t.Helper()
+
+	w, err := wal.New(config.WALConfig{
+		Enabled:              true,
+		DataDirectory:        dir,
+		FlushingBatchSize:    1,
+		FlushingBatchTimeout: 10 * time.Millisecond,
+		MaxSegmentSizeBytes:  200,
+	}, vfs.OS, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = w.Close() })
+
+	return w
+}
+
+func TestStreaming(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	masterDir, replicaDir := t.TempDir(), t.TempDir()
+	w := newTestWAL(t, masterDir)
+	write := func(i int) {
+		_, err := w.Write(entry.Entry{
+			Operation: entry.OperationSet, Key: fmt.Sprintf("key%d", i), Value: "value",
+		})
+		require.NoError(t, err)
+	}
+
+	// Entries written before the replica connects are caught up from the segments
+	for i := 0; i < 5; i++ {
+		write(i)
+	}
+
+	master := New(config.ReplicationConfig{
+		ReplicaType:     config.Master,
+		MasterHost:      "127.0.0.1",
+		ReplicationPort: "13237",
+		SyncInterval:    50 * time.Millisecond,
+	}, log, vfs.OS, masterDir, w, nil)
+	require.NoError(t, master.Start())
+	defer master.Stop()
+
+	applier := &testApplier{}
+	replica := New(config.ReplicationConfig{
+		ReplicaType:     config.Replica,
+		MasterHost:      "127.0.0.1",
+		ReplicationPort: "13237",
+		SyncRetryDelay:  10 * time.Millisecond,
+		SyncRetryCount:  3,
+		ReadTimeout:     time.Second,
+	}, log, vfs.OS, replicaDir, nil, applier)
+	require.NoError(t, replica.Start())
+	defer replica.Stop()
+
+	require.Eventually(t, func() bool { return applier.count() == 5 }, 2*time.Second, 5*time.Millisecond)
+
+	// Later entries are pushed as they are flushed, across segment rotations
+	for i := 5; i < 20; i++ {
+		write(i)
+	}
+	require.Eventually(t, func() bool { return applier.count() == 20 }, 2*time.Second, 5*time.Millisecond)
+
+	// The master knows how far the replica got
+	require.Eventually(t, func() bool {
+		replicas := master.Info().Replicas
+		return len(replicas) == 1 && replicas[0].AckedLSN == 20
+	}, 2*time.Second, 5*time.Millisecond)
+	info := master.Info()
+	assert.Equal(t, uint64(20), info.LSN)
+	assert.Zero(t, info.Replicas[0].BytesBehind)
+	assert.WithinDuration(t, time.Now(), info.Replicas[0].LastSeen, time.Second)
+
+	replicaInfo := replica.Info()
+	assert.True(t, replicaInfo.Connected)
+	assert.Equal(t, uint64(20), replicaInfo.AppliedLSN)
+
+	// The replica holds a copy of the segments of the master, except for the
+	// empty segment created ahead of the next write
+	segments, err := segment.ListSegments(vfs.OS, masterDir)
+	require.NoError(t, err)
+	require.Greater(t, len(segments), 2)
+	for _, s := range segments[:len(segments)-1] {
+		expected, err := os.ReadFile(filepath.Join(masterDir, s.Name))
+		require.NoError(t, err)
+		actual, err := os.ReadFile(filepath.Join(replicaDir, s.Name))
+		require.NoError(t, err)
+		assert.Equal(t, expected, actual, s.Name)
+	}
+}
+
+func TestApplySegmentData(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	applier := &testApplier{}
+	replica := New(config.ReplicationConfig{ReplicaType: config.Replica}, log, vfs.OS, t.TempDir(), nil, applier)
+
+	var buf bytes.Buffer
+	testEntries := []entry.Entry{
+		{Operation: entry.OperationSet, Key: "key1", Value: "value1"},
+		{Operation: entry.OperationSet, Key: "key2", Value: "value2"},
+		{Operation: entry.OperationDelete, Key: "key1"},
+	}
+	for _, e := range testEntries {
+		_, err := e.WriteTo(&buf)
+		require.NoError(t, err)
+	}
+	data := buf.Bytes()
+
+	// First update ends in the middle of the last entry
+	split := len(data) - 2
+	require.NoError(t, replica.applySegmentData(1, 0, data[:split]))
+	require.Len(t, applier.entries, 2)
+	assert.Equal(t, "key2", applier.entries[1].Key)
+
+	// Second update completes the partial entry, whose start is read back
+	// from the local segment
+	require.NoError(t, os.WriteFile(filepath.Join(replica.walDir, "wal-1.log"), data[:split], 0o600))
+	require.NoError(t, replica.applySegmentData(1, int64(split), data[split:]))
+	require.Len(t, applier.entries, 3)
+	assert.Equal(t, entry.OperationDelete, applier.entries[2].Operation)
+	assert.Equal(t, segment.Position{SegmentID: 1, Offset: int64(len(data))}, applier.pos)
+
+	// Repeated data is not applied twice
+	require.NoError(t, replica.applySegmentData(1, 0, data))
+	assert.Len(t, applier.entries, 3)
+
+	// A new segment is applied from the beginning
+	require.NoError(t, replica.applySegmentData(2, 0, data))
+	assert.Len(t, applier.entries, 6)
+	assert.Equal(t, segment.Position{SegmentID: 2, Offset: int64(len(data))}, applier.pos)
+}
+
+func TestApplySegmentData_Compressed(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	applier := &testApplier{}
+	replica := New(config.ReplicationConfig{ReplicaType: config.Replica}, log, vfs.OS, t.TempDir(), nil, applier)
+
+	var buf bytes.Buffer
+	plain := entry.Entry{LSN: 1, Operation: entry.OperationSet, Key: "key0", Value: "value"}
+	_, err := plain.WriteTo(&buf)
+	require.NoError(t, err)
+	var block []entry.Entry
+	for i := 1; i <= 10; i++ {
+		block = append(block, entry.Entry{
+			LSN: uint64(i + 1), Operation: entry.OperationSet, Key: fmt.Sprintf("key%d", i), Value: "value",
+		})
+	}
+	_, err = entry.WriteBlock(&buf, block)
+	require.NoError(t, err)
+	data := buf.Bytes()
+
+	// A partially received block is applied once it is complete
+	require.NoError(t, replica.applySegmentData(1, 0, data[:len(data)-1]))
+	require.Len(t, applier.entries, 1)
+
+	require.NoError(t, replica.applySegmentData(1, 0, data))
+	require.Len(t, applier.entries, 11)
+	assert.Equal(t, "key10", applier.entries[10].Key)
+}
+
+func TestFrames(t *testing.T) {
+	hello := handshake{
+		version:   protocolVersion,
+		clusterID: "cluster",
+		nodeID:    "replica-1",
+		pos:       segment.Position{SegmentID: 7, Offset: 42},
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, writeFrame(&buf, msgHandshake, hello.marshal()))
+		data := dataMessage{pos: segment.Position{SegmentID: 7, Offset: 42}, data: []byte("entries")}
+		require.NoError(t, writeFrame(&buf, msgData, data.marshal()))
+		require.NoError(t, writeFrame(&buf, msgHeartbeat, nil))
+		ack := ackMessage{pos: segment.Position{SegmentID: 7, Offset: 49}, lsn: 12}
+		require.NoError(t, writeFrame(&buf, msgAck, ack.marshal()))
+
+		f, err := readFrame(&buf)
+		require.NoError(t, err)
+		require.Equal(t, msgHandshake, f.typ)
+		decoded, err := unmarshalHandshake(f.payload)
+		require.NoError(t, err)
+		assert.Equal(t, hello, decoded)
+
+		f, err = readFrame(&buf)
+		require.NoError(t, err)
+		require.Equal(t, msgData, f.typ)
+		decodedData, err := unmarshalData(f.payload)
+		require.NoError(t, err)
+		assert.Equal(t, data, decodedData)
+
+		f, err = readFrame(&buf)
+		require.NoError(t, err)
+		assert.Equal(t, msgHeartbeat, f.typ)
+		assert.Empty(t, f.payload)
+
+		f, err = readFrame(&buf)
+		require.NoError(t, err)
+		require.Equal(t, msgAck, f.typ)
+		decodedAck, err := unmarshalAck(f.payload)
+		require.NoError(t, err)
+		assert.Equal(t, ack, decodedAck)
+
+		_, err = readFrame(&buf)
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("corrupted frame", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, writeFrame(&buf, msgHandshake, hello.marshal()))
+		data := buf.Bytes()
+		data[len(data)-1] ^= 0xFF
+
+		_, err := readFrame(bytes.NewReader(data))
+		assert.ErrorIs(t, err, ErrChecksumMismatch)
+
+		// The message type is covered by the checksum as well
+		data[len(data)-1] ^= 0xFF
+		data[0] = msgError
+		_, err = readFrame(bytes.NewReader(data))
+		assert.ErrorIs(t, err, ErrChecksumMismatch)
+	})
+
+	t.Run("oversized frame", func(t *testing.T) {
+		header := make([]byte, frameHeaderSize)
+		header[0] = msgData
+		header[4] = 0xFF
+
+		_, err := readFrame(bytes.NewReader(header))
+		assert.ErrorIs(t, err, ErrProtocol)
+	})
+
+	t.Run("malformed message", func(t *testing.T) {
+		_, err := unmarshalHandshake(hello.marshal()[:10])
+		assert.ErrorIs(t, err, ErrProtocol)
+		_, err = unmarshalAck(appendPosition(nil, hello.pos))
+		assert.ErrorIs(t, err, ErrProtocol)
+	})
+}
+
+func TestHandshake(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	newManager := func(clusterID string) *Manager {
+		return New(config.ReplicationConfig{ClusterID: clusterID, NodeID: "node"}, log, vfs.OS, t.TempDir(), nil, nil)
+	}
+	pos := segment.Position{SegmentID: 3, Offset: 10}
+
+	// connect runs the handshake of the replica against the master
+	connect := func(t *testing.T, master, replica *Manager) (handshake, error, error) {
+		t.Helper()
+
+		server, client := net.Pipe()
+		defer server.Close()
+		defer client.Close()
+
+		var (
+			hello     handshake
+			masterErr error
+		)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			hello, masterErr = master.acceptHandshake(server)
+		}()
+
+		replica.conn = client
+		replicaErr := replica.handshake(pos, 20)
+		<-done
+
+		return hello, masterErr, replicaErr
+	}
+
+	t.Run("accepted", func(t *testing.T) {
+		hello, masterErr, replicaErr := connect(t, newManager("cluster"), newManager("cluster"))
+		require.NoError(t, masterErr)
+		require.NoError(t, replicaErr)
+		assert.Equal(t, "node", hello.nodeID)
+		assert.Equal(t, pos, hello.pos)
+	})
+
+	t.Run("different cluster", func(t *testing.T) {
+		_, masterErr, replicaErr := connect(t, newManager("cluster"), newManager("other"))
+		assert.ErrorIs(t, masterErr, ErrHandshake)
+		assert.ErrorIs(t, replicaErr, ErrHandshake)
+		assert.ErrorContains(t, replicaErr, `cluster "other" does not match the cluster "cluster" of the master`)
+	})
+
+	t.Run("segments of the replica truncated on the master", func(t *testing.T) {
+		// createSegments creates empty segment files on the master
+		createSegments := func(t *testing.T, m *Manager, ids ...int64) {
+			t.Helper()
+			for _, id := range ids {
+				require.NoError(t, os.WriteFile(filepath.Join(m.walDir, segment.FileName(id)), nil, 0o600))
+			}
+		}
+
+		// The stream continues in the segment of the replica, or in the one
+		// that follows its last entry
+		for _, ids := range [][]int64{{1, 3, 30}, {21, 30}} {
+			master := newManager("cluster")
+			createSegments(t, master, ids...)
+			_, masterErr, replicaErr := connect(t, master, newManager("cluster"))
+			require.NoError(t, masterErr)
+			require.NoError(t, replicaErr)
+		}
+
+		// The entries 21 to 24 are gone
+		master := newManager("cluster")
+		createSegments(t, master, 25, 30)
+		_, masterErr, replicaErr := connect(t, master, newManager("cluster"))
+		assert.ErrorIs(t, masterErr, ErrMissingData)
+		assert.ErrorContains(t, replicaErr,
+			"the replica needs the entries after LSN 20, the oldest segment left starts at LSN 25")
+	})
+
+	t.Run("replica takes the epoch of the master", func(t *testing.T) {
+		master, replica := newManager("cluster"), newManager("cluster")
+		master.epochs = epochHistory{{Epoch: 1, LSN: 5}, {Epoch: 2, LSN: 30}}
+		replica.epochs = epochHistory{{Epoch: 1, LSN: 5}}
+
+		_, masterErr, replicaErr := connect(t, master, replica)
+		require.NoError(t, masterErr)
+		require.NoError(t, replicaErr)
+		assert.Equal(t, master.epochs, replica.epochs)
+		saved, err := loadEpochs(vfs.OS, replica.walDir)
+		require.NoError(t, err)
+		assert.Equal(t, master.epochs, saved)
+	})
+
+	t.Run("master of an older epoch is fenced", func(t *testing.T) {
+		master, replica := newManager("cluster"), newManager("cluster")
+		master.role = config.Master
+		replica.epochs = epochHistory{{Epoch: 1, LSN: 5}}
+
+		_, masterErr, replicaErr := connect(t, master, replica)
+		assert.ErrorIs(t, masterErr, ErrStaleEpoch)
+		assert.ErrorContains(t, replicaErr, "master of epoch 0, the replica knows epoch 1")
+		assert.True(t, master.Fenced())
+		assert.True(t, master.Info().Fenced)
+	})
+
+	t.Run("diverged replica", func(t *testing.T) {
+		master, replica := newManager("cluster"), newManager("cluster")
+		master.epochs = epochHistory{{Epoch: 1, LSN: 15}}
+
+		// The replica holds entries 16 to 20 written by the former master
+		// after the promotion
+		_, masterErr, replicaErr := connect(t, master, replica)
+		assert.ErrorIs(t, masterErr, ErrDiverged)
+		assert.ErrorContains(t, replicaErr, "replica of epoch 0 holds entries up to LSN 20")
+		assert.False(t, master.Fenced())
+	})
+
+	t.Run("different protocol version", func(t *testing.T) {
+		server, client := net.Pipe()
+		defer server.Close()
+		defer client.Close()
+
+		go func() {
+			hello := handshake{version: protocolVersion + 1, clusterID: "cluster"}
+			_ = writeFrame(client, msgHandshake, hello.marshal())
+		}()
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := newManager("cluster").acceptHandshake(server)
+			done <- err
+		}()
+
+		f, err := readFrame(client)
+		require.NoError(t, err)
+		assert.Equal(t, msgError, f.typ)
+		assert.Contains(t, string(f.payload), "unsupported protocol version 3")
+		assert.ErrorIs(t, <-done, ErrHandshake)
+	})
+}
+
+func TestProcessReceivedSegment(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	applier := &testApplier{}
+	replica := New(config.ReplicationConfig{ReplicaType: config.Replica}, log, vfs.OS, t.TempDir(), nil, applier)
+
+	var buf bytes.Buffer
+	e := entry.Entry{LSN: 1, Operation: entry.OperationSet, Key: "key", Value: "value"}
+	_, err := e.WriteTo(&buf)
+	require.NoError(t, err)
+	record := buf.Bytes()
+
+	pos := segment.Position{SegmentID: -1}
+	msg := dataMessage{pos: segment.Position{SegmentID: 1}, data: record}
+	require.NoError(t, replica.processReceivedSegment(msg, &pos))
+	assert.Equal(t, segment.Position{SegmentID: 1, Offset: int64(len(record))}, pos)
+	assert.Equal(t, 1, applier.count())
+
+	// Data that does not continue the local segment is not written
+	for _, at := range []segment.Position{{SegmentID: 1, Offset: 1}, {SegmentID: 0}, {SegmentID: 2, Offset: 5}} {
+		err := replica.processReceivedSegment(dataMessage{pos: at, data: record}, &pos)
+		assert.ErrorIs(t, err, ErrProtocol)
+	}
+	data, err := os.ReadFile(filepath.Join(replica.walDir, segment.FileName(1)))
+	require.NoError(t, err)
+	assert.Equal(t, record, data)
+	assert.Equal(t, 1, applier.count())
+
+	// A new segment must start with the entry after the last one applied
+	err = replica.processReceivedSegment(dataMessage{pos: segment.Position{SegmentID: 3}, data: record}, &pos)
+	assert.ErrorIs(t, err, ErrMissingData)
+	_, err = os.Stat(filepath.Join(replica.walDir, segment.FileName(3)))
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	buf.Reset()
+	e.LSN = 2
+	_, err = e.WriteTo(&buf)
+	require.NoError(t, err)
+	msg = dataMessage{pos: segment.Position{SegmentID: 2}, data: buf.Bytes()}
+	require.NoError(t, replica.processReceivedSegment(msg, &pos))
+	assert.Equal(t, 2, applier.count())
+}
+
+func TestBytesBetween(t *testing.T) {
+	sizes := map[int64]int64{1: 100, 5: 200, 9: 50}
+
+	tests := []struct {
+		name     string
+		from, to segment.Position
+		expected int64
+	}{
+		{"same segment", segment.Position{SegmentID: 9, Offset: 10}, segment.Position{SegmentID: 9, Offset: 50}, 40},
+		{"up to date", segment.Position{SegmentID: 9, Offset: 50}, segment.Position{SegmentID: 9, Offset: 50}, 0},
+		{"across segments", segment.Position{SegmentID: 1, Offset: 60}, segment.Position{SegmentID: 9, Offset: 30}, 270},
+		{"nothing replicated", segment.Position{SegmentID: -1}, segment.Position{SegmentID: 9, Offset: 30}, 330},
+		{"ahead of the master", segment.Position{SegmentID: 12}, segment.Position{SegmentID: 9, Offset: 30}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, bytesBetween(sizes, tt.from, tt.to))
+		})
+	}
+}
+
+type testSource struct {
+	synced wal.Synced
+}
+
+func (s testSource) Subscribe() (<-chan wal.Synced, func()) {
+	return make(chan wal.Synced), func() {}
+}
+
+func (s testSource) Synced() wal.Synced {
+	return s.synced
+}
+
+func (s testSource) Reopen() error {
+	return nil
+}
+
+func TestWaitForReplicas(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	newMaster := func(minReplicas int, policy config.SyncTimeoutPolicy) *Manager {
+		return New(config.ReplicationConfig{
+			ReplicaType:         config.Master,
+			MinSyncReplicas:     minReplicas,
+			SyncReplicasTimeout: 50 * time.Millisecond,
+			SyncTimeoutPolicy:   policy,
+		}, log, vfs.OS, t.TempDir(), testSource{synced: wal.Synced{LSN: 7}}, nil)
+	}
+	// connectReplica registers a replica that acknowledged the entries up to lsn
+	connectReplica := func(t *testing.T, m *Manager, lsn uint64) net.Conn {
+		t.Helper()
+
+		conn, peer := net.Pipe()
+		t.Cleanup(func() {
+			_ = conn.Close()
+			_ = peer.Close()
+		})
+		m.registerReplica(conn, handshake{nodeID: "replica"})
+		m.recordAck(conn, ackMessage{lsn: lsn})
+
+		return conn
+	}
+
+	t.Run("asynchronous replication", func(t *testing.T) {
+		assert.NoError(t, newMaster(0, config.SyncTimeoutFail).WaitForReplicas(5))
+	})
+
+	t.Run("acknowledged by enough replicas", func(t *testing.T) {
+		m := newMaster(2, config.SyncTimeoutFail)
+		m.cfg.SyncReplicasTimeout = time.Minute
+		first := connectReplica(t, m, 4)
+		second := connectReplica(t, m, 5)
+
+		done := make(chan error, 1)
+		go func() { done <- m.WaitForReplicas(5) }()
+
+		select {
+		case err := <-done:
+			t.Fatalf("returned before the acknowledgements: %v", err)
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		m.recordAck(first, ackMessage{lsn: 6})
+		m.recordAck(second, ackMessage{lsn: 6})
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("still waiting after the acknowledgements")
+		}
+	})
+
+	t.Run("fail on timeout", func(t *testing.T) {
+		m := newMaster(2, config.SyncTimeoutFail)
+		connectReplica(t, m, 5)
+
+		err := m.WaitForReplicas(5)
+		assert.ErrorIs(t, err, ErrSyncReplicasTimeout)
+		assert.ErrorContains(t, err, "1 of 2 replicas acknowledged LSN 5")
+		assert.False(t, m.Info().SyncDegraded)
+	})
+
+	t.Run("degrade on timeout", func(t *testing.T) {
+		m := newMaster(1, config.SyncTimeoutDegrade)
+		conn := connectReplica(t, m, 2)
+
+		require.NoError(t, m.WaitForReplicas(5))
+		assert.True(t, m.Info().SyncDegraded)
+
+		// Writes do not wait while the replication is asynchronous
+		start := time.Now()
+		require.NoError(t, m.WaitForReplicas(6))
+		assert.Less(t, time.Since(start), 50*time.Millisecond)
+
+		// A replica that catches up with the master ends it
+		m.recordAck(conn, ackMessage{lsn: 6})
+		assert.True(t, m.Info().SyncDegraded)
+		m.recordAck(conn, ackMessage{lsn: 7})
+		assert.False(t, m.Info().SyncDegraded)
+	})
+
+	t.Run("a write keeps waiting when the master becomes a replica", func(t *testing.T) {
+		m := newMaster(1, config.SyncTimeoutFail)
+		m.stateMu.Lock()
+		m.role = config.Replica
+		m.stateMu.Unlock()
+
+		assert.ErrorIs(t, m.WaitForReplicas(5), ErrSyncReplicasTimeout)
+	})
+}
+
+func TestEpochHistory(t *testing.T) {
+	var h epochHistory
+	assert.Equal(t, uint64(0), h.current())
+
+	h = h.next(0, 10)
+	h = h.next(4, 25)
+	assert.Equal(t, epochHistory{{Epoch: 1, LSN: 10}, {Epoch: 5, LSN: 25}}, h)
+
+	assert.False(t, h.diverged(0, 10))
+	assert.True(t, h.diverged(0, 11))
+	assert.False(t, h.diverged(1, 25))
+	assert.True(t, h.diverged(2, 26))
+	assert.False(t, h.diverged(5, 100))
+
+	dir := t.TempDir()
+	require.NoError(t, saveEpochs(vfs.OS, dir, h))
+	loaded, err := loadEpochs(vfs.OS, dir)
+	require.NoError(t, err)
+	assert.Equal(t, h, loaded)
+
+	loaded, err = loadEpochs(vfs.OS, t.TempDir())
+	require.NoError(t, err)
+	assert.Empty(t, loaded)
+}
+
+func TestFailover(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	newNode := func(port string) (*Manager, *wal.Service, *testApplier) {
+		dir := t.TempDir()
+		w := newTestWAL(t, dir)
+		applier := &testApplier{}
+		m := New(config.ReplicationConfig{
+			ReplicaType:     config.Master,
+			MasterHost:      "127.0.0.1",
+			ReplicationPort: port,
+			SyncInterval:    50 * time.Millisecond,
+			SyncRetryDelay:  50 * time.Millisecond,
+			ReadTimeout:     time.Second,
+		}, log, vfs.OS, dir, w, applier)
+		require.NoError(t, m.Start())
+		t.Cleanup(m.Stop)
+
+		return m, w, applier
+	}
+	write := func(t *testing.T, w *wal.Service, key string) {
+		t.Helper()
+		_, err := w.Write(entry.Entry{Operation: entry.OperationSet, Key: key, Value: "value"})
+		require.NoError(t, err)
+	}
+
+	a, walA, appliedA := newNode("13238")
+	b, walB, appliedB := newNode("13239")
+
+	// b follows a and keeps the WAL received from it
+	appliedB.SetWALTruncation(true)
+	require.NoError(t, b.ReplicaOf("127.0.0.1", "13238"))
+	assert.Equal(t, config.Replica, b.Role())
+	assert.False(t, appliedB.truncates())
+	for i := range 3 {
+		write(t, walA, fmt.Sprintf("key%d", i))
+	}
+	require.Eventually(t, func() bool { return appliedB.count() == 3 }, 5*time.Second, 10*time.Millisecond)
+
+	// b is promoted and continues the sequence numbers in a new epoch
+	require.NoError(t, b.Promote())
+	assert.Equal(t, config.Master, b.Role())
+	assert.True(t, appliedB.truncates())
+	assert.Equal(t, uint64(1), b.Info().Epoch)
+	assert.Equal(t, uint64(3), walB.LSN())
+	write(t, walB, "key3")
+	assert.Equal(t, uint64(4), walB.LSN())
+
+	// Promoting a master does not start another epoch
+	require.NoError(t, b.Promote())
+	assert.Equal(t, uint64(1), b.Info().Epoch)
+
+	// a follows b and receives the write of the new epoch
+	require.NoError(t, a.ReplicaOf("127.0.0.1", "13239"))
+	require.Eventually(t, func() bool {
+		info := a.Info()
+		return info.Connected && info.AppliedLSN == 4
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, appliedA.count())
+	assert.Equal(t, uint64(1), a.Info().Epoch)
+	require.Eventually(t, func() bool { return len(b.Info().Replicas) == 1 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestWriteGate(t *testing.T) {
+	m := New(config.ReplicationConfig{
+		ReplicaType:    config.Master,
+		SyncRetryDelay: 50 * time.Millisecond,
+		ReadTimeout:    time.Second,
+	}, slog.New(slog.NewTextHandler(io.Discard, nil)), vfs.OS, t.TempDir(), testSource{}, nil)
+	t.Cleanup(m.Stop)
+
+	// A role change waits for the write in progress
+	end := m.BeginWrite()
+	changed := make(chan error, 1)
+	go func() {
+		changed <- m.ReplicaOf("127.0.0.1", "13240")
+	}()
+	assert.Never(t, func() bool { return len(changed) > 0 }, 100*time.Millisecond, 10*time.Millisecond)
+	assert.Equal(t, config.Master, m.Role())
+
+	end()
+	require.NoError(t, <-changed)
+	assert.Equal(t, config.Replica, m.Role())
+}
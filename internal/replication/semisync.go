@@ -0,0 +1,88 @@
+package replication
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/8thgencore/valchemy/internal/config"
+	"github.com/8thgencore/valchemy/pkg/logger/sl"
+)
+
+// WaitForReplicas blocks until MinSyncReplicas replicas acknowledged the
+// entries up to lsn. If they do not in time, the write fails with
+// ErrSyncReplicasTimeout or, depending on the timeout policy, the master stops
+// waiting for the replicas until enough of them catch up. Only the writes of
+// a master reach the WAL, so a write keeps waiting when the node becomes a
+// replica meanwhile.
+func (m *Manager) WaitForReplicas(lsn uint64) error {
+	if m.cfg.MinSyncReplicas <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(m.cfg.SyncReplicasTimeout)
+	defer timer.Stop()
+
+	for {
+		m.stateMu.Lock()
+		acked, degraded, wake := m.ackedReplicas(lsn), m.degraded, m.acked
+		m.stateMu.Unlock()
+
+		if degraded || acked >= m.cfg.MinSyncReplicas {
+			return nil
+		}
+
+		select {
+		case <-wake:
+		case <-timer.C:
+			return m.syncTimeout(lsn, acked)
+		case <-m.done():
+			return m.syncTimeout(lsn, acked)
+		}
+	}
+}
+
+// syncTimeout applies the timeout policy to a write acknowledged by too few
+// replicas
+func (m *Manager) syncTimeout(lsn uint64, acked int) error {
+	err := fmt.Errorf("%w: %d of %d replicas acknowledged LSN %d",
+		ErrSyncReplicasTimeout, acked, m.cfg.MinSyncReplicas, lsn)
+	if m.cfg.SyncTimeoutPolicy == config.SyncTimeoutFail {
+		return err
+	}
+
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+
+	if !m.degraded {
+		m.degraded = true
+		m.log.Warn("Replicas are behind, replicating asynchronously until they catch up", sl.Err(err))
+	}
+
+	return nil
+}
+
+// replicasAcked wakes the writes waiting for the replicas and ends the
+// asynchronous replication once enough replicas caught up with the data
+// synced on the master. The caller must hold stateMu.
+func (m *Manager) replicasAcked() {
+	close(m.acked)
+	m.acked = make(chan struct{})
+
+	if m.degraded && m.source != nil && m.ackedReplicas(m.source.Synced().LSN) >= m.cfg.MinSyncReplicas {
+		m.degraded = false
+		m.log.Info("Replicas caught up, replicating semi-synchronously")
+	}
+}
+
+// ackedReplicas returns the number of replicas that acknowledged the entries
+// up to lsn. The caller must hold stateMu.
+func (m *Manager) ackedReplicas(lsn uint64) int {
+	n := 0
+	for _, r := range m.replicas {
+		if r.acked.lsn >= lsn {
+			n++
+		}
+	}
+
+	return n
+}
@@ -0,0 +1,260 @@
+// Package resp implements the subset of the Redis serialization protocol
+// (RESP2 and RESP3) needed to serve requests from Redis clients.
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Protocol versions
+const (
+	Version2 = 2
+	Version3 = 3
+)
+
+const (
+	// maxBulkLength is the largest bulk string accepted in a command
+	maxBulkLength = 512 << 20
+	// maxArrayLength is the largest number of arguments accepted in a command
+	maxArrayLength = 1 << 20
+	// maxLineLength is the largest inline command or length header
+	maxLineLength = 64 << 10
+)
+
+// ErrProtocol returned when the client sends malformed data
+var ErrProtocol = errors.New("protocol error")
+
+// ErrMessageTooLarge returned when a command exceeds the maximum message size
+var ErrMessageTooLarge = fmt.Errorf("%w: message too large", ErrProtocol)
+
+// Reader reads commands sent by a client
+type Reader struct {
+	r       *bufio.Reader
+	maxSize int
+	// remaining is the size left to the command being read, negative if unlimited
+	remaining int
+}
+
+// NewReader creates a new Reader
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// SetMaxMessageSize limits the size of a command, including the protocol
+// framing. A larger command fails with ErrMessageTooLarge; zero means no limit.
+func (r *Reader) SetMaxMessageSize(size int) {
+	r.maxSize = size
+}
+
+// ReadCommand reads a command sent either as an array of bulk strings or as
+// an inline command. An empty inline command returns no arguments.
+func (r *Reader) ReadCommand() ([]string, error) {
+	r.remaining = -1
+	if r.maxSize > 0 {
+		r.remaining = r.maxSize
+	}
+
+	prefix, err := r.r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if prefix[0] != '*' {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		return strings.Fields(line), nil
+	}
+
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	count, err := parseLength(line[1:], maxArrayLength)
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		arg, err := r.readBulkString()
+		if err != nil {
+			return nil, unexpected(err)
+		}
+		args = append(args, arg)
+	}
+
+	return args, nil
+}
+
+func (r *Reader) readBulkString() (string, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return "", err
+	}
+	if len(line) == 0 || line[0] != '$' {
+		return "", fmt.Errorf("%w: expected '$', got %q", ErrProtocol, line)
+	}
+
+	length, err := parseLength(line[1:], maxBulkLength)
+	if err != nil {
+		return "", err
+	}
+	if err := r.consume(length + 2); err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, length+2)
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		return "", unexpected(err)
+	}
+	if buf[length] != '\r' || buf[length+1] != '\n' {
+		return "", fmt.Errorf("%w: bulk string is not terminated by CRLF", ErrProtocol)
+	}
+
+	return string(buf[:length]), nil
+}
+
+// readLine reads a line terminated by CRLF (or a bare LF for inline commands)
+func (r *Reader) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, isPrefix, err := r.r.ReadLine()
+		if err != nil {
+			if len(line) > 0 {
+				return "", unexpected(err)
+			}
+			return "", err
+		}
+		line = append(line, chunk...)
+		if len(line) > maxLineLength {
+			return "", fmt.Errorf("%w: line too long", ErrProtocol)
+		}
+		if !isPrefix {
+			// Count the line break as well
+			if err := r.consume(len(line) + 2); err != nil {
+				return "", err
+			}
+			return string(line), nil
+		}
+	}
+}
+
+// consume counts n bytes against the size left to the command
+func (r *Reader) consume(n int) error {
+	if r.remaining < 0 {
+		return nil
+	}
+	if n > r.remaining {
+		return ErrMessageTooLarge
+	}
+	r.remaining -= n
+
+	return nil
+}
+
+func parseLength(s string, limit int) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n > limit {
+		return 0, fmt.Errorf("%w: invalid length %q", ErrProtocol, s)
+	}
+
+	return n, nil
+}
+
+// unexpected converts io.EOF in the middle of a command into io.ErrUnexpectedEOF
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
+// Writer writes replies in the protocol version negotiated with the client
+type Writer struct {
+	w       *bufio.Writer
+	version int
+}
+
+// NewWriter creates a new Writer speaking RESP2 until the version is changed
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		w:       bufio.NewWriter(w),
+		version: Version2,
+	}
+}
+
+// SetVersion changes the protocol version of the following replies
+func (w *Writer) SetVersion(version int) {
+	w.version = version
+}
+
+// Version returns the protocol version of the replies
+func (w *Writer) Version() int {
+	return w.version
+}
+
+// WriteSimpleString writes a status reply; s must not contain CR or LF
+func (w *Writer) WriteSimpleString(s string) {
+	w.writeLine('+', s)
+}
+
+// WriteError writes an error reply. The message should start with an error
+// code such as ERR; line breaks are replaced with spaces.
+func (w *Writer) WriteError(msg string) {
+	w.writeLine('-', strings.NewReplacer("\r", " ", "\n", " ").Replace(msg))
+}
+
+// WriteInteger writes an integer reply
+func (w *Writer) WriteInteger(n int64) {
+	w.writeLine(':', strconv.FormatInt(n, 10))
+}
+
+// WriteBulkString writes a binary safe string reply
+func (w *Writer) WriteBulkString(s string) {
+	w.writeLine('$', strconv.Itoa(len(s)))
+	_, _ = w.w.WriteString(s)
+	_, _ = w.w.WriteString("\r\n")
+}
+
+// WriteNull writes the null reply of the negotiated version
+func (w *Writer) WriteNull() {
+	if w.version >= Version3 {
+		_, _ = w.w.WriteString("_\r\n")
+		return
+	}
+	_, _ = w.w.WriteString("$-1\r\n")
+}
+
+// WriteArrayHeader starts an array reply of n elements
+func (w *Writer) WriteArrayHeader(n int) {
+	w.writeLine('*', strconv.Itoa(n))
+}
+
+// WriteMapHeader starts a map reply of n key-value pairs. RESP2 clients
+// receive a flat array of 2n elements.
+func (w *Writer) WriteMapHeader(n int) {
+	if w.version >= Version3 {
+		w.writeLine('%', strconv.Itoa(n))
+		return
+	}
+	w.WriteArrayHeader(2 * n)
+}
+
+// Flush sends the buffered replies
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
+
+func (w *Writer) writeLine(prefix byte, s string) {
+	_ = w.w.WriteByte(prefix)
+	_, _ = w.w.WriteString(s)
+	_, _ = w.w.WriteString("\r\n")
+}
@@ -0,0 +1,112 @@
+package resp
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReader_ReadCommand(t *testing.T) {
+	t.Run("array of bulk strings", func(t *testing.T) {
+		r := NewReader(strings.NewReader("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$12\r\nhello\r\nworld\r\n"))
+
+		args, err := r.ReadCommand()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"SET", "key", "hello\r\nworld"}, args)
+
+		_, err = r.ReadCommand()
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("inline command", func(t *testing.T) {
+		r := NewReader(strings.NewReader("GET  key\r\nPING\n"))
+
+		args, err := r.ReadCommand()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"GET", "key"}, args)
+
+		args, err = r.ReadCommand()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"PING"}, args)
+	})
+
+	t.Run("empty arguments", func(t *testing.T) {
+		r := NewReader(strings.NewReader("*2\r\n$3\r\nGET\r\n$0\r\n\r\n"))
+
+		args, err := r.ReadCommand()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"GET", ""}, args)
+	})
+
+	t.Run("protocol errors", func(t *testing.T) {
+		for _, input := range []string{
+			"*x\r\n",
+			"*1\r\n:1\r\n",
+			"*1\r\n$-1\r\n",
+			"*1\r\n$3\r\nGETX\r\n",
+			"*1\r\n$1000000000\r\n",
+		} {
+			_, err := NewReader(strings.NewReader(input)).ReadCommand()
+			assert.ErrorIs(t, err, ErrProtocol, "%q", input)
+		}
+	})
+
+	t.Run("message size limit", func(t *testing.T) {
+		input := "*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n"
+
+		r := NewReader(strings.NewReader(input))
+		r.SetMaxMessageSize(len(input))
+		args, err := r.ReadCommand()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"GET", "key"}, args)
+
+		r = NewReader(strings.NewReader(input))
+		r.SetMaxMessageSize(len(input) - 1)
+		_, err = r.ReadCommand()
+		require.ErrorIs(t, err, ErrMessageTooLarge)
+		assert.ErrorIs(t, err, ErrProtocol)
+
+		r = NewReader(strings.NewReader("GET " + strings.Repeat("k", 100) + "\r\n"))
+		r.SetMaxMessageSize(64)
+		_, err = r.ReadCommand()
+		assert.ErrorIs(t, err, ErrMessageTooLarge)
+	})
+
+	t.Run("incomplete command", func(t *testing.T) {
+		_, err := NewReader(strings.NewReader("*2\r\n$3\r\nGET\r\n")).ReadCommand()
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	})
+}
+
+func TestWriter(t *testing.T) {
+	t.Run("RESP2", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		w := NewWriter(buf)
+
+		w.WriteSimpleString("OK")
+		w.WriteError("ERR bad\nthing")
+		w.WriteInteger(-2)
+		w.WriteBulkString("a b")
+		w.WriteNull()
+		w.WriteMapHeader(1)
+		require.NoError(t, w.Flush())
+
+		assert.Equal(t, "+OK\r\n-ERR bad thing\r\n:-2\r\n$3\r\na b\r\n$-1\r\n*2\r\n", buf.String())
+	})
+
+	t.Run("RESP3", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		w := NewWriter(buf)
+		w.SetVersion(Version3)
+
+		w.WriteNull()
+		w.WriteMapHeader(2)
+		require.NoError(t, w.Flush())
+
+		assert.Equal(t, "_\r\n%2\r\n", buf.String())
+	})
+}
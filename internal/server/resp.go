@@ -0,0 +1,241 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/8thgencore/valchemy/internal/compute"
+	"github.com/8thgencore/valchemy/internal/resp"
+	"github.com/8thgencore/valchemy/pkg/logger/sl"
+)
+
+// serverName is reported to clients in the HELLO reply
+const serverName = "valchemy"
+
+// handleRESPConnection handles a connection speaking the Redis protocol
+func (s *Server) handleRESPConnection(conn net.Conn) {
+	defer s.closeConnection(conn)
+
+	s.log.Info("New RESP connection established", "remote_addr", conn.RemoteAddr())
+
+	reader := resp.NewReader(conn)
+	reader.SetMaxMessageSize(s.maxMessageSize())
+	writer := resp.NewWriter(conn)
+	for {
+		if !s.waitForCommand(conn) {
+			return
+		}
+
+		args, err := reader.ReadCommand()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				s.log.Info("Client disconnected", "remote_addr", conn.RemoteAddr())
+				return
+			}
+			if s.isShuttingDown() {
+				return
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				s.log.Info("Closing idle connection", "remote_addr", conn.RemoteAddr())
+				return
+			}
+			if errors.Is(err, resp.ErrProtocol) {
+				writer.WriteError("ERR " + err.Error())
+				_ = writer.Flush()
+			}
+			s.log.Error("Failed to read from connection", sl.Err(err))
+
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		quit := s.executeRESP(writer, args)
+
+		if err := writer.Flush(); err != nil {
+			s.log.Error("Failed to write response", sl.Err(err))
+			return
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// executeRESP executes a command and writes its reply. Connection level
+// commands are handled here, data commands are passed to the handler.
+// Returns true if the client asked to close the connection.
+func (s *Server) executeRESP(w *resp.Writer, args []string) bool {
+	name := strings.ToUpper(args[0])
+	s.log.Debug("Handling RESP command", "command", name)
+
+	switch name {
+	case "PING":
+		switch len(args) {
+		case 1:
+			w.WriteSimpleString("PONG")
+		case 2:
+			w.WriteBulkString(args[1])
+		default:
+			writeArityError(w, name)
+		}
+	case "ECHO":
+		if len(args) != 2 {
+			writeArityError(w, name)
+			break
+		}
+		w.WriteBulkString(args[1])
+	case "HELLO":
+		s.hello(w, args[1:])
+	case "CLIENT":
+		client(w, args[1:])
+	case "COMMAND":
+		// Clients use it for introspection only, no command documentation is provided
+		w.WriteArrayHeader(0)
+	case "SELECT":
+		if len(args) != 2 {
+			writeArityError(w, name)
+			break
+		}
+		if args[1] != "0" {
+			w.WriteError("ERR DB index is out of range")
+			break
+		}
+		w.WriteSimpleString(compute.ResponseOK)
+	case "QUIT":
+		w.WriteSimpleString(compute.ResponseOK)
+		return true
+	default:
+		cmd, err := compute.NewCommand(args)
+		if err != nil {
+			writeError(w, args[0], err)
+			break
+		}
+		reply, err := s.handler.Execute(cmd)
+		writeReply(w, cmd.Type, reply, err)
+	}
+
+	return false
+}
+
+// hello negotiates the protocol version: HELLO [protover [AUTH user pass] [SETNAME name]]
+func (s *Server) hello(w *resp.Writer, args []string) {
+	version := w.Version()
+	if len(args) > 0 {
+		v, err := strconv.Atoi(args[0])
+		if err != nil || v < resp.Version2 || v > resp.Version3 {
+			w.WriteError("NOPROTO unsupported protocol version")
+			return
+		}
+		version = v
+	}
+	w.SetVersion(version)
+
+	w.WriteMapHeader(4)
+	w.WriteBulkString("server")
+	w.WriteBulkString(serverName)
+	w.WriteBulkString("proto")
+	w.WriteInteger(int64(version))
+	w.WriteBulkString("mode")
+	w.WriteBulkString("standalone")
+	w.WriteBulkString("role")
+	w.WriteBulkString(string(s.handler.ReplicaType()))
+}
+
+// client accepts the CLIENT subcommands sent by client libraries on connect
+func client(w *resp.Writer, args []string) {
+	if len(args) == 0 {
+		writeArityError(w, "CLIENT")
+		return
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "SETNAME", "SETINFO", "NO-EVICT", "NO-TOUCH":
+		w.WriteSimpleString(compute.ResponseOK)
+	case "GETNAME":
+		w.WriteNull()
+	default:
+		w.WriteError("ERR unknown subcommand '" + args[0] + "'")
+	}
+}
+
+// writeReply writes the reply of a data command following the Redis
+// conventions for the corresponding Redis command
+func writeReply(w *resp.Writer, cmdType string, reply compute.Reply, err error) {
+	if errors.Is(err, compute.ErrKeyNotFound) {
+		switch cmdType {
+		case compute.CommandGet:
+			w.WriteNull()
+			return
+		case compute.CommandTTL:
+			w.WriteInteger(-2)
+			return
+		case compute.CommandExpire, compute.CommandPersist:
+			w.WriteInteger(0)
+			return
+		}
+	}
+	if err != nil {
+		writeError(w, cmdType, err)
+		return
+	}
+
+	switch cmdType {
+	case compute.CommandExpire, compute.CommandPersist:
+		w.WriteInteger(1)
+		return
+	case compute.CommandDel:
+		// The number of keys that existed
+		w.WriteInteger(reply.Int)
+		return
+	}
+
+	writeValue(w, reply)
+}
+
+// writeValue writes a reply according to its kind
+func writeValue(w *resp.Writer, reply compute.Reply) {
+	switch reply.Kind {
+	case compute.ReplyInteger:
+		w.WriteInteger(reply.Int)
+	case compute.ReplyBulk:
+		w.WriteBulkString(reply.Str)
+	case compute.ReplyNil:
+		w.WriteNull()
+	case compute.ReplyArray:
+		w.WriteArrayHeader(len(reply.Elems))
+		for _, elem := range reply.Elems {
+			writeValue(w, elem)
+		}
+	default:
+		// Multi-line statuses such as the help message cannot be simple strings
+		if strings.ContainsAny(reply.Str, "\r\n") {
+			w.WriteBulkString(reply.Str)
+			return
+		}
+		w.WriteSimpleString(reply.Str)
+	}
+}
+
+func writeError(w *resp.Writer, name string, err error) {
+	switch {
+	case errors.Is(err, compute.ErrUnknownCommand):
+		w.WriteError("ERR unknown command '" + name + "'")
+	case errors.Is(err, compute.ErrReadOnlyReplica):
+		w.WriteError("READONLY " + err.Error())
+	case errors.Is(err, compute.ErrWALUnavailable):
+		// Redis reports its persistence failures the same way
+		w.WriteError("MISCONF " + err.Error())
+	default:
+		w.WriteError("ERR " + err.Error())
+	}
+}
+
+func writeArityError(w *resp.Writer, name string) {
+	w.WriteError("ERR wrong number of arguments for '" + strings.ToLower(name) + "' command")
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"testing"
+
+	"github.com/8thgencore/valchemy/internal/compute"
+	"github.com/8thgencore/valchemy/internal/config"
+	"github.com/8thgencore/valchemy/internal/resp"
+	"github.com/8thgencore/valchemy/internal/storage"
+	"github.com/8thgencore/valchemy/internal/wal/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupRESPTest(t *testing.T) *Server {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	engine, err := storage.NewEngine(logger, mocks.NewMockWAL(), nil)
+	require.NoError(t, err)
+	handler := compute.NewHandler(logger, engine, config.Master, nil)
+
+	return NewServer(logger, &config.NetworkConfig{}, handler)
+}
+
+func TestExecuteRESP(t *testing.T) {
+	s := setupRESPTest(t)
+
+	testCases := []struct {
+		name     string
+		args     []string
+		expected string
+	}{
+		{"PING", []string{"ping"}, "+PONG\r\n"},
+		{"SET with spaces", []string{"SET", "key", "hello world"}, "+OK\r\n"},
+		{"GET", []string{"get", "key"}, "$11\r\nhello world\r\n"},
+		{"GET missing key", []string{"GET", "missing"}, "$-1\r\n"},
+		{"TTL without expiration", []string{"TTL", "key"}, ":-1\r\n"},
+		{"TTL missing key", []string{"TTL", "missing"}, ":-2\r\n"},
+		{"EXPIRE", []string{"EXPIRE", "key", "100"}, ":1\r\n"},
+		{"EXPIRE missing key", []string{"EXPIRE", "missing", "100"}, ":0\r\n"},
+		{"MSET", []string{"MSET", "a", "1", "b", "2"}, "+OK\r\n"},
+		{"MGET", []string{"MGET", "a", "missing", "b"}, "*3\r\n$1\r\n1\r\n$-1\r\n$1\r\n2\r\n"},
+		{"DEL", []string{"DEL", "key"}, ":1\r\n"},
+		{"DEL missing key", []string{"DEL", "key"}, ":0\r\n"},
+		{"DEL several keys", []string{"DEL", "a", "missing", "b"}, ":2\r\n"},
+		{"SELECT", []string{"SELECT", "1"}, "-ERR DB index is out of range\r\n"},
+		{"unknown command", []string{"FLUSHALL"}, "-ERR unknown command 'FLUSHALL'\r\n"},
+		{"invalid arguments", []string{"GET"}, "-ERR invalid command format\r\n"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			w := resp.NewWriter(buf)
+
+			assert.False(t, s.executeRESP(w, tc.args))
+			require.NoError(t, w.Flush())
+			assert.Equal(t, tc.expected, buf.String())
+		})
+	}
+
+	t.Run("HELLO switches to RESP3", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		w := resp.NewWriter(buf)
+
+		s.executeRESP(w, []string{"HELLO", "3"})
+		s.executeRESP(w, []string{"GET", "missing"})
+		require.NoError(t, w.Flush())
+
+		assert.Equal(t, resp.Version3, w.Version())
+		assert.Contains(t, buf.String(), "%4\r\n$6\r\nserver\r\n$8\r\nvalchemy\r\n")
+		assert.Contains(t, buf.String(), "$4\r\nrole\r\n$6\r\nmaster\r\n_\r\n")
+	})
+
+	t.Run("QUIT", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		w := resp.NewWriter(buf)
+
+		assert.True(t, s.executeRESP(w, []string{"QUIT"}))
+	})
+}
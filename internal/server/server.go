@@ -2,11 +2,16 @@ package server
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"math"
 	"net"
-	"strings"
+	"os"
 	"sync"
+	"time"
 
 	"github.com/8thgencore/valchemy/internal/compute"
 	"github.com/8thgencore/valchemy/internal/config"
@@ -16,13 +21,17 @@ import (
 
 // Server is the server struct
 type Server struct {
-	log           *slog.Logger
-	config        *config.NetworkConfig
-	handler       *compute.Handler
-	listener      net.Listener
-	connections   sync.WaitGroup
-	connCount     int32
-	connCountLock sync.Mutex
+	log         *slog.Logger
+	config      *config.NetworkConfig
+	handler     *compute.Handler
+	connections sync.WaitGroup
+
+	// mu guards the listeners, the open connections and the shutdown flag
+	mu           sync.Mutex
+	listener     net.Listener
+	respListener net.Listener
+	conns        map[net.Conn]struct{}
+	shuttingDown bool
 }
 
 // NewServer creates a new server
@@ -31,26 +40,65 @@ func NewServer(log *slog.Logger, config *config.NetworkConfig, handler *compute.
 		log:     log,
 		config:  config,
 		handler: handler,
+		conns:   make(map[net.Conn]struct{}),
 	}
 }
 
-// Start starts the server
+// Start starts the server and, if configured, the RESP listener. It blocks
+// until the server is shut down.
 func (s *Server) Start() error {
 	listener, err := net.Listen("tcp", s.config.Address)
 	if err != nil {
 		return fmt.Errorf("failed to start server: %w", err)
 	}
+
+	var respListener net.Listener
+	if s.config.RESPAddress != "" {
+		respListener, err = net.Listen("tcp", s.config.RESPAddress)
+		if err != nil {
+			_ = listener.Close()
+			return fmt.Errorf("failed to start RESP listener: %w", err)
+		}
+	}
+
+	s.mu.Lock()
+	if s.shuttingDown {
+		s.mu.Unlock()
+		_ = listener.Close()
+		if respListener != nil {
+			_ = respListener.Close()
+		}
+		return nil
+	}
 	s.listener = listener
+	s.respListener = respListener
+	s.mu.Unlock()
+
 	s.log.Info("Server started", "address", s.config.Address)
+	if respListener != nil {
+		s.log.Info("RESP listener started", "address", s.config.RESPAddress)
+		go s.serve(respListener, s.handleRESPConnection)
+	}
 
+	s.serve(listener, s.handleConnection)
+
+	return nil
+}
+
+// serve accepts connections on the listener and handles them with handle
+// until the listener is closed
+func (s *Server) serve(listener net.Listener, handle func(net.Conn)) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			s.log.Error("Failed to accept connection", sl.Err(err))
 			continue
 		}
 
-		if !s.canAcceptConnection() {
+		if !s.canAcceptConnection(conn) {
 			s.log.Warn("Max connections reached, rejecting connection")
 			err := conn.Close()
 			if err != nil {
@@ -60,38 +108,95 @@ func (s *Server) Start() error {
 			continue
 		}
 
-		s.connections.Add(1)
-		go s.handleConnection(conn)
+		go handle(conn)
 	}
 }
 
-// handleConnection handles a connection
-func (s *Server) handleConnection(conn net.Conn) {
-	defer func() {
-		err := conn.Close()
-		if err != nil {
-			s.log.Error("Failed to close connection", sl.Err(err))
+// Shutdown stops accepting connections and waits for the open ones to finish
+// the command in progress. Connections still open when the context is done
+// are closed forcibly and the context error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.shuttingDown = true
+	for _, listener := range []net.Listener{s.listener, s.respListener} {
+		if listener != nil {
+			if err := listener.Close(); err != nil {
+				s.log.Error("Failed to close listener", sl.Err(err))
+			}
 		}
-		s.connections.Done()
-		s.decrementConnCount()
+	}
+	// Interrupt the reads of idle connections; a command being executed
+	// still gets its response written
+	for conn := range s.conns {
+		_ = conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		s.connections.Wait()
+		close(drained)
 	}()
 
+	select {
+	case <-drained:
+		s.log.Info("Server stopped")
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for conn := range s.conns {
+			_ = conn.Close()
+		}
+		s.mu.Unlock()
+		s.log.Warn("Server stopped before all connections were drained")
+		return ctx.Err()
+	}
+}
+
+// isShuttingDown reports whether Shutdown has been called
+func (s *Server) isShuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.shuttingDown
+}
+
+// handleConnection handles a connection
+func (s *Server) handleConnection(conn net.Conn) {
+	defer s.closeConnection(conn)
+
 	s.log.Info("New connection established", "remote_addr", conn.RemoteAddr())
 
 	reader := bufio.NewReader(conn)
 	for {
-		input, err := reader.ReadString('\n')
-		if err != nil {
-			if err.Error() == "EOF" {
-				s.log.Info("Client disconnected", "remote_addr", conn.RemoteAddr())
-				return
-			}
-			s.log.Error("Failed to read from connection", sl.Err(err))
-
+		if !s.waitForCommand(conn) {
 			return
 		}
 
-		response, err := s.handler.Handle(strings.TrimSpace(input))
+		args, err := compute.ReadCommand(reader, s.maxMessageSize())
+		var response string
+		closing := false
+		switch {
+		case err == nil:
+			response, err = s.handler.HandleArgs(args)
+		case compute.IsSyntaxError(err):
+			// The malformed line is consumed, report it and go on
+		case errors.Is(err, compute.ErrMessageTooLarge):
+			// The rest of the message is still unread, the connection cannot be used further
+			s.log.Warn("Message too large, closing connection", "remote_addr", conn.RemoteAddr())
+			closing = true
+		case errors.Is(err, io.EOF):
+			s.log.Info("Client disconnected", "remote_addr", conn.RemoteAddr())
+			return
+		case s.isShuttingDown():
+			return
+		case errors.Is(err, os.ErrDeadlineExceeded):
+			s.log.Info("Closing idle connection", "remote_addr", conn.RemoteAddr())
+			return
+		default:
+			s.log.Error("Failed to read from connection", sl.Err(err))
+			return
+		}
 		if err != nil {
 			response = fmt.Sprintf("ERROR: %s", err)
 		}
@@ -107,26 +212,61 @@ func (s *Server) handleConnection(conn net.Conn) {
 			s.log.Error("Failed to write response", sl.Err(err))
 			return
 		}
+		if closing {
+			return
+		}
 	}
 }
 
-// canAcceptConnection checks if the server can accept a new connection
-func (s *Server) canAcceptConnection() bool {
-	s.connCountLock.Lock()
-	defer s.connCountLock.Unlock()
+// waitForCommand arms the idle timeout of a connection before the next
+// command is read. Returns false if the server is shutting down.
+func (s *Server) waitForCommand(conn net.Conn) bool {
+	if s.config.IdleTimeout > 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(s.config.IdleTimeout)); err != nil {
+			s.log.Error("Failed to set read deadline", sl.Err(err))
+			return false
+		}
+	}
 
-	if int(s.connCount) >= s.config.MaxConnections {
-		return false
+	// Checked after the deadline is set, so that it cannot replace the one
+	// set by Shutdown unnoticed
+	return !s.isShuttingDown()
+}
+
+// maxMessageSize returns the size limit of a command, zero if unlimited
+func (s *Server) maxMessageSize() int {
+	if s.config.MaxMessageSizeBytes > math.MaxInt32 {
+		return math.MaxInt32
 	}
 
-	s.connCount++
+	return int(s.config.MaxMessageSizeBytes)
+}
+
+// closeConnection closes a connection and releases its slot
+func (s *Server) closeConnection(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
 
-	return true
+	err := conn.Close()
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		s.log.Error("Failed to close connection", sl.Err(err))
+	}
+	s.connections.Done()
 }
 
-// decrementConnCount decrements the connection count
-func (s *Server) decrementConnCount() {
-	s.connCountLock.Lock()
-	s.connCount--
-	s.connCountLock.Unlock()
+// canAcceptConnection checks if the server can accept a new connection and
+// registers it
+func (s *Server) canAcceptConnection(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.shuttingDown || len(s.conns) >= s.config.MaxConnections {
+		return false
+	}
+
+	s.conns[conn] = struct{}{}
+	s.connections.Add(1)
+
+	return true
 }
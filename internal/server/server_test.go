@@ -0,0 +1,131 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/8thgencore/valchemy/internal/config"
+	"github.com/8thgencore/valchemy/pkg/constants"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startServer starts the server on a random port and returns its address
+func startServer(t *testing.T, s *Server) (string, chan error) {
+	t.Helper()
+
+	started := make(chan error, 1)
+	go func() { started <- s.Start() }()
+
+	var address string
+	require.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.listener == nil {
+			return false
+		}
+		address = s.listener.Addr().String()
+		return true
+	}, time.Second, 10*time.Millisecond)
+
+	return address, started
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	t.Run("idle connections are drained", func(t *testing.T) {
+		s := setupRESPTest(t)
+		s.config = &config.NetworkConfig{Address: "127.0.0.1:0", MaxConnections: 10}
+		address, started := startServer(t, s)
+
+		conn, err := net.Dial("tcp", address)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("SET key value\n"))
+		require.NoError(t, err)
+		response, err := bufio.NewReader(conn).ReadString(constants.EndMarker[0])
+		require.NoError(t, err)
+		assert.Equal(t, "OK\n"+constants.EndMarker, response)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		require.NoError(t, s.Shutdown(ctx))
+		require.NoError(t, <-started)
+
+		// The listener no longer accepts connections
+		_, err = net.Dial("tcp", address)
+		assert.Error(t, err)
+	})
+
+	t.Run("shutdown before start", func(t *testing.T) {
+		s := setupRESPTest(t)
+		s.config = &config.NetworkConfig{Address: "127.0.0.1:0", MaxConnections: 10}
+
+		require.NoError(t, s.Shutdown(context.Background()))
+		assert.NoError(t, s.Start())
+	})
+}
+
+func TestServer_Limits(t *testing.T) {
+	t.Run("oversized message is rejected", func(t *testing.T) {
+		s := setupRESPTest(t)
+		s.config = &config.NetworkConfig{Address: "127.0.0.1:0", MaxConnections: 10, MaxMessageSizeBytes: 64}
+		address, _ := startServer(t, s)
+		defer func() { _ = s.Shutdown(context.Background()) }()
+
+		conn, err := net.Dial("tcp", address)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("SET key " + strings.Repeat("v", 100) + "\n"))
+		require.NoError(t, err)
+		reader := bufio.NewReader(conn)
+		response, err := reader.ReadString(constants.EndMarker[0])
+		require.NoError(t, err)
+		assert.Equal(t, "ERROR: message too large\n"+constants.EndMarker, response)
+
+		// The connection is closed after the error
+		_, err = reader.ReadByte()
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("idle connection is closed and releases its slot", func(t *testing.T) {
+		s := setupRESPTest(t)
+		s.config = &config.NetworkConfig{
+			Address:        "127.0.0.1:0",
+			MaxConnections: 1,
+			IdleTimeout:    100 * time.Millisecond,
+		}
+		address, _ := startServer(t, s)
+		defer func() { _ = s.Shutdown(context.Background()) }()
+
+		conn, err := net.Dial("tcp", address)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = bufio.NewReader(conn).ReadByte()
+		assert.ErrorIs(t, err, io.EOF)
+
+		require.Eventually(t, func() bool {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return len(s.conns) == 0
+		}, time.Second, 10*time.Millisecond)
+
+		conn, err = net.Dial("tcp", address)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("SET key value\n"))
+		require.NoError(t, err)
+		response, err := bufio.NewReader(conn).ReadString(constants.EndMarker[0])
+		require.NoError(t, err)
+		assert.Equal(t, "OK\n"+constants.EndMarker, response)
+	})
+}
@@ -0,0 +1,474 @@
+package storage
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/8thgencore/valchemy/internal/config"
+	"github.com/8thgencore/valchemy/internal/storage/lsm"
+	"github.com/8thgencore/valchemy/internal/wal"
+	"github.com/8thgencore/valchemy/internal/wal/entry"
+	"github.com/8thgencore/valchemy/internal/wal/segment"
+	"github.com/8thgencore/valchemy/pkg/logger/sl"
+)
+
+// DiskEngine is a storage engine that keeps the data in an LSM tree on disk.
+// Recent writes are held in a memtable protected by the WAL; when the
+// memtable is flushed the WAL segments covered by it are truncated.
+type DiskEngine struct {
+	log  *slog.Logger
+	tree *lsm.Tree
+	wal  wal.WAL
+	// truncateWAL is false on replicas, whose WAL is received from the
+	// master. Guarded by flushMu once the engine is open.
+	truncateWAL bool
+	// replicas acknowledge the writes with semi-synchronous replication
+	replicas ReplicaWaiter
+	// gate is passed by the writes before they reach the WAL
+	gate WriteGate
+	// now returns the current time, replaceable in tests
+	now func() time.Time
+
+	// writeMu is held for reading by write operations and exclusively while
+	// the memtable is frozen at a WAL checkpoint
+	writeMu sync.RWMutex
+	// flushMu serializes memtable flushes
+	flushMu sync.Mutex
+	// frozenPos is the WAL position covered by the frozen memtable
+	frozenPos segment.Position
+	// frozenTruncatePos is the WAL position up to which the segments are
+	// removed once the frozen memtable is flushed, zero to keep them
+	frozenTruncatePos segment.Position
+	// appliedPos is the end in the WAL of the entries a replica applied,
+	// which the next memtable flush covers. Guarded by writeMu.
+	appliedPos segment.Position
+	// recovering is set while the WAL is replayed on startup
+	recovering bool
+}
+
+// NewDiskEngine opens the on-disk engine and replays the WAL entries that
+// were not flushed to the tree yet
+func NewDiskEngine(log *slog.Logger, w wal.WAL, cfg config.EngineConfig, truncateWAL bool) (*DiskEngine, error) {
+	tree, err := lsm.Open(log, cfg.DataDirectory, cfg.MemtableSizeBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open LSM tree: %w", err)
+	}
+
+	e := &DiskEngine{
+		log:         log,
+		tree:        tree,
+		wal:         w,
+		truncateWAL: truncateWAL,
+		now:         time.Now,
+	}
+
+	if w != nil {
+		// Apply the entries as they are read
+		now := e.now().UnixNano()
+		e.recovering = true
+		err := w.Replay(tree.Position(), func(el *entry.Entry) error {
+			e.apply(el, now)
+			return nil
+		})
+		e.recovering = false
+		if err != nil {
+			_ = tree.Close()
+			return nil, fmt.Errorf("failed to recover from WAL: %w", err)
+		}
+	}
+
+	return e, nil
+}
+
+// ApplyEntries applies WAL entries to the tree without writing them to the
+// WAL. On a replica pos is the end of the entries in its WAL, which the next
+// memtable flush covers.
+func (e *DiskEngine) ApplyEntries(entries []*entry.Entry, pos segment.Position) {
+	now := e.now().UnixNano()
+
+	for _, el := range entries {
+		e.apply(el, now)
+	}
+
+	if pos != (segment.Position{}) {
+		e.writeMu.Lock()
+		e.appliedPos = pos
+		e.writeMu.Unlock()
+	}
+}
+
+// apply applies a WAL entry to the tree and flushes the memtable when it is full
+func (e *DiskEngine) apply(el *entry.Entry, now int64) {
+	switch el.Operation {
+	case entry.OperationBatch:
+		e.applyEntries(el.Entries, now)
+	case entry.OperationClear:
+		if err := e.tree.Clear(); err != nil {
+			e.log.Error("Failed to clear LSM tree", sl.Err(err))
+		}
+	default:
+		e.applyEntries([]entry.Entry{*el}, now)
+	}
+	e.flushIfNeeded()
+}
+
+// applyEntries applies SET, EXPIRE and DELETE entries to the tree at once and
+// returns the number of keys deleted that had not expired at now
+func (e *DiskEngine) applyEntries(entries []entry.Entry, now int64) int {
+	deleted, err := e.tree.Apply(entries, now)
+	if err != nil {
+		e.log.Error("Failed to apply entries to LSM tree", sl.Err(err))
+	}
+
+	return deleted
+}
+
+// Set sets a key-value pair in the engine
+func (e *DiskEngine) Set(key, value string) error {
+	return e.set(key, value, 0)
+}
+
+// SetEx sets a key-value pair that expires after the ttl
+func (e *DiskEngine) SetEx(key, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+
+	return e.set(key, value, e.now().Add(ttl).UnixNano())
+}
+
+func (e *DiskEngine) set(key, value string, expiresAt int64) error {
+	el := entry.Entry{Operation: entry.OperationSet, Key: key, Value: value, ExpiresAt: expiresAt}
+
+	return e.write(el, func() error {
+		e.tree.Put(key, value, expiresAt)
+		return nil
+	})
+}
+
+// Get gets a value from the engine
+func (e *DiskEngine) Get(key string) (string, bool) {
+	value, _, ok := e.get(key, e.now().UnixNano())
+	return value, ok
+}
+
+// get returns the value and the expiration time of a key that has not expired at now
+func (e *DiskEngine) get(key string, now int64) (string, int64, bool) {
+	value, expiresAt, ok, err := e.tree.Get(key)
+	if err != nil {
+		e.log.Error("Failed to read from LSM tree", sl.Err(err), "key", key)
+		return "", 0, false
+	}
+	if !ok || (expiresAt != 0 && expiresAt <= now) {
+		return "", 0, false
+	}
+
+	return value, expiresAt, true
+}
+
+// MGet gets the values of several keys; found reports which keys exist. The
+// keys are read together, so that a concurrent batch is seen entirely or not
+// at all.
+func (e *DiskEngine) MGet(keys []string) ([]string, []bool) {
+	now := e.now().UnixNano()
+	values := make([]string, len(keys))
+	found := make([]bool, len(keys))
+
+	read, err := e.tree.GetMany(keys)
+	if err != nil {
+		e.log.Error("Failed to read from LSM tree", sl.Err(err), "keys", len(keys))
+		return values, found
+	}
+	for i, v := range read {
+		if v.Found && (v.ExpiresAt == 0 || v.ExpiresAt > now) {
+			values[i], found[i] = v.Value, true
+		}
+	}
+
+	return values, found
+}
+
+// MSet sets several key-value pairs. They are written to the WAL as a single
+// batch record, so they are recovered and replicated all or none.
+func (e *DiskEngine) MSet(pairs []KeyValue) error {
+	entries := make([]entry.Entry, len(pairs))
+	for i, kv := range pairs {
+		entries[i] = entry.Entry{Operation: entry.OperationSet, Key: kv.Key, Value: kv.Value}
+	}
+	_, err := e.writeBatch(entries)
+
+	return err
+}
+
+// MDelete deletes several keys as a single batch record and returns the
+// number of keys that existed
+func (e *DiskEngine) MDelete(keys []string) (int, error) {
+	entries := make([]entry.Entry, len(keys))
+	for i, key := range keys {
+		entries[i] = entry.Entry{Operation: entry.OperationDelete, Key: key}
+	}
+
+	return e.writeBatch(entries)
+}
+
+// writeBatch writes the entries to the WAL as one batch record, applies them
+// to the tree under one lock, so that readers see all or none of them, and
+// returns the number of keys deleted
+func (e *DiskEngine) writeBatch(entries []entry.Entry) (int, error) {
+	if len(entries) == 0 {
+		return 0, nil
+	}
+
+	var deleted int
+	el := entry.Entry{Operation: entry.OperationBatch, Entries: entries}
+	err := e.write(el, func() error {
+		deleted = e.applyEntries(entries, e.now().UnixNano())
+		return nil
+	})
+
+	return deleted, err
+}
+
+// TTL returns the remaining time to live of a key or NoExpiration if the key
+// does not expire. The flag is false if the key does not exist.
+func (e *DiskEngine) TTL(key string) (time.Duration, bool) {
+	now := e.now().UnixNano()
+	_, expiresAt, ok := e.get(key, now)
+	if !ok {
+		return 0, false
+	}
+	if expiresAt == 0 {
+		return NoExpiration, true
+	}
+
+	return time.Duration(expiresAt - now), true
+}
+
+// Expire sets the time to live of an existing key, a non-positive ttl deletes
+// the key. Returns false if the key does not exist.
+func (e *DiskEngine) Expire(key string, ttl time.Duration) (bool, error) {
+	if ttl <= 0 {
+		return e.Delete(key)
+	}
+
+	return e.expire(key, e.now().Add(ttl).UnixNano())
+}
+
+// Persist removes the time to live of an existing key. Returns false if the
+// key does not exist.
+func (e *DiskEngine) Persist(key string) (bool, error) {
+	return e.expire(key, 0)
+}
+
+func (e *DiskEngine) expire(key string, expiresAt int64) (bool, error) {
+	if _, exists := e.Get(key); !exists {
+		return false, nil
+	}
+
+	var updated bool
+	el := entry.Entry{Operation: entry.OperationExpire, Key: key, ExpiresAt: expiresAt}
+	if err := e.write(el, func() error {
+		var err error
+		updated, err = e.tree.Expire(key, expiresAt, e.now().UnixNano())
+		return err
+	}); err != nil {
+		return false, err
+	}
+
+	return updated, nil
+}
+
+// Delete deletes a key from the engine and reports whether it existed
+func (e *DiskEngine) Delete(key string) (bool, error) {
+	var deleted int
+	el := entry.Entry{Operation: entry.OperationDelete, Key: key}
+	err := e.write(el, func() error {
+		deleted = e.applyEntries([]entry.Entry{el}, e.now().UnixNano())
+		return nil
+	})
+
+	return deleted == 1, err
+}
+
+// Clear removes all keys from the engine
+func (e *DiskEngine) Clear() error {
+	// The gate comes first, a role change holds it while it takes flushMu
+	end, err := beginWrite(e.gate)
+	if err != nil {
+		return err
+	}
+
+	// Wait for a running flush so that it does not resurrect cleared data
+	e.flushMu.Lock()
+	lsn, err := e.writeLocked(entry.Entry{Operation: entry.OperationClear}, e.tree.Clear)
+	e.flushMu.Unlock()
+	end()
+	if err != nil {
+		return err
+	}
+
+	return waitReplicas(e.replicas, lsn)
+}
+
+// Snapshot flushes the memtable to disk and truncates the WAL covered by it
+func (e *DiskEngine) Snapshot() error {
+	e.flushMu.Lock()
+	defer e.flushMu.Unlock()
+
+	return e.flush()
+}
+
+// WALError returns the error that put the WAL in the failed state
+func (e *DiskEngine) WALError() error {
+	if e.wal == nil {
+		return nil
+	}
+
+	return e.wal.Err()
+}
+
+// ResumeWAL leaves the failed state of the WAL once its cause is fixed
+func (e *DiskEngine) ResumeWAL() error {
+	if e.wal == nil {
+		return nil
+	}
+
+	return e.wal.Resume()
+}
+
+// Close closes the LSM tree
+func (e *DiskEngine) Close() error {
+	return e.tree.Close()
+}
+
+// SetWALTruncation switches the memtable flushes between the WAL truncation
+// of a master, at its checkpoints, and that of a replica, up to the entries
+// applied. A flush in progress completes first.
+func (e *DiskEngine) SetWALTruncation(enabled bool) {
+	e.flushMu.Lock()
+	e.truncateWAL = enabled
+	// The entries applied as a replica do not carry over a role change
+	e.writeMu.Lock()
+	e.appliedPos = segment.Position{}
+	e.writeMu.Unlock()
+	e.flushMu.Unlock()
+}
+
+// SetReplicaWaiter makes the writes wait for the replicas to acknowledge
+// their WAL entries; it must be called before the engine serves writes
+func (e *DiskEngine) SetReplicaWaiter(replicas ReplicaWaiter) {
+	e.replicas = replicas
+}
+
+// SetWriteGate makes the writes pass the gate before they reach the WAL; it
+// must be called before the engine serves writes
+func (e *DiskEngine) SetWriteGate(gate WriteGate) {
+	e.gate = gate
+}
+
+// write passes the gate, records the entry in the WAL and applies it, then
+// leaves the gate, flushes the memtable when it is full and waits for the
+// replicas to acknowledge the entry
+func (e *DiskEngine) write(el entry.Entry, apply func() error) error {
+	end, err := beginWrite(e.gate)
+	if err != nil {
+		return err
+	}
+	lsn, err := e.writeLocked(el, apply)
+	end()
+	if err != nil {
+		return err
+	}
+	e.flushIfNeeded()
+
+	return waitReplicas(e.replicas, lsn)
+}
+
+// writeLocked records the entry in the WAL and then applies it while holding
+// writeMu, and returns the sequence number of the entry
+func (e *DiskEngine) writeLocked(el entry.Entry, apply func() error) (uint64, error) {
+	e.writeMu.RLock()
+	defer e.writeMu.RUnlock()
+
+	var lsn uint64
+	if e.wal != nil {
+		var err error
+		if lsn, err = e.wal.Write(el); err != nil {
+			return 0, err
+		}
+	}
+
+	return lsn, apply()
+}
+
+// flushIfNeeded flushes the memtable once it reaches its size limit
+func (e *DiskEngine) flushIfNeeded() {
+	if !e.tree.ShouldFlush() {
+		return
+	}
+
+	e.flushMu.Lock()
+	defer e.flushMu.Unlock()
+
+	// Another writer may have flushed the memtable in the meantime
+	if !e.tree.ShouldFlush() {
+		return
+	}
+
+	if err := e.flush(); err != nil {
+		e.log.Error("Failed to flush memtable", sl.Err(err))
+	}
+}
+
+// flush writes the memtable to a table; flushMu must be held
+func (e *DiskEngine) flush() error {
+	// A memtable frozen by a failed flush is retried with its own position
+	if !e.tree.HasFrozen() {
+		var pos, truncatePos segment.Position
+
+		// Freeze the memtable at a WAL checkpoint so that the table covers
+		// exactly the entries before the position
+		e.writeMu.Lock()
+		switch {
+		case e.recovering || (!e.truncateWAL && e.appliedPos == segment.Position{}):
+			// The replayed segments have no checkpoint yet and a replica
+			// has applied nothing since it started: the table keeps the
+			// position of the tree, a crash replays the entries after it again
+			pos = e.tree.Position()
+		case !e.truncateWAL:
+			// A replica appends the data of its master to its WAL: the table
+			// covers the entries applied, and only the segments before the
+			// one still being received are removed
+			pos = e.appliedPos
+			truncatePos = segment.Position{SegmentID: pos.SegmentID}
+		case e.wal != nil:
+			var err error
+			if pos, err = e.wal.Checkpoint(); err != nil {
+				e.writeMu.Unlock()
+				return err
+			}
+			truncatePos = pos
+		}
+		frozen := e.tree.Freeze()
+		e.writeMu.Unlock()
+
+		if !frozen {
+			return nil
+		}
+		e.frozenPos, e.frozenTruncatePos = pos, truncatePos
+	}
+
+	if err := e.tree.FlushFrozen(e.frozenPos); err != nil {
+		return err
+	}
+
+	if e.wal != nil && e.frozenTruncatePos != (segment.Position{}) {
+		if err := e.wal.Truncate(e.frozenTruncatePos); err != nil {
+			return fmt.Errorf("failed to truncate WAL: %w", err)
+		}
+	}
+
+	return nil
+}
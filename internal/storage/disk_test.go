@@ -0,0 +1,260 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/8thgencore/valchemy/internal/config"
+	"github.com/8thgencore/valchemy/internal/wal/entry"
+	"github.com/8thgencore/valchemy/internal/wal/mocks"
+	"github.com/8thgencore/valchemy/internal/wal/segment"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupDiskEngine(t *testing.T, mockWAL *mocks.MockWAL, dir string) *DiskEngine {
+	t.Helper()
+	logger, _ := setupTest(t)
+	cfg := config.EngineConfig{
+		Type:              config.OnDisk,
+		DataDirectory:     dir,
+		MemtableSizeBytes: 512,
+	}
+
+	engine, err := NewDiskEngine(logger, mockWAL, cfg, true)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = engine.Close() })
+
+	return engine
+}
+
+func TestDiskEngine(t *testing.T) {
+	t.Run("Set, Get and Delete", func(t *testing.T) {
+		_, mockWAL := setupTest(t)
+		engine := setupDiskEngine(t, mockWAL, t.TempDir())
+
+		require.NoError(t, engine.Set("key1", "value1"))
+		value, exists := engine.Get("key1")
+		assert.True(t, exists)
+		assert.Equal(t, "value1", value)
+
+		deleted, err := engine.Delete("key1")
+		require.NoError(t, err)
+		assert.True(t, deleted)
+		_, exists = engine.Get("key1")
+		assert.False(t, exists)
+
+		deleted, err = engine.Delete("key1")
+		require.NoError(t, err)
+		assert.False(t, deleted)
+
+		require.Len(t, mockWAL.Entries, 3)
+		assert.Equal(t, entry.OperationDelete, mockWAL.Entries[1].Operation)
+	})
+
+	t.Run("Multi-key operations", func(t *testing.T) {
+		_, mockWAL := setupTest(t)
+		dir := t.TempDir()
+		engine := setupDiskEngine(t, mockWAL, dir)
+
+		require.NoError(t, engine.MSet([]KeyValue{{"key1", "value1"}, {"key2", "value2"}}))
+		deleted, err := engine.MDelete([]string{"key2", "missing"})
+		require.NoError(t, err)
+		assert.Equal(t, 1, deleted)
+
+		values, found := engine.MGet([]string{"key1", "key2"})
+		assert.Equal(t, []string{"value1", ""}, values)
+		assert.Equal(t, []bool{true, false}, found)
+
+		require.Len(t, mockWAL.Entries, 2)
+		assert.Equal(t, entry.OperationBatch, mockWAL.Entries[0].Operation)
+
+		// The batches are replayed on recovery
+		require.NoError(t, engine.Close())
+		recovered := setupDiskEngine(t, mockWAL, dir)
+		_, found = recovered.MGet([]string{"key1", "key2"})
+		assert.Equal(t, []bool{true, false}, found)
+	})
+
+	t.Run("memtable flush truncates the WAL", func(t *testing.T) {
+		_, mockWAL := setupTest(t)
+		engine := setupDiskEngine(t, mockWAL, t.TempDir())
+
+		for i := 0; i < 50; i++ {
+			require.NoError(t, engine.Set(fmt.Sprintf("key%d", i), "value"))
+		}
+
+		require.NotNil(t, mockWAL.TruncatedTo)
+		for i := 0; i < 50; i++ {
+			_, exists := engine.Get(fmt.Sprintf("key%d", i))
+			assert.True(t, exists)
+		}
+	})
+
+	t.Run("memtable flush follows the WAL truncation", func(t *testing.T) {
+		_, mockWAL := setupTest(t)
+		engine := setupDiskEngine(t, mockWAL, t.TempDir())
+
+		// A replica that applied nothing from its master keeps its WAL
+		engine.SetWALTruncation(false)
+		for i := 0; i < 50; i++ {
+			require.NoError(t, engine.Set(fmt.Sprintf("key%d", i), "value"))
+		}
+		assert.Nil(t, mockWAL.TruncatedTo)
+
+		// Once promoted its flushes truncate the WAL again
+		engine.SetWALTruncation(true)
+		require.NoError(t, engine.Set("key", "value"))
+		require.NoError(t, engine.Snapshot())
+		assert.NotNil(t, mockWAL.TruncatedTo)
+	})
+
+	t.Run("replica flushes truncate the WAL up to the applied entries", func(t *testing.T) {
+		logger, mockWAL := setupTest(t)
+		dir := t.TempDir()
+		engine := setupDiskEngine(t, mockWAL, dir)
+		engine.SetWALTruncation(false)
+
+		// A replica never checkpoints the WAL it receives from its master
+		mockWAL.CheckpointErr = errors.New("checkpoint on a replica")
+		applied := segment.Position{SegmentID: 3, Offset: 100}
+		engine.ApplyEntries([]*entry.Entry{
+			{Operation: entry.OperationSet, Key: "key1", Value: "value1"},
+			{Operation: entry.OperationSet, Key: "key2", Value: "value2"},
+		}, applied)
+		require.NoError(t, engine.Snapshot())
+
+		// The segment still being received is kept
+		require.NotNil(t, mockWAL.TruncatedTo)
+		assert.Equal(t, segment.Position{SegmentID: 3}, *mockWAL.TruncatedTo)
+		require.NoError(t, engine.Close())
+
+		// A restart replays the WAL after the entries flushed
+		w := &replayWAL{MockWAL: mockWAL}
+		cfg := config.EngineConfig{Type: config.OnDisk, DataDirectory: dir, MemtableSizeBytes: 512}
+		engine, err := NewDiskEngine(logger, w, cfg, false)
+		require.NoError(t, err)
+		defer engine.Close()
+		assert.Equal(t, applied, w.from)
+		value, exists := engine.Get("key2")
+		assert.True(t, exists)
+		assert.Equal(t, "value2", value)
+	})
+
+	t.Run("flushes during recovery keep the WAL", func(t *testing.T) {
+		_, mockWAL := setupTest(t)
+		for i := 0; i < 50; i++ {
+			mockWAL.Entries = append(mockWAL.Entries, &entry.Entry{
+				Operation: entry.OperationSet, Key: fmt.Sprintf("key%d", i), Value: "value",
+			})
+		}
+
+		engine := setupDiskEngine(t, mockWAL, t.TempDir())
+
+		assert.Nil(t, mockWAL.TruncatedTo)
+		for i := 0; i < 50; i++ {
+			_, exists := engine.Get(fmt.Sprintf("key%d", i))
+			assert.True(t, exists)
+		}
+	})
+
+	t.Run("recovery from tables and WAL", func(t *testing.T) {
+		dir := t.TempDir()
+		_, mockWAL := setupTest(t)
+		engine := setupDiskEngine(t, mockWAL, dir)
+
+		require.NoError(t, engine.Set("flushed", "value1"))
+		require.NoError(t, engine.Snapshot())
+		require.NoError(t, engine.Close())
+
+		// The entries after the flush are recovered from the WAL
+		_, recoveryWAL := setupTest(t)
+		recoveryWAL.Entries = []*entry.Entry{
+			{Operation: entry.OperationSet, Key: "unflushed", Value: "value2"},
+		}
+		engine = setupDiskEngine(t, recoveryWAL, dir)
+
+		value, exists := engine.Get("flushed")
+		assert.True(t, exists)
+		assert.Equal(t, "value1", value)
+		value, exists = engine.Get("unflushed")
+		assert.True(t, exists)
+		assert.Equal(t, "value2", value)
+	})
+
+	t.Run("Clear", func(t *testing.T) {
+		_, mockWAL := setupTest(t)
+		engine := setupDiskEngine(t, mockWAL, t.TempDir())
+
+		require.NoError(t, engine.Set("key1", "value1"))
+		require.NoError(t, engine.Snapshot())
+		require.NoError(t, engine.Set("key2", "value2"))
+
+		require.NoError(t, engine.Clear())
+		_, exists := engine.Get("key1")
+		assert.False(t, exists)
+		_, exists = engine.Get("key2")
+		assert.False(t, exists)
+	})
+
+	t.Run("WAL errors", func(t *testing.T) {
+		_, mockWAL := setupTest(t)
+		engine := setupDiskEngine(t, mockWAL, t.TempDir())
+		mockWAL.WriteError = errors.New("write error")
+
+		assert.Error(t, engine.Set("key1", "value1"))
+		_, exists := engine.Get("key1")
+		assert.False(t, exists)
+	})
+
+	t.Run("Expiration", func(t *testing.T) {
+		_, mockWAL := setupTest(t)
+		dir := t.TempDir()
+		engine := setupDiskEngine(t, mockWAL, dir)
+
+		now := time.Unix(1000, 0)
+		engine.now = func() time.Time { return now }
+
+		require.NoError(t, engine.SetEx("key1", "value1", 10*time.Second))
+		require.NoError(t, engine.Set("key2", "value2"))
+
+		ttl, exists := engine.TTL("key1")
+		assert.True(t, exists)
+		assert.Equal(t, 10*time.Second, ttl)
+
+		ok, err := engine.Expire("key2", 5*time.Second)
+		require.NoError(t, err)
+		assert.True(t, ok)
+
+		ok, err = engine.Persist("key1")
+		require.NoError(t, err)
+		assert.True(t, ok)
+
+		ttl, exists = engine.TTL("key1")
+		assert.True(t, exists)
+		assert.Equal(t, NoExpiration, ttl)
+
+		now = now.Add(5 * time.Second)
+		_, exists = engine.Get("key2")
+		assert.False(t, exists)
+
+		ok, err = engine.Expire("key2", time.Second)
+		require.NoError(t, err)
+		assert.False(t, ok)
+		assert.Equal(t, entry.OperationExpire, mockWAL.Entries[len(mockWAL.Entries)-1].Operation)
+	})
+}
+
+// replayWAL is a WAL that records the position its replay starts from
+type replayWAL struct {
+	*mocks.MockWAL
+	from segment.Position
+}
+
+func (w *replayWAL) Replay(from segment.Position, fn func(*entry.Entry) error) error {
+	w.from = from
+
+	return w.MockWAL.Replay(from, fn)
+}
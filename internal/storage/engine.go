@@ -1,161 +1,647 @@
 package storage
 
 import (
+	"errors"
+	"fmt"
 	"hash/fnv"
 	"log/slog"
+	"runtime"
 	"sync"
+	"time"
 
+	"github.com/8thgencore/valchemy/internal/storage/snapshot"
 	"github.com/8thgencore/valchemy/internal/wal"
 	"github.com/8thgencore/valchemy/internal/wal/entry"
+	"github.com/8thgencore/valchemy/internal/wal/segment"
 	"github.com/8thgencore/valchemy/pkg/logger/sl"
 )
 
 // Engine is a struct that represents the storage engine
 type Engine struct {
+	log        *slog.Logger
 	partitions []*partition
 	wal        wal.WAL
+	snapshots  *snapshot.Store
 	numShards  int
+	// now returns the current time, replaceable in tests
+	now func() time.Time
+
+	// writeMu is held for reading by write operations and exclusively while
+	// a snapshot captures a state consistent with the WAL position
+	writeMu sync.RWMutex
+	// snapshotMu serializes snapshots
+	snapshotMu sync.Mutex
+	// truncateWAL enables the snapshots, which truncate the WAL; false on
+	// replicas, whose WAL is received from the master. Guarded by snapshotMu.
+	truncateWAL bool
+	// replicas acknowledge the writes with semi-synchronous replication
+	replicas ReplicaWaiter
+	// gate is passed by the writes before they reach the WAL
+	gate WriteGate
+
+	// stop terminates the background loops
+	stop      chan struct{}
+	closeOnce sync.Once
+	loops     sync.WaitGroup
 }
 
 type partition struct {
 	data map[string]string
-	mu   sync.RWMutex
+	// expires holds the expiration times in Unix nanoseconds of the keys that expire
+	expires map[string]int64
+	mu      sync.RWMutex
 }
 
-const defaultNumShards = 16
+const (
+	defaultNumShards = 16
+
+	// expirationSweepInterval is the period of the background removal of expired keys
+	expirationSweepInterval = time.Second
+)
 
-// NewEngine creates a new Engine
-func NewEngine(log *slog.Logger, w wal.WAL) *Engine {
+// NewEngine creates a new Engine. The state is restored from the newest
+// snapshot (if snapshots are enabled) and the WAL entries written after it.
+func NewEngine(log *slog.Logger, w wal.WAL, snapshots *snapshot.Store) (*Engine, error) {
 	e := &Engine{
-		partitions: make([]*partition, defaultNumShards),
-		wal:        w,
-		numShards:  defaultNumShards,
+		log:         log,
+		partitions:  make([]*partition, defaultNumShards),
+		wal:         w,
+		snapshots:   snapshots,
+		numShards:   defaultNumShards,
+		now:         time.Now,
+		truncateWAL: true,
+		stop:        make(chan struct{}),
 	}
 
 	// Initialize partitions
 	for i := 0; i < defaultNumShards; i++ {
-		e.partitions[i] = &partition{
-			data: make(map[string]string),
+		e.partitions[i] = newPartition()
+	}
+
+	// Load the newest snapshot if available
+	var from segment.Position
+	if snapshots != nil {
+		snap, err := snapshots.LoadLatest()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load snapshot: %w", err)
+		}
+		if snap != nil {
+			e.loadSnapshot(snap)
+			from = snap.Position
+			log.Info("Loaded snapshot",
+				"segment_id", snap.Position.SegmentID,
+				"offset", snap.Position.Offset,
+				"keys", len(snap.Data))
 		}
 	}
 
-	// Recover data from WAL if available
+	// Recover data from WAL if available, applying the entries as they are read
 	if w != nil {
-		entries, err := w.Recover()
-		if err != nil {
-			log.Error("Failed to recover from WAL", sl.Err(err))
+		if err := e.replay(w, from, runtime.GOMAXPROCS(0)); err != nil {
+			return nil, fmt.Errorf("failed to recover from WAL: %w", err)
+		}
+	}
+
+	for _, p := range e.partitions {
+		e.loops.Add(1)
+		go e.sweepLoop(p)
+	}
+
+	if snapshots != nil && snapshots.Interval() > 0 {
+		e.loops.Add(1)
+		go e.snapshotLoop(snapshots.Interval())
+	}
+
+	return e, nil
+}
+
+func newPartition() *partition {
+	return &partition{
+		data:    make(map[string]string),
+		expires: make(map[string]int64),
+	}
+}
+
+// get returns the value and the expiration time of a key. An expired key is
+// removed and reported as missing.
+func (p *partition) get(key string, now int64) (string, int64, bool) {
+	p.mu.RLock()
+	value, exists := p.data[key]
+	expiresAt := p.expires[key]
+	p.mu.RUnlock()
+
+	if !exists || expiresAt == 0 || expiresAt > now {
+		return value, expiresAt, exists
+	}
+
+	// Lazy expiration, the key may have been overwritten meanwhile
+	p.mu.Lock()
+	if expiresAt, ok := p.expires[key]; ok && expiresAt <= now {
+		delete(p.data, key)
+		delete(p.expires, key)
+	}
+	p.mu.Unlock()
+
+	return "", 0, false
+}
+
+// set stores a value with an expiration time, zero for a key that does not expire
+func (p *partition) set(key, value string, expiresAt int64) {
+	p.mu.Lock()
+	p.setLocked(key, value, expiresAt)
+	p.mu.Unlock()
+}
+
+func (p *partition) setLocked(key, value string, expiresAt int64) {
+	p.data[key] = value
+	if expiresAt != 0 {
+		p.expires[key] = expiresAt
+	} else {
+		delete(p.expires, key)
+	}
+}
+
+// expire changes the expiration time of an existing key, zero removes it
+// expire changes the expiration time of a key and reports whether the key
+// existed and had not expired at now
+func (p *partition) expire(key string, expiresAt, now int64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.existsLocked(key, now) {
+		return false
+	}
+	p.expireLocked(key, expiresAt)
+
+	return true
+}
+
+func (p *partition) expireLocked(key string, expiresAt int64) {
+	if _, exists := p.data[key]; exists {
+		if expiresAt != 0 {
+			p.expires[key] = expiresAt
+		} else {
+			delete(p.expires, key)
+		}
+	}
+}
+
+// delete removes a key and reports whether it existed and had not expired at now
+func (p *partition) delete(key string, now int64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	existed := p.existsLocked(key, now)
+	p.deleteLocked(key)
+
+	return existed
+}
+
+// existsLocked reports whether a key exists and has not expired at now
+func (p *partition) existsLocked(key string, now int64) bool {
+	if _, exists := p.data[key]; !exists {
+		return false
+	}
+	expiresAt := p.expires[key]
+
+	return expiresAt == 0 || expiresAt > now
+}
+
+func (p *partition) deleteLocked(key string) {
+	delete(p.data, key)
+	delete(p.expires, key)
+}
+
+// applyLocked applies a SET, EXPIRE or DELETE entry and reports whether it
+// deleted a key that had not expired at now; p.mu must be held
+func (p *partition) applyLocked(el *entry.Entry, now int64) bool {
+	switch el.Operation {
+	case entry.OperationSet:
+		// A key that expired meanwhile must not be resurrected
+		if el.Expired(now) {
+			p.deleteLocked(el.Key)
+		} else {
+			p.setLocked(el.Key, el.Value, el.ExpiresAt)
 		}
+	case entry.OperationExpire:
+		if el.Expired(now) {
+			p.deleteLocked(el.Key)
+		} else {
+			p.expireLocked(el.Key, el.ExpiresAt)
+		}
+	case entry.OperationDelete:
+		existed := p.existsLocked(el.Key, now)
+		p.deleteLocked(el.Key)
+		return existed
+	}
+
+	return false
+}
 
-		// Apply recovered entries
-		e.applyEntries(entries)
+func (p *partition) clear() {
+	p.mu.Lock()
+	p.data = make(map[string]string)
+	p.expires = make(map[string]int64)
+	p.mu.Unlock()
+}
+
+// sweep removes the expired keys and returns their number
+func (p *partition) sweep(now int64) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	removed := 0
+	for key, expiresAt := range p.expires {
+		if expiresAt <= now {
+			delete(p.data, key)
+			delete(p.expires, key)
+			removed++
+		}
 	}
 
-	return e
+	return removed
+}
+
+// sweepLoop periodically removes the expired keys of a partition
+func (e *Engine) sweepLoop(p *partition) {
+	defer e.loops.Done()
+
+	ticker := time.NewTicker(expirationSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case tick := <-ticker.C:
+			p.sweep(tick.UnixNano())
+		case <-e.stop:
+			return
+		}
+	}
 }
 
 // getPartition returns the partition for a given key
 func (e *Engine) getPartition(key string) *partition {
+	return e.partitions[e.partitionIndex(key)]
+}
+
+// partitionIndex returns the index of the partition for a given key
+func (e *Engine) partitionIndex(key string) int {
 	hash := fnv.New32a()
 	// Handle error if hash write fails
 	if _, err := hash.Write([]byte(key)); err != nil {
-		// Return first partition as fallback
-		return e.partitions[0]
+		// Use the first partition as fallback
+		return 0
 	}
 
 	// Ensure numShards is within the valid range for uint32
 	if e.numShards < 0 || e.numShards > int(^uint32(0)) {
-		return e.partitions[0]
+		return 0
 	}
 
-	index := hash.Sum32() % uint32(e.numShards)
-
-	return e.partitions[index]
+	return int(hash.Sum32() % uint32(e.numShards))
 }
 
-// applyEntries applies a slice of WAL entries to the in-memory state
-func (e *Engine) applyEntries(entries []*entry.Entry) {
+// ApplyEntries applies a slice of WAL entries to the in-memory state without
+// writing them to the WAL. It is used by replicas to apply entries streamed
+// from the master; their position in the WAL is not needed.
+func (e *Engine) ApplyEntries(entries []*entry.Entry, _ segment.Position) {
+	now := e.now().UnixNano()
+
 	for _, el := range entries {
-		switch el.Operation {
-		case entry.OperationSet:
-			p := e.getPartition(el.Key)
-			p.mu.Lock()
-			p.data[el.Key] = el.Value
-			p.mu.Unlock()
-		case entry.OperationDelete:
-			p := e.getPartition(el.Key)
+		e.apply(el, now)
+	}
+}
+
+// apply applies a WAL entry to the in-memory state
+func (e *Engine) apply(el *entry.Entry, now int64) {
+	switch el.Operation {
+	case entry.OperationSet, entry.OperationExpire, entry.OperationDelete:
+		p := e.getPartition(el.Key)
+		p.mu.Lock()
+		p.applyLocked(el, now)
+		p.mu.Unlock()
+	case entry.OperationBatch:
+		e.applyBatch(el.Entries, now)
+	case entry.OperationClear:
+		for _, p := range e.partitions {
+			p.clear()
+		}
+	}
+}
+
+// applyBatch applies the entries of a batch while holding the locks of all
+// the partitions they affect, so that readers see either none or all of them.
+// Returns the number of keys deleted that had not expired at now.
+func (e *Engine) applyBatch(entries []entry.Entry, now int64) int {
+	locked := make([]bool, e.numShards)
+	for i := range entries {
+		locked[e.partitionIndex(entries[i].Key)] = true
+	}
+
+	// Locks are taken in partition order so that concurrent batches cannot deadlock
+	for i, p := range e.partitions {
+		if locked[i] {
 			p.mu.Lock()
-			delete(p.data, el.Key)
+		}
+	}
+
+	deleted := 0
+	for i := range entries {
+		if e.getPartition(entries[i].Key).applyLocked(&entries[i], now) {
+			deleted++
+		}
+	}
+
+	for i, p := range e.partitions {
+		if locked[i] {
 			p.mu.Unlock()
-		case entry.OperationClear:
-			for _, p := range e.partitions {
-				p.mu.Lock()
-				p.data = make(map[string]string)
-				p.mu.Unlock()
+		}
+	}
+
+	return deleted
+}
+
+// Snapshot writes the current state to a snapshot file and removes the WAL
+// segments covered by it
+func (e *Engine) Snapshot() error {
+	if e.snapshots == nil || e.wal == nil {
+		return ErrSnapshotsDisabled
+	}
+
+	e.snapshotMu.Lock()
+	defer e.snapshotMu.Unlock()
+
+	if !e.truncateWAL {
+		return ErrSnapshotsDisabled
+	}
+
+	// Block writes so that the copied data matches the WAL position exactly
+	e.writeMu.Lock()
+	pos, err := e.wal.Checkpoint()
+	if err != nil {
+		e.writeMu.Unlock()
+		return err
+	}
+	data, expires := e.copyData()
+	e.writeMu.Unlock()
+
+	info, err := e.snapshots.Save(pos, data, expires)
+	if err != nil {
+		return fmt.Errorf("failed to save snapshot: %w", err)
+	}
+
+	if err := e.wal.Truncate(pos); err != nil {
+		return fmt.Errorf("failed to truncate WAL: %w", err)
+	}
+
+	e.log.Info("Snapshot created", "name", info.Name, "keys", len(data))
+
+	return nil
+}
+
+// WALError returns the error that put the WAL in the failed state
+func (e *Engine) WALError() error {
+	if e.wal == nil {
+		return nil
+	}
+
+	return e.wal.Err()
+}
+
+// ResumeWAL leaves the failed state of the WAL once its cause is fixed
+func (e *Engine) ResumeWAL() error {
+	if e.wal == nil {
+		return nil
+	}
+
+	return e.wal.Resume()
+}
+
+// snapshotLoop periodically creates snapshots
+func (e *Engine) snapshotLoop(interval time.Duration) {
+	defer e.loops.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := e.Snapshot(); err != nil && !errors.Is(err, ErrSnapshotsDisabled) {
+				e.log.Error("Failed to create snapshot", sl.Err(err))
+			}
+		case <-e.stop:
+			return
+		}
+	}
+}
+
+// Close stops the background expiration sweeps and snapshots
+func (e *Engine) Close() error {
+	e.closeOnce.Do(func() {
+		close(e.stop)
+	})
+	e.loops.Wait()
+
+	return nil
+}
+
+// copyData returns a copy of the data and the expiration times of all
+// partitions without the expired keys
+func (e *Engine) copyData() (map[string]string, map[string]int64) {
+	now := e.now().UnixNano()
+	data := make(map[string]string)
+	expires := make(map[string]int64)
+	for _, p := range e.partitions {
+		p.mu.RLock()
+		for key, value := range p.data {
+			expiresAt, ok := p.expires[key]
+			if ok && expiresAt <= now {
+				continue
+			}
+			data[key] = value
+			if ok {
+				expires[key] = expiresAt
 			}
 		}
+		p.mu.RUnlock()
+	}
+
+	return data, expires
+}
+
+// loadSnapshot replaces the state of the partitions with the snapshot data
+func (e *Engine) loadSnapshot(snap *snapshot.Snapshot) {
+	now := e.now().UnixNano()
+	for key, value := range snap.Data {
+		expiresAt := snap.Expires[key]
+		if expiresAt != 0 && expiresAt <= now {
+			continue
+		}
+		e.getPartition(key).set(key, value, expiresAt)
 	}
 }
 
 // Set sets a key-value pair in the engine
 func (e *Engine) Set(key, value string) error {
+	return e.set(key, value, 0)
+}
+
+// SetEx sets a key-value pair that expires after the ttl
+func (e *Engine) SetEx(key, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+
+	return e.set(key, value, e.now().Add(ttl).UnixNano())
+}
+
+func (e *Engine) set(key, value string, expiresAt int64) error {
 	// Prepare the entry
 	entry := entry.Entry{
 		Operation: entry.OperationSet,
 		Key:       key,
 		Value:     value,
-	}
-
-	// Write to WAL first
-	if e.wal != nil {
-		if err := e.wal.Write(entry); err != nil {
-			return err
-		}
+		ExpiresAt: expiresAt,
 	}
 
 	// Get the appropriate partition
 	p := e.getPartition(key)
 
-	// Apply the change to in-memory state
-	p.mu.Lock()
-	p.data[key] = value
-	p.mu.Unlock()
-
-	return nil
+	return e.write(entry, func() {
+		p.set(key, value, expiresAt)
+	})
 }
 
 // Get gets a value from the engine
 func (e *Engine) Get(key string) (string, bool) {
-	p := e.getPartition(key)
-	p.mu.RLock()
-	value, exists := p.data[key]
-	p.mu.RUnlock()
+	value, _, exists := e.getPartition(key).get(key, e.now().UnixNano())
 	return value, exists
 }
 
-// Delete deletes a key from the engine
-func (e *Engine) Delete(key string) error {
+// MGet gets the values of several keys; found reports which keys exist
+func (e *Engine) MGet(keys []string) ([]string, []bool) {
+	now := e.now().UnixNano()
+	values := make([]string, len(keys))
+	found := make([]bool, len(keys))
+	for i, key := range keys {
+		values[i], _, found[i] = e.getPartition(key).get(key, now)
+	}
+
+	return values, found
+}
+
+// MSet sets several key-value pairs. They are written to the WAL as a single
+// batch record, so they are recovered and replicated all or none.
+func (e *Engine) MSet(pairs []KeyValue) error {
+	entries := make([]entry.Entry, len(pairs))
+	for i, kv := range pairs {
+		entries[i] = entry.Entry{Operation: entry.OperationSet, Key: kv.Key, Value: kv.Value}
+	}
+	_, err := e.writeBatch(entries)
+
+	return err
+}
+
+// MDelete deletes several keys as a single batch record and returns the
+// number of keys that existed
+func (e *Engine) MDelete(keys []string) (int, error) {
+	entries := make([]entry.Entry, len(keys))
+	for i, key := range keys {
+		entries[i] = entry.Entry{Operation: entry.OperationDelete, Key: key}
+	}
+
+	return e.writeBatch(entries)
+}
+
+// writeBatch writes the entries to the WAL as one batch record, applies them
+// and returns the number of keys deleted
+func (e *Engine) writeBatch(entries []entry.Entry) (int, error) {
+	if len(entries) == 0 {
+		return 0, nil
+	}
+
+	var deleted int
+	err := e.write(entry.Entry{Operation: entry.OperationBatch, Entries: entries}, func() {
+		deleted = e.applyBatch(entries, e.now().UnixNano())
+	})
+
+	return deleted, err
+}
+
+// TTL returns the remaining time to live of a key or NoExpiration if the key
+// does not expire. The flag is false if the key does not exist.
+func (e *Engine) TTL(key string) (time.Duration, bool) {
+	now := e.now().UnixNano()
+	_, expiresAt, exists := e.getPartition(key).get(key, now)
+	if !exists {
+		return 0, false
+	}
+	if expiresAt == 0 {
+		return NoExpiration, true
+	}
+
+	return time.Duration(expiresAt - now), true
+}
+
+// Expire sets the time to live of an existing key, a non-positive ttl deletes
+// the key. Returns false if the key does not exist.
+func (e *Engine) Expire(key string, ttl time.Duration) (bool, error) {
+	if ttl <= 0 {
+		return e.Delete(key)
+	}
+
+	return e.expire(key, e.now().Add(ttl).UnixNano())
+}
+
+// Persist removes the time to live of an existing key. Returns false if the
+// key does not exist.
+func (e *Engine) Persist(key string) (bool, error) {
+	return e.expire(key, 0)
+}
+
+func (e *Engine) expire(key string, expiresAt int64) (bool, error) {
+	// Get the appropriate partition
+	p := e.getPartition(key)
+	if _, _, exists := p.get(key, e.now().UnixNano()); !exists {
+		return false, nil
+	}
+
 	// Prepare the entry
 	entry := entry.Entry{
-		Operation: entry.OperationDelete,
+		Operation: entry.OperationExpire,
 		Key:       key,
+		ExpiresAt: expiresAt,
 	}
 
-	// Write to WAL first
-	if e.wal != nil {
-		if err := e.wal.Write(entry); err != nil {
-			return err
-		}
+	// The key may have been deleted since the check above
+	var updated bool
+	if err := e.write(entry, func() {
+		updated = p.expire(key, expiresAt, e.now().UnixNano())
+	}); err != nil {
+		return false, err
+	}
+
+	return updated, nil
+}
+
+// Delete deletes a key from the engine and reports whether it existed
+func (e *Engine) Delete(key string) (bool, error) {
+	// Prepare the entry
+	entry := entry.Entry{
+		Operation: entry.OperationDelete,
+		Key:       key,
 	}
 
 	// Get the appropriate partition
 	p := e.getPartition(key)
 
-	// Apply the change to in-memory state
-	p.mu.Lock()
-	delete(p.data, key)
-	p.mu.Unlock()
+	var deleted bool
+	err := e.write(entry, func() {
+		deleted = p.delete(key, e.now().UnixNano())
+	})
 
-	return nil
+	return deleted, err
 }
 
 // Clear removes all keys from the engine
@@ -165,19 +651,66 @@ func (e *Engine) Clear() error {
 		Operation: entry.OperationClear,
 	}
 
-	// Write to WAL first
-	if e.wal != nil {
-		if err := e.wal.Write(entry); err != nil {
-			return err
+	return e.write(entry, func() {
+		// Clear all partitions
+		for _, p := range e.partitions {
+			p.clear()
 		}
+	})
+}
+
+// SetWALTruncation enables or disables the snapshots, which truncate the WAL.
+// A snapshot in progress completes first.
+func (e *Engine) SetWALTruncation(enabled bool) {
+	e.snapshotMu.Lock()
+	e.truncateWAL = enabled
+	e.snapshotMu.Unlock()
+}
+
+// SetReplicaWaiter makes the writes wait for the replicas to acknowledge
+// their WAL entries; it must be called before the engine serves writes
+func (e *Engine) SetReplicaWaiter(replicas ReplicaWaiter) {
+	e.replicas = replicas
+}
+
+// SetWriteGate makes the writes pass the gate before they reach the WAL; it
+// must be called before the engine serves writes
+func (e *Engine) SetWriteGate(gate WriteGate) {
+	e.gate = gate
+}
+
+// write passes the gate, records the entry in the WAL and applies the change
+// to the in-memory state, then leaves the gate and waits for the replicas to
+// acknowledge the entry
+func (e *Engine) write(el entry.Entry, apply func()) error {
+	end, err := beginWrite(e.gate)
+	if err != nil {
+		return err
+	}
+	lsn, err := e.writeLocked(el, apply)
+	end()
+	if err != nil {
+		return err
 	}
 
-	// Clear all partitions
-	for _, p := range e.partitions {
-		p.mu.Lock()
-		p.data = make(map[string]string)
-		p.mu.Unlock()
+	return waitReplicas(e.replicas, lsn)
+}
+
+// writeLocked records the entry in the WAL and then applies it while holding
+// writeMu, and returns the sequence number of the entry
+func (e *Engine) writeLocked(el entry.Entry, apply func()) (uint64, error) {
+	e.writeMu.RLock()
+	defer e.writeMu.RUnlock()
+
+	// Write to WAL first
+	var lsn uint64
+	if e.wal != nil {
+		var err error
+		if lsn, err = e.wal.Write(el); err != nil {
+			return 0, err
+		}
 	}
+	apply()
 
-	return nil
+	return lsn, nil
 }
@@ -7,9 +7,13 @@ import (
 	"os"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/8thgencore/valchemy/internal/config"
+	"github.com/8thgencore/valchemy/internal/storage/snapshot"
 	"github.com/8thgencore/valchemy/internal/wal/entry"
 	"github.com/8thgencore/valchemy/internal/wal/mocks"
+	"github.com/8thgencore/valchemy/internal/wal/segment"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -24,7 +28,8 @@ func setupTest(_ *testing.T) (*slog.Logger, *mocks.MockWAL) {
 func TestEngine(t *testing.T) {
 	t.Run("NewEngine", func(t *testing.T) {
 		logger, mockWAL := setupTest(t)
-		engine := NewEngine(logger, mockWAL)
+		engine, err := NewEngine(logger, mockWAL, nil)
+		require.NoError(t, err)
 		assert.NotNil(t, engine)
 		assert.NotNil(t, engine.partitions)
 		assert.Equal(t, defaultNumShards, len(engine.partitions))
@@ -43,7 +48,8 @@ func TestEngine(t *testing.T) {
 			{Operation: entry.OperationDelete, Key: "key1"},
 		}
 
-		engine := NewEngine(logger, mockWAL)
+		engine, err := NewEngine(logger, mockWAL, nil)
+		require.NoError(t, err)
 
 		// Проверяем что key1 был удален, а key2 существует
 		_, exists := engine.Get("key1")
@@ -54,11 +60,93 @@ func TestEngine(t *testing.T) {
 		assert.Equal(t, "value2", value)
 	})
 
+	t.Run("NewEngine with recovery error", func(t *testing.T) {
+		logger, mockWAL := setupTest(t)
+		mockWAL.RecoverErr = errors.New("corrupt segment")
+
+		engine, err := NewEngine(logger, mockWAL, nil)
+		assert.ErrorContains(t, err, "corrupt segment")
+		assert.Nil(t, engine)
+	})
+
+	t.Run("ApplyEntries", func(t *testing.T) {
+		logger, mockWAL := setupTest(t)
+		engine, err := NewEngine(logger, mockWAL, nil)
+		require.NoError(t, err)
+
+		engine.ApplyEntries([]*entry.Entry{
+			{Operation: entry.OperationSet, Key: "key1", Value: "value1"},
+			{Operation: entry.OperationSet, Key: "key2", Value: "value2"},
+			{Operation: entry.OperationDelete, Key: "key2"},
+		}, segment.Position{})
+
+		value, exists := engine.Get("key1")
+		assert.True(t, exists)
+		assert.Equal(t, "value1", value)
+
+		_, exists = engine.Get("key2")
+		assert.False(t, exists)
+
+		// Applied entries must not be written to the WAL again
+		assert.Empty(t, mockWAL.Entries)
+	})
+
+	t.Run("Multi-key operations", func(t *testing.T) {
+		logger, mockWAL := setupTest(t)
+		engine, err := NewEngine(logger, mockWAL, nil)
+		require.NoError(t, err)
+
+		err = engine.MSet([]KeyValue{{"key1", "value1"}, {"key2", "value2"}, {"key1", "value3"}})
+		require.NoError(t, err)
+
+		values, found := engine.MGet([]string{"key1", "missing", "key2"})
+		assert.Equal(t, []string{"value3", "", "value2"}, values)
+		assert.Equal(t, []bool{true, false, true}, found)
+
+		deleted, err := engine.MDelete([]string{"key1", "key2", "missing"})
+		require.NoError(t, err)
+		assert.Equal(t, 2, deleted)
+		_, found = engine.MGet([]string{"key1", "key2"})
+		assert.Equal(t, []bool{false, false}, found)
+
+		// Each multi-key write is a single batch record
+		require.Len(t, mockWAL.Entries, 2)
+		assert.Equal(t, entry.OperationBatch, mockWAL.Entries[0].Operation)
+		assert.Len(t, mockWAL.Entries[0].Entries, 3)
+		assert.Equal(t, entry.OperationBatch, mockWAL.Entries[1].Operation)
+
+		// A failed WAL write applies nothing
+		mockWAL.WriteError = errors.New("wal error")
+		assert.Error(t, engine.MSet([]KeyValue{{"key1", "value1"}}))
+		_, exists := engine.Get("key1")
+		assert.False(t, exists)
+	})
+
+	t.Run("ApplyEntries with batch", func(t *testing.T) {
+		logger, mockWAL := setupTest(t)
+		engine, err := NewEngine(logger, mockWAL, nil)
+		require.NoError(t, err)
+
+		engine.ApplyEntries([]*entry.Entry{
+			{Operation: entry.OperationSet, Key: "key3", Value: "value3"},
+			{Operation: entry.OperationBatch, Entries: []entry.Entry{
+				{Operation: entry.OperationSet, Key: "key1", Value: "value1"},
+				{Operation: entry.OperationSet, Key: "key2", Value: "value2"},
+				{Operation: entry.OperationDelete, Key: "key3"},
+			}},
+		}, segment.Position{})
+
+		values, found := engine.MGet([]string{"key1", "key2", "key3"})
+		assert.Equal(t, []string{"value1", "value2", ""}, values)
+		assert.Equal(t, []bool{true, true, false}, found)
+	})
+
 	t.Run("Set and Get operations", func(t *testing.T) {
 		logger, mockWAL := setupTest(t)
-		engine := NewEngine(logger, mockWAL)
+		engine, err := NewEngine(logger, mockWAL, nil)
+		require.NoError(t, err)
 
-		err := engine.Set("key1", "value1")
+		err = engine.Set("key1", "value1")
 		require.NoError(t, err)
 
 		value, exists := engine.Get("key1")
@@ -79,21 +167,28 @@ func TestEngine(t *testing.T) {
 
 	t.Run("Delete operation", func(t *testing.T) {
 		logger, mockWAL := setupTest(t)
-		engine := NewEngine(logger, mockWAL)
+		engine, err := NewEngine(logger, mockWAL, nil)
+		require.NoError(t, err)
 
-		err := engine.Set("key1", "value1")
+		err = engine.Set("key1", "value1")
 		require.NoError(t, err)
 
-		err = engine.Delete("key1")
+		deleted, err := engine.Delete("key1")
 		require.NoError(t, err)
+		assert.True(t, deleted)
 
 		// Проверка что значение удалено
 		value, exists := engine.Get("key1")
 		assert.False(t, exists)
 		assert.Empty(t, value)
 
+		// Повторное удаление не находит ключ
+		deleted, err = engine.Delete("key1")
+		require.NoError(t, err)
+		assert.False(t, deleted)
+
 		// Проверяем записи в WAL
-		require.Len(t, mockWAL.Entries, 2)
+		require.Len(t, mockWAL.Entries, 3)
 		assert.Equal(t, entry.OperationDelete, mockWAL.Entries[1].Operation)
 		assert.Equal(t, "key1", mockWAL.Entries[1].Key)
 	})
@@ -102,20 +197,22 @@ func TestEngine(t *testing.T) {
 		logger, mockWAL := setupTest(t)
 		mockWAL.WriteError = errors.New("write error")
 
-		engine := NewEngine(logger, mockWAL)
+		engine, err := NewEngine(logger, mockWAL, nil)
+		require.NoError(t, err)
 
-		err := engine.Set("key1", "value1")
+		err = engine.Set("key1", "value1")
 		assert.Error(t, err)
 		assert.Contains(t, err.Error(), "write error")
 
-		err = engine.Delete("key1")
+		_, err = engine.Delete("key1")
 		assert.Error(t, err)
 		assert.Contains(t, err.Error(), "write error")
 	})
 
 	t.Run("Concurrent operations", func(t *testing.T) {
 		logger, mockWAL := setupTest(t)
-		engine := NewEngine(logger, mockWAL)
+		engine, err := NewEngine(logger, mockWAL, nil)
+		require.NoError(t, err)
 
 		done := make(chan bool)
 		const iterations = 100
@@ -131,7 +228,7 @@ func TestEngine(t *testing.T) {
 		go func() {
 			for i := 0; i < iterations; i++ {
 				engine.Get(fmt.Sprintf("key%d", i))
-				_ = engine.Delete(fmt.Sprintf("key%d", i))
+				_, _ = engine.Delete(fmt.Sprintf("key%d", i))
 			}
 			done <- true
 		}()
@@ -142,7 +239,8 @@ func TestEngine(t *testing.T) {
 
 	t.Run("Concurrent Set operations", func(t *testing.T) {
 		logger, mockWAL := setupTest(t)
-		engine := NewEngine(logger, mockWAL)
+		engine, err := NewEngine(logger, mockWAL, nil)
+		require.NoError(t, err)
 
 		const iterations = 100
 		var wg sync.WaitGroup
@@ -174,7 +272,8 @@ func TestEngine(t *testing.T) {
 
 	t.Run("Clear operation", func(t *testing.T) {
 		logger, mockWAL := setupTest(t)
-		engine := NewEngine(logger, mockWAL)
+		engine, err := NewEngine(logger, mockWAL, nil)
+		require.NoError(t, err)
 
 		// Set some data
 		require.NoError(t, engine.Set("key1", "value1"))
@@ -196,7 +295,8 @@ func TestEngine(t *testing.T) {
 
 	t.Run("Partition distribution", func(t *testing.T) {
 		logger, mockWAL := setupTest(t)
-		engine := NewEngine(logger, mockWAL)
+		engine, err := NewEngine(logger, mockWAL, nil)
+		require.NoError(t, err)
 
 		// Set multiple keys and verify they're distributed across partitions
 		keys := []string{"key1", "key2", "key3", "key4", "key5"}
@@ -219,4 +319,210 @@ func TestEngine(t *testing.T) {
 		}
 		assert.Equal(t, len(keys), totalKeys)
 	})
+
+	t.Run("Snapshot", func(t *testing.T) {
+		logger, mockWAL := setupTest(t)
+		store := snapshot.New(config.WALConfig{Enabled: true, DataDirectory: t.TempDir()})
+		engine, err := NewEngine(logger, mockWAL, store)
+		require.NoError(t, err)
+
+		require.NoError(t, engine.Set("key1", "value1"))
+		require.NoError(t, engine.Set("key2", "value2"))
+		require.NoError(t, engine.Snapshot())
+
+		// The WAL is truncated up to the snapshot position
+		require.NotNil(t, mockWAL.TruncatedTo)
+		assert.Equal(t, int64(2), mockWAL.TruncatedTo.Offset)
+
+		// A new engine restores the state from the snapshot
+		restored, err := NewEngine(logger, mocks.NewMockWAL(), store)
+		require.NoError(t, err)
+		value, exists := restored.Get("key2")
+		assert.True(t, exists)
+		assert.Equal(t, "value2", value)
+	})
+
+	t.Run("Snapshot disabled", func(t *testing.T) {
+		logger, mockWAL := setupTest(t)
+		engine, err := NewEngine(logger, mockWAL, nil)
+		require.NoError(t, err)
+
+		assert.ErrorIs(t, engine.Snapshot(), ErrSnapshotsDisabled)
+	})
+
+	t.Run("Snapshot follows the WAL truncation", func(t *testing.T) {
+		logger, mockWAL := setupTest(t)
+		store := snapshot.New(config.WALConfig{Enabled: true, DataDirectory: t.TempDir()})
+		engine, err := NewEngine(logger, mockWAL, store)
+		require.NoError(t, err)
+		require.NoError(t, engine.Set("key1", "value1"))
+
+		// A replica keeps its WAL
+		engine.SetWALTruncation(false)
+		assert.ErrorIs(t, engine.Snapshot(), ErrSnapshotsDisabled)
+		assert.Nil(t, mockWAL.TruncatedTo)
+
+		// Once promoted it takes snapshots again
+		engine.SetWALTruncation(true)
+		require.NoError(t, engine.Snapshot())
+		assert.NotNil(t, mockWAL.TruncatedTo)
+	})
+
+	t.Run("Snapshot with checkpoint error", func(t *testing.T) {
+		logger, mockWAL := setupTest(t)
+		mockWAL.CheckpointErr = errors.New("checkpoint error")
+		store := snapshot.New(config.WALConfig{Enabled: true, DataDirectory: t.TempDir()})
+		engine, err := NewEngine(logger, mockWAL, store)
+		require.NoError(t, err)
+
+		assert.Error(t, engine.Snapshot())
+		assert.Nil(t, mockWAL.TruncatedTo)
+	})
+
+	t.Run("Expiration", func(t *testing.T) {
+		logger, mockWAL := setupTest(t)
+		engine, err := NewEngine(logger, mockWAL, nil)
+		require.NoError(t, err)
+
+		now := time.Unix(1000, 0)
+		engine.now = func() time.Time { return now }
+
+		require.NoError(t, engine.SetEx("key1", "value1", 10*time.Second))
+		require.NoError(t, engine.Set("key2", "value2"))
+		assert.ErrorIs(t, engine.SetEx("key3", "value3", 0), ErrInvalidTTL)
+
+		ttl, exists := engine.TTL("key1")
+		assert.True(t, exists)
+		assert.Equal(t, 10*time.Second, ttl)
+
+		ttl, exists = engine.TTL("key2")
+		assert.True(t, exists)
+		assert.Equal(t, NoExpiration, ttl)
+
+		_, exists = engine.TTL("missing")
+		assert.False(t, exists)
+
+		ok, err := engine.Expire("key2", 5*time.Second)
+		require.NoError(t, err)
+		assert.True(t, ok)
+
+		ok, err = engine.Persist("key1")
+		require.NoError(t, err)
+		assert.True(t, ok)
+
+		ok, err = engine.Expire("missing", time.Second)
+		require.NoError(t, err)
+		assert.False(t, ok)
+
+		// key2 expires lazily on access
+		now = now.Add(5 * time.Second)
+		_, exists = engine.Get("key2")
+		assert.False(t, exists)
+		_, exists = engine.Get("key1")
+		assert.True(t, exists)
+
+		ok, err = engine.Persist("key2")
+		require.NoError(t, err)
+		assert.False(t, ok)
+
+		// A non-positive ttl deletes the key
+		ok, err = engine.Expire("key1", 0)
+		require.NoError(t, err)
+		assert.True(t, ok)
+		_, exists = engine.Get("key1")
+		assert.False(t, exists)
+	})
+
+	t.Run("Expire races with a delete", func(t *testing.T) {
+		logger, mockWAL := setupTest(t)
+		wal := &hookWAL{MockWAL: mockWAL}
+		engine, err := NewEngine(logger, wal, nil)
+		require.NoError(t, err)
+
+		require.NoError(t, engine.Set("key", "value"))
+
+		// The key is deleted between the existence check and the apply
+		wal.before = func(entry.Entry) { engine.getPartition("key").delete("key", 0) }
+		ok, err := engine.Expire("key", time.Hour)
+		require.NoError(t, err)
+		assert.False(t, ok)
+
+		_, exists := engine.TTL("key")
+		assert.False(t, exists)
+	})
+
+	t.Run("Expiration sweep", func(t *testing.T) {
+		logger, mockWAL := setupTest(t)
+		engine, err := NewEngine(logger, mockWAL, nil)
+		require.NoError(t, err)
+
+		now := time.Unix(1000, 0)
+		engine.now = func() time.Time { return now }
+
+		require.NoError(t, engine.SetEx("key1", "value1", time.Second))
+		require.NoError(t, engine.Set("key2", "value2"))
+
+		p := engine.getPartition("key1")
+		assert.Equal(t, 0, p.sweep(now.UnixNano()))
+		assert.Equal(t, 1, p.sweep(now.Add(time.Second).UnixNano()))
+
+		p.mu.RLock()
+		_, exists := p.data["key1"]
+		p.mu.RUnlock()
+		assert.False(t, exists)
+	})
+
+	t.Run("Recovery does not resurrect expired keys", func(t *testing.T) {
+		logger, mockWAL := setupTest(t)
+		past := time.Now().Add(-time.Minute).UnixNano()
+		future := time.Now().Add(time.Hour).UnixNano()
+		mockWAL.Entries = []*entry.Entry{
+			{Operation: entry.OperationSet, Key: "expired", Value: "value"},
+			{Operation: entry.OperationSet, Key: "expiring", Value: "value", ExpiresAt: future},
+			{Operation: entry.OperationExpire, Key: "expired", ExpiresAt: past},
+			{Operation: entry.OperationSet, Key: "stale", Value: "value", ExpiresAt: past},
+		}
+
+		engine, err := NewEngine(logger, mockWAL, nil)
+		require.NoError(t, err)
+
+		_, exists := engine.Get("expired")
+		assert.False(t, exists)
+		_, exists = engine.Get("stale")
+		assert.False(t, exists)
+
+		ttl, exists := engine.TTL("expiring")
+		assert.True(t, exists)
+		assert.Greater(t, ttl, 59*time.Minute)
+	})
+
+	t.Run("Snapshot keeps expiration", func(t *testing.T) {
+		logger, mockWAL := setupTest(t)
+		store := snapshot.New(config.WALConfig{Enabled: true, DataDirectory: t.TempDir()})
+		engine, err := NewEngine(logger, mockWAL, store)
+		require.NoError(t, err)
+
+		require.NoError(t, engine.SetEx("key1", "value1", time.Hour))
+		require.NoError(t, engine.Snapshot())
+
+		restored, err := NewEngine(logger, mocks.NewMockWAL(), store)
+		require.NoError(t, err)
+		ttl, exists := restored.TTL("key1")
+		assert.True(t, exists)
+		assert.Greater(t, ttl, 59*time.Minute)
+	})
+}
+
+// hookWAL is a WAL that calls before ahead of each write
+type hookWAL struct {
+	*mocks.MockWAL
+	before func(entry.Entry)
+}
+
+func (w *hookWAL) Write(e entry.Entry) (uint64, error) {
+	if w.before != nil {
+		w.before(e)
+	}
+
+	return w.MockWAL.Write(e)
 }
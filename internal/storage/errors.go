@@ -0,0 +1,11 @@
+package storage
+
+import "errors"
+
+var (
+	// ErrSnapshotsDisabled is an error that occurs when a snapshot is requested but snapshots are not enabled
+	ErrSnapshotsDisabled = errors.New("snapshots are disabled: WAL is not enabled on this node")
+
+	// ErrInvalidTTL is an error that occurs when a key is set with a non-positive time to live
+	ErrInvalidTTL = errors.New("invalid time to live")
+)
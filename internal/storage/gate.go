@@ -0,0 +1,15 @@
+package storage
+
+// WriteGate is passed by each write before it reaches the WAL. A write the
+// gate rejects fails with its error; otherwise end is called once the write
+// is applied, before the write waits for the replicas.
+type WriteGate func() (end func(), err error)
+
+// beginWrite passes the gate of a write; without a gate every write passes
+func beginWrite(gate WriteGate) (end func(), err error) {
+	if gate == nil {
+		return func() {}, nil
+	}
+
+	return gate()
+}
@@ -0,0 +1,78 @@
+package lsm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/8thgencore/valchemy/internal/wal/segment"
+)
+
+const manifestName = "MANIFEST"
+
+// manifest describes the live tables of the tree and the WAL position
+// their content is consistent with
+type manifest struct {
+	Tables       []string `json:"tables"`
+	NextFile     uint64   `json:"next_file"`
+	WALSegmentID int64    `json:"wal_segment_id"`
+	WALOffset    int64    `json:"wal_offset"`
+}
+
+func (m *manifest) position() segment.Position {
+	return segment.Position{SegmentID: m.WALSegmentID, Offset: m.WALOffset}
+}
+
+// readManifest reads the manifest of the directory. A missing manifest
+// describes an empty tree.
+func readManifest(directory string) (*manifest, error) {
+	data, err := os.ReadFile(filepath.Join(directory, manifestName))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &manifest{NextFile: 1}, nil
+		}
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	m := &manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+
+	return m, nil
+}
+
+// writeManifest replaces the manifest atomically
+func writeManifest(directory string, m *manifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+
+	path := filepath.Join(directory, manifestName)
+	tmpPath := path + ".tmp"
+
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create manifest: %w", err)
+	}
+	if _, err := file.Write(data); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to sync manifest: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close manifest: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to rename manifest: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package lsm
+
+import "sort"
+
+// recordOverhead approximates the memory used by a record besides its key and value
+const recordOverhead = 32
+
+// record is a value or a deletion marker (tombstone) for a key
+type record struct {
+	key     string
+	value   string
+	deleted bool
+	// expiresAt is the expiration time in Unix nanoseconds, zero if the value does not expire
+	expiresAt int64
+}
+
+// expired reports whether the record holds a value that expired at now
+func (r record) expired(now int64) bool {
+	return r.expiresAt != 0 && r.expiresAt <= now
+}
+
+// memtable holds the most recent writes in memory until they are flushed
+type memtable struct {
+	data map[string]record
+	size uint64
+}
+
+func newMemtable() *memtable {
+	return &memtable{
+		data: make(map[string]record),
+	}
+}
+
+func (m *memtable) put(r record) {
+	if old, ok := m.data[r.key]; ok {
+		m.size -= recordSize(old)
+	}
+	m.data[r.key] = r
+	m.size += recordSize(r)
+}
+
+func (m *memtable) get(key string) (record, bool) {
+	r, ok := m.data[key]
+	return r, ok
+}
+
+func (m *memtable) len() int {
+	return len(m.data)
+}
+
+// sorted returns the records ordered by key
+func (m *memtable) sorted() []record {
+	records := make([]record, 0, len(m.data))
+	for _, r := range m.data {
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].key < records[j].key
+	})
+
+	return records
+}
+
+func recordSize(r record) uint64 {
+	return uint64(len(r.key)+len(r.value)) + recordOverhead
+}
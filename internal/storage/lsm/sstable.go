@@ -0,0 +1,354 @@
+package lsm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	// indexInterval is the number of records between sparse index entries
+	indexInterval = 16
+
+	footerSize = 24
+	tableMagic = uint64(0x5641_4c43_5353_5401) // "VALCSST" + format version 1
+
+	flagValue     byte = 0
+	flagTombstone byte = 1
+	// flagExpiring marks a value followed by its expiration time
+	flagExpiring byte = 2
+)
+
+// ErrCorruptTable returned when an SSTable file is malformed
+var ErrCorruptTable = errors.New("corrupt SSTable")
+
+// indexEntry points to the record that starts a block of the table
+type indexEntry struct {
+	key    string
+	offset int64
+}
+
+// table is an immutable sorted file of records. Layout:
+// records | index (count, then key and offset of every block) | footer
+// (index offset, record count, magic). Only the sparse index is kept in memory.
+type table struct {
+	name        string
+	file        *os.File
+	index       []indexEntry
+	indexOffset int64
+	count       uint64
+}
+
+// tableWriter writes records in key order to a new table file
+type tableWriter struct {
+	file   *os.File
+	writer *bufio.Writer
+	offset int64
+	count  uint64
+	index  []indexEntry
+}
+
+func newTableWriter(path string) (*tableWriter, error) {
+	file, err := os.OpenFile(filepath.Clean(path), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create table file: %w", err)
+	}
+
+	return &tableWriter{
+		file:   file,
+		writer: bufio.NewWriter(file),
+	}, nil
+}
+
+// add appends a record; records must be added in increasing key order
+func (w *tableWriter) add(r record) error {
+	if w.count%indexInterval == 0 {
+		w.index = append(w.index, indexEntry{key: r.key, offset: w.offset})
+	}
+
+	n, err := writeRecord(w.writer, r)
+	if err != nil {
+		return fmt.Errorf("failed to write record: %w", err)
+	}
+	w.offset += n
+	w.count++
+
+	return nil
+}
+
+// finish writes the index and the footer and syncs the file
+func (w *tableWriter) finish() error {
+	buf := binary.LittleEndian.AppendUint32(nil, uint32(len(w.index)))
+	for _, e := range w.index {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(e.key)))
+		buf = append(buf, e.key...)
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(e.offset))
+	}
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(w.offset))
+	buf = binary.LittleEndian.AppendUint64(buf, w.count)
+	buf = binary.LittleEndian.AppendUint64(buf, tableMagic)
+	if _, err := w.writer.Write(buf); err != nil {
+		return fmt.Errorf("failed to write table index: %w", err)
+	}
+
+	if err := w.writer.Flush(); err != nil {
+		return fmt.Errorf("failed to flush table file: %w", err)
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync table file: %w", err)
+	}
+
+	return w.file.Close()
+}
+
+// abort closes and removes an unfinished table file
+func (w *tableWriter) abort() {
+	_ = w.file.Close()
+	_ = os.Remove(w.file.Name())
+}
+
+// writeTable writes the sorted records to a new table file
+func writeTable(path string, records []record) error {
+	w, err := newTableWriter(path)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range records {
+		if err := w.add(r); err != nil {
+			w.abort()
+			return err
+		}
+	}
+
+	if err := w.finish(); err != nil {
+		w.abort()
+		return err
+	}
+
+	return nil
+}
+
+// openTable opens a table file and loads its sparse index
+func openTable(directory, name string) (*table, error) {
+	file, err := os.Open(filepath.Clean(filepath.Join(directory, name)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open table %s: %w", name, err)
+	}
+
+	t, err := loadTable(file, name)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func loadTable(file *os.File, name string) (*table, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat table %s: %w", name, err)
+	}
+	if info.Size() < footerSize {
+		return nil, fmt.Errorf("%w: %s is too small", ErrCorruptTable, name)
+	}
+
+	footer := make([]byte, footerSize)
+	if _, err := file.ReadAt(footer, info.Size()-footerSize); err != nil {
+		return nil, fmt.Errorf("failed to read footer of table %s: %w", name, err)
+	}
+	if binary.LittleEndian.Uint64(footer[16:24]) != tableMagic {
+		return nil, fmt.Errorf("%w: %s has invalid magic", ErrCorruptTable, name)
+	}
+
+	t := &table{
+		name:        name,
+		file:        file,
+		indexOffset: int64(binary.LittleEndian.Uint64(footer[0:8])),
+		count:       binary.LittleEndian.Uint64(footer[8:16]),
+	}
+	indexEnd := info.Size() - footerSize
+	if t.indexOffset < 0 || t.indexOffset > indexEnd {
+		return nil, fmt.Errorf("%w: %s has invalid index offset", ErrCorruptTable, name)
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(file, t.indexOffset, indexEnd-t.indexOffset))
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(reader, buf[:4]); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrCorruptTable, name, err)
+	}
+	count := binary.LittleEndian.Uint32(buf[:4])
+	for i := uint32(0); i < count; i++ {
+		key, err := readString(reader, uint64(indexEnd))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrCorruptTable, name, err)
+		}
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrCorruptTable, name, err)
+		}
+		t.index = append(t.index, indexEntry{key: key, offset: int64(binary.LittleEndian.Uint64(buf))})
+	}
+
+	return t, nil
+}
+
+// get looks up a key by scanning the single block that may contain it
+func (t *table) get(key string) (record, bool, error) {
+	i := sort.Search(len(t.index), func(i int) bool {
+		return t.index[i].key > key
+	}) - 1
+	if i < 0 {
+		return record{}, false, nil
+	}
+
+	end := t.indexOffset
+	if i+1 < len(t.index) {
+		end = t.index[i+1].offset
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(t.file, t.index[i].offset, end-t.index[i].offset))
+	for {
+		r, err := readRecord(reader, uint64(t.indexOffset))
+		if err == io.EOF {
+			return record{}, false, nil
+		}
+		if err != nil {
+			return record{}, false, fmt.Errorf("%w: %s: %v", ErrCorruptTable, t.name, err)
+		}
+		if r.key == key {
+			return r, true, nil
+		}
+		if r.key > key {
+			return record{}, false, nil
+		}
+	}
+}
+
+// iterator returns a sequential reader over all records of the table
+func (t *table) iterator() *tableIterator {
+	return &tableIterator{
+		table:  t,
+		reader: bufio.NewReader(io.NewSectionReader(t.file, 0, t.indexOffset)),
+	}
+}
+
+func (t *table) close() error {
+	return t.file.Close()
+}
+
+// tableIterator reads the records of a table in key order
+type tableIterator struct {
+	table   *table
+	reader  *bufio.Reader
+	current record
+	valid   bool
+	err     error
+}
+
+// next advances the iterator and reports whether a record is available
+func (it *tableIterator) next() bool {
+	r, err := readRecord(it.reader, uint64(it.table.indexOffset))
+	if err != nil {
+		if err != io.EOF {
+			it.err = fmt.Errorf("%w: %s: %v", ErrCorruptTable, it.table.name, err)
+		}
+		it.valid = false
+		return false
+	}
+	it.current = r
+	it.valid = true
+
+	return true
+}
+
+func writeRecord(w io.Writer, r record) (int64, error) {
+	flag := flagValue
+	switch {
+	case r.deleted:
+		flag = flagTombstone
+	case r.expiresAt != 0:
+		flag = flagExpiring
+	}
+
+	buf := make([]byte, 0, 17+len(r.key)+len(r.value))
+	buf = append(buf, flag)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(r.key)))
+	buf = append(buf, r.key...)
+	if !r.deleted {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(r.value)))
+		buf = append(buf, r.value...)
+	}
+	if flag == flagExpiring {
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(r.expiresAt))
+	}
+
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+func readRecord(r io.Reader, maxLen uint64) (record, error) {
+	flag := make([]byte, 1)
+	if _, err := io.ReadFull(r, flag); err != nil {
+		return record{}, err
+	}
+
+	key, err := readString(r, maxLen)
+	if err != nil {
+		return record{}, unexpected(err)
+	}
+
+	switch flag[0] {
+	case flagTombstone:
+		return record{key: key, deleted: true}, nil
+	case flagValue, flagExpiring:
+		value, err := readString(r, maxLen)
+		if err != nil {
+			return record{}, unexpected(err)
+		}
+		rec := record{key: key, value: value}
+		if flag[0] == flagExpiring {
+			buf := make([]byte, 8)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return record{}, unexpected(err)
+			}
+			rec.expiresAt = int64(binary.LittleEndian.Uint64(buf))
+		}
+		return rec, nil
+	default:
+		return record{}, fmt.Errorf("unknown record flag %d", flag[0])
+	}
+}
+
+func readString(r io.Reader, maxLen uint64) (string, error) {
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+
+	length := binary.LittleEndian.Uint32(buf)
+	if uint64(length) > maxLen {
+		return "", fmt.Errorf("string length %d exceeds table size", length)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// unexpected converts io.EOF in the middle of a record into io.ErrUnexpectedEOF
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
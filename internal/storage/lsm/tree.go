@@ -0,0 +1,562 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/8thgencore/valchemy/internal/wal/entry"
+	"github.com/8thgencore/valchemy/internal/wal/segment"
+	"github.com/8thgencore/valchemy/pkg/logger/sl"
+)
+
+// compactionThreshold is the number of tables that triggers a full compaction
+const compactionThreshold = 8
+
+// ErrTreeClosed returned when operating on a closed tree
+var ErrTreeClosed = errors.New("LSM tree is closed")
+
+// Tree is a log-structured merge tree. Writes go to an in-memory memtable
+// that is flushed to immutable sorted tables on disk when it grows beyond
+// the configured size. Lookups check the memtables and then the tables from
+// the newest to the oldest.
+type Tree struct {
+	log          *slog.Logger
+	directory    string
+	memtableSize uint64
+
+	mu       sync.RWMutex
+	active   *memtable
+	frozen   *memtable
+	tables   []*table // ordered from the oldest to the newest
+	manifest *manifest
+	// epoch changes on Clear so that a running compaction can detect it
+	epoch      uint64
+	compacting bool
+	closed     bool
+
+	// manifestMu serializes manifest updates
+	manifestMu sync.Mutex
+	compaction sync.WaitGroup
+}
+
+// Open opens the tree stored in the directory, creating it if needed
+func Open(log *slog.Logger, directory string, memtableSize uint64) (*Tree, error) {
+	if err := os.MkdirAll(directory, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create engine directory: %w", err)
+	}
+
+	m, err := readManifest(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Tree{
+		log:          log,
+		directory:    directory,
+		memtableSize: memtableSize,
+		active:       newMemtable(),
+		manifest:     m,
+	}
+
+	for _, name := range m.Tables {
+		tbl, err := openTable(directory, name)
+		if err != nil {
+			_ = t.closeTables()
+			return nil, err
+		}
+		t.tables = append(t.tables, tbl)
+	}
+
+	if err := t.removeOrphans(); err != nil {
+		_ = t.closeTables()
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// Position returns the WAL position the flushed tables are consistent with
+func (t *Tree) Position() segment.Position {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.manifest.position()
+}
+
+// Get returns the value of a key and its expiration time in Unix
+// nanoseconds, zero if the value does not expire. Expired values are
+// returned as well; it is up to the caller to compare the time.
+func (t *Tree) Get(key string) (string, int64, bool, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	r, ok, err := t.lookup(key)
+	if err != nil || !ok || r.deleted {
+		return "", 0, false, err
+	}
+
+	return r.value, r.expiresAt, true, nil
+}
+
+// Value is the value of a key read by GetMany
+type Value struct {
+	Value string
+	// ExpiresAt is the expiration time in Unix nanoseconds, zero if the
+	// value does not expire
+	ExpiresAt int64
+	Found     bool
+}
+
+// GetMany looks up several keys under one lock, so that the values are
+// consistent with each other with respect to Apply. Expired values are
+// returned as well, like Get does.
+func (t *Tree) GetMany(keys []string) ([]Value, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	values := make([]Value, len(keys))
+	for i, key := range keys {
+		r, ok, err := t.lookup(key)
+		if err != nil {
+			return nil, err
+		}
+		if ok && !r.deleted {
+			values[i] = Value{Value: r.value, ExpiresAt: r.expiresAt, Found: true}
+		}
+	}
+
+	return values, nil
+}
+
+// lookup finds the newest record of a key; t.mu must be held
+func (t *Tree) lookup(key string) (record, bool, error) {
+	if r, ok := t.active.get(key); ok {
+		return r, true, nil
+	}
+	if t.frozen != nil {
+		if r, ok := t.frozen.get(key); ok {
+			return r, true, nil
+		}
+	}
+
+	for i := len(t.tables) - 1; i >= 0; i-- {
+		r, ok, err := t.tables[i].get(key)
+		if err != nil || ok {
+			return r, ok, err
+		}
+	}
+
+	return record{}, false, nil
+}
+
+// Put sets the value of a key with an expiration time in Unix nanoseconds,
+// zero for a value that does not expire
+func (t *Tree) Put(key, value string, expiresAt int64) {
+	t.mu.Lock()
+	t.active.put(record{key: key, value: value, expiresAt: expiresAt})
+	t.mu.Unlock()
+}
+
+// Expire changes the expiration time of a key that exists and has not
+// expired at now; zero makes the value persistent. Returns false if there is
+// no such key.
+func (t *Tree) Expire(key string, expiresAt, now int64) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.expireLocked(key, expiresAt, now)
+}
+
+// expireLocked changes the expiration time of a key; t.mu must be held
+func (t *Tree) expireLocked(key string, expiresAt, now int64) (bool, error) {
+	r, ok, err := t.lookup(key)
+	if err != nil || !ok || r.deleted || r.expired(now) {
+		return false, err
+	}
+
+	r.expiresAt = expiresAt
+	t.active.put(r)
+
+	return true, nil
+}
+
+// Delete removes a key by writing a tombstone
+func (t *Tree) Delete(key string) {
+	t.mu.Lock()
+	t.active.put(record{key: key, deleted: true})
+	t.mu.Unlock()
+}
+
+// Apply applies SET, EXPIRE and DELETE entries under one lock, so that
+// readers see either none or all of them, and returns the number of DELETE
+// entries whose key existed and had not expired at now. An entry that expired
+// at now deletes its key, which must not be resurrected. A lookup that fails
+// does not stop the other entries; the errors are returned together.
+func (t *Tree) Apply(entries []entry.Entry, now int64) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	deleted := 0
+	var errs error
+	for i := range entries {
+		el := &entries[i]
+		switch {
+		case el.Operation == entry.OperationDelete:
+			r, ok, err := t.lookup(el.Key)
+			if err != nil {
+				errs = errors.Join(errs, fmt.Errorf("failed to look up %q: %w", el.Key, err))
+			} else if ok && !r.deleted && !r.expired(now) {
+				deleted++
+			}
+			t.active.put(record{key: el.Key, deleted: true})
+		case (el.Operation == entry.OperationSet || el.Operation == entry.OperationExpire) && el.Expired(now):
+			t.active.put(record{key: el.Key, deleted: true})
+		case el.Operation == entry.OperationSet:
+			t.active.put(record{key: el.Key, value: el.Value, expiresAt: el.ExpiresAt})
+		case el.Operation == entry.OperationExpire:
+			if _, err := t.expireLocked(el.Key, el.ExpiresAt, now); err != nil {
+				errs = errors.Join(errs, fmt.Errorf("failed to expire %q: %w", el.Key, err))
+			}
+		}
+	}
+
+	return deleted, errs
+}
+
+// Clear removes all data from the memtables and the disk
+func (t *Tree) Clear() error {
+	t.manifestMu.Lock()
+	defer t.manifestMu.Unlock()
+
+	t.mu.Lock()
+	m := t.manifest.clone()
+	m.Tables = nil
+	if err := writeManifest(t.directory, m); err != nil {
+		t.mu.Unlock()
+		return err
+	}
+	old := t.tables
+	t.active = newMemtable()
+	t.frozen = nil
+	t.tables = nil
+	t.manifest = m
+	t.epoch++
+	t.mu.Unlock()
+
+	return t.dropTables(old)
+}
+
+// ShouldFlush reports whether the active memtable has reached its size limit
+func (t *Tree) ShouldFlush() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.active.size >= t.memtableSize
+}
+
+// HasFrozen reports whether a frozen memtable is waiting to be flushed
+func (t *Tree) HasFrozen() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.frozen != nil
+}
+
+// Freeze makes the active memtable immutable and starts a new one.
+// It returns false if there is nothing to flush or a frozen memtable
+// has not been flushed yet.
+func (t *Tree) Freeze() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.frozen != nil || t.active.len() == 0 {
+		return false
+	}
+	t.frozen = t.active
+	t.active = newMemtable()
+
+	return true
+}
+
+// FlushFrozen writes the frozen memtable to a new table and records the WAL
+// position covered by it
+func (t *Tree) FlushFrozen(pos segment.Position) error {
+	t.manifestMu.Lock()
+	defer t.manifestMu.Unlock()
+
+	t.mu.Lock()
+	frozen := t.frozen
+	if frozen == nil {
+		t.mu.Unlock()
+		return nil
+	}
+	name := t.nextTableName()
+	t.mu.Unlock()
+
+	path := filepath.Join(t.directory, name)
+	if err := writeTable(path, frozen.sorted()); err != nil {
+		return err
+	}
+	tbl, err := openTable(t.directory, name)
+	if err != nil {
+		_ = os.Remove(path)
+		return err
+	}
+
+	t.mu.Lock()
+	m := t.manifest.clone()
+	m.Tables = append(m.Tables, name)
+	m.WALSegmentID = pos.SegmentID
+	m.WALOffset = pos.Offset
+	if err := writeManifest(t.directory, m); err != nil {
+		t.mu.Unlock()
+		_ = tbl.close()
+		_ = os.Remove(path)
+		return err
+	}
+	t.tables = append(t.tables, tbl)
+	t.frozen = nil
+	t.manifest = m
+	startCompaction := len(t.tables) >= compactionThreshold && !t.compacting && !t.closed
+	if startCompaction {
+		t.compacting = true
+		t.compaction.Add(1)
+	}
+	t.mu.Unlock()
+
+	if startCompaction {
+		go t.compact()
+	}
+
+	return nil
+}
+
+// Close waits for a running compaction and closes the table files.
+// Data in the memtables that was not flushed is discarded; it is
+// recovered from the WAL on the next start.
+func (t *Tree) Close() error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return ErrTreeClosed
+	}
+	t.closed = true
+	t.mu.Unlock()
+
+	t.compaction.Wait()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.closeTables()
+}
+
+// compact merges all current tables into one, dropping overwritten values
+// and tombstones
+func (t *Tree) compact() {
+	defer t.compaction.Done()
+	defer func() {
+		t.mu.Lock()
+		t.compacting = false
+		t.mu.Unlock()
+	}()
+
+	t.mu.Lock()
+	inputs := append([]*table(nil), t.tables...)
+	epoch := t.epoch
+	name := t.nextTableName()
+	t.mu.Unlock()
+
+	path := filepath.Join(t.directory, name)
+	if err := mergeTables(path, inputs, time.Now().UnixNano()); err != nil {
+		t.log.Error("Failed to compact tables", sl.Err(err))
+		return
+	}
+	output, err := openTable(t.directory, name)
+	if err != nil {
+		t.log.Error("Failed to open compacted table", sl.Err(err))
+		_ = os.Remove(path)
+		return
+	}
+
+	if err := t.installCompacted(output, inputs, epoch); err != nil {
+		t.log.Error("Failed to install compacted table", sl.Err(err))
+		_ = output.close()
+		_ = os.Remove(path)
+		return
+	}
+
+	if err := t.dropTables(inputs); err != nil {
+		t.log.Error("Failed to remove compacted tables", sl.Err(err))
+	}
+
+	t.log.Info("Compacted tables", "inputs", len(inputs), "output", name, "records", output.count)
+}
+
+// installCompacted replaces the compacted tables with the output table
+func (t *Tree) installCompacted(output *table, inputs []*table, epoch uint64) error {
+	t.manifestMu.Lock()
+	defer t.manifestMu.Unlock()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.epoch != epoch {
+		return errors.New("tree changed during compaction")
+	}
+
+	// Tables flushed during the compaction are newer than the merged ones
+	newer := t.tables[len(inputs):]
+	m := t.manifest.clone()
+	m.Tables = []string{output.name}
+	for _, tbl := range newer {
+		m.Tables = append(m.Tables, tbl.name)
+	}
+	if err := writeManifest(t.directory, m); err != nil {
+		return err
+	}
+
+	t.tables = append([]*table{output}, newer...)
+	t.manifest = m
+
+	return nil
+}
+
+// mergeTables merges the tables into a new table holding only live records,
+// dropping the values expired at now. For duplicate keys the record from the
+// newest table wins.
+func mergeTables(path string, tables []*table, now int64) error {
+	iterators := make([]*tableIterator, len(tables))
+	for i, tbl := range tables {
+		iterators[i] = tbl.iterator()
+		iterators[i].next()
+	}
+
+	w, err := newTableWriter(path)
+	if err != nil {
+		return err
+	}
+
+	for {
+		// Tables are ordered from the oldest to the newest, so on equal keys
+		// the last matching iterator holds the newest record
+		newest := -1
+		for i, it := range iterators {
+			if !it.valid {
+				continue
+			}
+			if newest < 0 || it.current.key <= iterators[newest].current.key {
+				newest = i
+			}
+		}
+		if newest < 0 {
+			break
+		}
+
+		r := iterators[newest].current
+		for _, it := range iterators {
+			for it.valid && it.current.key == r.key {
+				it.next()
+			}
+		}
+		if r.deleted || r.expired(now) {
+			continue
+		}
+		if err := w.add(r); err != nil {
+			w.abort()
+			return err
+		}
+	}
+
+	for _, it := range iterators {
+		if it.err != nil {
+			w.abort()
+			return it.err
+		}
+	}
+
+	if err := w.finish(); err != nil {
+		w.abort()
+		return err
+	}
+
+	return nil
+}
+
+// nextTableName allocates a file name for a new table; t.mu must be held
+func (t *Tree) nextTableName() string {
+	name := tableName(t.manifest.NextFile)
+	t.manifest.NextFile++
+
+	return name
+}
+
+// dropTables closes and deletes tables that are no longer referenced
+func (t *Tree) dropTables(tables []*table) error {
+	var errs []error
+	for _, tbl := range tables {
+		if err := tbl.close(); err != nil {
+			errs = append(errs, err)
+		}
+		if err := os.Remove(filepath.Join(t.directory, tbl.name)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// removeOrphans deletes table files left by an interrupted flush or compaction
+func (t *Tree) removeOrphans() error {
+	files, err := os.ReadDir(t.directory)
+	if err != nil {
+		return fmt.Errorf("failed to read engine directory: %w", err)
+	}
+
+	live := make(map[string]bool, len(t.manifest.Tables))
+	for _, name := range t.manifest.Tables {
+		live[name] = true
+	}
+
+	for _, f := range files {
+		name := f.Name()
+		if strings.HasSuffix(name, tableSuffix) && !live[name] {
+			if err := os.Remove(filepath.Join(t.directory, name)); err != nil {
+				return fmt.Errorf("failed to remove orphan table %s: %w", name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (t *Tree) closeTables() error {
+	var errs []error
+	for _, tbl := range t.tables {
+		if err := tbl.close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	t.tables = nil
+
+	return errors.Join(errs...)
+}
+
+const tableSuffix = ".sst"
+
+func tableName(n uint64) string {
+	return fmt.Sprintf("%06d%s", n, tableSuffix)
+}
+
+func (m *manifest) clone() *manifest {
+	c := *m
+	c.Tables = append([]string(nil), m.Tables...)
+
+	return &c
+}
@@ -0,0 +1,275 @@
+package lsm
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/8thgencore/valchemy/internal/wal/entry"
+	"github.com/8thgencore/valchemy/internal/wal/segment"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupTree(t *testing.T, dir string) *Tree {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	tree, err := Open(logger, dir, 1024)
+	require.NoError(t, err)
+
+	return tree
+}
+
+func flush(t *testing.T, tree *Tree, pos segment.Position) {
+	t.Helper()
+	require.True(t, tree.Freeze())
+	require.NoError(t, tree.FlushFrozen(pos))
+}
+
+func TestTree(t *testing.T) {
+	t.Run("memtable operations", func(t *testing.T) {
+		tree := setupTree(t, t.TempDir())
+		defer tree.Close()
+
+		tree.Put("key1", "value1", 0)
+		value, _, ok, err := tree.Get("key1")
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, "value1", value)
+
+		tree.Delete("key1")
+		_, _, ok, err = tree.Get("key1")
+		require.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("flush and reopen", func(t *testing.T) {
+		dir := t.TempDir()
+		tree := setupTree(t, dir)
+
+		for i := 0; i < 100; i++ {
+			tree.Put(fmt.Sprintf("key%03d", i), fmt.Sprintf("value%d", i), 0)
+		}
+		pos := segment.Position{SegmentID: 7, Offset: 42}
+		flush(t, tree, pos)
+
+		// Data not flushed is lost on close
+		tree.Put("unflushed", "value", 0)
+		require.NoError(t, tree.Close())
+
+		tree = setupTree(t, dir)
+		defer tree.Close()
+
+		assert.Equal(t, pos, tree.Position())
+		for i := 0; i < 100; i++ {
+			value, _, ok, err := tree.Get(fmt.Sprintf("key%03d", i))
+			require.NoError(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, fmt.Sprintf("value%d", i), value)
+		}
+		_, _, ok, err := tree.Get("unflushed")
+		require.NoError(t, err)
+		assert.False(t, ok)
+		_, _, ok, err = tree.Get("missing")
+		require.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("newer tables shadow older ones", func(t *testing.T) {
+		tree := setupTree(t, t.TempDir())
+		defer tree.Close()
+
+		tree.Put("key1", "old", 0)
+		tree.Put("key2", "value2", 0)
+		flush(t, tree, segment.Position{})
+
+		tree.Put("key1", "new", 0)
+		tree.Delete("key2")
+		flush(t, tree, segment.Position{})
+
+		value, _, ok, err := tree.Get("key1")
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, "new", value)
+
+		_, _, ok, err = tree.Get("key2")
+		require.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("compaction", func(t *testing.T) {
+		dir := t.TempDir()
+		tree := setupTree(t, dir)
+
+		for i := 0; i < compactionThreshold; i++ {
+			tree.Put("shared", fmt.Sprintf("value%d", i), 0)
+			tree.Put(fmt.Sprintf("key%d", i), "value", 0)
+			if i > 0 {
+				tree.Delete(fmt.Sprintf("key%d", i-1))
+			}
+			flush(t, tree, segment.Position{})
+		}
+
+		// Close waits for the compaction started by the last flush
+		require.NoError(t, tree.Close())
+
+		tree = setupTree(t, dir)
+		defer tree.Close()
+
+		assert.Len(t, tree.tables, 1)
+		value, _, ok, err := tree.Get("shared")
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, fmt.Sprintf("value%d", compactionThreshold-1), value)
+
+		_, _, ok, err = tree.Get("key0")
+		require.NoError(t, err)
+		assert.False(t, ok)
+		_, _, ok, err = tree.Get(fmt.Sprintf("key%d", compactionThreshold-1))
+		require.NoError(t, err)
+		assert.True(t, ok)
+
+		files, err := filepath.Glob(filepath.Join(dir, "*"+tableSuffix))
+		require.NoError(t, err)
+		assert.Len(t, files, 1)
+	})
+
+	t.Run("clear", func(t *testing.T) {
+		dir := t.TempDir()
+		tree := setupTree(t, dir)
+
+		tree.Put("key1", "value1", 0)
+		flush(t, tree, segment.Position{})
+		tree.Put("key2", "value2", 0)
+
+		require.NoError(t, tree.Clear())
+		_, _, ok, err := tree.Get("key1")
+		require.NoError(t, err)
+		assert.False(t, ok)
+		_, _, ok, err = tree.Get("key2")
+		require.NoError(t, err)
+		assert.False(t, ok)
+		require.NoError(t, tree.Close())
+
+		files, err := filepath.Glob(filepath.Join(dir, "*"+tableSuffix))
+		require.NoError(t, err)
+		assert.Empty(t, files)
+	})
+
+	t.Run("expiration", func(t *testing.T) {
+		dir := t.TempDir()
+		tree := setupTree(t, dir)
+
+		tree.Put("expiring", "value", 100)
+		tree.Put("persistent", "value", 0)
+		flush(t, tree, segment.Position{})
+
+		// The expiration time survives the flush and the reopen
+		require.NoError(t, tree.Close())
+		tree = setupTree(t, dir)
+		defer tree.Close()
+
+		_, expiresAt, ok, err := tree.Get("expiring")
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, int64(100), expiresAt)
+
+		ok, err = tree.Expire("persistent", 200, 50)
+		require.NoError(t, err)
+		assert.True(t, ok)
+		_, expiresAt, _, err = tree.Get("persistent")
+		require.NoError(t, err)
+		assert.Equal(t, int64(200), expiresAt)
+
+		ok, err = tree.Expire("expiring", 0, 150)
+		require.NoError(t, err)
+		assert.False(t, ok, "expired key must not be revived")
+
+		ok, err = tree.Expire("missing", 200, 50)
+		require.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("apply and get many", func(t *testing.T) {
+		tree := setupTree(t, t.TempDir())
+		defer tree.Close()
+
+		tree.Put("deleted", "value", 0)
+		tree.Put("expiring", "value", 0)
+		deleted, err := tree.Apply([]entry.Entry{
+			{Operation: entry.OperationSet, Key: "key1", Value: "value1"},
+			{Operation: entry.OperationSet, Key: "key2", Value: "value2", ExpiresAt: 200},
+			{Operation: entry.OperationSet, Key: "stale", Value: "value", ExpiresAt: 50},
+			{Operation: entry.OperationDelete, Key: "deleted"},
+			{Operation: entry.OperationExpire, Key: "expiring", ExpiresAt: 300},
+			{Operation: entry.OperationExpire, Key: "missing", ExpiresAt: 300},
+			{Operation: entry.OperationDelete, Key: "stale"},
+			{Operation: entry.OperationDelete, Key: "missing"},
+		}, 100)
+		require.NoError(t, err)
+		assert.Equal(t, 1, deleted, "only deleted keys that existed are counted")
+
+		values, err := tree.GetMany([]string{"key1", "key2", "stale", "deleted", "expiring", "missing"})
+		require.NoError(t, err)
+		assert.Equal(t, []Value{
+			{Value: "value1", Found: true},
+			{Value: "value2", ExpiresAt: 200, Found: true},
+			{},
+			{},
+			{Value: "value", ExpiresAt: 300, Found: true},
+			{},
+		}, values)
+	})
+
+	t.Run("compaction drops expired values", func(t *testing.T) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, tableName(1))
+		require.NoError(t, writeTable(path, []record{
+			{key: "expired", value: "value", expiresAt: 100},
+			{key: "live", value: "value", expiresAt: 300},
+		}))
+		tbl, err := openTable(dir, tableName(1))
+		require.NoError(t, err)
+		defer tbl.close()
+
+		output := filepath.Join(dir, tableName(2))
+		require.NoError(t, mergeTables(output, []*table{tbl}, 200))
+		merged, err := openTable(dir, tableName(2))
+		require.NoError(t, err)
+		defer merged.close()
+
+		assert.Equal(t, uint64(1), merged.count)
+		r, ok, err := merged.get("live")
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, int64(300), r.expiresAt)
+	})
+
+	t.Run("orphan tables are removed", func(t *testing.T) {
+		dir := t.TempDir()
+		orphan := filepath.Join(dir, tableName(99))
+		require.NoError(t, writeTable(orphan, []record{{key: "key", value: "value"}}))
+
+		tree := setupTree(t, dir)
+		defer tree.Close()
+
+		_, err := os.Stat(orphan)
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("corrupted table", func(t *testing.T) {
+		dir := t.TempDir()
+		tree := setupTree(t, dir)
+		tree.Put("key1", "value1", 0)
+		flush(t, tree, segment.Position{})
+		require.NoError(t, tree.Close())
+
+		require.NoError(t, os.WriteFile(filepath.Join(dir, tableName(1)), []byte("garbage"), 0o600))
+
+		logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+		_, err := Open(logger, dir, 1024)
+		assert.ErrorIs(t, err, ErrCorruptTable)
+	})
+}
@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"sync"
+
+	"github.com/8thgencore/valchemy/internal/wal"
+	"github.com/8thgencore/valchemy/internal/wal/entry"
+	"github.com/8thgencore/valchemy/internal/wal/segment"
+)
+
+const (
+	// replayChunkSize is the number of entries handed to a replay worker at once
+	replayChunkSize = 256
+	// replayQueueSize is the number of chunks a replay worker can have queued
+	replayQueueSize = 4
+)
+
+// replayItem is an entry to apply to a partition
+type replayItem struct {
+	p  *partition
+	el *entry.Entry
+}
+
+// replayer applies the WAL entries read on startup to the partitions in
+// parallel. Every partition is owned by a single worker, so the entries of a
+// key are applied in WAL order. CLEAR records affect all partitions and act
+// as barriers: the queued entries are applied before the partitions are cleared.
+type replayer struct {
+	e   *Engine
+	now int64
+
+	queues []chan []replayItem
+	chunks [][]replayItem
+	// pending counts the chunks sent and not applied yet
+	pending sync.WaitGroup
+	workers sync.WaitGroup
+}
+
+// replay applies the WAL entries after the position with up to numWorkers
+// workers. The segments are decoded in order by the caller while the workers
+// apply the entries.
+func (e *Engine) replay(w wal.WAL, from segment.Position, numWorkers int) error {
+	now := e.now().UnixNano()
+
+	numWorkers = min(numWorkers, e.numShards)
+	if numWorkers <= 1 {
+		return w.Replay(from, func(el *entry.Entry) error {
+			e.apply(el, now)
+			return nil
+		})
+	}
+
+	r := &replayer{
+		e:      e,
+		now:    now,
+		queues: make([]chan []replayItem, numWorkers),
+		chunks: make([][]replayItem, numWorkers),
+	}
+	for i := range r.queues {
+		r.queues[i] = make(chan []replayItem, replayQueueSize)
+		r.chunks[i] = make([]replayItem, 0, replayChunkSize)
+		r.workers.Add(1)
+		go r.work(i)
+	}
+	defer r.close()
+
+	return w.Replay(from, func(el *entry.Entry) error {
+		r.apply(el)
+		return nil
+	})
+}
+
+// apply routes an entry to the workers owning the partitions it affects
+func (r *replayer) apply(el *entry.Entry) {
+	switch el.Operation {
+	case entry.OperationSet, entry.OperationExpire, entry.OperationDelete:
+		r.dispatch(el)
+	case entry.OperationBatch:
+		// Nothing reads the partitions yet, the batch needs no atomicity
+		for i := range el.Entries {
+			r.dispatch(&el.Entries[i])
+		}
+	case entry.OperationClear:
+		r.barrier()
+		for _, p := range r.e.partitions {
+			p.clear()
+		}
+	}
+}
+
+// dispatch adds an entry to the chunk of the worker owning its partition
+func (r *replayer) dispatch(el *entry.Entry) {
+	idx := r.e.partitionIndex(el.Key)
+	worker := idx % len(r.queues)
+
+	r.chunks[worker] = append(r.chunks[worker], replayItem{p: r.e.partitions[idx], el: el})
+	if len(r.chunks[worker]) == replayChunkSize {
+		r.send(worker)
+	}
+}
+
+// send hands the chunk of a worker over to it
+func (r *replayer) send(worker int) {
+	if len(r.chunks[worker]) == 0 {
+		return
+	}
+
+	r.pending.Add(1)
+	r.queues[worker] <- r.chunks[worker]
+	r.chunks[worker] = make([]replayItem, 0, replayChunkSize)
+}
+
+// barrier waits until all the entries dispatched so far are applied
+func (r *replayer) barrier() {
+	for i := range r.queues {
+		r.send(i)
+	}
+	r.pending.Wait()
+}
+
+// close applies the remaining entries and stops the workers
+func (r *replayer) close() {
+	r.barrier()
+	for _, queue := range r.queues {
+		close(queue)
+	}
+	r.workers.Wait()
+}
+
+// work applies the chunks of a worker. The locks of its partitions are taken
+// once per chunk rather than per entry.
+func (r *replayer) work(worker int) {
+	defer r.workers.Done()
+
+	var owned []*partition
+	for i := worker; i < len(r.e.partitions); i += len(r.queues) {
+		owned = append(owned, r.e.partitions[i])
+	}
+
+	for chunk := range r.queues[worker] {
+		for _, p := range owned {
+			p.mu.Lock()
+		}
+		for _, item := range chunk {
+			item.p.applyLocked(item.el, r.now)
+		}
+		for _, p := range owned {
+			p.mu.Unlock()
+		}
+		r.pending.Done()
+	}
+}
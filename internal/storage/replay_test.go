@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/8thgencore/valchemy/internal/wal/entry"
+	"github.com/8thgencore/valchemy/internal/wal/segment"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEngine_Replay(t *testing.T) {
+	// replayEntries returns entries overwriting, expiring and deleting keys of
+	// all partitions, with batches and a CLEAR in the middle
+	replayEntries := func() []*entry.Entry {
+		var entries []*entry.Entry
+		for i := 0; i < 2000; i++ {
+			key := fmt.Sprintf("key%d", i%300)
+			switch {
+			case i == 1000:
+				entries = append(entries, &entry.Entry{Operation: entry.OperationClear})
+			case i%7 == 0:
+				entries = append(entries, &entry.Entry{Operation: entry.OperationDelete, Key: key})
+			case i%11 == 0:
+				entries = append(entries, &entry.Entry{
+					Operation: entry.OperationExpire, Key: key, ExpiresAt: 1 << 62,
+				})
+			case i%13 == 0:
+				entries = append(entries, &entry.Entry{Operation: entry.OperationBatch, Entries: []entry.Entry{
+					{Operation: entry.OperationSet, Key: key, Value: fmt.Sprintf("batch%d", i)},
+					{Operation: entry.OperationDelete, Key: fmt.Sprintf("key%d", (i+1)%300)},
+				}})
+			default:
+				entries = append(entries, &entry.Entry{
+					Operation: entry.OperationSet, Key: key, Value: fmt.Sprintf("value%d", i),
+				})
+			}
+		}
+
+		return entries
+	}
+
+	t.Run("parallel replay matches serial apply", func(t *testing.T) {
+		logger, _ := setupTest(t)
+
+		expected, err := NewEngine(logger, nil, nil)
+		require.NoError(t, err)
+		defer expected.Close()
+		expected.ApplyEntries(replayEntries(), segment.Position{})
+
+		for _, workers := range []int{1, 3, defaultNumShards, 2 * defaultNumShards} {
+			_, mockWAL := setupTest(t)
+			mockWAL.Entries = replayEntries()
+
+			engine, err := NewEngine(logger, nil, nil)
+			require.NoError(t, err)
+			require.NoError(t, engine.replay(mockWAL, segment.Position{}, workers))
+
+			data, expires := engine.copyData()
+			expectedData, expectedExpires := expected.copyData()
+			assert.Equal(t, expectedData, data, "workers %d", workers)
+			assert.Equal(t, expectedExpires, expires, "workers %d", workers)
+			require.NoError(t, engine.Close())
+		}
+	})
+
+	t.Run("replay error", func(t *testing.T) {
+		logger, mockWAL := setupTest(t)
+		mockWAL.RecoverErr = errors.New("recover error")
+
+		engine, err := NewEngine(logger, nil, nil)
+		require.NoError(t, err)
+		defer engine.Close()
+
+		err = engine.replay(mockWAL, segment.Position{}, defaultNumShards)
+		assert.ErrorIs(t, err, mockWAL.RecoverErr)
+	})
+}
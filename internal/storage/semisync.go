@@ -0,0 +1,19 @@
+package storage
+
+// ReplicaWaiter waits for the replicas to acknowledge the WAL entries up to
+// a sequence number
+type ReplicaWaiter interface {
+	WaitForReplicas(lsn uint64) error
+}
+
+// waitReplicas waits for the replicas to acknowledge the entry of a write with
+// semi-synchronous replication. The wait happens after the write is applied
+// and its locks are released, so an error of the waiter does not undo the
+// write on this node. Without a WAL the write has no entry to wait for.
+func waitReplicas(replicas ReplicaWaiter, lsn uint64) error {
+	if replicas == nil || lsn == 0 {
+		return nil
+	}
+
+	return replicas.WaitForReplicas(lsn)
+}
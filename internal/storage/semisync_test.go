@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/8thgencore/valchemy/internal/config"
+	"github.com/8thgencore/valchemy/internal/wal/entry"
+	"github.com/8thgencore/valchemy/internal/wal/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testReplicaWaiter struct {
+	lsns []uint64
+	err  error
+}
+
+func (w *testReplicaWaiter) WaitForReplicas(lsn uint64) error {
+	w.lsns = append(w.lsns, lsn)
+	return w.err
+}
+
+// busyWAL is a WAL that accepts an entry of another writer right after each write
+type busyWAL struct {
+	*mocks.MockWAL
+}
+
+func (w *busyWAL) Write(e entry.Entry) (uint64, error) {
+	lsn, err := w.MockWAL.Write(e)
+	if err != nil {
+		return 0, err
+	}
+	_, err = w.MockWAL.Write(entry.Entry{Operation: entry.OperationSet, Key: "other"})
+
+	return lsn, err
+}
+
+func TestSemiSync(t *testing.T) {
+	logger, mockWAL := setupTest(t)
+	engine, err := NewEngine(logger, mockWAL, nil)
+	require.NoError(t, err)
+	defer engine.Close()
+
+	replicas := &testReplicaWaiter{}
+	engine.SetReplicaWaiter(replicas)
+
+	t.Run("writes wait for their entry", func(t *testing.T) {
+		require.NoError(t, engine.Set("key1", "value1"))
+		require.NoError(t, engine.MSet([]KeyValue{{Key: "key2", Value: "value2"}}))
+		updated, err := engine.Expire("key1", time.Hour)
+		require.NoError(t, err)
+		assert.True(t, updated)
+		deleted, err := engine.Delete("key2")
+		require.NoError(t, err)
+		assert.True(t, deleted)
+		assert.Equal(t, []uint64{1, 2, 3, 4}, replicas.lsns)
+	})
+
+	t.Run("no wait without a write", func(t *testing.T) {
+		replicas.lsns = nil
+
+		updated, err := engine.Persist("missing")
+		require.NoError(t, err)
+		assert.False(t, updated)
+		assert.ErrorIs(t, engine.SetEx("key", "value", 0), ErrInvalidTTL)
+		assert.Empty(t, replicas.lsns)
+	})
+
+	t.Run("failed wait keeps the write", func(t *testing.T) {
+		replicas.err = errors.New("timeout")
+		defer func() { replicas.err = nil }()
+
+		assert.ErrorIs(t, engine.Set("key3", "value3"), replicas.err)
+		value, ok := engine.Get("key3")
+		assert.True(t, ok)
+		assert.Equal(t, "value3", value)
+	})
+
+	t.Run("writes do not wait for later entries", func(t *testing.T) {
+		for name, newEngine := range map[string]func(w *busyWAL) (Storage, error){
+			"memory": func(w *busyWAL) (Storage, error) { return NewEngine(logger, w, nil) },
+			"disk": func(w *busyWAL) (Storage, error) {
+				return NewDiskEngine(logger, w, config.EngineConfig{DataDirectory: t.TempDir()}, true)
+			},
+		} {
+			t.Run(name, func(t *testing.T) {
+				w := &busyWAL{MockWAL: mocks.NewMockWAL()}
+				engine, err := newEngine(w)
+				require.NoError(t, err)
+				defer engine.Close()
+
+				replicas := &testReplicaWaiter{}
+				engine.SetReplicaWaiter(replicas)
+
+				require.NoError(t, engine.Set("key1", "value1"))
+				require.NoError(t, engine.Set("key2", "value2"))
+				assert.Equal(t, []uint64{1, 3}, replicas.lsns)
+				assert.Equal(t, uint64(4), w.LSN())
+			})
+		}
+	})
+
+	t.Run("writes leave the gate before they wait", func(t *testing.T) {
+		for name, newEngine := range map[string]func(w *mocks.MockWAL) (Storage, error){
+			"memory": func(w *mocks.MockWAL) (Storage, error) { return NewEngine(logger, w, nil) },
+			"disk": func(w *mocks.MockWAL) (Storage, error) {
+				return NewDiskEngine(logger, w, config.EngineConfig{DataDirectory: t.TempDir()}, true)
+			},
+		} {
+			t.Run(name, func(t *testing.T) {
+				w := mocks.NewMockWAL()
+				engine, err := newEngine(w)
+				require.NoError(t, err)
+				defer engine.Close()
+
+				replicas := &testReplicaWaiter{}
+				engine.SetReplicaWaiter(replicas)
+
+				// ended records the number of waits when each write left the gate
+				var ended []int
+				var gateErr error
+				engine.SetWriteGate(func() (func(), error) {
+					if gateErr != nil {
+						return nil, gateErr
+					}
+					return func() { ended = append(ended, len(replicas.lsns)) }, nil
+				})
+
+				require.NoError(t, engine.Set("key1", "value1"))
+				require.NoError(t, engine.Clear())
+				assert.Equal(t, []int{0, 1}, ended)
+				assert.Equal(t, []uint64{1, 2}, replicas.lsns)
+
+				// A write the gate rejects reaches neither the WAL nor the engine
+				gateErr = errors.New("read-only")
+				assert.ErrorIs(t, engine.Set("key2", "value2"), gateErr)
+				assert.ErrorIs(t, engine.Clear(), gateErr)
+				_, ok := engine.Get("key2")
+				assert.False(t, ok)
+				assert.Len(t, w.Entries, 2)
+				assert.Len(t, replicas.lsns, 2)
+			})
+		}
+	})
+}
@@ -0,0 +1,374 @@
+package snapshot
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/8thgencore/valchemy/internal/config"
+	"github.com/8thgencore/valchemy/internal/wal/segment"
+)
+
+const (
+	filePrefix = "snapshot-"
+	fileSuffix = ".snap"
+
+	// formatVersion is written to new snapshots; version 1 snapshots have no
+	// expiration times and are still readable
+	formatVersion byte = 2
+)
+
+var magic = [4]byte{'V', 'S', 'N', 'P'}
+
+var (
+	// ErrInvalidSnapshot returned when a snapshot file is malformed
+	ErrInvalidSnapshot = errors.New("invalid snapshot file")
+
+	// ErrChecksumMismatch returned when the snapshot checksum does not match its content
+	ErrChecksumMismatch = errors.New("snapshot checksum mismatch")
+)
+
+// Snapshot is a point-in-time copy of the storage data
+type Snapshot struct {
+	// Position is the last WAL position reflected in the data
+	Position segment.Position
+	Data     map[string]string
+	// Expires holds the expiration times in Unix nanoseconds of the keys that expire
+	Expires map[string]int64
+}
+
+// Info represents snapshot file metadata
+type Info struct {
+	Position segment.Position
+	Name     string
+}
+
+// Store manages snapshot files in a directory
+type Store struct {
+	directory string
+	interval  time.Duration
+}
+
+// New creates a snapshot store that keeps snapshots next to the WAL segments.
+// Returns nil if WAL is disabled in the configuration.
+func New(cfg config.WALConfig) *Store {
+	if !cfg.Enabled {
+		return nil
+	}
+
+	return &Store{
+		directory: cfg.DataDirectory,
+		interval:  cfg.SnapshotInterval,
+	}
+}
+
+// Interval returns the period of automatic snapshots, zero if disabled
+func (s *Store) Interval() time.Duration {
+	return s.interval
+}
+
+// Save writes a snapshot atomically and removes the older snapshots. Expires
+// holds the expiration times of the keys that expire and may be nil.
+func (s *Store) Save(pos segment.Position, data map[string]string, expires map[string]int64) (Info, error) {
+	if err := os.MkdirAll(s.directory, 0o750); err != nil {
+		return Info{}, fmt.Errorf("failed to create snapshot directory: %w", err)
+	}
+
+	info := Info{
+		Position: pos,
+		Name:     fileName(pos),
+	}
+	path := filepath.Join(s.directory, info.Name)
+	tmpPath := path + ".tmp"
+
+	if err := writeFile(tmpPath, pos, data, expires); err != nil {
+		_ = os.Remove(tmpPath)
+		return Info{}, err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		_ = os.Remove(tmpPath)
+		return Info{}, fmt.Errorf("failed to rename snapshot file: %w", err)
+	}
+
+	if err := s.removeOlder(info); err != nil {
+		return info, err
+	}
+
+	return info, nil
+}
+
+// LoadLatest loads the newest valid snapshot. Returns nil if there is none.
+func (s *Store) LoadLatest() (*Snapshot, error) {
+	snapshots, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		snap, err := readFile(filepath.Join(s.directory, snapshots[i].Name))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", snapshots[i].Name, err))
+			continue
+		}
+
+		return snap, nil
+	}
+
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("no valid snapshot found: %w", errors.Join(errs...))
+	}
+
+	return nil, nil
+}
+
+// List returns the snapshots in the directory sorted by position
+func (s *Store) List() ([]Info, error) {
+	files, err := os.ReadDir(s.directory)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read snapshot directory: %w", err)
+	}
+
+	var snapshots []Info
+	for _, f := range files {
+		pos, err := parseFileName(f.Name())
+		if err != nil {
+			continue // Skip files that are not snapshots
+		}
+		snapshots = append(snapshots, Info{Position: pos, Name: f.Name()})
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return less(snapshots[i].Position, snapshots[j].Position)
+	})
+
+	return snapshots, nil
+}
+
+// removeOlder deletes the snapshots that precede the given one
+func (s *Store) removeOlder(latest Info) error {
+	snapshots, err := s.List()
+	if err != nil {
+		return err
+	}
+
+	for _, snap := range snapshots {
+		if !less(snap.Position, latest.Position) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.directory, snap.Name)); err != nil {
+			return fmt.Errorf("failed to remove snapshot %s: %w", snap.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func fileName(pos segment.Position) string {
+	return fmt.Sprintf("%s%d-%d%s", filePrefix, pos.SegmentID, pos.Offset, fileSuffix)
+}
+
+func parseFileName(name string) (segment.Position, error) {
+	if !strings.HasPrefix(name, filePrefix) || !strings.HasSuffix(name, fileSuffix) {
+		return segment.Position{}, fmt.Errorf("invalid snapshot name %s", name)
+	}
+
+	base := strings.TrimSuffix(strings.TrimPrefix(name, filePrefix), fileSuffix)
+	segmentPart, offsetPart, ok := strings.Cut(base, "-")
+	if !ok {
+		return segment.Position{}, fmt.Errorf("invalid snapshot name %s", name)
+	}
+
+	segmentID, err := strconv.ParseInt(segmentPart, 10, 64)
+	if err != nil {
+		return segment.Position{}, fmt.Errorf("invalid snapshot name %s: %w", name, err)
+	}
+	offset, err := strconv.ParseInt(offsetPart, 10, 64)
+	if err != nil {
+		return segment.Position{}, fmt.Errorf("invalid snapshot name %s: %w", name, err)
+	}
+
+	return segment.Position{SegmentID: segmentID, Offset: offset}, nil
+}
+
+func less(a, b segment.Position) bool {
+	if a.SegmentID != b.SegmentID {
+		return a.SegmentID < b.SegmentID
+	}
+
+	return a.Offset < b.Offset
+}
+
+// writeFile writes the snapshot as: magic, version, segment ID, offset,
+// number of records, records (key and value prefixed with their lengths,
+// expiration time) and a CRC32 of everything before it
+func writeFile(path string, pos segment.Position, data map[string]string, expires map[string]int64) (err error) {
+	file, err := os.OpenFile(filepath.Clean(path), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot file: %w", err)
+	}
+	defer func() {
+		if closeErr := file.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("failed to close snapshot file: %w", closeErr)
+		}
+	}()
+
+	checksum := crc32.NewIEEE()
+	writer := bufio.NewWriter(io.MultiWriter(file, checksum))
+
+	header := make([]byte, 0, 29)
+	header = append(header, magic[:]...)
+	header = append(header, formatVersion)
+	header = binary.LittleEndian.AppendUint64(header, uint64(pos.SegmentID))
+	header = binary.LittleEndian.AppendUint64(header, uint64(pos.Offset))
+	header = binary.LittleEndian.AppendUint64(header, uint64(len(data)))
+	if _, err := writer.Write(header); err != nil {
+		return fmt.Errorf("failed to write snapshot header: %w", err)
+	}
+
+	for key, value := range data {
+		if err := writeString(writer, key); err != nil {
+			return fmt.Errorf("failed to write snapshot record: %w", err)
+		}
+		if err := writeString(writer, value); err != nil {
+			return fmt.Errorf("failed to write snapshot record: %w", err)
+		}
+		if _, err := writer.Write(binary.LittleEndian.AppendUint64(nil, uint64(expires[key]))); err != nil {
+			return fmt.Errorf("failed to write snapshot record: %w", err)
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("failed to flush snapshot file: %w", err)
+	}
+
+	if _, err := file.Write(binary.LittleEndian.AppendUint32(nil, checksum.Sum32())); err != nil {
+		return fmt.Errorf("failed to write snapshot checksum: %w", err)
+	}
+
+	return file.Sync()
+}
+
+func readFile(path string) (*Snapshot, error) {
+	file, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open snapshot file: %w", err)
+	}
+	defer func() { _ = file.Close() }()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat snapshot file: %w", err)
+	}
+	maxLen := uint64(stat.Size())
+
+	checksum := crc32.NewIEEE()
+	reader := io.TeeReader(bufio.NewReader(file), checksum)
+
+	header := make([]byte, 29)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+	}
+	version := header[4]
+	if [4]byte(header[:4]) != magic || version < 1 || version > formatVersion {
+		return nil, ErrInvalidSnapshot
+	}
+
+	snap := &Snapshot{
+		Position: segment.Position{
+			SegmentID: int64(binary.LittleEndian.Uint64(header[5:13])),
+			Offset:    int64(binary.LittleEndian.Uint64(header[13:21])),
+		},
+		Data:    make(map[string]string),
+		Expires: make(map[string]int64),
+	}
+
+	count := binary.LittleEndian.Uint64(header[21:29])
+	for i := uint64(0); i < count; i++ {
+		key, err := readString(reader, maxLen)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+		}
+		value, err := readString(reader, maxLen)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+		}
+		snap.Data[key] = value
+
+		if version < 2 {
+			continue
+		}
+		buf := make([]byte, 8)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+		}
+		if expiresAt := int64(binary.LittleEndian.Uint64(buf)); expiresAt != 0 {
+			snap.Expires[key] = expiresAt
+		}
+	}
+
+	if err := verifyChecksum(reader, checksum); err != nil {
+		return nil, err
+	}
+
+	return snap, nil
+}
+
+func verifyChecksum(reader io.Reader, checksum hash.Hash32) error {
+	expected := checksum.Sum32()
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+	}
+	if binary.LittleEndian.Uint32(buf) != expected {
+		return ErrChecksumMismatch
+	}
+
+	return nil
+}
+
+func writeString(w io.Writer, s string) error {
+	if uint64(len(s)) > uint64(^uint32(0)) {
+		return errors.New("string length exceeds maximum allowed value")
+	}
+	if _, err := w.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(s)))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, s)
+
+	return err
+}
+
+func readString(r io.Reader, maxLen uint64) (string, error) {
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+
+	length := binary.LittleEndian.Uint32(buf)
+	if uint64(length) > maxLen {
+		return "", fmt.Errorf("string length %d exceeds file size", length)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
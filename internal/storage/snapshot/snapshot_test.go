@@ -0,0 +1,125 @@
+package snapshot
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/8thgencore/valchemy/internal/config"
+	"github.com/8thgencore/valchemy/internal/wal/segment"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupStore(t *testing.T) *Store {
+	t.Helper()
+	return New(config.WALConfig{Enabled: true, DataDirectory: t.TempDir()})
+}
+
+func TestNew(t *testing.T) {
+	t.Run("disabled WAL", func(t *testing.T) {
+		assert.Nil(t, New(config.WALConfig{Enabled: false}))
+	})
+}
+
+func TestStore_SaveAndLoad(t *testing.T) {
+	t.Run("round trip", func(t *testing.T) {
+		store := setupStore(t)
+		pos := segment.Position{SegmentID: 42, Offset: 128}
+		data := map[string]string{"key1": "value1", "key2": "", "": "empty key"}
+		expires := map[string]int64{"key1": 1700000000000000000}
+
+		info, err := store.Save(pos, data, expires)
+		require.NoError(t, err)
+		assert.Equal(t, pos, info.Position)
+
+		snap, err := store.LoadLatest()
+		require.NoError(t, err)
+		require.NotNil(t, snap)
+		assert.Equal(t, pos, snap.Position)
+		assert.Equal(t, data, snap.Data)
+		assert.Equal(t, expires, snap.Expires)
+	})
+
+	t.Run("version 1 snapshot", func(t *testing.T) {
+		store := setupStore(t)
+		pos := segment.Position{SegmentID: 1, Offset: 10}
+
+		content := append([]byte{}, magic[:]...)
+		content = append(content, 1)
+		content = binary.LittleEndian.AppendUint64(content, uint64(pos.SegmentID))
+		content = binary.LittleEndian.AppendUint64(content, uint64(pos.Offset))
+		content = binary.LittleEndian.AppendUint64(content, 1)
+		content = binary.LittleEndian.AppendUint32(content, 3)
+		content = append(content, "key"...)
+		content = binary.LittleEndian.AppendUint32(content, 5)
+		content = append(content, "value"...)
+		content = binary.LittleEndian.AppendUint32(content, crc32.ChecksumIEEE(content))
+		require.NoError(t, os.WriteFile(filepath.Join(store.directory, fileName(pos)), content, 0o600))
+
+		snap, err := store.LoadLatest()
+		require.NoError(t, err)
+		require.NotNil(t, snap)
+		assert.Equal(t, map[string]string{"key": "value"}, snap.Data)
+		assert.Empty(t, snap.Expires)
+	})
+
+	t.Run("no snapshots", func(t *testing.T) {
+		store := setupStore(t)
+
+		snap, err := store.LoadLatest()
+		require.NoError(t, err)
+		assert.Nil(t, snap)
+	})
+
+	t.Run("older snapshots are removed", func(t *testing.T) {
+		store := setupStore(t)
+
+		_, err := store.Save(segment.Position{SegmentID: 1, Offset: 10}, map[string]string{"a": "1"}, nil)
+		require.NoError(t, err)
+		_, err = store.Save(segment.Position{SegmentID: 2, Offset: 5}, map[string]string{"b": "2"}, nil)
+		require.NoError(t, err)
+
+		snapshots, err := store.List()
+		require.NoError(t, err)
+		require.Len(t, snapshots, 1)
+		assert.Equal(t, int64(2), snapshots[0].Position.SegmentID)
+	})
+}
+
+func TestStore_LoadCorrupted(t *testing.T) {
+	t.Run("falls back to an older valid snapshot", func(t *testing.T) {
+		store := setupStore(t)
+
+		older := segment.Position{SegmentID: 1, Offset: 10}
+		_, err := store.Save(older, map[string]string{"a": "1"}, nil)
+		require.NoError(t, err)
+
+		// Write a newer snapshot with a broken checksum
+		newer := segment.Position{SegmentID: 2, Offset: 10}
+		path := filepath.Join(store.directory, fileName(newer))
+		require.NoError(t, writeFile(path, newer, map[string]string{"b": "2"}, nil))
+		content, err := os.ReadFile(path)
+		require.NoError(t, err)
+		content[len(content)-1] ^= 0xFF
+		require.NoError(t, os.WriteFile(path, content, 0o600))
+
+		snap, err := store.LoadLatest()
+		require.NoError(t, err)
+		require.NotNil(t, snap)
+		assert.Equal(t, older, snap.Position)
+	})
+
+	t.Run("error when no snapshot is valid", func(t *testing.T) {
+		store := setupStore(t)
+
+		path := filepath.Join(store.directory, fileName(segment.Position{SegmentID: 1}))
+		require.NoError(t, os.WriteFile(path, []byte("garbage"), 0o600))
+
+		snap, err := store.LoadLatest()
+		assert.ErrorIs(t, err, ErrInvalidSnapshot)
+		assert.Nil(t, snap)
+	})
+}
@@ -1,13 +1,64 @@
 package storage
 
+import (
+	"time"
+
+	"github.com/8thgencore/valchemy/internal/wal/entry"
+	"github.com/8thgencore/valchemy/internal/wal/segment"
+)
+
+// NoExpiration is the TTL reported for keys that do not expire
+const NoExpiration time.Duration = -1
+
+// KeyValue is a key-value pair of a multi-key write
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
 // Storage is an interface that defines the storage operations
 type Storage interface {
 	// Set sets a key-value pair in the storage
 	Set(key, value string) error
+	// SetEx sets a key-value pair that expires after the ttl
+	SetEx(key, value string, ttl time.Duration) error
 	// Get gets a value from the storage
 	Get(key string) (string, bool)
-	// Delete deletes a key from the storage
-	Delete(key string) error
+	// MSet sets several key-value pairs as one atomic write
+	MSet(pairs []KeyValue) error
+	// MGet gets the values of several keys; found reports which keys exist
+	MGet(keys []string) (values []string, found []bool)
+	// Expire sets the time to live of an existing key
+	Expire(key string, ttl time.Duration) (bool, error)
+	// Persist removes the time to live of an existing key
+	Persist(key string) (bool, error)
+	// TTL returns the remaining time to live of a key
+	TTL(key string) (time.Duration, bool)
+	// Delete deletes a key from the storage and reports whether it existed
+	Delete(key string) (bool, error)
+	// MDelete deletes several keys as one atomic write and returns the number
+	// of keys that existed
+	MDelete(keys []string) (int, error)
 	// Clear removes all keys from the storage
 	Clear() error
+	// Snapshot persists the current state and truncates the WAL
+	Snapshot() error
+	// WALError returns the error that put the WAL in the failed state, in
+	// which writes are rejected, nil if the WAL accepts writes or is disabled
+	WALError() error
+	// ResumeWAL leaves the failed state of the WAL once its cause is fixed
+	ResumeWAL() error
+	// SetWALTruncation switches between the WAL truncation of a master and
+	// that of a replica, whose WAL is received from the master
+	SetWALTruncation(enabled bool)
+	// SetReplicaWaiter makes the writes return once the replicas acknowledge
+	// their WAL entries
+	SetReplicaWaiter(replicas ReplicaWaiter)
+	// SetWriteGate makes the writes pass the gate before they reach the WAL
+	SetWriteGate(gate WriteGate)
+	// ApplyEntries applies WAL entries without writing them to the WAL; pos
+	// is the end of the entries in the WAL of a replica, zero if unknown
+	ApplyEntries(entries []*entry.Entry, pos segment.Position)
+	// Close stops the background work of the storage
+	Close() error
 }
@@ -0,0 +1,571 @@
+package vfs
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Op identifies a file system operation for the fault injection
+type Op string
+
+// Operations passed to a Fault
+const (
+	OpOpen     Op = "open"
+	OpRead     Op = "read"
+	OpWrite    Op = "write"
+	OpSync     Op = "sync"
+	OpStat     Op = "stat"
+	OpReadDir  Op = "readdir"
+	OpMkdir    Op = "mkdir"
+	OpRemove   Op = "remove"
+	OpRename   Op = "rename"
+	OpTruncate Op = "truncate"
+	OpLink     Op = "link"
+)
+
+// Fault decides the outcome of an operation on the named file before it is
+// executed: a non-nil error fails the operation without any effect
+type Fault func(op Op, name string) error
+
+// MemFS is an in-memory file system for tests. It keeps apart the data
+// written to a file and the data made durable by Sync, so that a crash can be
+// simulated, and it can inject errors into any operation. Directory changes
+// are durable as soon as they are made.
+type MemFS struct {
+	mu    sync.Mutex
+	dirs  map[string]struct{}
+	files map[string]*memNode
+	fault Fault
+	// capacity bounds the total size of the files, negative if unbounded
+	capacity int64
+}
+
+// memNode holds the data of a file, shared by its hard links
+type memNode struct {
+	data []byte
+	// durable is the data as of the last sync
+	durable []byte
+	modTime time.Time
+}
+
+// NewMemFS creates an empty in-memory file system
+func NewMemFS() *MemFS {
+	return &MemFS{
+		dirs:     map[string]struct{}{},
+		files:    map[string]*memNode{},
+		capacity: -1,
+	}
+}
+
+// SetFault sets the fault consulted before every operation, nil to remove it
+func (m *MemFS) SetFault(fault Fault) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.fault = fault
+}
+
+// SetCapacity bounds the total size of the files. A write that does not fit
+// writes the bytes that do and fails with ENOSPC. A negative capacity removes
+// the bound.
+func (m *MemFS) SetCapacity(capacity int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.capacity = capacity
+}
+
+// Crash returns the file system as found after a power loss: each file keeps
+// its data as of the last sync, followed by at most keep of the bytes
+// appended since. The receiver is left as is, so that the writers still
+// holding it cannot affect the crashed copy.
+func (m *MemFS) Crash(keep int64) *MemFS {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	crashed := NewMemFS()
+	for dir := range m.dirs {
+		crashed.dirs[dir] = struct{}{}
+	}
+
+	nodes := make(map[*memNode]*memNode, len(m.files))
+	for name, node := range m.files {
+		if _, ok := nodes[node]; !ok {
+			data := node.durable
+			if bytes.HasPrefix(node.data, node.durable) {
+				appended := int64(len(node.data) - len(node.durable))
+				data = node.data[:len(node.durable)+int(min(keep, appended))]
+			}
+			nodes[node] = &memNode{
+				data:    bytes.Clone(data),
+				durable: bytes.Clone(data),
+				modTime: node.modTime,
+			}
+		}
+		crashed.files[name] = nodes[node]
+	}
+
+	return crashed
+}
+
+// check consults the fault for an operation, with m.mu held
+func (m *MemFS) check(op Op, name string) error {
+	if m.fault == nil {
+		return nil
+	}
+	if err := m.fault(op, name); err != nil {
+		return &fs.PathError{Op: string(op), Path: name, Err: err}
+	}
+
+	return nil
+}
+
+// dirExists reports whether the directory exists, with m.mu held
+func (m *MemFS) dirExists(dir string) bool {
+	if dir == "." || dir == string(filepath.Separator) {
+		return true
+	}
+	_, ok := m.dirs[dir]
+
+	return ok
+}
+
+// used returns the total size of the files, with m.mu held
+func (m *MemFS) used() int64 {
+	seen := make(map[*memNode]struct{}, len(m.files))
+	var size int64
+	for _, node := range m.files {
+		if _, ok := seen[node]; !ok {
+			seen[node] = struct{}{}
+			size += int64(len(node.data))
+		}
+	}
+
+	return size
+}
+
+// OpenFile opens the named file with the flags of os.OpenFile
+func (m *MemFS) OpenFile(name string, flag int, _ fs.FileMode) (File, error) {
+	name = filepath.Clean(name)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.check(OpOpen, name); err != nil {
+		return nil, err
+	}
+
+	node, ok := m.files[name]
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case !ok && flag&os.O_CREATE == 0:
+		if _, isDir := m.dirs[name]; isDir {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+		}
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case !ok:
+		if !m.dirExists(filepath.Dir(name)) {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		node = &memNode{modTime: time.Now()}
+		m.files[name] = node
+	}
+
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if writable && flag&os.O_TRUNC != 0 {
+		node.data = node.data[:0]
+		node.modTime = time.Now()
+	}
+
+	return &memFile{
+		fs:       m,
+		name:     name,
+		node:     node,
+		readable: flag&os.O_WRONLY == 0,
+		writable: writable,
+		append:   flag&os.O_APPEND != 0,
+	}, nil
+}
+
+// Stat returns the description of the named file or directory
+func (m *MemFS) Stat(name string) (fs.FileInfo, error) {
+	name = filepath.Clean(name)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.check(OpStat, name); err != nil {
+		return nil, err
+	}
+
+	return m.stat(name)
+}
+
+// stat describes the named file or directory, with m.mu held
+func (m *MemFS) stat(name string) (fs.FileInfo, error) {
+	if node, ok := m.files[name]; ok {
+		return &memInfo{name: filepath.Base(name), size: int64(len(node.data)), modTime: node.modTime}, nil
+	}
+	if m.dirExists(name) {
+		return &memInfo{name: filepath.Base(name), dir: true}, nil
+	}
+
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+// ReadDir returns the entries of the named directory sorted by name
+func (m *MemFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	name = filepath.Clean(name)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.check(OpReadDir, name); err != nil {
+		return nil, err
+	}
+	if !m.dirExists(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	var entries []fs.DirEntry
+	add := func(path string) {
+		if filepath.Dir(path) != name {
+			return
+		}
+		info, _ := m.stat(path)
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+	for path := range m.files {
+		add(path)
+	}
+	for path := range m.dirs {
+		add(path)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	return entries, nil
+}
+
+// MkdirAll creates the directory and its missing parents
+func (m *MemFS) MkdirAll(path string, _ fs.FileMode) error {
+	path = filepath.Clean(path)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.check(OpMkdir, path); err != nil {
+		return err
+	}
+
+	for dir := path; !m.dirExists(dir); dir = filepath.Dir(dir) {
+		if _, ok := m.files[dir]; ok {
+			return &fs.PathError{Op: "mkdir", Path: dir, Err: syscall.ENOTDIR}
+		}
+		m.dirs[dir] = struct{}{}
+	}
+
+	return nil
+}
+
+// Remove removes the named file or empty directory
+func (m *MemFS) Remove(name string) error {
+	name = filepath.Clean(name)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.check(OpRemove, name); err != nil {
+		return err
+	}
+
+	if _, ok := m.files[name]; ok {
+		delete(m.files, name)
+		return nil
+	}
+	if _, ok := m.dirs[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	prefix := name + string(filepath.Separator)
+	for path := range m.files {
+		if strings.HasPrefix(path, prefix) {
+			return &fs.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+		}
+	}
+	for path := range m.dirs {
+		if strings.HasPrefix(path, prefix) {
+			return &fs.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+		}
+	}
+	delete(m.dirs, name)
+
+	return nil
+}
+
+// Rename moves a file, replacing the target if it exists
+func (m *MemFS) Rename(oldpath, newpath string) error {
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.check(OpRename, oldpath); err != nil {
+		return err
+	}
+
+	node, ok := m.files[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	if !m.dirExists(filepath.Dir(newpath)) {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	delete(m.files, oldpath)
+	m.files[newpath] = node
+
+	return nil
+}
+
+// Truncate changes the size of the named file
+func (m *MemFS) Truncate(name string, size int64) error {
+	name = filepath.Clean(name)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.check(OpTruncate, name); err != nil {
+		return err
+	}
+
+	node, ok := m.files[name]
+	if !ok {
+		return &fs.PathError{Op: "truncate", Path: name, Err: fs.ErrNotExist}
+	}
+	if size < 0 {
+		return &fs.PathError{Op: "truncate", Path: name, Err: fs.ErrInvalid}
+	}
+	if size <= int64(len(node.data)) {
+		node.data = node.data[:size]
+	} else {
+		node.data = append(node.data, make([]byte, size-int64(len(node.data)))...)
+	}
+	node.modTime = time.Now()
+
+	return nil
+}
+
+// Link creates newname as a hard link to the oldname file
+func (m *MemFS) Link(oldname, newname string) error {
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.check(OpLink, oldname); err != nil {
+		return err
+	}
+
+	node, ok := m.files[oldname]
+	if !ok {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: fs.ErrNotExist}
+	}
+	if _, exists := m.files[newname]; exists {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: fs.ErrExist}
+	}
+	if !m.dirExists(filepath.Dir(newname)) {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: fs.ErrNotExist}
+	}
+	m.files[newname] = node
+
+	return nil
+}
+
+// memFile is an open file of a MemFS
+type memFile struct {
+	fs       *MemFS
+	name     string
+	node     *memNode
+	offset   int64
+	readable bool
+	writable bool
+	append   bool
+	closed   bool
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	n, err := f.readAt(p, f.offset)
+	f.offset += int64(n)
+
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	n, err := f.readAt(p, off)
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+// readAt reads from the offset, with the file system lock held
+func (f *memFile) readAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrClosed}
+	}
+	if !f.readable {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: syscall.EBADF}
+	}
+	if err := f.fs.check(OpRead, f.name); err != nil {
+		return 0, err
+	}
+	if off >= int64(len(f.node.data)) {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+
+	return copy(p, f.node.data[off:]), nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrClosed}
+	}
+	if !f.writable {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: syscall.EBADF}
+	}
+	if err := f.fs.check(OpWrite, f.name); err != nil {
+		return 0, err
+	}
+
+	if f.append {
+		f.offset = int64(len(f.node.data))
+	}
+
+	// Only the bytes that do not overwrite existing data take space
+	data := p
+	var errNoSpace error
+	if f.fs.capacity >= 0 {
+		grow := max(0, f.offset+int64(len(p))-int64(len(f.node.data)))
+		if free := max(0, f.fs.capacity-f.fs.used()); grow > free {
+			data = p[:int64(len(p))-(grow-free)]
+			errNoSpace = &fs.PathError{Op: "write", Path: f.name, Err: syscall.ENOSPC}
+		}
+	}
+
+	end := f.offset + int64(len(data))
+	if end > int64(len(f.node.data)) {
+		f.node.data = append(f.node.data, make([]byte, end-int64(len(f.node.data)))...)
+	}
+	copy(f.node.data[f.offset:], data)
+	f.offset = end
+	f.node.modTime = time.Now()
+
+	return len(data), errNoSpace
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrClosed}
+	}
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.offset = offset
+
+	return offset, nil
+}
+
+func (f *memFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return &fs.PathError{Op: "sync", Path: f.name, Err: fs.ErrClosed}
+	}
+	if err := f.fs.check(OpSync, f.name); err != nil {
+		return err
+	}
+	f.node.durable = bytes.Clone(f.node.data)
+
+	return nil
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return nil, &fs.PathError{Op: "stat", Path: f.name, Err: fs.ErrClosed}
+	}
+
+	return &memInfo{name: filepath.Base(f.name), size: int64(len(f.node.data)), modTime: f.node.modTime}, nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.closed = true
+
+	return nil
+}
+
+// memInfo describes a file or a directory of a MemFS
+type memInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i *memInfo) Name() string       { return i.name }
+func (i *memInfo) Size() int64        { return i.size }
+func (i *memInfo) ModTime() time.Time { return i.modTime }
+func (i *memInfo) IsDir() bool        { return i.dir }
+func (i *memInfo) Sys() any           { return nil }
+
+func (i *memInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0o750
+	}
+
+	return 0o600
+}
@@ -0,0 +1,119 @@
+package vfs
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemFS(t *testing.T) {
+	t.Run("files and directories", func(t *testing.T) {
+		m := NewMemFS()
+		require.NoError(t, m.MkdirAll("/data/wal", 0o750))
+		require.NoError(t, WriteFile(m, "/data/wal/b.log", []byte("bbb"), 0o600))
+		require.NoError(t, WriteFile(m, "/data/wal/a.log", []byte("a"), 0o600))
+
+		entries, err := m.ReadDir("/data/wal")
+		require.NoError(t, err)
+		require.Len(t, entries, 2)
+		assert.Equal(t, "a.log", entries[0].Name())
+		assert.Equal(t, "b.log", entries[1].Name())
+
+		info, err := m.Stat("/data/wal/b.log")
+		require.NoError(t, err)
+		assert.Equal(t, int64(3), info.Size())
+
+		require.NoError(t, m.Rename("/data/wal/b.log", "/data/wal/c.log"))
+		data, err := ReadFile(m, "/data/wal/c.log")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("bbb"), data)
+
+		require.NoError(t, m.Truncate("/data/wal/c.log", 1))
+		require.NoError(t, m.Link("/data/wal/c.log", "/data/wal/d.log"))
+		data, err = ReadFile(m, "/data/wal/d.log")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("b"), data)
+
+		_, err = m.OpenFile("/data/wal/a.log", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		assert.ErrorIs(t, err, fs.ErrExist)
+		_, err = Open(m, "/data/wal/b.log")
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+		_, err = m.OpenFile("/missing/a.log", os.O_CREATE|os.O_WRONLY, 0o600)
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+		assert.ErrorIs(t, m.Remove("/data/wal"), syscall.ENOTEMPTY)
+	})
+
+	t.Run("crash keeps the synced data", func(t *testing.T) {
+		m := NewMemFS()
+		f, err := m.OpenFile("log", os.O_CREATE|os.O_WRONLY, 0o600)
+		require.NoError(t, err)
+		_, err = f.Write([]byte("synced"))
+		require.NoError(t, err)
+		require.NoError(t, f.Sync())
+		_, err = f.Write([]byte("-pending"))
+		require.NoError(t, err)
+
+		for keep, expected := range map[int64]string{0: "synced", 3: "synced-pe", 100: "synced-pending"} {
+			data, err := ReadFile(m.Crash(keep), "log")
+			require.NoError(t, err)
+			assert.Equal(t, expected, string(data))
+		}
+
+		// The crashed copy does not see the later writes
+		crashed := m.Crash(0)
+		_, err = f.Write([]byte("!"))
+		require.NoError(t, err)
+		data, err := ReadFile(crashed, "log")
+		require.NoError(t, err)
+		assert.Equal(t, "synced", string(data))
+	})
+
+	t.Run("full disk", func(t *testing.T) {
+		m := NewMemFS()
+		m.SetCapacity(4)
+		f, err := m.OpenFile("log", os.O_CREATE|os.O_WRONLY, 0o600)
+		require.NoError(t, err)
+
+		n, err := f.Write([]byte("abcdef"))
+		assert.Equal(t, 4, n)
+		assert.ErrorIs(t, err, syscall.ENOSPC)
+
+		data, err := ReadFile(m, "log")
+		require.NoError(t, err)
+		assert.Equal(t, "abcd", string(data))
+	})
+
+	t.Run("injected faults", func(t *testing.T) {
+		m := NewMemFS()
+		m.SetFault(func(op Op, name string) error {
+			if op == OpSync && name == "log" {
+				return syscall.EIO
+			}
+			return nil
+		})
+
+		f, err := m.OpenFile("log", os.O_CREATE|os.O_RDWR, 0o600)
+		require.NoError(t, err)
+		_, err = f.Write([]byte("data"))
+		require.NoError(t, err)
+		assert.ErrorIs(t, f.Sync(), syscall.EIO)
+
+		// Nothing was synced
+		data, err := ReadFile(m.Crash(0), "log")
+		require.NoError(t, err)
+		assert.Empty(t, data)
+
+		m.SetFault(nil)
+		require.NoError(t, f.Sync())
+		_, err = f.Seek(0, io.SeekStart)
+		require.NoError(t, err)
+		data, err = io.ReadAll(f)
+		require.NoError(t, err)
+		assert.Equal(t, "data", string(data))
+	})
+}
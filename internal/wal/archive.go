@@ -0,0 +1,209 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/8thgencore/valchemy/internal/vfs"
+	"github.com/8thgencore/valchemy/internal/wal/entry"
+	"github.com/8thgencore/valchemy/internal/wal/segment"
+)
+
+// errStopRestore stops the scan of a segment at the restore target
+var errStopRestore = errors.New("restore target reached")
+
+// archiveSegment copies a segment that is no longer written to the archive
+// directory, if one is configured. A segment already archived is left as is.
+func (w *Service) archiveSegment(name string) error {
+	if w.config.archiveDirectory == "" {
+		return nil
+	}
+
+	src := filepath.Join(w.config.dataDirectory, name)
+	dst := filepath.Join(w.config.archiveDirectory, name)
+	if archived, err := w.fsys.Stat(dst); err == nil {
+		// A segment of the same name but of another size was written by a
+		// server restored to an earlier point
+		info, err := w.fsys.Stat(src)
+		if err != nil || info.Size() != archived.Size() {
+			return fmt.Errorf("%w %s: a different segment is archived under the same name", ErrArchiveSegment, name)
+		}
+		return nil
+	}
+
+	// A closed segment is never modified again, so on the same file system
+	// a hard link is enough
+	if err := w.fsys.Link(src, dst); err == nil {
+		return nil
+	}
+
+	if err := copyFile(w.fsys, src, dst, -1, nil); err != nil {
+		return fmt.Errorf("%w %s: %v", ErrArchiveSegment, name, err)
+	}
+
+	return nil
+}
+
+// copyFile copies the first size bytes of src, the whole file if size is
+// negative, to dst followed by the tail entries. The copy is synced and
+// renamed into place so that dst never holds a partial file.
+func copyFile(fsys vfs.FS, src, dst string, size int64, tail []entry.Entry) (err error) {
+	in, err := vfs.Open(fsys, filepath.Clean(src))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := dst + ".tmp"
+	out, err := fsys.OpenFile(filepath.Clean(tmp), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = out.Close()
+			_ = fsys.Remove(tmp)
+		}
+	}()
+
+	var r io.Reader = in
+	if size >= 0 {
+		r = io.LimitReader(in, size)
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		return err
+	}
+	for i := range tail {
+		if _, err := tail[i].WriteTo(out); err != nil {
+			return err
+		}
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	return fsys.Rename(tmp, dst)
+}
+
+// RestoreTarget is the point up to which the archived entries are restored.
+// The zero value restores every entry.
+type RestoreTarget struct {
+	// LSN is the sequence number of the last entry restored
+	LSN uint64
+	// Time excludes the entries accepted after it
+	Time time.Time
+}
+
+// includes reports whether the entry precedes the target. Entries written
+// before LSNs or timestamps were introduced precede the ones that have them.
+func (t RestoreTarget) includes(e *entry.Entry) bool {
+	if t.LSN != 0 && e.LSN > t.LSN {
+		return false
+	}
+	if !t.Time.IsZero() && e.Timestamp > t.Time.UnixNano() {
+		return false
+	}
+
+	return true
+}
+
+// RestoreResult describes the entries restored
+type RestoreResult struct {
+	Segments int
+	Entries  int
+	// LastLSN and LastTimestamp are those of the last entry restored
+	LastLSN       uint64
+	LastTimestamp int64
+}
+
+// Restore rebuilds a WAL data directory of fsys from the archived segments,
+// keeping the entries up to the target. The directory must not hold a WAL already;
+// a server started on it replays the restored entries, so the storage
+// engine must start empty as well.
+func Restore(fsys vfs.FS, archiveDirectory, dataDirectory string, target RestoreTarget) (RestoreResult, error) {
+	var result RestoreResult
+
+	segments, err := segment.ListSegments(fsys, archiveDirectory)
+	if err != nil {
+		return result, err
+	}
+	if len(segments) == 0 {
+		return result, fmt.Errorf("%w: no segments in %s", ErrRestore, archiveDirectory)
+	}
+
+	if err := fsys.MkdirAll(dataDirectory, 0o750); err != nil {
+		return result, fmt.Errorf("%w: %v", ErrRestore, err)
+	}
+	files, err := fsys.ReadDir(dataDirectory)
+	if err != nil {
+		return result, fmt.Errorf("%w: %v", ErrRestore, err)
+	}
+	if len(files) > 0 {
+		return result, fmt.Errorf("%w: %s is not empty", ErrRestore, dataDirectory)
+	}
+
+	var expected uint64
+	for _, s := range segments {
+		// The offset of the first entry after the target, if any
+		end := int64(-1)
+		// The entries of the current record already restored: when the target
+		// falls inside a compressed block they are written as plain records
+		var (
+			block       []entry.Entry
+			blockOffset int64
+		)
+		err := segment.ScanSegment(fsys, archiveDirectory, s.Name, 0, func(e *entry.Entry, offset int64) error {
+			if offset != blockOffset {
+				block = block[:0]
+				blockOffset = offset
+			}
+
+			if e.LSN != 0 {
+				if expected == 0 && result.Entries == 0 && e.LSN > 1 {
+					return fmt.Errorf("%w: the archive starts at LSN %d", ErrArchiveGap, e.LSN)
+				}
+				if expected != 0 && e.LSN != expected {
+					return fmt.Errorf("%w: segment %s has LSN %d where %d is expected",
+						ErrArchiveGap, s.Name, e.LSN, expected)
+				}
+				expected = e.LSN + 1
+			}
+			if !target.includes(e) {
+				end = offset
+				return errStopRestore
+			}
+
+			block = append(block, *e)
+			result.Entries++
+			result.LastLSN = e.LSN
+			result.LastTimestamp = e.Timestamp
+			return nil
+		})
+		if err != nil && !errors.Is(err, errStopRestore) {
+			return result, err
+		}
+
+		if end < 0 {
+			block = nil
+		}
+		if end != 0 || len(block) > 0 {
+			src := filepath.Join(archiveDirectory, s.Name)
+			if err := copyFile(fsys, src, filepath.Join(dataDirectory, s.Name), end, block); err != nil {
+				return result, fmt.Errorf("%w: %v", ErrRestore, err)
+			}
+			result.Segments++
+		}
+		if end >= 0 {
+			break
+		}
+	}
+
+	return result, nil
+}
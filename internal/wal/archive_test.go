@@ -0,0 +1,179 @@
+package wal
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/8thgencore/valchemy/internal/config"
+	"github.com/8thgencore/valchemy/internal/vfs"
+	"github.com/8thgencore/valchemy/internal/wal/entry"
+	"github.com/8thgencore/valchemy/internal/wal/segment"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArchive(t *testing.T) {
+	t.Run("completed segments are archived before truncation", func(t *testing.T) {
+		cfg := config.WALConfig{
+			Enabled:              true,
+			DataDirectory:        t.TempDir(),
+			ArchiveDirectory:     filepath.Join(t.TempDir(), "archive"),
+			FlushingBatchSize:    1,
+			FlushingBatchTimeout: 10 * time.Millisecond,
+			MaxSegmentSizeBytes:  100,
+		}
+		w, err := New(cfg, vfs.OS, testLogger())
+		require.NoError(t, err)
+		defer w.Close()
+
+		for i := 0; i < 10; i++ {
+			_, err := w.Write(entry.Entry{
+				Operation: entry.OperationSet, Key: fmt.Sprintf("key%d", i), Value: "value",
+			})
+			require.NoError(t, err)
+		}
+
+		pos, err := w.Checkpoint()
+		require.NoError(t, err)
+		require.NoError(t, w.Truncate(pos))
+
+		remaining, err := segment.ListSegments(vfs.OS, cfg.DataDirectory)
+		require.NoError(t, err)
+		require.Len(t, remaining, 1)
+		archived, err := segment.ListSegments(vfs.OS, cfg.ArchiveDirectory)
+		require.NoError(t, err)
+		assert.Greater(t, len(archived), 1)
+
+		// Every entry can be restored from the archive
+		result, err := Restore(vfs.OS, cfg.ArchiveDirectory, t.TempDir(), RestoreTarget{})
+		require.NoError(t, err)
+		assert.Equal(t, 10, result.Entries)
+		assert.Equal(t, uint64(10), result.LastLSN)
+		assert.NotZero(t, result.LastTimestamp)
+	})
+
+	t.Run("segment archived under the same name by another server", func(t *testing.T) {
+		cfg := config.WALConfig{
+			Enabled:              true,
+			DataDirectory:        t.TempDir(),
+			ArchiveDirectory:     t.TempDir(),
+			FlushingBatchSize:    1,
+			FlushingBatchTimeout: 10 * time.Millisecond,
+			MaxSegmentSizeBytes:  1024,
+		}
+		writeSegment(t, cfg.ArchiveDirectory, segment.FileName(1),
+			entry.Entry{LSN: 1, Operation: entry.OperationClear})
+
+		w, err := New(cfg, vfs.OS, testLogger())
+		require.NoError(t, err)
+		defer w.Close()
+
+		_, err = w.Write(entry.Entry{Operation: entry.OperationSet, Key: "key", Value: "value"})
+		require.NoError(t, err)
+		pos, err := w.Checkpoint()
+		require.NoError(t, err)
+
+		// The segment is kept as long as it cannot be archived
+		assert.ErrorIs(t, w.Truncate(pos), ErrArchiveSegment)
+		_, err = os.Stat(filepath.Join(cfg.DataDirectory, segment.FileName(1)))
+		assert.NoError(t, err)
+	})
+}
+
+func TestRestore(t *testing.T) {
+	base := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(minutes int) int64 {
+		return base.Add(time.Duration(minutes) * time.Minute).UnixNano()
+	}
+
+	archive := t.TempDir()
+	writeSegment(t, archive, segment.FileName(1),
+		entry.Entry{LSN: 1, Timestamp: at(0), Operation: entry.OperationSet, Key: "k1", Value: "v1"},
+		entry.Entry{LSN: 2, Timestamp: at(1), Operation: entry.OperationSet, Key: "k2", Value: "v2"},
+	)
+	writeSegment(t, archive, segment.FileName(3),
+		entry.Entry{LSN: 3, Timestamp: at(2), Operation: entry.OperationClear},
+		entry.Entry{LSN: 4, Timestamp: at(3), Operation: entry.OperationDelete, Key: "k1"},
+	)
+
+	restored := func(t *testing.T, dir string) []uint64 {
+		t.Helper()
+
+		var lsns []uint64
+		segments, err := segment.ListSegments(vfs.OS, dir)
+		require.NoError(t, err)
+		for _, s := range segments {
+			entries, err := segment.ReadSegmentEntries(vfs.OS, dir, s.Name)
+			require.NoError(t, err)
+			for _, e := range entries {
+				lsns = append(lsns, e.LSN)
+			}
+		}
+
+		return lsns
+	}
+
+	t.Run("up to an LSN", func(t *testing.T) {
+		dir := t.TempDir()
+		result, err := Restore(vfs.OS, archive, dir, RestoreTarget{LSN: 3})
+		require.NoError(t, err)
+		assert.Equal(t, RestoreResult{
+			Segments:      2,
+			Entries:       3,
+			LastLSN:       3,
+			LastTimestamp: at(2),
+		}, result)
+		assert.Equal(t, []uint64{1, 2, 3}, restored(t, dir))
+	})
+
+	t.Run("up to a time, before the mistaken CLEAR", func(t *testing.T) {
+		dir := t.TempDir()
+		result, err := Restore(vfs.OS, archive, dir, RestoreTarget{Time: base.Add(90 * time.Second)})
+		require.NoError(t, err)
+		assert.Equal(t, 1, result.Segments)
+		assert.Equal(t, []uint64{1, 2}, restored(t, dir))
+	})
+
+	t.Run("target inside a compressed block", func(t *testing.T) {
+		blocks := t.TempDir()
+		var buf bytes.Buffer
+		var entries []entry.Entry
+		for i := 1; i <= 20; i++ {
+			entries = append(entries, entry.Entry{
+				LSN: uint64(i), Operation: entry.OperationSet, Key: fmt.Sprintf("key%d", i), Value: "value",
+			})
+		}
+		_, err := entry.WriteBlock(&buf, entries)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(blocks, segment.FileName(1)), buf.Bytes(), 0o600))
+
+		dir := t.TempDir()
+		result, err := Restore(vfs.OS, blocks, dir, RestoreTarget{LSN: 5})
+		require.NoError(t, err)
+		assert.Equal(t, 5, result.Entries)
+		assert.Equal(t, []uint64{1, 2, 3, 4, 5}, restored(t, dir))
+	})
+
+	t.Run("non-empty data directory", func(t *testing.T) {
+		dir := t.TempDir()
+		writeSegment(t, dir, segment.FileName(1))
+
+		_, err := Restore(vfs.OS, archive, dir, RestoreTarget{})
+		assert.ErrorIs(t, err, ErrRestore)
+	})
+
+	t.Run("missing segment", func(t *testing.T) {
+		gapped := t.TempDir()
+		writeSegment(t, gapped, segment.FileName(1),
+			entry.Entry{LSN: 1, Operation: entry.OperationSet, Key: "k1", Value: "v1"})
+		writeSegment(t, gapped, segment.FileName(5),
+			entry.Entry{LSN: 5, Operation: entry.OperationSet, Key: "k1", Value: "v1"})
+
+		_, err := Restore(vfs.OS, gapped, t.TempDir(), RestoreTarget{})
+		assert.ErrorIs(t, err, ErrArchiveGap)
+	})
+}
@@ -0,0 +1,150 @@
+package entry
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"sync"
+)
+
+// FormatFlate marks a framed record whose payload is the flate-compressed
+// sequence of the framed records of several entries
+const FormatFlate byte = 0xA3
+
+// maxBlockSize bounds the decompressed size of a compressed block
+const maxBlockSize = 1 << 30
+
+var flateWriters = sync.Pool{
+	New: func() any {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+// WriteBlock writes the entries to w as a single compressed record. The
+// entries are written as plain records instead if they do not compress.
+func WriteBlock(w io.Writer, entries []Entry) (int64, error) {
+	var records bytes.Buffer
+	for i := range entries {
+		if _, err := entries[i].WriteTo(&records); err != nil {
+			return 0, err
+		}
+	}
+
+	var compressed bytes.Buffer
+	fw, _ := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(fw)
+	fw.Reset(&compressed)
+	if _, err := fw.Write(records.Bytes()); err != nil {
+		return 0, err
+	}
+	if err := fw.Close(); err != nil {
+		return 0, err
+	}
+
+	if compressed.Len()+headerSize >= records.Len() || compressed.Len() > math.MaxUint32 {
+		n, err := w.Write(records.Bytes())
+		return int64(n), err
+	}
+
+	block := make([]byte, headerSize, headerSize+compressed.Len())
+	block[0] = FormatFlate
+	binary.LittleEndian.PutUint32(block[1:5], uint32(compressed.Len()))
+	binary.LittleEndian.PutUint32(block[5:9], crc32.Checksum(compressed.Bytes(), crcTable))
+	block = append(block, compressed.Bytes()...)
+
+	n, err := w.Write(block)
+
+	return int64(n), err
+}
+
+// Reader reads the entries of a sequence of records, plain or compressed
+type Reader struct {
+	r io.Reader
+	// pending holds the entries of a compressed block not returned yet
+	pending []*Entry
+}
+
+// NewReader creates a Reader reading the records from r
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// Next returns the next entry and the number of bytes read from the
+// underlying reader for it: the size of its record, or of the whole block for
+// the first entry of a compressed block and zero for the others. It returns
+// io.EOF if there is no more data and io.ErrUnexpectedEOF if the record is
+// incomplete.
+func (r *Reader) Next() (*Entry, int64, error) {
+	if len(r.pending) > 0 {
+		e := r.pending[0]
+		r.pending = r.pending[1:]
+		return e, 0, nil
+	}
+
+	marker := make([]byte, 1)
+	n, err := io.ReadFull(r.r, marker)
+	if err != nil {
+		return nil, int64(n), err
+	}
+
+	if marker[0] != FormatFlate {
+		e := &Entry{}
+		m, err := e.readRecord(r.r, marker[0])
+		if err != nil {
+			return nil, int64(n) + m, err
+		}
+		return e, int64(n) + m, nil
+	}
+
+	payload, m, err := readPayload(r.r)
+	if err != nil {
+		return nil, int64(n) + m, err
+	}
+	entries, err := decompressBlock(payload)
+	if err != nil {
+		return nil, int64(n) + m, err
+	}
+
+	r.pending = entries[1:]
+
+	return entries[0], int64(n) + m, nil
+}
+
+// decompressBlock decodes the entries of a compressed block payload
+func decompressBlock(payload []byte) ([]*Entry, error) {
+	var records bytes.Buffer
+	fr := flate.NewReader(bytes.NewReader(payload))
+	defer fr.Close()
+
+	n, err := io.Copy(&records, io.LimitReader(fr, maxBlockSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptEntry, err)
+	}
+	if n > maxBlockSize {
+		return nil, fmt.Errorf("%w: block exceeds %d bytes", ErrCorruptEntry, maxBlockSize)
+	}
+
+	var entries []*Entry
+	for {
+		e := &Entry{}
+		_, err := e.ReadFrom(&records)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorruptEntry, err)
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%w: empty block", ErrCorruptEntry)
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,154 @@
+package entry
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// jsonEntries returns entries with compressible values
+func jsonEntries(lsn uint64, count int) []Entry {
+	entries := make([]Entry, count)
+	for i := range entries {
+		entries[i] = Entry{
+			LSN:       lsn + uint64(i),
+			Timestamp: 1700000000000000000,
+			Operation: OperationSet,
+			Key:       fmt.Sprintf("user:%d", i),
+			Value:     fmt.Sprintf(`{"id":%d,"name":"user","roles":["reader","writer"],"active":true}`, i),
+		}
+	}
+
+	return entries
+}
+
+// readAll reads the entries with a Reader and the bytes consumed for each
+func readAll(t *testing.T, r io.Reader) ([]Entry, []int64) {
+	t.Helper()
+
+	var (
+		entries []Entry
+		sizes   []int64
+	)
+	reader := NewReader(r)
+	for {
+		e, n, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		entries = append(entries, *e)
+		sizes = append(sizes, n)
+	}
+
+	return entries, sizes
+}
+
+func TestWriteBlock(t *testing.T) {
+	t.Run("round trip", func(t *testing.T) {
+		entries := jsonEntries(1, 50)
+
+		var plain bytes.Buffer
+		for _, e := range entries {
+			_, err := e.WriteTo(&plain)
+			require.NoError(t, err)
+		}
+
+		var buf bytes.Buffer
+		n, err := WriteBlock(&buf, entries)
+		require.NoError(t, err)
+		assert.Equal(t, int64(buf.Len()), n)
+		assert.Equal(t, FormatFlate, buf.Bytes()[0])
+		assert.Less(t, buf.Len(), plain.Len()/3)
+
+		read, sizes := readAll(t, &buf)
+		assert.Equal(t, entries, read)
+
+		// The whole block is accounted to its first entry
+		assert.Equal(t, n, sizes[0])
+		for _, size := range sizes[1:] {
+			assert.Zero(t, size)
+		}
+	})
+
+	t.Run("incompressible entries are written as plain records", func(t *testing.T) {
+		entries := []Entry{{LSN: 1, Operation: OperationDelete, Key: "k"}}
+
+		var buf bytes.Buffer
+		_, err := WriteBlock(&buf, entries)
+		require.NoError(t, err)
+		assert.Equal(t, FormatV2, buf.Bytes()[0])
+
+		read, _ := readAll(t, &buf)
+		assert.Equal(t, entries, read)
+	})
+
+	t.Run("plain and compressed records mixed", func(t *testing.T) {
+		var buf bytes.Buffer
+		first := Entry{LSN: 1, Operation: OperationSet, Key: "k", Value: "v"}
+		_, err := first.WriteTo(&buf)
+		require.NoError(t, err)
+		block := jsonEntries(2, 20)
+		_, err = WriteBlock(&buf, block)
+		require.NoError(t, err)
+		last := Entry{LSN: 22, Operation: OperationClear}
+		_, err = last.WriteTo(&buf)
+		require.NoError(t, err)
+
+		read, _ := readAll(t, &buf)
+		expected := append(append([]Entry{first}, block...), last)
+		assert.Equal(t, expected, read)
+	})
+}
+
+func TestReader_Errors(t *testing.T) {
+	block := func(t *testing.T) []byte {
+		t.Helper()
+
+		var buf bytes.Buffer
+		_, err := WriteBlock(&buf, jsonEntries(1, 20))
+		require.NoError(t, err)
+
+		return buf.Bytes()
+	}
+
+	t.Run("checksum mismatch", func(t *testing.T) {
+		data := block(t)
+		data[len(data)-1] ^= 0xFF
+
+		_, _, err := NewReader(bytes.NewReader(data)).Next()
+		assert.ErrorIs(t, err, ErrChecksumMismatch)
+	})
+
+	t.Run("incomplete block", func(t *testing.T) {
+		data := block(t)
+
+		_, n, err := NewReader(bytes.NewReader(data[:len(data)-1])).Next()
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+		assert.Equal(t, int64(len(data)-1), n)
+	})
+
+	t.Run("block read as a single entry", func(t *testing.T) {
+		_, err := ReadEntry(bytes.NewReader(block(t)))
+		assert.ErrorIs(t, err, ErrUnknownFormat)
+	})
+
+	t.Run("corrupt compressed data", func(t *testing.T) {
+		payload := []byte(strings.Repeat("x", 16))
+		header := make([]byte, headerSize)
+		header[0] = FormatFlate
+		binary.LittleEndian.PutUint32(header[1:5], uint32(len(payload)))
+		binary.LittleEndian.PutUint32(header[5:9], crc32.Checksum(payload, crcTable))
+		data := append(header, payload...)
+
+		_, _, err := NewReader(bytes.NewReader(data)).Next()
+		assert.ErrorIs(t, err, ErrCorruptEntry)
+	})
+}
@@ -1,8 +1,11 @@
 package entry
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"math"
 )
@@ -17,116 +20,412 @@ const (
 	OperationDelete Operation = 2
 	// OperationClear is the clear operation
 	OperationClear Operation = 3
+	// OperationExpire sets (or removes, when ExpiresAt is zero) the expiration of a key
+	OperationExpire Operation = 4
+	// OperationBatch groups the SET, DELETE and EXPIRE operations of Entries
+	// into a single record, so they are recovered and replicated all or none
+	OperationBatch Operation = 5
+)
+
+// String returns the name of the operation
+func (o Operation) String() string {
+	switch o {
+	case OperationSet:
+		return "SET"
+	case OperationDelete:
+		return "DELETE"
+	case OperationClear:
+		return "CLEAR"
+	case OperationExpire:
+		return "EXPIRE"
+	case OperationBatch:
+		return "BATCH"
+	}
+
+	return fmt.Sprintf("Operation(%d)", byte(o))
+}
+
+const (
+	// FormatV1 marks a framed record: marker, payload length, CRC32 of the
+	// payload and the payload itself. Records written before framing was
+	// introduced start directly with the operation byte and are still readable.
+	FormatV1 byte = 0xA1
+	// FormatV2 marks a framed record whose payload has a flags byte after the
+	// operation announcing the optional fields that follow it
+	FormatV2 byte = 0xA2
+)
+
+// Payload flags of FormatV2 records
+const (
+	flagExpiresAt byte = 1 << iota
+	flagLSN
+	flagTimestamp
+)
+
+// headerSize is the size of the marker, length and checksum of a framed record
+const headerSize = 9
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	// ErrChecksumMismatch returned when the checksum of a record does not match its payload
+	ErrChecksumMismatch = errors.New("entry checksum mismatch")
+
+	// ErrUnknownFormat returned when a record starts with an unknown marker
+	ErrUnknownFormat = errors.New("unknown entry format")
+
+	// ErrCorruptEntry returned when a record payload cannot be decoded
+	ErrCorruptEntry = errors.New("corrupt entry")
+
+	// ErrInvalidBatch returned when a batch holds an operation that cannot be batched
+	ErrInvalidBatch = errors.New("invalid batch operation")
 )
 
 // Entry represents a single WAL entry
 type Entry struct {
+	// LSN is the log sequence number assigned by the WAL, zero for the
+	// operations of a batch and for records written before LSNs were introduced
+	LSN uint64
+	// Timestamp is the time the WAL accepted the entry in Unix nanoseconds,
+	// zero for the operations of a batch and for older records
+	Timestamp int64
 	Operation Operation
 	Key       string
 	Value     string
+	// ExpiresAt is the absolute expiration time in Unix nanoseconds, zero if the key does not expire
+	ExpiresAt int64
+	// Entries holds the operations of a batch
+	Entries []Entry
 }
 
-// WriteTo writes the entry to an io.Writer
+// WriteTo writes the entry to an io.Writer as a framed record
 func (e *Entry) WriteTo(w io.Writer) (int64, error) {
-	var total int64
+	payload, err := e.marshal()
+	if err != nil {
+		return 0, err
+	}
+
+	record := make([]byte, headerSize, headerSize+len(payload))
+	record[0] = FormatV2
+	binary.LittleEndian.PutUint32(record[1:5], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[5:9], crc32.Checksum(payload, crcTable))
+	record = append(record, payload...)
+
+	n, err := w.Write(record)
+
+	return int64(n), err
+}
+
+// marshal encodes the operation, the flags, the optional fields, the key and,
+// for SET, the value. A batch encodes the number of its operations followed
+// by their length-prefixed payloads instead of the key.
+func (e *Entry) marshal() ([]byte, error) {
+	if e.Operation == OperationBatch {
+		return e.marshalBatch()
+	}
+	if len(e.Key) > math.MaxUint32 {
+		return nil, errors.New("key length exceeds maximum allowed value")
+	}
+	if len(e.Value) > math.MaxUint32 {
+		return nil, errors.New("value length exceeds maximum allowed value")
+	}
+
+	buf := make([]byte, 0, 34+len(e.Key)+len(e.Value))
+	buf = e.appendHeader(buf)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(e.Key)))
+	buf = append(buf, e.Key...)
+
+	// For the SET operation, write the value
+	if e.Operation == OperationSet {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(e.Value)))
+		buf = append(buf, e.Value...)
+	}
+
+	if len(buf) > math.MaxUint32 {
+		return nil, errors.New("entry size exceeds maximum allowed value")
+	}
+
+	return buf, nil
+}
 
-	// Write the operation type
-	n, err := w.Write([]byte{byte(e.Operation)})
+// appendHeader appends the operation, the flags and the optional fields
+func (e *Entry) appendHeader(buf []byte) []byte {
+	var flags byte
+	if e.ExpiresAt != 0 {
+		flags |= flagExpiresAt
+	}
+	if e.LSN != 0 {
+		flags |= flagLSN
+	}
+	if e.Timestamp != 0 {
+		flags |= flagTimestamp
+	}
+
+	buf = append(buf, byte(e.Operation), flags)
+	if flags&flagExpiresAt != 0 {
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(e.ExpiresAt))
+	}
+	if flags&flagLSN != 0 {
+		buf = binary.LittleEndian.AppendUint64(buf, e.LSN)
+	}
+	if flags&flagTimestamp != 0 {
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(e.Timestamp))
+	}
+
+	return buf
+}
+
+func (e *Entry) marshalBatch() ([]byte, error) {
+	if len(e.Entries) > math.MaxUint32 {
+		return nil, errors.New("batch size exceeds maximum allowed value")
+	}
+
+	buf := e.appendHeader(make([]byte, 0, 30))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(e.Entries)))
+	for i := range e.Entries {
+		if !isBatchable(e.Entries[i].Operation) {
+			return nil, fmt.Errorf("%w: %d", ErrInvalidBatch, e.Entries[i].Operation)
+		}
+		payload, err := e.Entries[i].marshal()
+		if err != nil {
+			return nil, err
+		}
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(payload)))
+		buf = append(buf, payload...)
+	}
+
+	if len(buf) > math.MaxUint32 {
+		return nil, errors.New("entry size exceeds maximum allowed value")
+	}
+
+	return buf, nil
+}
+
+// ReadFrom reads an entry from an io.Reader. It returns io.EOF if there is
+// no more data and io.ErrUnexpectedEOF if the record is incomplete. The
+// compressed blocks of several entries are read with a Reader instead.
+func (e *Entry) ReadFrom(r io.Reader) (int64, error) {
+	marker := make([]byte, 1)
+	n, err := io.ReadFull(r, marker)
 	if err != nil {
-		return total, err
+		return int64(n), err
 	}
-	total += int64(n)
 
-	// Write the length of the key using a preallocated buffer
-	keyLen := len(e.Key)
-	if keyLen > math.MaxUint32 {
-		return total, errors.New("key length exceeds maximum allowed value")
+	m, err := e.readRecord(r, marker[0])
+
+	return int64(n) + m, err
+}
+
+// readRecord reads the rest of a record after its marker
+func (e *Entry) readRecord(r io.Reader, marker byte) (int64, error) {
+	switch {
+	case marker == FormatV1, marker == FormatV2:
+		return e.readFramed(r, marker)
+	case isOperation(marker) && Operation(marker) != OperationBatch:
+		return e.readLegacy(r, Operation(marker))
+	default:
+		return 0, fmt.Errorf("%w: marker 0x%02x", ErrUnknownFormat, marker)
 	}
-	buf := make([]byte, 4)
-	binary.LittleEndian.PutUint32(buf, uint32(keyLen))
-	n, err = w.Write(buf)
+}
+
+// readFramed reads the rest of a framed record after its marker
+func (e *Entry) readFramed(r io.Reader, format byte) (int64, error) {
+	payload, total, err := readPayload(r)
 	if err != nil {
 		return total, err
 	}
-	total += int64(n)
 
-	// Write the key
-	n, err = w.Write([]byte(e.Key))
-	if err != nil {
+	if err := e.unmarshal(payload, format); err != nil {
 		return total, err
 	}
+
+	return total, nil
+}
+
+// readPayload reads the length, the checksum and the payload of a framed
+// record after its marker and verifies the checksum
+func readPayload(r io.Reader) ([]byte, int64, error) {
+	var total int64
+
+	header := make([]byte, headerSize-1)
+	n, err := io.ReadFull(r, header)
 	total += int64(n)
+	if err != nil {
+		return nil, total, unexpected(err)
+	}
+	length := binary.LittleEndian.Uint32(header[0:4])
+	checksum := binary.LittleEndian.Uint32(header[4:8])
 
-	// For the SET operation, write the value
-	if e.Operation == OperationSet {
-		valueLen := len(e.Value)
-		if valueLen > math.MaxUint32 {
-			return total, errors.New("value length exceeds maximum allowed value")
+	// The payload buffer grows with the data actually read, so a corrupted
+	// length cannot cause a huge allocation
+	var payload bytes.Buffer
+	m, err := io.CopyN(&payload, r, int64(length))
+	total += m
+	if err != nil {
+		return nil, total, unexpected(err)
+	}
+
+	if crc32.Checksum(payload.Bytes(), crcTable) != checksum {
+		return nil, total, ErrChecksumMismatch
+	}
+
+	return payload.Bytes(), total, nil
+}
+
+// unmarshal decodes a record payload
+func (e *Entry) unmarshal(payload []byte, format byte) error {
+	if len(payload) == 0 || !isOperation(payload[0]) {
+		return ErrCorruptEntry
+	}
+	op := Operation(payload[0])
+	payload = payload[1:]
+
+	var (
+		expiresAt int64
+		lsn       uint64
+		timestamp int64
+	)
+	if format == FormatV2 {
+		if len(payload) == 0 {
+			return ErrCorruptEntry
 		}
-		binary.LittleEndian.PutUint32(buf, uint32(valueLen))
-		n, err = w.Write(buf)
-		if err != nil {
-			return total, err
+		flags := payload[0]
+		payload = payload[1:]
+
+		if flags&flagExpiresAt != 0 {
+			if len(payload) < 8 {
+				return ErrCorruptEntry
+			}
+			expiresAt = int64(binary.LittleEndian.Uint64(payload))
+			payload = payload[8:]
 		}
-		total += int64(n)
+		if flags&flagLSN != 0 {
+			if len(payload) < 8 {
+				return ErrCorruptEntry
+			}
+			lsn = binary.LittleEndian.Uint64(payload)
+			payload = payload[8:]
+		}
+		if flags&flagTimestamp != 0 {
+			if len(payload) < 8 {
+				return ErrCorruptEntry
+			}
+			timestamp = int64(binary.LittleEndian.Uint64(payload))
+			payload = payload[8:]
+		}
+	}
 
-		n, err = w.Write([]byte(e.Value))
+	if op == OperationBatch {
+		if format != FormatV2 {
+			return ErrCorruptEntry
+		}
+		entries, err := unmarshalBatch(payload)
 		if err != nil {
-			return total, err
+			return err
 		}
-		total += int64(n)
+		*e = Entry{LSN: lsn, Timestamp: timestamp, Operation: OperationBatch, Entries: entries}
+
+		return nil
 	}
 
-	return total, nil
+	r := bytes.NewReader(payload)
+	if _, err := e.readLegacy(r, op); err != nil {
+		return fmt.Errorf("%w: %v", ErrCorruptEntry, err)
+	}
+	if r.Len() != 0 {
+		return fmt.Errorf("%w: %d trailing bytes", ErrCorruptEntry, r.Len())
+	}
+	e.ExpiresAt = expiresAt
+	e.LSN = lsn
+	e.Timestamp = timestamp
+
+	return nil
 }
 
-// ReadFrom reads an entry from an io.Reader
-func (e *Entry) ReadFrom(r io.Reader) (int64, error) {
-	var total int64
+// unmarshalBatch decodes the operations of a batch payload
+func unmarshalBatch(payload []byte) ([]Entry, error) {
+	if len(payload) < 4 {
+		return nil, ErrCorruptEntry
+	}
+	count := binary.LittleEndian.Uint32(payload)
+	payload = payload[4:]
 
-	// Read operation type
-	opByte := make([]byte, 1)
-	n, err := io.ReadFull(r, opByte)
-	if err != nil {
-		return total, err
+	// Every operation takes at least its length, so a corrupted count
+	// cannot cause a huge allocation
+	if uint64(count) > uint64(len(payload)/4) {
+		return nil, fmt.Errorf("%w: batch of %d operations in %d bytes", ErrCorruptEntry, count, len(payload))
 	}
-	total += int64(n)
-	e.Operation = Operation(opByte[0])
+
+	entries := make([]Entry, count)
+	for i := range entries {
+		if len(payload) < 4 {
+			return nil, ErrCorruptEntry
+		}
+		length := binary.LittleEndian.Uint32(payload)
+		payload = payload[4:]
+		if uint64(length) > uint64(len(payload)) {
+			return nil, ErrCorruptEntry
+		}
+
+		if length == 0 || !isBatchable(Operation(payload[0])) {
+			return nil, fmt.Errorf("%w: %w", ErrCorruptEntry, ErrInvalidBatch)
+		}
+
+		if err := entries[i].unmarshal(payload[:length], FormatV2); err != nil {
+			return nil, err
+		}
+		payload = payload[length:]
+	}
+	if len(payload) != 0 {
+		return nil, fmt.Errorf("%w: %d trailing bytes", ErrCorruptEntry, len(payload))
+	}
+
+	return entries, nil
+}
+
+// readLegacy reads the key and value that follow the operation byte
+func (e *Entry) readLegacy(r io.Reader, op Operation) (int64, error) {
+	var total int64
+	e.Operation = op
+	e.Key = ""
+	e.Value = ""
+	e.ExpiresAt = 0
+	e.LSN = 0
+	e.Timestamp = 0
+	e.Entries = nil
 
 	// Read key length using a preallocated buffer
 	buf := make([]byte, 4)
-	n, err = io.ReadFull(r, buf)
+	n, err := io.ReadFull(r, buf)
+	total += int64(n)
 	if err != nil {
-		return total, err
+		return total, unexpected(err)
 	}
-	total += int64(n)
 	keyLen := binary.LittleEndian.Uint32(buf)
 
 	// Read key
-	keyBytes := make([]byte, keyLen)
-	n, err = io.ReadFull(r, keyBytes)
+	key, m, err := readString(r, keyLen)
+	total += m
 	if err != nil {
 		return total, err
 	}
-	total += int64(n)
-	e.Key = string(keyBytes)
+	e.Key = key
 
 	// For SET operations, read value
 	if e.Operation == OperationSet {
 		n, err = io.ReadFull(r, buf)
+		total += int64(n)
 		if err != nil {
-			return total, err
+			return total, unexpected(err)
 		}
-		total += int64(n)
 		valueLen := binary.LittleEndian.Uint32(buf)
 
-		valueBytes := make([]byte, valueLen)
-		n, err = io.ReadFull(r, valueBytes)
+		value, m, err := readString(r, valueLen)
+		total += m
 		if err != nil {
 			return total, err
 		}
-		total += int64(n)
-		e.Value = string(valueBytes)
+		e.Value = value
 	}
 
 	return total, nil
@@ -141,3 +440,41 @@ func ReadEntry(r io.Reader) (*Entry, error) {
 
 	return entry, nil
 }
+
+func readString(r io.Reader, length uint32) (string, int64, error) {
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, r, int64(length))
+	if err != nil {
+		return "", n, unexpected(err)
+	}
+
+	return buf.String(), n, nil
+}
+
+func isOperation(b byte) bool {
+	switch Operation(b) {
+	case OperationSet, OperationDelete, OperationClear, OperationExpire, OperationBatch:
+		return true
+	default:
+		return false
+	}
+}
+
+// isBatchable reports whether the operation can be part of a batch
+func isBatchable(op Operation) bool {
+	return op == OperationSet || op == OperationDelete || op == OperationExpire
+}
+
+// unexpected converts io.EOF in the middle of a record into io.ErrUnexpectedEOF
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
+// Expired reports whether the entry carries an expiration time that is not after now
+func (e *Entry) Expired(now int64) bool {
+	return e.ExpiresAt != 0 && e.ExpiresAt <= now
+}
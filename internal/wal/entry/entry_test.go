@@ -2,6 +2,9 @@ package entry
 
 import (
 	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -44,6 +47,123 @@ func TestEntry_WriteTo(t *testing.T) {
 		require.NoError(t, err)
 		assert.Equal(t, e, *readEntry)
 	})
+
+	t.Run("write SET operation with expiration", func(t *testing.T) {
+		e := Entry{
+			Operation: OperationSet,
+			Key:       "test-key",
+			Value:     "test-value",
+			ExpiresAt: 1700000000000000000,
+		}
+
+		buf := new(bytes.Buffer)
+		_, err := e.WriteTo(buf)
+		require.NoError(t, err)
+
+		readEntry, err := ReadEntry(buf)
+		require.NoError(t, err)
+		assert.Equal(t, e, *readEntry)
+	})
+
+	t.Run("write operation with LSN and timestamp", func(t *testing.T) {
+		e := Entry{
+			LSN:       42,
+			Timestamp: 1700000000123456789,
+			Operation: OperationSet,
+			Key:       "test-key",
+			Value:     "test-value",
+			ExpiresAt: 1700000000000000000,
+		}
+
+		buf := new(bytes.Buffer)
+		_, err := e.WriteTo(buf)
+		require.NoError(t, err)
+
+		readEntry, err := ReadEntry(buf)
+		require.NoError(t, err)
+		assert.Equal(t, e, *readEntry)
+	})
+
+	t.Run("write EXPIRE operation", func(t *testing.T) {
+		e := Entry{
+			Operation: OperationExpire,
+			Key:       "test-key",
+			ExpiresAt: 1700000000000000000,
+		}
+
+		buf := new(bytes.Buffer)
+		_, err := e.WriteTo(buf)
+		require.NoError(t, err)
+
+		readEntry, err := ReadEntry(buf)
+		require.NoError(t, err)
+		assert.Equal(t, e, *readEntry)
+	})
+}
+
+func TestEntry_Expired(t *testing.T) {
+	assert.False(t, (&Entry{}).Expired(100))
+	assert.False(t, (&Entry{ExpiresAt: 200}).Expired(100))
+	assert.True(t, (&Entry{ExpiresAt: 100}).Expired(100))
+}
+
+func TestEntry_Framing(t *testing.T) {
+	t.Run("checksum mismatch", func(t *testing.T) {
+		e := Entry{Operation: OperationSet, Key: "test-key", Value: "test-value"}
+
+		buf := new(bytes.Buffer)
+		_, err := e.WriteTo(buf)
+		require.NoError(t, err)
+
+		data := buf.Bytes()
+		data[len(data)-1] ^= 0xFF
+
+		_, err = ReadEntry(bytes.NewReader(data))
+		assert.ErrorIs(t, err, ErrChecksumMismatch)
+	})
+
+	t.Run("incomplete record", func(t *testing.T) {
+		e := Entry{Operation: OperationSet, Key: "test-key", Value: "test-value"}
+
+		buf := new(bytes.Buffer)
+		_, err := e.WriteTo(buf)
+		require.NoError(t, err)
+
+		for _, size := range []int{1, headerSize, buf.Len() - 1} {
+			_, err = ReadEntry(bytes.NewReader(buf.Bytes()[:size]))
+			assert.ErrorIs(t, err, io.ErrUnexpectedEOF, "size %d", size)
+		}
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		_, err := ReadEntry(bytes.NewReader([]byte{0, 0, 0, 0}))
+		assert.ErrorIs(t, err, ErrUnknownFormat)
+	})
+
+	t.Run("read V1 framed record", func(t *testing.T) {
+		payload := []byte{byte(OperationDelete), 3, 0, 0, 0, 'k', 'e', 'y'}
+		header := make([]byte, headerSize)
+		header[0] = FormatV1
+		binary.LittleEndian.PutUint32(header[1:5], uint32(len(payload)))
+		binary.LittleEndian.PutUint32(header[5:9], crc32.Checksum(payload, crcTable))
+
+		e, err := ReadEntry(bytes.NewReader(append(header, payload...)))
+		require.NoError(t, err)
+		assert.Equal(t, &Entry{Operation: OperationDelete, Key: "key"}, e)
+	})
+
+	t.Run("read legacy record", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		buf.WriteByte(byte(OperationSet))
+		buf.Write([]byte{3, 0, 0, 0})
+		buf.WriteString("key")
+		buf.Write([]byte{5, 0, 0, 0})
+		buf.WriteString("value")
+
+		e, err := ReadEntry(buf)
+		require.NoError(t, err)
+		assert.Equal(t, &Entry{Operation: OperationSet, Key: "key", Value: "value"}, e)
+	})
 }
 
 func TestEntry_ReadFrom(t *testing.T) {
@@ -124,3 +244,45 @@ func TestReadEntry(t *testing.T) {
 		assert.Nil(t, entry)
 	})
 }
+
+func TestEntry_Batch(t *testing.T) {
+	t.Run("round trip", func(t *testing.T) {
+		e := Entry{
+			LSN:       7,
+			Timestamp: 1700000000123456789,
+			Operation: OperationBatch,
+			Entries: []Entry{
+				{Operation: OperationSet, Key: "k1", Value: "v1"},
+				{Operation: OperationSet, Key: "k2", Value: "v2", ExpiresAt: 1700000000000000000},
+				{Operation: OperationDelete, Key: "k3"},
+			},
+		}
+
+		buf := new(bytes.Buffer)
+		_, err := e.WriteTo(buf)
+		require.NoError(t, err)
+
+		readEntry, err := ReadEntry(buf)
+		require.NoError(t, err)
+		assert.Equal(t, e, *readEntry)
+	})
+
+	t.Run("operations that cannot be batched", func(t *testing.T) {
+		for _, op := range []Operation{OperationClear, OperationBatch} {
+			e := Entry{Operation: OperationBatch, Entries: []Entry{{Operation: op}}}
+			_, err := e.WriteTo(new(bytes.Buffer))
+			assert.ErrorIs(t, err, ErrInvalidBatch)
+		}
+	})
+
+	t.Run("corrupted count", func(t *testing.T) {
+		payload := []byte{byte(OperationBatch), 0, 0xFF, 0xFF, 0xFF, 0xFF}
+		header := make([]byte, headerSize)
+		header[0] = FormatV2
+		binary.LittleEndian.PutUint32(header[1:5], uint32(len(payload)))
+		binary.LittleEndian.PutUint32(header[5:9], crc32.Checksum(payload, crcTable))
+
+		_, err := ReadEntry(bytes.NewReader(append(header, payload...)))
+		assert.ErrorIs(t, err, ErrCorruptEntry)
+	})
+}
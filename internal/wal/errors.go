@@ -24,6 +24,33 @@ var (
 	// ErrRotateSegment returned when segment rotation fails
 	ErrRotateSegment = errors.New("failed to rotate segment")
 
+	// ErrWALFailed returned by the writes once a flush has failed, until the WAL is resumed
+	ErrWALFailed = errors.New("WAL failed")
+
+	// ErrResume returned when the WAL cannot leave the failed state
+	ErrResume = errors.New("failed to resume WAL")
+
+	// ErrReopen returned when the WAL cannot continue after the segments of the data directory
+	ErrReopen = errors.New("failed to reopen WAL")
+
 	// ErrCloseSegment returned when closing current segment fails
 	ErrCloseSegment = errors.New("failed to close current segment")
+
+	// ErrCheckpoint returned when a checkpoint of the WAL fails
+	ErrCheckpoint = errors.New("failed to checkpoint WAL")
+
+	// ErrUnknownDurability returned when the configured durability mode is not supported
+	ErrUnknownDurability = errors.New("unknown WAL durability mode")
+
+	// ErrUnknownCompression returned when the configured compression is not supported
+	ErrUnknownCompression = errors.New("unknown WAL compression")
+
+	// ErrArchiveSegment returned when a segment cannot be copied to the archive
+	ErrArchiveSegment = errors.New("failed to archive segment")
+
+	// ErrRestore returned when the WAL cannot be restored from the archive
+	ErrRestore = errors.New("failed to restore WAL")
+
+	// ErrArchiveGap returned when the archived segments miss entries
+	ErrArchiveGap = errors.New("missing entries in the WAL archive")
 )
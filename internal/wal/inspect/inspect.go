@@ -0,0 +1,226 @@
+// Package inspect reads and repairs the WAL segments of a stopped server
+package inspect
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/8thgencore/valchemy/internal/vfs"
+	"github.com/8thgencore/valchemy/internal/wal/entry"
+	"github.com/8thgencore/valchemy/internal/wal/segment"
+)
+
+var (
+	// ErrUnknownOperation returned when an operation name is not recognized
+	ErrUnknownOperation = errors.New("unknown operation")
+
+	// ErrInvalidSegmentName returned when a name does not designate a segment file
+	ErrInvalidSegmentName = errors.New("invalid segment name")
+
+	// ErrNotTorn returned when truncating a segment would drop the records
+	// that follow a corrupt one
+	ErrNotTorn = errors.New("the corrupt record is followed by other data")
+)
+
+// SegmentStat describes a segment file
+type SegmentStat struct {
+	Name    string
+	Size    int64
+	Entries int
+	// FirstLSN and LastLSN are the LSNs of the first and the last entries,
+	// zero for entries written before LSNs were introduced
+	FirstLSN uint64
+	LastLSN  uint64
+	// Err is the *segment.CorruptionError of a segment whose records cannot
+	// all be decoded; Entries counts the ones before the corrupt record
+	Err error
+}
+
+// Stat decodes every segment of the directory and returns their stats
+func Stat(directory string) ([]SegmentStat, error) {
+	segments, err := segment.ListSegments(vfs.OS, directory)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make([]SegmentStat, 0, len(segments))
+	for _, seg := range segments {
+		stat, err := statSegment(directory, seg.Name)
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, stat)
+	}
+
+	return stats, nil
+}
+
+func statSegment(directory, name string) (SegmentStat, error) {
+	info, err := vfs.OS.Stat(filepath.Join(directory, name))
+	if err != nil {
+		return SegmentStat{}, fmt.Errorf("failed to stat segment %s: %w", name, err)
+	}
+
+	stat := SegmentStat{Name: name, Size: info.Size()}
+	err = segment.ReplaySegment(vfs.OS, directory, name, 0, func(e *entry.Entry) error {
+		if stat.Entries == 0 {
+			stat.FirstLSN = e.LSN
+		}
+		stat.LastLSN = e.LSN
+		stat.Entries++
+		return nil
+	})
+	if errors.Is(err, segment.ErrCorruptSegment) {
+		stat.Err = err
+	} else if err != nil {
+		return SegmentStat{}, err
+	}
+
+	return stat, nil
+}
+
+// ParseOperation returns the operation with the given case-insensitive name
+func ParseOperation(name string) (entry.Operation, error) {
+	for op := entry.OperationSet; op <= entry.OperationBatch; op++ {
+		if strings.EqualFold(name, op.String()) {
+			return op, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: %s", ErrUnknownOperation, name)
+}
+
+// Filter selects the entries to dump. The operations of a batch are matched
+// individually and the batch is selected if one of them is.
+type Filter struct {
+	KeyPrefix string
+	// Operation selects the entries of one operation, zero selects all
+	Operation entry.Operation
+}
+
+// Match reports whether the filter selects the entry
+func (f Filter) Match(e *entry.Entry) bool {
+	if f == (Filter{}) {
+		return true
+	}
+
+	if e.Operation == entry.OperationBatch {
+		inner := f
+		if f.Operation == entry.OperationBatch {
+			if f.KeyPrefix == "" {
+				return true
+			}
+			inner.Operation = 0
+		}
+		for i := range e.Entries {
+			if inner.Match(&e.Entries[i]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if f.Operation != 0 && f.Operation != e.Operation {
+		return false
+	}
+
+	return f.KeyPrefix == "" || (e.Operation != entry.OperationClear && strings.HasPrefix(e.Key, f.KeyPrefix))
+}
+
+// Entry is the JSON form of an entry
+type Entry struct {
+	LSN       uint64  `json:"lsn,omitempty"`
+	Timestamp int64   `json:"timestamp,omitempty"`
+	Operation string  `json:"op"`
+	Key       string  `json:"key,omitempty"`
+	Value     string  `json:"value,omitempty"`
+	ExpiresAt int64   `json:"expires_at,omitempty"`
+	Entries   []Entry `json:"entries,omitempty"`
+}
+
+// Record is the JSON form of an entry with its location in the WAL
+type Record struct {
+	Segment string `json:"segment"`
+	Offset  int64  `json:"offset"`
+	Entry
+}
+
+func newEntry(e *entry.Entry) Entry {
+	out := Entry{
+		LSN:       e.LSN,
+		Timestamp: e.Timestamp,
+		Operation: e.Operation.String(),
+		Key:       e.Key,
+		Value:     e.Value,
+		ExpiresAt: e.ExpiresAt,
+	}
+	for i := range e.Entries {
+		out.Entries = append(out.Entries, newEntry(&e.Entries[i]))
+	}
+
+	return out
+}
+
+// Dump writes the entries selected by the filter to w as JSON lines. A
+// corrupt segment does not stop the dump: its entries before the corrupt
+// record are written and the errors are returned once all segments are read.
+func Dump(directory string, filter Filter, w io.Writer) error {
+	segments, err := segment.ListSegments(vfs.OS, directory)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(w)
+	var errs []error
+	for _, seg := range segments {
+		err := segment.ScanSegment(vfs.OS, directory, seg.Name, 0, func(e *entry.Entry, offset int64) error {
+			if !filter.Match(e) {
+				return nil
+			}
+			return encoder.Encode(Record{Segment: seg.Name, Offset: offset, Entry: newEntry(e)})
+		})
+		if errors.Is(err, segment.ErrCorruptSegment) {
+			errs = append(errs, err)
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Truncate cuts a segment at the end of its last record that can be decoded
+// and returns the number of bytes removed, zero if the segment is intact.
+// Unless force is set, a segment is only cut if the damage reaches its end,
+// as left by an interrupted write, so that no valid record is dropped.
+func Truncate(directory, name string, force bool) (int64, error) {
+	if filepath.Base(name) != name {
+		return 0, fmt.Errorf("%w: %s", ErrInvalidSegmentName, name)
+	}
+	if _, err := segment.GetSegmentInfo(name); err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrInvalidSegmentName, name)
+	}
+
+	err := segment.ReplaySegment(vfs.OS, directory, name, 0, func(*entry.Entry) error { return nil })
+	if err == nil {
+		return 0, nil
+	}
+
+	var corruption *segment.CorruptionError
+	if !errors.As(err, &corruption) {
+		return 0, err
+	}
+	if !corruption.Torn && !force {
+		return 0, fmt.Errorf("%w: %w", ErrNotTorn, err)
+	}
+
+	if err := segment.TruncateSegment(vfs.OS, directory, name, corruption.Offset); err != nil {
+		return 0, err
+	}
+
+	return corruption.Size - corruption.Offset, nil
+}
@@ -0,0 +1,201 @@
+package inspect
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/8thgencore/valchemy/internal/wal/entry"
+	"github.com/8thgencore/valchemy/internal/wal/segment"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeSegment writes the entries to a segment file followed by the tail bytes
+func writeSegment(t *testing.T, dir, name string, tail []byte, entries ...entry.Entry) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	for _, e := range entries {
+		_, err := e.WriteTo(&buf)
+		require.NoError(t, err)
+	}
+	buf.Write(tail)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name), buf.Bytes(), 0o600))
+}
+
+func testEntries() []entry.Entry {
+	return []entry.Entry{
+		{LSN: 1, Operation: entry.OperationSet, Key: "user:1", Value: "alice"},
+		{LSN: 2, Operation: entry.OperationBatch, Entries: []entry.Entry{
+			{Operation: entry.OperationSet, Key: "order:1", Value: "book"},
+			{Operation: entry.OperationDelete, Key: "user:2"},
+		}},
+		{LSN: 3, Operation: entry.OperationClear},
+	}
+}
+
+func TestStat(t *testing.T) {
+	dir := t.TempDir()
+	writeSegment(t, dir, segment.FileName(1), nil, testEntries()...)
+	writeSegment(t, dir, segment.FileName(4), []byte{entry.FormatV2, 9},
+		entry.Entry{LSN: 4, Operation: entry.OperationDelete, Key: "user:1"})
+
+	stats, err := Stat(dir)
+	require.NoError(t, err)
+	require.Len(t, stats, 2)
+
+	assert.Equal(t, "wal-1.log", stats[0].Name)
+	assert.Equal(t, 3, stats[0].Entries)
+	assert.Equal(t, uint64(1), stats[0].FirstLSN)
+	assert.Equal(t, uint64(3), stats[0].LastLSN)
+	assert.NoError(t, stats[0].Err)
+
+	// The entries before the incomplete record are counted
+	assert.Equal(t, 1, stats[1].Entries)
+	assert.ErrorIs(t, stats[1].Err, segment.ErrCorruptSegment)
+}
+
+func TestParseOperation(t *testing.T) {
+	op, err := ParseOperation("set")
+	require.NoError(t, err)
+	assert.Equal(t, entry.OperationSet, op)
+
+	op, err = ParseOperation("BATCH")
+	require.NoError(t, err)
+	assert.Equal(t, entry.OperationBatch, op)
+
+	_, err = ParseOperation("get")
+	assert.ErrorIs(t, err, ErrUnknownOperation)
+}
+
+func TestDump(t *testing.T) {
+	dump := func(t *testing.T, dir string, filter Filter) ([]Record, error) {
+		t.Helper()
+
+		var buf bytes.Buffer
+		err := Dump(dir, filter, &buf)
+
+		var records []Record
+		decoder := json.NewDecoder(&buf)
+		for decoder.More() {
+			var r Record
+			require.NoError(t, decoder.Decode(&r))
+			records = append(records, r)
+		}
+
+		return records, err
+	}
+
+	dir := t.TempDir()
+	writeSegment(t, dir, segment.FileName(1), nil, testEntries()...)
+
+	t.Run("all entries with their offsets", func(t *testing.T) {
+		records, err := dump(t, dir, Filter{})
+		require.NoError(t, err)
+		require.Len(t, records, 3)
+
+		assert.Equal(t, Record{
+			Segment: "wal-1.log",
+			Entry:   Entry{LSN: 1, Operation: "SET", Key: "user:1", Value: "alice"},
+		}, records[0])
+		assert.Greater(t, records[1].Offset, int64(0))
+		assert.Equal(t, []Entry{
+			{Operation: "SET", Key: "order:1", Value: "book"},
+			{Operation: "DELETE", Key: "user:2"},
+		}, records[1].Entries)
+		assert.Equal(t, "CLEAR", records[2].Operation)
+	})
+
+	t.Run("filter by key prefix", func(t *testing.T) {
+		records, err := dump(t, dir, Filter{KeyPrefix: "order:"})
+		require.NoError(t, err)
+		require.Len(t, records, 1)
+		assert.Equal(t, uint64(2), records[0].LSN)
+	})
+
+	t.Run("filter by operation", func(t *testing.T) {
+		records, err := dump(t, dir, Filter{Operation: entry.OperationDelete})
+		require.NoError(t, err)
+		require.Len(t, records, 1)
+		assert.Equal(t, "BATCH", records[0].Operation)
+
+		records, err = dump(t, dir, Filter{Operation: entry.OperationSet, KeyPrefix: "user:"})
+		require.NoError(t, err)
+		require.Len(t, records, 1)
+		assert.Equal(t, uint64(1), records[0].LSN)
+	})
+
+	t.Run("corrupt segment", func(t *testing.T) {
+		dir := t.TempDir()
+		writeSegment(t, dir, segment.FileName(1), []byte{0xFF}, testEntries()...)
+		writeSegment(t, dir, segment.FileName(4), nil,
+			entry.Entry{LSN: 4, Operation: entry.OperationDelete, Key: "user:1"})
+
+		// The dump goes on with the next segment
+		records, err := dump(t, dir, Filter{})
+		assert.ErrorIs(t, err, segment.ErrCorruptSegment)
+		assert.Len(t, records, 4)
+	})
+}
+
+func TestTruncate(t *testing.T) {
+	t.Run("incomplete last record", func(t *testing.T) {
+		dir := t.TempDir()
+		writeSegment(t, dir, segment.FileName(1), []byte{entry.FormatV2, 9, 0}, testEntries()...)
+
+		removed, err := Truncate(dir, "wal-1.log", false)
+		require.NoError(t, err)
+		assert.Equal(t, int64(3), removed)
+
+		stats, err := Stat(dir)
+		require.NoError(t, err)
+		assert.NoError(t, stats[0].Err)
+		assert.Equal(t, 3, stats[0].Entries)
+	})
+
+	t.Run("intact segment", func(t *testing.T) {
+		dir := t.TempDir()
+		writeSegment(t, dir, segment.FileName(1), nil, testEntries()...)
+
+		removed, err := Truncate(dir, "wal-1.log", false)
+		require.NoError(t, err)
+		assert.Zero(t, removed)
+	})
+
+	t.Run("corruption followed by records requires force", func(t *testing.T) {
+		dir := t.TempDir()
+		var buf bytes.Buffer
+		for _, e := range testEntries() {
+			_, err := e.WriteTo(&buf)
+			require.NoError(t, err)
+		}
+		data := buf.Bytes()
+		// Damage a record followed by other ones
+		data[len(data)-30] ^= 0xFF
+		writeSegment(t, dir, segment.FileName(1), data,
+			entry.Entry{LSN: 1, Operation: entry.OperationSet, Key: "user:1", Value: "alice"})
+
+		_, err := Truncate(dir, "wal-1.log", false)
+		assert.ErrorIs(t, err, ErrNotTorn)
+
+		removed, err := Truncate(dir, "wal-1.log", true)
+		require.NoError(t, err)
+		assert.Positive(t, removed)
+
+		stats, err := Stat(dir)
+		require.NoError(t, err)
+		assert.NoError(t, stats[0].Err)
+	})
+
+	t.Run("invalid segment name", func(t *testing.T) {
+		dir := t.TempDir()
+		for _, name := range []string{"../wal-1.log", "snapshot-1.snap"} {
+			_, err := Truncate(dir, name, false)
+			assert.ErrorIs(t, err, ErrInvalidSegmentName)
+		}
+	})
+}
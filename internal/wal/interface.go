@@ -1,10 +1,28 @@
 package wal
 
-import "github.com/8thgencore/valchemy/internal/wal/entry"
+import (
+	"github.com/8thgencore/valchemy/internal/wal/entry"
+	"github.com/8thgencore/valchemy/internal/wal/segment"
+)
 
 // WAL represents the interface for Write-Ahead Log operations
 type WAL interface {
-	Write(entry entry.Entry) error
+	// Write adds an entry to the WAL and returns the sequence number assigned to it
+	Write(entry entry.Entry) (uint64, error)
+	// LSN returns the sequence number of the last entry accepted by the WAL
+	LSN() uint64
 	Close() error
-	Recover() ([]*entry.Entry, error)
+	// Replay passes the entries written after the given position to fn as
+	// they are read from disk; an error of fn stops the replay
+	Replay(from segment.Position, fn func(*entry.Entry) error) error
+	// Checkpoint flushes pending entries, starts a new segment and returns
+	// the position that covers everything written so far
+	Checkpoint() (segment.Position, error)
+	// Truncate removes the segments that are fully covered by the position
+	Truncate(pos segment.Position) error
+	// Err returns the error that put the WAL in the failed state, in which
+	// writes are rejected, nil if the WAL accepts writes
+	Err() error
+	// Resume leaves the failed state once its cause is fixed
+	Resume() error
 }
@@ -5,15 +5,22 @@ import (
 
 	"github.com/8thgencore/valchemy/internal/wal"
 	"github.com/8thgencore/valchemy/internal/wal/entry"
+	"github.com/8thgencore/valchemy/internal/wal/segment"
 )
 
 type MockWAL struct {
 	*wal.Service
-	Entries    []*entry.Entry
-	WriteError error
-	CloseError error
-	RecoverErr error
-	mu         sync.Mutex
+	Entries       []*entry.Entry
+	WriteError    error
+	CloseError    error
+	RecoverErr    error
+	CheckpointErr error
+	TruncateErr   error
+	Failure       error
+	ResumeErr     error
+	Position      segment.Position
+	TruncatedTo   *segment.Position
+	mu            sync.Mutex
 }
 
 func NewMockWAL() *MockWAL {
@@ -22,14 +29,21 @@ func NewMockWAL() *MockWAL {
 	}
 }
 
-func (m *MockWAL) Write(e entry.Entry) error {
+func (m *MockWAL) Write(e entry.Entry) (uint64, error) {
 	if m.WriteError != nil {
-		return m.WriteError
+		return 0, m.WriteError
 	}
 	m.mu.Lock()
 	m.Entries = append(m.Entries, &e)
+	lsn := uint64(len(m.Entries))
 	m.mu.Unlock()
-	return nil
+	return lsn, nil
+}
+
+func (m *MockWAL) LSN() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return uint64(len(m.Entries))
 }
 
 func (m *MockWAL) Close() error {
@@ -45,3 +59,57 @@ func (m *MockWAL) Recover() ([]*entry.Entry, error) {
 	m.mu.Unlock()
 	return entries, nil
 }
+
+func (m *MockWAL) RecoverFrom(_ segment.Position) ([]*entry.Entry, error) {
+	return m.Recover()
+}
+
+func (m *MockWAL) Replay(from segment.Position, fn func(*entry.Entry) error) error {
+	entries, err := m.RecoverFrom(from)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MockWAL) Checkpoint() (segment.Position, error) {
+	if m.CheckpointErr != nil {
+		return segment.Position{}, m.CheckpointErr
+	}
+	m.mu.Lock()
+	m.Position.Offset = int64(len(m.Entries))
+	pos := m.Position
+	m.mu.Unlock()
+	return pos, nil
+}
+
+func (m *MockWAL) Truncate(pos segment.Position) error {
+	if m.TruncateErr != nil {
+		return m.TruncateErr
+	}
+	m.mu.Lock()
+	m.TruncatedTo = &pos
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *MockWAL) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.Failure
+}
+
+func (m *MockWAL) Resume() error {
+	if m.ResumeErr != nil {
+		return m.ResumeErr
+	}
+	m.mu.Lock()
+	m.Failure = nil
+	m.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,75 @@
+package wal
+
+import (
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"github.com/8thgencore/valchemy/internal/vfs"
+	"github.com/8thgencore/valchemy/internal/wal/segment"
+)
+
+// replayProgressInterval is the minimal period between two progress reports of a replay
+const replayProgressInterval = 5 * time.Second
+
+// replayProgress reports the progress of a replay in segments and bytes
+type replayProgress struct {
+	log        *slog.Logger
+	sizes      []int64
+	totalBytes int64
+	doneBytes  int64
+	entries    int
+	start      time.Time
+	lastReport time.Time
+}
+
+func newReplayProgress(log *slog.Logger, fsys vfs.FS, directory string, segments []segment.Info) *replayProgress {
+	p := &replayProgress{
+		log:   log,
+		sizes: make([]int64, len(segments)),
+		start: time.Now(),
+	}
+	p.lastReport = p.start
+
+	for i, s := range segments {
+		if info, err := fsys.Stat(filepath.Join(directory, s.Name)); err == nil {
+			p.sizes[i] = info.Size()
+			p.totalBytes += info.Size()
+		}
+	}
+
+	if len(segments) > 0 {
+		log.Info("Replaying WAL", "segments", len(segments), "total_bytes", p.totalBytes)
+	}
+
+	return p
+}
+
+// segmentDone records the end of the i-th segment and reports the progress
+// if the last report is old enough
+func (p *replayProgress) segmentDone(i int) {
+	p.doneBytes += p.sizes[i]
+
+	if time.Since(p.lastReport) < replayProgressInterval {
+		return
+	}
+	p.lastReport = time.Now()
+	p.log.Info("WAL replay progress",
+		"segments_done", i+1,
+		"segments", len(p.sizes),
+		"bytes_done", p.doneBytes,
+		"total_bytes", p.totalBytes,
+		"entries", p.entries)
+}
+
+// finish reports the end of the replay
+func (p *replayProgress) finish() {
+	if len(p.sizes) == 0 {
+		return
+	}
+	p.log.Info("WAL replayed",
+		"segments", len(p.sizes),
+		"bytes", p.doneBytes,
+		"entries", p.entries,
+		"duration", time.Since(p.start))
+}
@@ -0,0 +1,81 @@
+package segment
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/8thgencore/valchemy/internal/wal/entry"
+)
+
+// ErrCorruptSegment is matched by every *CorruptionError
+var ErrCorruptSegment = errors.New("corrupt WAL segment")
+
+// CorruptionError describes a record of a segment that cannot be decoded
+type CorruptionError struct {
+	Segment string
+	// Offset is the position of the first record that cannot be decoded
+	Offset int64
+	// Size is the size of the segment file
+	Size int64
+	// Torn is set when the damage reaches the end of the file, as left by a
+	// write interrupted by a crash. Such a tail can be safely cut off.
+	Torn bool
+	Err  error
+}
+
+func (e *CorruptionError) Error() string {
+	kind := "corrupt record"
+	if e.Torn {
+		kind = "incomplete record at the end"
+	}
+
+	return fmt.Sprintf("%s of segment %s at offset %d (size %d): %v", kind, e.Segment, e.Offset, e.Size, e.Err)
+}
+
+func (e *CorruptionError) Unwrap() []error {
+	return []error{ErrCorruptSegment, e.Err}
+}
+
+// newCorruptionError classifies a decoding failure of the record at offset
+// that consumed n bytes of the file before failing
+func newCorruptionError(r io.ReaderAt, name string, offset, n, size int64, err error) *CorruptionError {
+	torn := false
+	switch {
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		torn = true
+	case errors.Is(err, entry.ErrChecksumMismatch), errors.Is(err, entry.ErrCorruptEntry):
+		// Only the last record of the file may be partially written
+		torn = offset+n == size
+	case errors.Is(err, entry.ErrUnknownFormat):
+		// A crash can leave a zero-filled tail after the last complete record
+		torn = onlyZeros(io.NewSectionReader(r, offset, size-offset))
+	}
+
+	return &CorruptionError{
+		Segment: name,
+		Offset:  offset,
+		Size:    size,
+		Torn:    torn,
+		Err:     err,
+	}
+}
+
+// onlyZeros reports whether the reader contains only zero bytes
+func onlyZeros(r io.Reader) bool {
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return false
+			}
+		}
+		if err == io.EOF {
+			return true
+		}
+		if err != nil {
+			return false
+		}
+	}
+}
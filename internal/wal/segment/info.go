@@ -4,28 +4,43 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
-	"time"
 )
 
 // Info represents WAL segment metadata
 type Info struct {
+	// ID is the LSN of the first entry of the segment. Segments written
+	// before LSNs were introduced are identified by their creation time in
+	// Unix nanoseconds, which is larger than any LSN that precedes them.
 	ID   int64
 	Name string
 }
 
+// Position identifies a point in the WAL: the segment and the byte offset
+// within it. Everything before the offset and all earlier segments are
+// considered to precede the position.
+type Position struct {
+	SegmentID int64
+	Offset    int64
+}
+
 // ParseSegmentName extracts segment ID from filename
 func ParseSegmentName(name string) (int64, error) {
-	// Extract timestamp from "wal-{timestamp}.log"
+	// Extract the ID from "wal-{id}.log"
 	base := strings.TrimSuffix(strings.TrimPrefix(name, "wal-"), ".log")
 	return strconv.ParseInt(base, 10, 64)
 }
 
-// NewSegmentInfo creates a new segment info with a unique ID
-func NewSegmentInfo() Info {
-	id := time.Now().UnixNano()
+// FileName returns the file name of the segment with the given ID
+func FileName(id int64) string {
+	return fmt.Sprintf("wal-%d.log", id)
+}
+
+// NewSegmentInfo creates the info of a segment whose first entry has the given LSN
+func NewSegmentInfo(firstLSN uint64) Info {
+	id := int64(firstLSN)
 	return Info{
 		ID:   id,
-		Name: fmt.Sprintf("wal-%d.log", id),
+		Name: FileName(id),
 	}
 }
 
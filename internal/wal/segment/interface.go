@@ -5,8 +5,11 @@ import "github.com/8thgencore/valchemy/internal/wal/entry"
 // Segment interface
 type Segment interface {
 	Write(entry.Entry) error
+	// WriteBlock writes the entries as a single compressed record
+	WriteBlock([]entry.Entry) error
 	Sync() error
 	Close() error
 	Size() uint64
+	ID() int64
 	CreateSegmentFile() error
 }
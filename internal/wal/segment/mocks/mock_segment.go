@@ -9,12 +9,17 @@ type MockSegment struct {
 	CloseErr         error
 	CreateSegmentErr error
 	Size_            uint64
+	ID_              int64
 }
 
 func (m *MockSegment) Write(e entry.Entry) error {
 	return m.WriteErr
 }
 
+func (m *MockSegment) WriteBlock(entries []entry.Entry) error {
+	return m.WriteErr
+}
+
 func (m *MockSegment) Sync() error {
 	return m.SyncErr
 }
@@ -27,6 +32,10 @@ func (m *MockSegment) Size() uint64 {
 	return m.Size_
 }
 
+func (m *MockSegment) ID() int64 {
+	return m.ID_
+}
+
 func (m *MockSegment) CreateSegmentFile() error {
 	return m.CreateSegmentErr
 }
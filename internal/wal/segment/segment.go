@@ -5,45 +5,67 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
 
+	"github.com/8thgencore/valchemy/internal/vfs"
 	"github.com/8thgencore/valchemy/internal/wal/entry"
 )
 
+// readBufferSize is the size of the buffer used to read segment files
+const readBufferSize = 256 << 10
+
 // Segment represents a WAL Segment file
 type segment struct {
-	file      *os.File
+	fsys      vfs.FS
+	id        int64
+	file      vfs.File
 	writer    *bufio.Writer
 	size      uint64
 	filename  string
 	directory string
 }
 
-// NewSegment creates a new WAL segment
-func NewSegment(directory string) (*segment, error) {
-	if err := os.MkdirAll(directory, 0o750); err != nil {
+// NewSegment creates a new WAL segment that starts with the entry of the given LSN.
+// The file is created on the first write.
+func NewSegment(fsys vfs.FS, directory string, firstLSN uint64) (*segment, error) {
+	if err := fsys.MkdirAll(directory, 0o750); err != nil {
 		return nil, fmt.Errorf("failed to create WAL directory: %w", err)
 	}
 
-	info := NewSegmentInfo()
+	info := NewSegmentInfo(firstLSN)
 	filename := filepath.Join(directory, info.Name)
 
 	return &segment{
+		fsys:      fsys,
+		id:        info.ID,
 		filename:  filename,
 		directory: directory,
 	}, nil
 }
 
 // Write writes data to the segment and updates its size
-func (s *segment) Write(entry entry.Entry) error {
+func (s *segment) Write(e entry.Entry) error {
+	return s.write(e.WriteTo)
+}
+
+// WriteBlock writes the entries to the segment as a single compressed record
+func (s *segment) WriteBlock(entries []entry.Entry) error {
+	return s.write(func(w io.Writer) (int64, error) {
+		return entry.WriteBlock(w, entries)
+	})
+}
+
+// write writes a record with writeTo and updates the size of the segment
+func (s *segment) write(writeTo func(io.Writer) (int64, error)) error {
 	if err := s.CreateSegmentFile(); err != nil {
 		return fmt.Errorf("failed to create segment file: %w", err)
 	}
 
-	n, err := entry.WriteTo(s.writer)
+	n, err := writeTo(s.writer)
 	if err != nil {
 		return fmt.Errorf("failed to write entry: %w", err)
 	}
@@ -79,7 +101,9 @@ func (s *segment) Close() error {
 		return nil
 	}
 
+	// The file is closed even if the buffer cannot be flushed
 	if err := s.writer.Flush(); err != nil {
+		_ = s.file.Close()
 		return fmt.Errorf("failed to flush buffer on close: %w", err)
 	}
 
@@ -91,23 +115,64 @@ func (s *segment) Size() uint64 {
 	return s.size
 }
 
-// CreateSegmentFile creates a new segment file if it doesn't exist
+// ID returns the identifier of the segment
+func (s *segment) ID() int64 {
+	return s.id
+}
+
+// CreateSegmentFile creates the segment file if it is not open yet. An empty
+// file of the same name, created ahead of the writes before a restart, is
+// reused; a file holding data is never overwritten.
 func (s *segment) CreateSegmentFile() error {
-	if s.file == nil {
-		file, err := os.OpenFile(s.filename, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o600)
-		if err != nil {
-			return fmt.Errorf("failed to create segment file: %w", err)
-		}
-		s.file = file
-		s.writer = bufio.NewWriter(file)
+	if s.file != nil {
+		return nil
+	}
+
+	file, err := s.fsys.OpenFile(s.filename, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o600)
+	if errors.Is(err, fs.ErrExist) {
+		file, err = openEmpty(s.fsys, s.filename)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create segment file: %w", err)
+	}
+	s.file = file
+	s.writer = bufio.NewWriter(file)
+
+	return nil
+}
+
+// openEmpty opens an existing file for writing if it is empty
+func openEmpty(fsys vfs.FS, name string) (vfs.File, error) {
+	file, err := fsys.OpenFile(name, os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err == nil && info.Size() > 0 {
+		err = fmt.Errorf("%w: %s holds %d bytes", fs.ErrExist, filepath.Base(name), info.Size())
+	}
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// RemoveSegment deletes the given segment file
+func RemoveSegment(fsys vfs.FS, directory, segmentName string) error {
+	segmentPath := filepath.Clean(filepath.Join(directory, segmentName))
+	if err := fsys.Remove(segmentPath); err != nil {
+		return fmt.Errorf("failed to remove segment %s: %w", segmentName, err)
 	}
 
 	return nil
 }
 
 // ListSegments returns a sorted list of WAL segment infos
-func ListSegments(directory string) ([]Info, error) {
-	files, err := os.ReadDir(directory)
+func ListSegments(fsys vfs.FS, directory string) ([]Info, error) {
+	files, err := fsys.ReadDir(directory)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read WAL directory: %w", err)
 	}
@@ -135,33 +200,92 @@ func ListSegments(directory string) ([]Info, error) {
 }
 
 // ReadSegmentEntries reads all entries from the given segment file
-func ReadSegmentEntries(directory, segmentName string) ([]*entry.Entry, error) {
+func ReadSegmentEntries(fsys vfs.FS, directory, segmentName string) ([]*entry.Entry, error) {
+	return ReadSegmentEntriesFrom(fsys, directory, segmentName, 0)
+}
+
+// ReadSegmentEntriesFrom reads the entries of the given segment file starting at offset.
+// If a record cannot be decoded, the entries before it are returned together
+// with a *CorruptionError.
+func ReadSegmentEntriesFrom(fsys vfs.FS, directory, segmentName string, offset int64) ([]*entry.Entry, error) {
+	var entries []*entry.Entry
+	err := ReplaySegment(fsys, directory, segmentName, offset, func(e *entry.Entry) error {
+		entries = append(entries, e)
+		return nil
+	})
+
+	return entries, err
+}
+
+// ReplaySegment decodes the entries of the given segment file starting at
+// offset and passes them to fn as they are read. If a record cannot be
+// decoded, a *CorruptionError is returned once the entries before it are
+// passed. An error returned by fn stops the replay and is returned as is.
+func ReplaySegment(fsys vfs.FS, directory, segmentName string, offset int64, fn func(*entry.Entry) error) error {
+	return ScanSegment(fsys, directory, segmentName, offset, func(e *entry.Entry, _ int64) error {
+		return fn(e)
+	})
+}
+
+// ScanSegment is like ReplaySegment but also passes fn the offset of the
+// record of each entry
+func ScanSegment(
+	fsys vfs.FS, directory, segmentName string, offset int64, fn func(*entry.Entry, int64) error,
+) (err error) {
 	// Validate and sanitize the input paths
 	segmentPath := filepath.Join(directory, segmentName)
 	segmentPath = filepath.Clean(segmentPath)
 
-	file, err := os.Open(segmentPath)
+	file, err := vfs.Open(fsys, segmentPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open segment %s: %w", segmentName, err)
+		return fmt.Errorf("failed to open segment %s: %w", segmentName, err)
 	}
 
 	defer func() {
-		if closeErr := file.Close(); closeErr != nil {
+		if closeErr := file.Close(); closeErr != nil && err == nil {
 			err = fmt.Errorf("failed to close segment file: %w", closeErr)
 		}
 	}()
 
-	var entries []*entry.Entry
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat segment %s: %w", segmentName, err)
+	}
+
+	if offset > 0 {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to seek segment %s: %w", segmentName, err)
+		}
+	}
+
+	reader := entry.NewReader(bufio.NewReaderSize(file, readBufferSize))
+	recordOffset := offset
 	for {
-		entry, err := entry.ReadEntry(file)
+		e, n, err := reader.Next()
 		if err == io.EOF {
-			break
+			return nil
 		}
 		if err != nil {
-			return nil, fmt.Errorf("failed to read entry from segment %s: %w", segmentName, err)
+			return newCorruptionError(file, segmentName, offset, n, info.Size(), err)
 		}
-		entries = append(entries, entry)
+		// The entries of a compressed block after the first one consume no
+		// data and share the offset of the block
+		if n > 0 {
+			recordOffset = offset
+			offset += n
+		}
+		if err := fn(e, recordOffset); err != nil {
+			return err
+		}
+	}
+}
+
+// TruncateSegment cuts the segment file to the given size
+func TruncateSegment(fsys vfs.FS, directory, segmentName string, size int64) error {
+	segmentPath := filepath.Clean(filepath.Join(directory, segmentName))
+	if err := fsys.Truncate(segmentPath, size); err != nil {
+		return fmt.Errorf("failed to truncate segment %s: %w", segmentName, err)
 	}
 
-	return entries, nil
+	return nil
 }
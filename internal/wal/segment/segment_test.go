@@ -4,8 +4,8 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
-	"time"
 
+	"github.com/8thgencore/valchemy/internal/vfs"
 	"github.com/8thgencore/valchemy/internal/wal/entry"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -23,7 +23,7 @@ func TestNewSegment(t *testing.T) {
 		dir := setupTestDir(t)
 		defer os.RemoveAll(dir)
 
-		s, err := NewSegment(dir)
+		s, err := NewSegment(vfs.OS, dir, 1)
 		require.NoError(t, err)
 		assert.NotNil(t, s)
 		assert.Contains(t, s.filename, "wal-")
@@ -32,7 +32,7 @@ func TestNewSegment(t *testing.T) {
 
 	t.Run("error creating directory without permissions", func(t *testing.T) {
 		dir := "/proc/nonexistent" // директория, в которую точно нельзя писать
-		_, err := NewSegment(dir)
+		_, err := NewSegment(vfs.OS, dir, 1)
 		assert.Error(t, err)
 	})
 }
@@ -42,7 +42,7 @@ func TestSegment_CreateSegmentFile(t *testing.T) {
 		dir := setupTestDir(t)
 		defer os.RemoveAll(dir)
 
-		s, err := NewSegment(dir)
+		s, err := NewSegment(vfs.OS, dir, 1)
 		require.NoError(t, err)
 
 		err = s.CreateSegmentFile()
@@ -66,6 +66,7 @@ func TestSegment_CreateSegmentFile(t *testing.T) {
 		require.NoError(t, err)
 
 		s := &segment{
+			fsys:      vfs.OS,
 			filename:  testFile,
 			directory: tempDir,
 		}
@@ -74,6 +75,24 @@ func TestSegment_CreateSegmentFile(t *testing.T) {
 		err = s.CreateSegmentFile()
 		assert.Error(t, err, "expected error when creating file that already exists")
 	})
+
+	t.Run("empty file is reused", func(t *testing.T) {
+		dir := setupTestDir(t)
+		defer os.RemoveAll(dir)
+
+		s, err := NewSegment(vfs.OS, dir, 5)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(s.filename, nil, 0o600))
+
+		require.NoError(t, s.CreateSegmentFile())
+		require.NoError(t, s.Write(entry.Entry{LSN: 5, Operation: entry.OperationSet, Key: "key", Value: "value"}))
+		require.NoError(t, s.Close())
+
+		entries, err := ReadSegmentEntries(vfs.OS, dir, FileName(5))
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		assert.Equal(t, uint64(5), entries[0].LSN)
+	})
 }
 
 func TestSegment_Write(t *testing.T) {
@@ -81,7 +100,7 @@ func TestSegment_Write(t *testing.T) {
 		dir := setupTestDir(t)
 		defer os.RemoveAll(dir)
 
-		s, err := NewSegment(dir)
+		s, err := NewSegment(vfs.OS, dir, 1)
 		require.NoError(t, err)
 
 		e := entry.Entry{
@@ -101,7 +120,7 @@ func TestSegment_Sync(t *testing.T) {
 		dir := setupTestDir(t)
 		defer os.RemoveAll(dir)
 
-		s, err := NewSegment(dir)
+		s, err := NewSegment(vfs.OS, dir, 1)
 		require.NoError(t, err)
 
 		err = s.CreateSegmentFile()
@@ -123,31 +142,32 @@ func TestListSegments(t *testing.T) {
 		dir := setupTestDir(t)
 		defer os.RemoveAll(dir)
 
-		// Create several segments
-		for i := 0; i < 3; i++ {
-			s, err := NewSegment(dir)
+		// Create several segments, the numeric order differs from the lexical one
+		for _, lsn := range []uint64{100, 9, 1} {
+			s, err := NewSegment(vfs.OS, dir, lsn)
 			require.NoError(t, err)
 			err = s.CreateSegmentFile()
 			require.NoError(t, err)
-			time.Sleep(time.Millisecond) // For different timestamps
 		}
 
-		segments, err := ListSegments(dir)
+		segments, err := ListSegments(vfs.OS, dir)
 		require.NoError(t, err)
-		assert.Len(t, segments, 3)
+		require.Len(t, segments, 3)
+		assert.Equal(t, []int64{1, 9, 100}, []int64{segments[0].ID, segments[1].ID, segments[2].ID})
+		assert.Equal(t, "wal-1.log", segments[0].Name)
 	})
 
 	t.Run("empty directory", func(t *testing.T) {
 		dir := setupTestDir(t)
 		defer os.RemoveAll(dir)
 
-		segments, err := ListSegments(dir)
+		segments, err := ListSegments(vfs.OS, dir)
 		require.NoError(t, err)
 		assert.Empty(t, segments)
 	})
 
 	t.Run("error reading directory", func(t *testing.T) {
-		_, err := ListSegments("/proc/nonexistent") // директория, которая точно не существует
+		_, err := ListSegments(vfs.OS, "/proc/nonexistent") // директория, которая точно не существует
 		assert.Error(t, err)
 	})
 }
@@ -157,7 +177,7 @@ func TestReadSegmentEntries(t *testing.T) {
 		dir := setupTestDir(t)
 		defer os.RemoveAll(dir)
 
-		s, err := NewSegment(dir)
+		s, err := NewSegment(vfs.OS, dir, 1)
 		require.NoError(t, err)
 
 		// Write several entries
@@ -174,7 +194,7 @@ func TestReadSegmentEntries(t *testing.T) {
 		require.NoError(t, s.Close())
 
 		// Read entries
-		entries, err := ReadSegmentEntries(dir, filepath.Base(s.filename))
+		entries, err := ReadSegmentEntries(vfs.OS, dir, filepath.Base(s.filename))
 		require.NoError(t, err)
 		assert.Len(t, entries, len(testEntries))
 	})
@@ -183,7 +203,7 @@ func TestReadSegmentEntries(t *testing.T) {
 		dir := setupTestDir(t)
 		defer os.RemoveAll(dir)
 
-		entries, err := ReadSegmentEntries(dir, "nonexistent.log")
+		entries, err := ReadSegmentEntries(vfs.OS, dir, "nonexistent.log")
 		assert.Error(t, err)
 		assert.Nil(t, entries)
 	})
@@ -197,8 +217,45 @@ func TestReadSegmentEntries(t *testing.T) {
 		err := os.WriteFile(filename, []byte{1, 2, 3}, 0o600)
 		require.NoError(t, err)
 
-		entries, err := ReadSegmentEntries(dir, "corrupted.log")
+		entries, err := ReadSegmentEntries(vfs.OS, dir, "corrupted.log")
 		assert.Error(t, err)
 		assert.Nil(t, entries)
 	})
+
+	t.Run("incomplete last record", func(t *testing.T) {
+		dir := setupTestDir(t)
+		defer os.RemoveAll(dir)
+
+		s, err := NewSegment(vfs.OS, dir, 1)
+		require.NoError(t, err)
+		require.NoError(t, s.Write(entry.Entry{Operation: entry.OperationSet, Key: "key1", Value: "value1"}))
+		require.NoError(t, s.Write(entry.Entry{Operation: entry.OperationSet, Key: "key2", Value: "value2"}))
+		require.NoError(t, s.Close())
+
+		require.NoError(t, os.Truncate(s.filename, int64(s.Size())-1))
+
+		entries, err := ReadSegmentEntries(vfs.OS, dir, filepath.Base(s.filename))
+		require.Len(t, entries, 1)
+
+		var corruption *CorruptionError
+		require.ErrorAs(t, err, &corruption)
+		assert.True(t, corruption.Torn)
+		assert.Equal(t, int64(s.Size())-1, corruption.Size)
+		assert.Less(t, corruption.Offset, corruption.Size)
+		assert.ErrorIs(t, err, ErrCorruptSegment)
+	})
+}
+
+func TestTruncateSegment(t *testing.T) {
+	dir := setupTestDir(t)
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "wal-1.log")
+	require.NoError(t, os.WriteFile(filename, []byte("0123456789"), 0o600))
+
+	require.NoError(t, TruncateSegment(vfs.OS, dir, "wal-1.log", 4))
+
+	data, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, "0123", string(data))
 }
@@ -0,0 +1,61 @@
+package wal
+
+import "github.com/8thgencore/valchemy/internal/wal/segment"
+
+// Synced is the end of the data synced to the WAL
+type Synced struct {
+	// Position is the end of the synced data in the current segment. The
+	// segments before it are complete.
+	Position segment.Position
+	// LSN is the sequence number of the last synced entry
+	LSN uint64
+}
+
+// Subscribe returns a channel that receives the end of the synced data
+// after every flush, starting with the current one, and a function that
+// cancels the subscription. Notifications are coalesced: a subscriber that
+// falls behind only sees the latest position, so it never holds up the WAL.
+func (w *Service) Subscribe() (<-chan Synced, func()) {
+	ch := make(chan Synced, 1)
+
+	w.subsMu.Lock()
+	ch <- w.synced
+	w.subs[ch] = struct{}{}
+	w.subsMu.Unlock()
+
+	cancel := func() {
+		w.subsMu.Lock()
+		delete(w.subs, ch)
+		w.subsMu.Unlock()
+	}
+
+	return ch, cancel
+}
+
+// Synced returns the end of the data synced to the WAL
+func (w *Service) Synced() Synced {
+	w.subsMu.Lock()
+	defer w.subsMu.Unlock()
+
+	return w.synced
+}
+
+// publish notifies the subscribers of the end of the synced data. It is
+// called by the flusher only, so a notification replaced here cannot race
+// with another one.
+func (w *Service) publish() {
+	w.subsMu.Lock()
+	defer w.subsMu.Unlock()
+
+	w.synced = Synced{
+		Position: segment.Position{SegmentID: w.currentSegment.ID(), Offset: int64(w.syncedSize)},
+		LSN:      w.syncedLSN,
+	}
+	for ch := range w.subs {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- w.synced
+	}
+}
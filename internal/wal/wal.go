@@ -1,125 +1,444 @@
 package wal
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/8thgencore/valchemy/internal/config"
+	"github.com/8thgencore/valchemy/internal/vfs"
 	"github.com/8thgencore/valchemy/internal/wal/entry"
 	"github.com/8thgencore/valchemy/internal/wal/segment"
+	"github.com/8thgencore/valchemy/pkg/logger/sl"
 )
 
 // Service represents the Write-Ahead Log that provides durability guarantees
 // by writing entries to disk before acknowledging the write operation.
 type Service struct {
+	log  *slog.Logger
+	fsys vfs.FS
+
 	// Worker configuration (immutable copy)
 	config struct {
+		durability     config.DurabilityMode
+		compress       bool
 		batchSize      int
 		batchTimeout   time.Duration
 		maxSegmentSize uint64
 		dataDirectory  string
+		// archiveDirectory receives the completed segments, empty if disabled
+		archiveDirectory string
 	}
 
-	// Segment management
+	// Segment management, owned by the flusher
 	currentSegment segment.Segment
+	// completed holds the segments rotated out during a flush, closed and
+	// archived by the flusher once the writers are acknowledged
+	completed []segment.Segment
+	// lsn is the sequence number of the last entry accepted by the worker
+	lsn atomic.Uint64
+	// syncedLSN and syncedSize are the sequence number of the last entry
+	// synced and the size of the current segment at that point, owned by the
+	// flusher
+	syncedLSN  uint64
+	syncedSize uint64
+	// failure holds the error that put the WAL in the failed state
+	failure atomic.Pointer[error]
+
+	// subs are the channels notified after each flush, and synced the last
+	// position sent to them
+	subsMu sync.Mutex
+	subs   map[chan Synced]struct{}
+	synced Synced
 
 	// Batch processing and lifecycle
-	commands chan command
-	done     chan struct{}
+	commands    chan command
+	checkpoints chan chan checkpointResult
+	resumes     chan chan error
+	reopens     chan chan error
+	// jobs passes the collected batches from the worker to the flusher, and
+	// flushed returns them once they are written and synced
+	jobs      chan flushJob
+	flushed   chan *pendingBatch
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	// closeErr is the error of the final flush, set by the worker before done is closed
+	closeErr error
 }
 
 type command struct {
 	entry entry.Entry
-	done  chan error
+	// lsn receives the sequence number of the entry before done is signaled
+	lsn  *uint64
+	done chan error
+}
+
+// pendingBatch holds the entries collected since the last flush and the
+// writers waiting for them to be synced
+type pendingBatch struct {
+	entries []entry.Entry
+	waiters []chan error
+	// err is the result of the flush, set by the flusher
+	err error
+}
+
+// flushJob is a batch handed over to the flusher
+type flushJob struct {
+	batch *pendingBatch
+	// checkpoint receives the result of a checkpoint taken after the flush,
+	// nil if none was requested
+	checkpoint chan checkpointResult
+	// resume receives the result of a resumption after the flush, nil if
+	// none was requested
+	resume chan error
+	// reopen receives the result of a reopening after the flush, nil if
+	// none was requested
+	reopen chan error
+	// lsn is the sequence number of the last entry accepted before the job
+	lsn uint64
+}
+
+type checkpointResult struct {
+	pos segment.Position
+	err error
 }
 
-// New creates a new WAL instance with the provided configuration.
-// Returns nil if WAL is disabled in the configuration.
-func New(cfg config.WALConfig) (*Service, error) {
+// New creates a new WAL instance with the provided configuration, storing
+// the segments in fsys. Returns nil if WAL is disabled in the configuration.
+func New(cfg config.WALConfig, fsys vfs.FS, log *slog.Logger) (*Service, error) {
 	if !cfg.Enabled {
 		return nil, nil
 	}
 
-	segment, err := segment.NewSegment(cfg.DataDirectory)
+	durability := cfg.Durability
+	switch durability {
+	case "":
+		durability = config.DurabilityAsync
+	case config.DurabilityAlways, config.DurabilityGroup, config.DurabilityAsync:
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownDurability, durability)
+	}
+
+	switch cfg.Compression {
+	case "", config.CompressionNone, config.CompressionFlate:
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownCompression, cfg.Compression)
+	}
+
+	lsn, err := lastLSN(fsys, cfg.DataDirectory)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.ArchiveDirectory != "" {
+		if err := fsys.MkdirAll(cfg.ArchiveDirectory, 0o750); err != nil {
+			return nil, fmt.Errorf("failed to create WAL archive directory: %w", err)
+		}
+	}
+
+	segment, err := segment.NewSegment(fsys, cfg.DataDirectory, lsn+1)
 	if err != nil {
 		return nil, fmt.Errorf("%w: %v", ErrCreateSegment, err)
 	}
 
 	w := &Service{
+		log:  log,
+		fsys: fsys,
 		config: struct {
-			batchSize      int
-			batchTimeout   time.Duration
-			maxSegmentSize uint64
-			dataDirectory  string
+			durability       config.DurabilityMode
+			compress         bool
+			batchSize        int
+			batchTimeout     time.Duration
+			maxSegmentSize   uint64
+			dataDirectory    string
+			archiveDirectory string
 		}{
-			batchSize:      cfg.FlushingBatchSize,
-			batchTimeout:   cfg.FlushingBatchTimeout,
-			maxSegmentSize: cfg.MaxSegmentSizeBytes,
-			dataDirectory:  cfg.DataDirectory,
+			durability:       durability,
+			compress:         cfg.Compression == config.CompressionFlate,
+			batchSize:        cfg.FlushingBatchSize,
+			batchTimeout:     cfg.FlushingBatchTimeout,
+			maxSegmentSize:   cfg.MaxSegmentSizeBytes,
+			dataDirectory:    cfg.DataDirectory,
+			archiveDirectory: cfg.ArchiveDirectory,
 		},
 		currentSegment: segment,
 		commands:       make(chan command),
+		checkpoints:    make(chan chan checkpointResult),
+		resumes:        make(chan chan error),
+		reopens:        make(chan chan error),
+		subs:           make(map[chan Synced]struct{}),
+		jobs:           make(chan flushJob),
+		flushed:        make(chan *pendingBatch),
+		stop:           make(chan struct{}),
 		done:           make(chan struct{}),
 	}
 
+	w.lsn.Store(lsn)
+	w.syncedLSN = lsn
+	w.publish()
+
+	log.Info("WAL opened", "lsn", lsn, "durability", durability)
+
 	go w.worker()
+	go w.flusher()
 
 	return w, nil
 }
 
+// lastLSN returns the sequence number of the last entry in the WAL directory.
+// A segment is named after the LSN of its first entry, so the result is
+// never below the ID of the last segment minus one. An empty last segment,
+// such as the one created by a checkpoint, keeps the numbering after the
+// segments before it are truncated; the next write reuses its file.
+func lastLSN(fsys vfs.FS, directory string) (uint64, error) {
+	segments, err := segment.ListSegments(fsys, directory)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(segments) == 0 {
+		return 0, nil
+	}
+
+	last := segments[len(segments)-1]
+	lsn := uint64(last.ID) - 1
+
+	// A torn tail is cut off by the recovery, the entries before it count
+	entries, err := segment.ReadSegmentEntries(fsys, directory, last.Name)
+	var corruption *segment.CorruptionError
+	if err != nil && !errors.As(err, &corruption) {
+		return 0, err
+	}
+
+	// Entries written before LSNs were introduced are numbered from the ID
+	// of their segment
+	next := uint64(last.ID)
+	for _, e := range entries {
+		if e.LSN != 0 {
+			next = e.LSN
+		}
+		lsn = max(lsn, next)
+		next++
+	}
+
+	return lsn, nil
+}
+
+// worker collects the writes into a batch while the previous batch is being
+// written and synced by the flusher. A batch is handed over as soon as it is
+// due and the flusher is idle, so the writes that arrive during a sync are
+// flushed together by the next one.
 func (w *Service) worker() {
-	batch := make([]entry.Entry, 0, w.config.batchSize)
+	batch := w.newBatch()
+	// spare is the other batch buffer, nil while the flusher holds it
+	spare := w.newBatch()
+	// due is set once the batch must be flushed
+	due := false
+	// checkpoint, resume and reopen are the pending requests, if any
+	var (
+		checkpoint chan checkpointResult
+		resume     chan error
+		reopen     chan error
+	)
+	stop := w.stop
+
 	timer := time.NewTimer(w.config.batchTimeout)
 	defer timer.Stop()
 
 	for {
-		select {
-		case cmd, ok := <-w.commands:
-			if !ok {
-				flushBatchIfNeeded(&batch, w, &cmd)
+		stopping := stop == nil
+		if spare != nil && (due || checkpoint != nil || resume != nil || reopen != nil || stopping) {
+			job := flushJob{batch: batch, checkpoint: checkpoint, resume: resume, reopen: reopen, lsn: w.lsn.Load()}
+			w.jobs <- job
+			batch, spare = spare, nil
+			due, checkpoint, resume, reopen = false, nil, nil, nil
+			timer.Reset(w.config.batchTimeout)
+
+			// No sequence number is assigned while the flusher resets it
+			if job.resume != nil || job.reopen != nil || stopping {
+				spare = <-w.flushed
+			}
+			if stopping {
+				if spare.err != nil {
+					w.closeErr = fmt.Errorf("%w: %v", ErrFlushFinalBatch, spare.err)
+				}
+				close(w.jobs)
 				close(w.done)
 				return
 			}
-			batch = append(batch, cmd.entry)
-			if len(batch) >= w.config.batchSize {
-				flushBatchIfNeeded(&batch, w, &cmd)
-				timer.Reset(w.config.batchTimeout)
-			} else {
-				cmd.done <- nil
+		}
+
+		// The writes are held back while the batch is full and the previous
+		// one is still being flushed
+		commands := w.commands
+		if stopping || (spare == nil && len(batch.entries) >= w.config.batchSize) {
+			commands = nil
+		}
+		checkpoints := w.checkpoints
+		if stopping || checkpoint != nil {
+			checkpoints = nil
+		}
+		resumes := w.resumes
+		if stopping || resume != nil {
+			resumes = nil
+		}
+		reopens := w.reopens
+		if stopping || reopen != nil {
+			reopens = nil
+		}
+
+		select {
+		case <-stop:
+			stop = nil
+		case cmd := <-commands:
+			if w.handleCommand(batch, cmd) {
+				due = true
 			}
 		case <-timer.C:
-			flushBatchIfNeeded(&batch, w, nil)
+			if len(batch.entries) > 0 {
+				due = true
+			}
 			timer.Reset(w.config.batchTimeout)
+		case result := <-checkpoints:
+			checkpoint = result
+		case result := <-resumes:
+			resume = result
+		case result := <-reopens:
+			reopen = result
+		case b := <-w.flushed:
+			spare = b
 		}
 	}
 }
 
-func flushBatchIfNeeded(batch *[]entry.Entry, w *Service, cmd *command) {
-	if len(*batch) > 0 {
-		if err := w.flush(*batch); err != nil && cmd != nil {
-			cmd.done <- err
-		} else if cmd != nil {
-			cmd.done <- nil
+func (w *Service) newBatch() *pendingBatch {
+	return &pendingBatch{entries: make([]entry.Entry, 0, w.config.batchSize)}
+}
+
+// handleCommand adds the entry of a write to the batch and acknowledges the
+// write according to the durability mode. Returns true if the batch is due
+// for a flush.
+func (w *Service) handleCommand(batch *pendingBatch, cmd command) bool {
+	cmd.entry.LSN = w.lsn.Add(1)
+	*cmd.lsn = cmd.entry.LSN
+	if cmd.entry.Timestamp == 0 {
+		cmd.entry.Timestamp = time.Now().UnixNano()
+	}
+	batch.entries = append(batch.entries, cmd.entry)
+	full := len(batch.entries) >= w.config.batchSize
+
+	switch w.config.durability {
+	case config.DurabilityAlways:
+		batch.waiters = append(batch.waiters, cmd.done)
+		return true
+	case config.DurabilityGroup:
+		batch.waiters = append(batch.waiters, cmd.done)
+		return full
+	default:
+		// The write is acknowledged before it is synced, unless it fills the batch
+		if full {
+			batch.waiters = append(batch.waiters, cmd.done)
+			return true
 		}
-		*batch = (*batch)[:0]
+		cmd.done <- nil
+		return false
 	}
 }
 
-// Write adds an entry to the WAL batch and ensures it's written to disk
-func (w *Service) Write(entry entry.Entry) error {
+// flusher writes and syncs the batches handed over by the worker,
+// acknowledges the writers waiting for them and returns the batch buffers
+func (w *Service) flusher() {
+	for job := range w.jobs {
+		batch := job.batch
+		batch.err = w.flushOrFail(batch.entries)
+		for _, done := range batch.waiters {
+			done <- batch.err
+		}
+
+		var result checkpointResult
+		if job.checkpoint != nil {
+			result.pos, result.err = w.checkpoint(batch.err, job.lsn)
+			if result.err != nil && batch.err == nil {
+				w.fail(result.err)
+			}
+		}
+		var resumeErr, reopenErr error
+		if job.resume != nil {
+			resumeErr = w.resume()
+		}
+		if job.reopen != nil {
+			reopenErr = w.reopen()
+		}
+		w.finishRotation()
+		if job.checkpoint != nil {
+			job.checkpoint <- result
+		}
+		if job.resume != nil {
+			job.resume <- resumeErr
+		}
+		if job.reopen != nil {
+			job.reopen <- reopenErr
+		}
+
+		batch.entries = batch.entries[:0]
+		batch.waiters = batch.waiters[:0]
+		w.flushed <- batch
+	}
+}
+
+// Write adds an entry to the WAL and returns its sequence number. In the
+// always and group durability modes it returns once the entry is synced to
+// disk, with the error of the sync if any; in the async mode it returns as
+// soon as the entry is queued, so an error is reported only to the write that
+// fills a batch. Once a flush has failed, writes fail with ErrWALFailed until
+// the WAL is resumed.
+func (w *Service) Write(entry entry.Entry) (uint64, error) {
 	select {
 	case <-w.done:
-		return ErrWALClosed
+		return 0, ErrWALClosed
 	default:
 	}
+	if err := w.Err(); err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrWALFailed, err)
+	}
 
+	var lsn uint64
 	done := make(chan error, 1)
 	select {
-	case w.commands <- command{entry: entry, done: done}:
-		return <-done
+	case w.commands <- command{entry: entry, lsn: &lsn, done: done}:
+		err := <-done
+		return lsn, err
 	case <-w.done:
-		return ErrWALClosed
+		return 0, ErrWALClosed
+	}
+}
+
+// flushOrFail flushes the entries unless the WAL has failed, and puts the
+// WAL in the failed state if the flush fails
+func (w *Service) flushOrFail(batch []entry.Entry) error {
+	if err := w.Err(); err != nil {
+		return fmt.Errorf("%w: %w", ErrWALFailed, err)
+	}
+
+	if err := w.flush(batch); err != nil {
+		w.fail(err)
+		return err
 	}
+	if len(batch) > 0 {
+		w.syncedLSN = batch[len(batch)-1].LSN
+		w.syncedSize = w.currentSegment.Size()
+		w.publish()
+	}
+
+	return nil
 }
 
 // flush writes the current batch to disk and manages segment rotation.
@@ -128,6 +447,10 @@ func (w *Service) flush(batch []entry.Entry) error {
 		return nil
 	}
 
+	if w.config.compress {
+		return w.flushBlock(batch)
+	}
+
 	// Write entries and handle segment rotation
 	for _, entry := range batch {
 		if err := w.currentSegment.Write(entry); err != nil {
@@ -135,7 +458,7 @@ func (w *Service) flush(batch []entry.Entry) error {
 		}
 
 		if w.currentSegment.Size() >= w.config.maxSegmentSize {
-			if err := w.rotateSegment(); err != nil {
+			if err := w.rotateSegment(entry.LSN + 1); err != nil {
 				return fmt.Errorf("%w: %v", ErrRotateSegment, err)
 			}
 		}
@@ -149,51 +472,406 @@ func (w *Service) flush(batch []entry.Entry) error {
 	return nil
 }
 
-// rotateSegment creates a new segment and closes the current one
-func (w *Service) rotateSegment() error {
-	if err := w.currentSegment.Close(); err != nil {
-		return fmt.Errorf("%w: %v", ErrCloseSegment, err)
+// flushBlock writes the batch to disk as a single compressed record. The
+// segment is rotated after the block, so it may exceed the maximum size by
+// up to one batch.
+func (w *Service) flushBlock(batch []entry.Entry) error {
+	if err := w.currentSegment.WriteBlock(batch); err != nil {
+		return fmt.Errorf("%w: %v", ErrWriteEntry, err)
+	}
+
+	if w.currentSegment.Size() >= w.config.maxSegmentSize {
+		if err := w.rotateSegment(batch[len(batch)-1].LSN + 1); err != nil {
+			return fmt.Errorf("%w: %v", ErrRotateSegment, err)
+		}
+	}
+
+	if err := w.currentSegment.Sync(); err != nil {
+		return fmt.Errorf("%w: %v", ErrSyncWAL, err)
 	}
 
-	segment, err := segment.NewSegment(w.config.dataDirectory)
+	return nil
+}
+
+// rotateSegment syncs the current segment and switches to a new one starting
+// with the entry of the given LSN. The old segment is closed and archived by
+// finishRotation once the writers of the batch are acknowledged.
+func (w *Service) rotateSegment(firstLSN uint64) error {
+	if err := w.currentSegment.Sync(); err != nil {
+		return fmt.Errorf("%w: %v", ErrSyncWAL, err)
+	}
+
+	w.syncedLSN = firstLSN - 1
+	w.syncedSize = w.currentSegment.Size()
+
+	segment, err := segment.NewSegment(w.fsys, w.config.dataDirectory, firstLSN)
 	if err != nil {
 		return err
 	}
+	w.completed = append(w.completed, w.currentSegment)
 	w.currentSegment = segment
+	w.syncedSize = 0
 
 	return nil
 }
 
-// Close closes the WAL
-func (w *Service) Close() error {
+// finishRotation closes and archives the segments rotated out by the last
+// flush and creates the file of the new segment ahead of the next write. The
+// file stays empty if the WAL is closed first and is reused after a restart.
+// A failed archiving does not stop the writes: it is retried before the
+// segment is truncated.
+func (w *Service) finishRotation() {
+	if len(w.completed) == 0 {
+		return
+	}
+
+	for _, s := range w.completed {
+		if err := s.Close(); err != nil {
+			w.log.Error("Failed to close WAL segment", sl.Err(fmt.Errorf("%w: %v", ErrCloseSegment, err)))
+			continue
+		}
+		if err := w.archiveSegment(segment.FileName(s.ID())); err != nil {
+			w.log.Error("Failed to archive WAL segment", sl.Err(err))
+		}
+	}
+	w.completed = nil
+
+	// The next write retries the creation if it fails here
+	if err := w.currentSegment.CreateSegmentFile(); err != nil {
+		w.log.Error("Failed to create WAL segment", sl.Err(err))
+	}
+}
+
+// LSN returns the sequence number of the last entry accepted by the WAL. In
+// the async durability mode the entry may not be synced yet.
+func (w *Service) LSN() uint64 {
+	return w.lsn.Load()
+}
+
+// Err returns the error that put the WAL in the failed state, nil if the
+// WAL accepts writes
+func (w *Service) Err() error {
+	if err := w.failure.Load(); err != nil {
+		return *err
+	}
+
+	return nil
+}
+
+// fail puts the WAL in the failed state, keeping the first error
+func (w *Service) fail(err error) {
+	if w.failure.CompareAndSwap(nil, &err) {
+		w.log.Error("WAL failed, writes are rejected until it is resumed", sl.Err(err))
+	}
+}
+
+// Resume leaves the failed state once its cause is fixed, for instance once
+// disk space is freed. The data written after the last successful sync is
+// cut off and the writes continue in a new segment.
+func (w *Service) Resume() error {
+	result := make(chan error, 1)
 	select {
+	case w.resumes <- result:
 	case <-w.done:
 		return ErrWALClosed
-	default:
 	}
 
-	close(w.commands)
+	return <-result
+}
+
+// resume is executed by the flusher on behalf of Resume, while the worker
+// waits. The entries cut off were reported as failed to their writers,
+// except in the async mode, and their sequence numbers are reused.
+func (w *Service) resume() error {
+	if w.Err() == nil {
+		return nil
+	}
+
+	// The file is closed even if the buffered data cannot be written
+	_ = w.currentSegment.Close()
+	name := segment.FileName(w.currentSegment.ID())
+	if w.syncedSize > 0 {
+		if err := segment.TruncateSegment(w.fsys, w.config.dataDirectory, name, int64(w.syncedSize)); err != nil {
+			return fmt.Errorf("%w: %v", ErrResume, err)
+		}
+		if err := w.archiveSegment(name); err != nil {
+			w.log.Error("Failed to archive WAL segment", sl.Err(err))
+		}
+	} else {
+		// Nothing was synced to the segment, so the new one takes its name
+		err := segment.RemoveSegment(w.fsys, w.config.dataDirectory, name)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("%w: %v", ErrResume, err)
+		}
+	}
+
+	next, err := segment.NewSegment(w.fsys, w.config.dataDirectory, w.syncedLSN+1)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrResume, err)
+	}
+	if err := next.CreateSegmentFile(); err != nil {
+		return fmt.Errorf("%w: %v", ErrResume, err)
+	}
+	w.currentSegment = next
+	w.syncedSize = 0
+	w.lsn.Store(w.syncedLSN)
+	w.failure.Store(nil)
+	w.publish()
+
+	w.log.Info("WAL resumed", "lsn", w.syncedLSN)
+
+	return nil
+}
+
+// Reopen flushes the pending batch and continues the WAL after the last
+// entry of the data directory, in a new segment. It is called once the
+// segments were written by another writer, such as the replication stream
+// of a replica, so that the writes continue the sequence numbers received.
+func (w *Service) Reopen() error {
+	result := make(chan error, 1)
+	select {
+	case w.reopens <- result:
+	case <-w.done:
+		return ErrWALClosed
+	}
+
+	return <-result
+}
+
+// reopen is executed by the flusher on behalf of Reopen, while the worker
+// waits. A failure leaves the WAL in the failed state.
+func (w *Service) reopen() error {
+	if err := w.Err(); err != nil {
+		return fmt.Errorf("%w: %w", ErrWALFailed, err)
+	}
+
+	next, lsn, err := w.openAfterLast()
+	if err != nil {
+		err = fmt.Errorf("%w: %v", ErrReopen, err)
+		w.fail(err)
+		return err
+	}
+
+	w.currentSegment = next
+	w.syncedLSN = lsn
+	w.syncedSize = 0
+	w.lsn.Store(lsn)
+	w.publish()
+
+	w.log.Info("WAL reopened", "lsn", lsn)
+
+	return nil
+}
+
+// openAfterLast closes the current segment and opens a new one after the
+// last entry of the data directory, whose sequence number is returned
+func (w *Service) openAfterLast() (segment.Segment, uint64, error) {
+	if err := w.currentSegment.Close(); err != nil {
+		return nil, 0, err
+	}
+	if err := w.cutTornTail(); err != nil {
+		return nil, 0, err
+	}
+
+	lsn, err := lastLSN(w.fsys, w.config.dataDirectory)
+	if err != nil {
+		return nil, 0, err
+	}
+	next, err := segment.NewSegment(w.fsys, w.config.dataDirectory, lsn+1)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := next.CreateSegmentFile(); err != nil {
+		return nil, 0, err
+	}
+
+	return next, lsn, nil
+}
+
+// cutTornTail cuts off an incomplete record at the end of the last segment,
+// such as one left by an interrupted replication stream
+func (w *Service) cutTornTail() error {
+	segments, err := segment.ListSegments(w.fsys, w.config.dataDirectory)
+	if err != nil || len(segments) == 0 {
+		return err
+	}
+
+	last := segments[len(segments)-1]
+	err = segment.ReplaySegment(w.fsys, w.config.dataDirectory, last.Name, 0, func(*entry.Entry) error {
+		return nil
+	})
+	var corruption *segment.CorruptionError
+	if !errors.As(err, &corruption) || !corruption.Torn {
+		return err
+	}
+
+	return segment.TruncateSegment(w.fsys, w.config.dataDirectory, last.Name, corruption.Offset)
+}
+
+// Checkpoint flushes the pending batch and rotates the current segment.
+// The returned position covers every entry written before the call.
+func (w *Service) Checkpoint() (segment.Position, error) {
+	result := make(chan checkpointResult, 1)
+	select {
+	case w.checkpoints <- result:
+	case <-w.done:
+		return segment.Position{}, ErrWALClosed
+	}
+
+	res := <-result
+	return res.pos, res.err
+}
+
+// checkpoint is executed by the flusher on behalf of Checkpoint, after the
+// flush of the entries written before the call. lsn is the sequence number
+// of the last of them.
+func (w *Service) checkpoint(flushErr error, lsn uint64) (segment.Position, error) {
+	if flushErr != nil {
+		return segment.Position{}, fmt.Errorf("%w: %v", ErrCheckpoint, flushErr)
+	}
+
+	pos := segment.Position{
+		SegmentID: w.currentSegment.ID(),
+		Offset:    int64(w.currentSegment.Size()),
+	}
+
+	// An empty segment has nothing to cover, so there is no need to rotate it
+	if pos.Offset > 0 {
+		if err := w.rotateSegment(lsn + 1); err != nil {
+			return segment.Position{}, fmt.Errorf("%w: %v", ErrCheckpoint, err)
+		}
+		// The file of the new segment is created right away: its name keeps
+		// the LSN when the segments covered by the checkpoint are truncated
+		if err := w.currentSegment.CreateSegmentFile(); err != nil {
+			return segment.Position{}, fmt.Errorf("%w: %v", ErrCheckpoint, err)
+		}
+	}
+
+	return pos, nil
+}
+
+// Truncate removes the segments that are fully covered by the given position.
+// With archiving enabled, a segment is removed only once it is archived.
+func (w *Service) Truncate(pos segment.Position) error {
+	segments, err := segment.ListSegments(w.fsys, w.config.dataDirectory)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range segments {
+		if s.ID > pos.SegmentID {
+			break
+		}
+
+		// The segment holding the position is removed only when it has no
+		// data after the position. A checkpoint at offset zero refers to the
+		// current segment, which must be kept.
+		if s.ID == pos.SegmentID {
+			if pos.Offset == 0 {
+				break
+			}
+			info, err := w.fsys.Stat(filepath.Join(w.config.dataDirectory, s.Name))
+			if err != nil || info.Size() > pos.Offset {
+				break
+			}
+		}
+
+		if err := w.archiveSegment(s.Name); err != nil {
+			return err
+		}
+		if err := segment.RemoveSegment(w.fsys, w.config.dataDirectory, s.Name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close flushes the pending batch and closes the WAL. Writes that are
+// accepted before Close are persisted; later writes fail with ErrWALClosed.
+func (w *Service) Close() error {
+	closing := false
+	w.closeOnce.Do(func() {
+		close(w.stop)
+		closing = true
+	})
+	if !closing {
+		return ErrWALClosed
+	}
+
 	<-w.done
 
-	return w.currentSegment.Close()
+	if err := w.currentSegment.Close(); err != nil {
+		return errors.Join(w.closeErr, fmt.Errorf("%w: %v", ErrCloseSegment, err))
+	}
+
+	return w.closeErr
 }
 
 // Recover reads all WAL segments and returns entries for recovery
 func (w *Service) Recover() ([]*entry.Entry, error) {
+	return w.RecoverFrom(segment.Position{})
+}
+
+// RecoverFrom reads the WAL segments and returns the entries written after
+// the given position. Large logs should be read with Replay instead.
+func (w *Service) RecoverFrom(pos segment.Position) ([]*entry.Entry, error) {
 	var entries []*entry.Entry
+	if err := w.Replay(pos, func(e *entry.Entry) error {
+		entries = append(entries, e)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
 
-	segments, err := segment.ListSegments(w.config.dataDirectory)
+	return entries, nil
+}
+
+// Replay passes the entries written after the given position to fn in order,
+// as they are decoded from the segments. An incomplete record at the end of
+// the last segment, left by a crash in the middle of a write, is cut off;
+// corruption anywhere else is returned as an error. An error returned by fn
+// stops the replay and is returned as is.
+func (w *Service) Replay(from segment.Position, fn func(*entry.Entry) error) error {
+	segments, err := segment.ListSegments(w.fsys, w.config.dataDirectory)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	for _, s := range segments {
-		segmentEntries, err := segment.ReadSegmentEntries(w.config.dataDirectory, s.Name)
+	// Skip the segments covered by the position
+	for len(segments) > 0 && segments[0].ID < from.SegmentID {
+		segments = segments[1:]
+	}
+
+	progress := newReplayProgress(w.log, w.fsys, w.config.dataDirectory, segments)
+	for i, s := range segments {
+		var offset int64
+		if s.ID == from.SegmentID {
+			offset = from.Offset
+		}
+
+		err := segment.ReplaySegment(w.fsys, w.config.dataDirectory, s.Name, offset, func(e *entry.Entry) error {
+			progress.entries++
+			return fn(e)
+		})
 		if err != nil {
-			return nil, err
+			var corruption *segment.CorruptionError
+			if !errors.As(err, &corruption) || !corruption.Torn || i != len(segments)-1 {
+				return err
+			}
+
+			if err := segment.TruncateSegment(w.fsys, w.config.dataDirectory, s.Name, corruption.Offset); err != nil {
+				return err
+			}
+			w.log.Warn("Truncated incomplete WAL tail",
+				"segment", s.Name,
+				"offset", corruption.Offset,
+				"discarded_bytes", corruption.Size-corruption.Offset,
+				"reason", corruption.Err.Error())
 		}
-		entries = append(entries, segmentEntries...)
+		progress.segmentDone(i)
 	}
+	progress.finish()
 
-	return entries, nil
+	return nil
 }
@@ -1,20 +1,30 @@
 package wal
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/8thgencore/valchemy/internal/config"
+	"github.com/8thgencore/valchemy/internal/vfs"
 	"github.com/8thgencore/valchemy/internal/wal/entry"
+	"github.com/8thgencore/valchemy/internal/wal/segment"
 	"github.com/8thgencore/valchemy/internal/wal/segment/mocks"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
+func testLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+}
+
 // testWAL represents test helper struct
 type testWAL struct {
 	wal *Service
@@ -38,7 +48,7 @@ func setupWAL(t *testing.T) *testWAL {
 		MaxSegmentSizeBytes:  1024,
 	}
 
-	w, err := New(cfg)
+	w, err := New(cfg, vfs.OS, testLogger())
 	require.NoError(t, err)
 
 	cleanup := func() {
@@ -66,7 +76,7 @@ func TestNew(t *testing.T) {
 
 	t.Run("disabled WAL", func(t *testing.T) {
 		cfg := config.WALConfig{Enabled: false}
-		w, err := New(cfg)
+		w, err := New(cfg, vfs.OS, testLogger())
 
 		assert.NoError(t, err)
 		assert.Nil(t, w)
@@ -77,7 +87,7 @@ func TestNew(t *testing.T) {
 			Enabled:       true,
 			DataDirectory: "/proc/nonexistent",
 		}
-		w, err := New(cfg)
+		w, err := New(cfg, vfs.OS, testLogger())
 
 		assert.Error(t, err)
 		assert.Nil(t, w)
@@ -100,7 +110,7 @@ func TestWrite(t *testing.T) {
 		require.NoError(t, err)
 		cfg.DataDirectory = tempDir
 
-		w, err := New(cfg)
+		w, err := New(cfg, vfs.OS, testLogger())
 		require.NoError(t, err)
 
 		cleanup := func() {
@@ -112,7 +122,7 @@ func TestWrite(t *testing.T) {
 		defer cleanup()
 
 		// Write first entry
-		err = w.Write(entry.Entry{
+		_, err = w.Write(entry.Entry{
 			Operation: entry.OperationSet,
 			Key:       "key1",
 			Value:     "value1",
@@ -120,7 +130,7 @@ func TestWrite(t *testing.T) {
 		require.NoError(t, err)
 
 		// Write second entry to trigger flush
-		err = w.Write(entry.Entry{
+		_, err = w.Write(entry.Entry{
 			Operation: entry.OperationSet,
 			Key:       "key2",
 			Value:     "value2",
@@ -131,7 +141,7 @@ func TestWrite(t *testing.T) {
 		time.Sleep(50 * time.Millisecond)
 
 		// Create new WAL instance to read entries
-		w, err = New(cfg)
+		w, err = New(cfg, vfs.OS, testLogger())
 		require.NoError(t, err)
 
 		// Verify entries were written correctly
@@ -160,7 +170,7 @@ func TestWrite(t *testing.T) {
 		require.NoError(t, err)
 		cfg.DataDirectory = tempDir
 
-		w, err := New(cfg)
+		w, err := New(cfg, vfs.OS, testLogger())
 		require.NoError(t, err)
 
 		cleanup := func() {
@@ -172,7 +182,7 @@ func TestWrite(t *testing.T) {
 		defer cleanup()
 
 		// Write one entry
-		err = w.Write(entry.Entry{
+		_, err = w.Write(entry.Entry{
 			Operation: entry.OperationSet,
 			Key:       "key1",
 			Value:     "value1",
@@ -187,7 +197,7 @@ func TestWrite(t *testing.T) {
 		require.NoError(t, err)
 
 		// Create new WAL instance to read entries
-		w, err = New(cfg)
+		w, err = New(cfg, vfs.OS, testLogger())
 		require.NoError(t, err)
 
 		// Verify entry was written
@@ -210,7 +220,7 @@ func TestWrite(t *testing.T) {
 		for i := 0; i < numWrites; i++ {
 			go func(i int) {
 				defer wg.Done()
-				err := tw.wal.Write(entry.Entry{
+				_, err := tw.wal.Write(entry.Entry{
 					Operation: entry.OperationSet,
 					Key:       string(rune(i)),
 					Value:     "value",
@@ -225,7 +235,7 @@ func TestWrite(t *testing.T) {
 
 		// Create new WAL instance to read entries
 		tw.wal.Close()
-		w, err := New(tw.cfg)
+		w, err := New(tw.cfg, vfs.OS, testLogger())
 		require.NoError(t, err)
 		defer w.Close()
 
@@ -245,25 +255,291 @@ func TestWrite_Errors(t *testing.T) {
 			WriteErr: errors.New("write error"),
 		}
 
-		err := tw.wal.Write(entry.Entry{
+		_, err := tw.wal.Write(entry.Entry{
 			Operation: entry.OperationSet,
 			Key:       "key1",
 			Value:     "value1",
 		})
-		assert.NoError(t, err) // Write now always returns nil, as errors are handled in worker
+		assert.NoError(t, err) // In the async mode a write that does not fill the batch is acknowledged before the flush
 
 		// Small pause to ensure worker processed the command
 		time.Sleep(10 * time.Millisecond)
 	})
 }
 
+func TestDurability(t *testing.T) {
+	newWAL := func(t *testing.T, durability config.DurabilityMode) *Service {
+		t.Helper()
+		cfg := config.WALConfig{
+			Enabled:              true,
+			Durability:           durability,
+			DataDirectory:        t.TempDir(),
+			FlushingBatchSize:    100,
+			FlushingBatchTimeout: 20 * time.Millisecond,
+			MaxSegmentSizeBytes:  1 << 20,
+		}
+		w, err := New(cfg, vfs.OS, testLogger())
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = w.Close() })
+
+		return w
+	}
+
+	for _, durability := range []config.DurabilityMode{config.DurabilityAlways, config.DurabilityGroup} {
+		t.Run(string(durability)+" acknowledges synced writes", func(t *testing.T) {
+			w := newWAL(t, durability)
+
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					_, err := w.Write(entry.Entry{Operation: entry.OperationSet, Key: string(rune('a' + i))})
+					assert.NoError(t, err)
+				}(i)
+			}
+			wg.Wait()
+
+			// Every acknowledged write is on disk without closing the WAL
+			entries, err := w.Recover()
+			require.NoError(t, err)
+			assert.Len(t, entries, 10)
+		})
+
+		t.Run(string(durability)+" reports sync errors", func(t *testing.T) {
+			w := newWAL(t, durability)
+			syncErr := errors.New("sync error")
+
+			// The worker is idle once it has answered the checkpoint, so the
+			// segment can be replaced
+			_, err := w.Write(entry.Entry{Operation: entry.OperationSet, Key: "key1"})
+			require.NoError(t, err)
+			_, err = w.Checkpoint()
+			require.NoError(t, err)
+			w.currentSegment = &mocks.MockSegment{SyncErr: syncErr}
+
+			_, err = w.Write(entry.Entry{Operation: entry.OperationSet, Key: "key2"})
+			assert.ErrorIs(t, err, ErrSyncWAL)
+			assert.ErrorContains(t, err, "sync error")
+		})
+	}
+
+	t.Run("async acknowledges before the sync", func(t *testing.T) {
+		w := newWAL(t, config.DurabilityAsync)
+		w.currentSegment = &mocks.MockSegment{SyncErr: errors.New("sync error")}
+
+		_, err := w.Write(entry.Entry{Operation: entry.OperationSet, Key: "key1"})
+		assert.NoError(t, err)
+	})
+
+	t.Run("unknown mode", func(t *testing.T) {
+		_, err := New(config.WALConfig{Enabled: true, Durability: "sometimes", DataDirectory: t.TempDir()}, vfs.OS, testLogger())
+		assert.ErrorIs(t, err, ErrUnknownDurability)
+	})
+}
+
+// slowSegment is a segment whose syncs wait to be released. It records the
+// number of entries written before each sync.
+type slowSegment struct {
+	mocks.MockSegment
+	syncing chan struct{}
+	release chan struct{}
+	written int
+	synced  []int
+}
+
+func (s *slowSegment) Write(entry.Entry) error {
+	s.written++
+	return nil
+}
+
+func (s *slowSegment) Sync() error {
+	s.syncing <- struct{}{}
+	<-s.release
+	s.synced = append(s.synced, s.written)
+	s.written = 0
+	return nil
+}
+
+func TestPipeline(t *testing.T) {
+	newWAL := func(t *testing.T, durability config.DurabilityMode, batchSize int) (*Service, *slowSegment) {
+		t.Helper()
+
+		w, err := New(config.WALConfig{
+			Enabled:              true,
+			Durability:           durability,
+			DataDirectory:        t.TempDir(),
+			FlushingBatchSize:    batchSize,
+			FlushingBatchTimeout: time.Hour,
+			MaxSegmentSizeBytes:  1 << 20,
+		}, vfs.OS, testLogger())
+		require.NoError(t, err)
+
+		seg := &slowSegment{syncing: make(chan struct{}, 10), release: make(chan struct{})}
+		w.currentSegment = seg
+
+		return w, seg
+	}
+
+	t.Run("writes are collected while the previous batch is synced", func(t *testing.T) {
+		w, seg := newWAL(t, config.DurabilityAlways, 100)
+
+		var wg sync.WaitGroup
+		write := func(key string) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := w.Write(entry.Entry{Operation: entry.OperationSet, Key: key})
+				assert.NoError(t, err)
+			}()
+		}
+
+		write("key0")
+		<-seg.syncing
+		for i := 1; i <= 5; i++ {
+			write(fmt.Sprintf("key%d", i))
+		}
+		require.Eventually(t, func() bool { return w.LSN() == 6 }, time.Second, time.Millisecond)
+
+		// The five writes that arrived during the first sync share the second one
+		close(seg.release)
+		wg.Wait()
+		require.NoError(t, w.Close())
+		assert.Equal(t, []int{1, 5}, seg.synced)
+	})
+
+	t.Run("async writes are acknowledged during a sync", func(t *testing.T) {
+		w, seg := newWAL(t, config.DurabilityAsync, 2)
+
+		_, err := w.Write(entry.Entry{Operation: entry.OperationSet, Key: "key0"})
+		require.NoError(t, err)
+		filled := make(chan error, 1)
+		go func() {
+			_, err := w.Write(entry.Entry{Operation: entry.OperationSet, Key: "key1"})
+			filled <- err
+		}()
+		<-seg.syncing
+
+		_, err = w.Write(entry.Entry{Operation: entry.OperationSet, Key: "key2"})
+		require.NoError(t, err)
+		assert.Empty(t, filled)
+
+		close(seg.release)
+		assert.NoError(t, <-filled)
+		require.NoError(t, w.Close())
+		assert.Equal(t, []int{2, 1}, seg.synced)
+	})
+}
+
+func TestCompression(t *testing.T) {
+	newConfig := func(dir string, compression config.Compression) config.WALConfig {
+		return config.WALConfig{
+			Enabled:              true,
+			Durability:           config.DurabilityGroup,
+			Compression:          compression,
+			DataDirectory:        dir,
+			FlushingBatchSize:    20,
+			FlushingBatchTimeout: time.Hour,
+			MaxSegmentSizeBytes:  1 << 20,
+		}
+	}
+
+	// write writes count entries with JSON values concurrently, so that
+	// they fill whole batches
+	write := func(t *testing.T, w *Service, from, count int) {
+		t.Helper()
+
+		var wg sync.WaitGroup
+		for i := from; i < from+count; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, err := w.Write(entry.Entry{
+					Operation: entry.OperationSet,
+					Key:       fmt.Sprintf("user:%d", i),
+					Value:     fmt.Sprintf(`{"id":%d,"name":"user","roles":["reader","writer"],"active":true}`, i),
+				})
+				assert.NoError(t, err)
+			}(i)
+		}
+		wg.Wait()
+	}
+
+	segmentsSize := func(t *testing.T, dir string) int64 {
+		t.Helper()
+
+		var size int64
+		segments, err := segment.ListSegments(vfs.OS, dir)
+		require.NoError(t, err)
+		for _, s := range segments {
+			info, err := os.Stat(filepath.Join(dir, s.Name))
+			require.NoError(t, err)
+			size += info.Size()
+		}
+
+		return size
+	}
+
+	t.Run("batches are compressed and recovered", func(t *testing.T) {
+		plainDir, compressedDir := t.TempDir(), t.TempDir()
+		for dir, compression := range map[string]config.Compression{
+			plainDir:      config.CompressionNone,
+			compressedDir: config.CompressionFlate,
+		} {
+			w, err := New(newConfig(dir, compression), vfs.OS, testLogger())
+			require.NoError(t, err)
+			write(t, w, 0, 100)
+			require.NoError(t, w.Close())
+		}
+
+		assert.Less(t, segmentsSize(t, compressedDir), segmentsSize(t, plainDir)/3)
+
+		w, err := New(newConfig(compressedDir, config.CompressionFlate), vfs.OS, testLogger())
+		require.NoError(t, err)
+		defer w.Close()
+
+		entries, err := w.Recover()
+		require.NoError(t, err)
+		require.Len(t, entries, 100)
+		for i, e := range entries {
+			assert.Equal(t, uint64(i+1), e.LSN)
+		}
+		assert.Equal(t, uint64(100), w.LSN())
+	})
+
+	t.Run("segments written with and without compression", func(t *testing.T) {
+		dir := t.TempDir()
+		for i, compression := range []config.Compression{
+			config.CompressionNone, config.CompressionFlate, config.CompressionNone,
+		} {
+			w, err := New(newConfig(dir, compression), vfs.OS, testLogger())
+			require.NoError(t, err)
+			write(t, w, i*20, 20)
+			require.NoError(t, w.Close())
+		}
+
+		w, err := New(newConfig(dir, config.CompressionNone), vfs.OS, testLogger())
+		require.NoError(t, err)
+		defer w.Close()
+
+		entries, err := w.Recover()
+		require.NoError(t, err)
+		assert.Len(t, entries, 60)
+	})
+
+	t.Run("unknown compression", func(t *testing.T) {
+		_, err := New(newConfig(t.TempDir(), "zip"), vfs.OS, testLogger())
+		assert.ErrorIs(t, err, ErrUnknownCompression)
+	})
+}
+
 func TestClose(t *testing.T) {
 	t.Run("close with pending entries", func(t *testing.T) {
 		t.Parallel()
 		tw := setupWAL(t)
 
 		// Write some entries
-		err := tw.wal.Write(entry.Entry{
+		_, err := tw.wal.Write(entry.Entry{
 			Operation: entry.OperationSet,
 			Key:       "key1",
 			Value:     "value1",
@@ -278,7 +554,7 @@ func TestClose(t *testing.T) {
 		require.NoError(t, err)
 
 		// Create new WAL instance to verify entries
-		w, err := New(tw.cfg)
+		w, err := New(tw.cfg, vfs.OS, testLogger())
 		require.NoError(t, err)
 		defer w.Close()
 
@@ -293,6 +569,27 @@ func TestClose(t *testing.T) {
 		tw.cleanup()
 	})
 
+	t.Run("close flushes the batch still waiting for the timeout", func(t *testing.T) {
+		t.Parallel()
+		tw := setupWAL(t)
+		defer tw.cleanup()
+
+		_, err := tw.wal.Write(entry.Entry{Operation: entry.OperationSet, Key: "key1", Value: "value1"})
+		require.NoError(t, err)
+		require.NoError(t, tw.wal.Close())
+		_, err = tw.wal.Write(entry.Entry{Operation: entry.OperationDelete, Key: "key1"})
+		assert.ErrorIs(t, err, ErrWALClosed)
+
+		w, err := New(tw.cfg, vfs.OS, testLogger())
+		require.NoError(t, err)
+		defer w.Close()
+
+		entries, err := w.Recover()
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		assert.Equal(t, "key1", entries[0].Key)
+	})
+
 	t.Run("multiple close calls", func(t *testing.T) {
 		t.Parallel()
 		tw := setupWAL(t)
@@ -325,7 +622,7 @@ func TestRecover(t *testing.T) {
 		cfg.DataDirectory = tempDir
 
 		// Create WAL with pre-configured configuration
-		w, err := New(cfg)
+		w, err := New(cfg, vfs.OS, testLogger())
 		require.NoError(t, err)
 
 		cleanup := func() {
@@ -344,7 +641,7 @@ func TestRecover(t *testing.T) {
 		}
 
 		for _, e := range testEntries {
-			err := w.Write(e)
+			_, err := w.Write(e)
 			require.NoError(t, err)
 		}
 
@@ -355,7 +652,7 @@ func TestRecover(t *testing.T) {
 		require.NoError(t, err)
 
 		// Create new WAL instance and recover
-		w, err = New(cfg)
+		w, err = New(cfg, vfs.OS, testLogger())
 		require.NoError(t, err)
 
 		entries, err := w.Recover()
@@ -380,6 +677,58 @@ func TestRecover(t *testing.T) {
 	})
 }
 
+func TestReplay(t *testing.T) {
+	t.Run("entries are streamed in order across segments", func(t *testing.T) {
+		tw := setupWAL(t)
+		defer tw.cleanup()
+
+		dir := tw.cfg.DataDirectory
+		writeSegment(t, dir, segment.FileName(1),
+			entry.Entry{LSN: 1, Operation: entry.OperationSet, Key: "key1", Value: "value1"},
+			entry.Entry{LSN: 2, Operation: entry.OperationSet, Key: "key2", Value: "value2"},
+		)
+		writeSegment(t, dir, segment.FileName(3),
+			entry.Entry{LSN: 3, Operation: entry.OperationDelete, Key: "key1"},
+		)
+
+		var lsns []uint64
+		err := tw.wal.Replay(segment.Position{}, func(e *entry.Entry) error {
+			lsns = append(lsns, e.LSN)
+			return nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, []uint64{1, 2, 3}, lsns)
+
+		// Segments before the position are skipped
+		lsns = nil
+		err = tw.wal.Replay(segment.Position{SegmentID: 3}, func(e *entry.Entry) error {
+			lsns = append(lsns, e.LSN)
+			return nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, []uint64{3}, lsns)
+	})
+
+	t.Run("error from the callback stops the replay", func(t *testing.T) {
+		tw := setupWAL(t)
+		defer tw.cleanup()
+
+		writeSegment(t, tw.cfg.DataDirectory, segment.FileName(1),
+			entry.Entry{LSN: 1, Operation: entry.OperationSet, Key: "key1", Value: "value1"},
+			entry.Entry{LSN: 2, Operation: entry.OperationSet, Key: "key2", Value: "value2"},
+		)
+
+		errStop := errors.New("stop")
+		calls := 0
+		err := tw.wal.Replay(segment.Position{}, func(*entry.Entry) error {
+			calls++
+			return errStop
+		})
+		assert.ErrorIs(t, err, errStop)
+		assert.Equal(t, 1, calls)
+	})
+}
+
 func TestRecover_Errors(t *testing.T) {
 	t.Run("error on listing segments", func(t *testing.T) {
 		tw := setupWAL(t)
@@ -398,21 +747,182 @@ func TestRecover_Errors(t *testing.T) {
 		assert.Nil(t, entries)
 	})
 
-	t.Run("error on reading segment entries", func(t *testing.T) {
+	t.Run("error on corrupted segment in the middle", func(t *testing.T) {
 		tw := setupWAL(t)
 		defer tw.cleanup()
 
-		// Create a corrupted segment file
-		segmentPath := filepath.Join(tw.cfg.DataDirectory, "wal-1.log")
-		err := os.WriteFile(segmentPath, []byte{1, 2, 3}, 0o600)
+		// Create a corrupted segment followed by a valid one
+		err := os.WriteFile(filepath.Join(tw.cfg.DataDirectory, "wal-1.log"), []byte{1, 2, 3}, 0o600)
 		require.NoError(t, err)
+		writeSegment(t, tw.cfg.DataDirectory, "wal-2.log", entry.Entry{Operation: entry.OperationSet, Key: "k", Value: "v"})
 
 		entries, err := tw.wal.Recover()
-		assert.Error(t, err)
+		assert.ErrorIs(t, err, segment.ErrCorruptSegment)
+		assert.Nil(t, entries)
+	})
+
+	t.Run("error on checksum mismatch before the last record", func(t *testing.T) {
+		tw := setupWAL(t)
+		defer tw.cleanup()
+
+		path := writeSegment(t, tw.cfg.DataDirectory, "wal-1.log",
+			entry.Entry{Operation: entry.OperationSet, Key: "key1", Value: "value1"},
+			entry.Entry{Operation: entry.OperationSet, Key: "key2", Value: "value2"},
+		)
+
+		// Flip a byte of the first record's value
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		data[20] ^= 0xFF
+		require.NoError(t, os.WriteFile(path, data, 0o600))
+
+		entries, err := tw.wal.Recover()
+		assert.ErrorIs(t, err, entry.ErrChecksumMismatch)
 		assert.Nil(t, entries)
 	})
 }
 
+func TestRecover_TornTail(t *testing.T) {
+	t.Run("incomplete last record is truncated", func(t *testing.T) {
+		tw := setupWAL(t)
+		defer tw.cleanup()
+
+		path := writeSegment(t, tw.cfg.DataDirectory, "wal-1.log",
+			entry.Entry{Operation: entry.OperationSet, Key: "key1", Value: "value1"},
+			entry.Entry{Operation: entry.OperationSet, Key: "key2", Value: "value2"},
+		)
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		require.NoError(t, os.Truncate(path, info.Size()-3))
+
+		entries, err := tw.wal.Recover()
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		assert.Equal(t, "key1", entries[0].Key)
+
+		// The torn record is cut off the file
+		truncated, err := os.Stat(path)
+		require.NoError(t, err)
+		entries, err = tw.wal.Recover()
+		require.NoError(t, err)
+		assert.Len(t, entries, 1)
+		assert.Less(t, truncated.Size(), info.Size()-3)
+	})
+
+	t.Run("zero-filled tail is truncated", func(t *testing.T) {
+		tw := setupWAL(t)
+		defer tw.cleanup()
+
+		path := writeSegment(t, tw.cfg.DataDirectory, "wal-1.log",
+			entry.Entry{Operation: entry.OperationSet, Key: "key1", Value: "value1"},
+		)
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o600)
+		require.NoError(t, err)
+		_, err = file.Write(make([]byte, 64))
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+
+		entries, err := tw.wal.Recover()
+		require.NoError(t, err)
+		assert.Len(t, entries, 1)
+	})
+
+	t.Run("corrupted last record is truncated", func(t *testing.T) {
+		tw := setupWAL(t)
+		defer tw.cleanup()
+
+		path := writeSegment(t, tw.cfg.DataDirectory, "wal-1.log",
+			entry.Entry{Operation: entry.OperationSet, Key: "key1", Value: "value1"},
+			entry.Entry{Operation: entry.OperationSet, Key: "key2", Value: "value2"},
+		)
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		data[len(data)-1] ^= 0xFF
+		require.NoError(t, os.WriteFile(path, data, 0o600))
+
+		entries, err := tw.wal.Recover()
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		assert.Equal(t, "key1", entries[0].Key)
+	})
+}
+
+// writeSegment writes the entries to a segment file and returns its path
+func writeSegment(t *testing.T, dir, name string, entries ...entry.Entry) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	for _, e := range entries {
+		_, err := e.WriteTo(&buf)
+		require.NoError(t, err)
+	}
+
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, buf.Bytes(), 0o600))
+
+	return path
+}
+
+func TestCheckpoint(t *testing.T) {
+	t.Run("recover from checkpoint and truncate", func(t *testing.T) {
+		tw := setupWAL(t)
+		defer tw.cleanup()
+
+		_, err := tw.wal.Write(entry.Entry{Operation: entry.OperationSet, Key: "key1", Value: "value1"})
+		require.NoError(t, err)
+
+		pos, err := tw.wal.Checkpoint()
+		require.NoError(t, err)
+		assert.Greater(t, pos.Offset, int64(0))
+
+		_, err = tw.wal.Write(entry.Entry{Operation: entry.OperationSet, Key: "key2", Value: "value2"})
+		require.NoError(t, err)
+		time.Sleep(50 * time.Millisecond)
+
+		// Only the entry written after the checkpoint is returned
+		entries, err := tw.wal.RecoverFrom(pos)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		assert.Equal(t, "key2", entries[0].Key)
+
+		// The segment covered by the checkpoint is removed
+		require.NoError(t, tw.wal.Truncate(pos))
+		entries, err = tw.wal.Recover()
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		assert.Equal(t, "key2", entries[0].Key)
+	})
+
+	t.Run("checkpoint of an empty segment", func(t *testing.T) {
+		tw := setupWAL(t)
+		defer tw.cleanup()
+
+		pos, err := tw.wal.Checkpoint()
+		require.NoError(t, err)
+		assert.Equal(t, int64(0), pos.Offset)
+
+		_, err = tw.wal.Write(entry.Entry{Operation: entry.OperationSet, Key: "key1", Value: "value1"})
+		require.NoError(t, err)
+		time.Sleep(50 * time.Millisecond)
+
+		// The current segment is kept
+		require.NoError(t, tw.wal.Truncate(pos))
+		entries, err := tw.wal.RecoverFrom(pos)
+		require.NoError(t, err)
+		assert.Len(t, entries, 1)
+	})
+
+	t.Run("checkpoint on closed WAL", func(t *testing.T) {
+		tw := setupWAL(t)
+		defer tw.cleanup()
+
+		require.NoError(t, tw.wal.Close())
+
+		_, err := tw.wal.Checkpoint()
+		assert.ErrorIs(t, err, ErrWALClosed)
+	})
+}
+
 func TestSegmentRotation(t *testing.T) {
 	t.Run("automatic segment rotation", func(t *testing.T) {
 		t.Parallel()
@@ -431,7 +941,7 @@ func TestSegmentRotation(t *testing.T) {
 		cfg.DataDirectory = tempDir
 
 		// Create WAL with pre-configured configuration
-		w, err := New(cfg)
+		w, err := New(cfg, vfs.OS, testLogger())
 		require.NoError(t, err)
 
 		cleanup := func() {
@@ -448,7 +958,7 @@ func TestSegmentRotation(t *testing.T) {
 
 		for i := 0; i < numEntries; i++ {
 			key := string(rune(i))
-			err := w.Write(entry.Entry{
+			_, err := w.Write(entry.Entry{
 				Operation: entry.OperationSet,
 				Key:       key,
 				Value:     "long_value_to_force_rotation",
@@ -477,7 +987,7 @@ func TestSegmentRotation(t *testing.T) {
 		require.NoError(t, err)
 
 		// Create new WAL instance to read entries
-		w, err = New(cfg)
+		w, err = New(cfg, vfs.OS, testLogger())
 		require.NoError(t, err)
 
 		// Check if multiple segments were created
@@ -496,3 +1006,495 @@ func TestSegmentRotation(t *testing.T) {
 		}
 	})
 }
+
+func TestLSN(t *testing.T) {
+	t.Run("entries are numbered and segments named by their first LSN", func(t *testing.T) {
+		cfg := config.WALConfig{
+			Enabled:              true,
+			Durability:           config.DurabilityAlways,
+			DataDirectory:        t.TempDir(),
+			FlushingBatchSize:    10,
+			FlushingBatchTimeout: 10 * time.Millisecond,
+			MaxSegmentSizeBytes:  100,
+		}
+
+		w, err := New(cfg, vfs.OS, testLogger())
+		require.NoError(t, err)
+		assert.Equal(t, uint64(0), w.LSN())
+
+		for i := 0; i < 5; i++ {
+			lsn, err := w.Write(entry.Entry{Operation: entry.OperationSet, Key: "key", Value: "a_value_long_enough_to_rotate"})
+			require.NoError(t, err)
+			assert.Equal(t, uint64(i+1), lsn)
+		}
+		assert.Equal(t, uint64(5), w.LSN())
+		require.NoError(t, w.Close())
+
+		entries, err := w.Recover()
+		require.NoError(t, err)
+		require.Len(t, entries, 5)
+		for i, e := range entries {
+			assert.Equal(t, uint64(i+1), e.LSN)
+		}
+
+		segments, err := segment.ListSegments(vfs.OS, cfg.DataDirectory)
+		require.NoError(t, err)
+		require.Greater(t, len(segments), 1)
+		for _, s := range segments {
+			first, err := segment.ReadSegmentEntries(vfs.OS, cfg.DataDirectory, s.Name)
+			require.NoError(t, err)
+			require.NotEmpty(t, first)
+			assert.Equal(t, uint64(s.ID), first[0].LSN)
+		}
+
+		// The numbering continues after a restart
+		w, err = New(cfg, vfs.OS, testLogger())
+		require.NoError(t, err)
+		defer w.Close()
+		assert.Equal(t, uint64(5), w.LSN())
+
+		_, err = w.Write(entry.Entry{Operation: entry.OperationDelete, Key: "key"})
+		require.NoError(t, err)
+		assert.Equal(t, uint64(6), w.LSN())
+	})
+
+	t.Run("numbering continues after the segments are truncated", func(t *testing.T) {
+		tw := setupWAL(t)
+		defer tw.cleanup()
+
+		_, err := tw.wal.Write(entry.Entry{Operation: entry.OperationSet, Key: "key", Value: "value"})
+		require.NoError(t, err)
+		pos, err := tw.wal.Checkpoint()
+		require.NoError(t, err)
+		require.NoError(t, tw.wal.Truncate(pos))
+		require.NoError(t, tw.wal.Close())
+
+		w, err := New(tw.cfg, vfs.OS, testLogger())
+		require.NoError(t, err)
+		defer w.Close()
+
+		_, err = w.Write(entry.Entry{Operation: entry.OperationDelete, Key: "key"})
+		require.NoError(t, err)
+		assert.Equal(t, uint64(2), w.LSN())
+
+		// The entries written after the checkpoint are found from its position
+		require.NoError(t, w.Close())
+		entries, err := w.RecoverFrom(pos)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		assert.Equal(t, entry.OperationDelete, entries[0].Operation)
+	})
+
+	t.Run("restart after a checkpoint leaves no gap in the archive", func(t *testing.T) {
+		cfg := config.WALConfig{
+			Enabled:              true,
+			DataDirectory:        t.TempDir(),
+			ArchiveDirectory:     t.TempDir(),
+			FlushingBatchSize:    1,
+			FlushingBatchTimeout: 10 * time.Millisecond,
+			MaxSegmentSizeBytes:  1024,
+		}
+		write := func(w *Service, key string) {
+			_, err := w.Write(entry.Entry{Operation: entry.OperationSet, Key: key, Value: "value"})
+			require.NoError(t, err)
+		}
+
+		w, err := New(cfg, vfs.OS, testLogger())
+		require.NoError(t, err)
+		for i := 0; i < 3; i++ {
+			write(w, fmt.Sprintf("key%d", i))
+		}
+		_, err = w.Checkpoint()
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+
+		// The empty segment created by the checkpoint takes the next entry
+		w, err = New(cfg, vfs.OS, testLogger())
+		require.NoError(t, err)
+		defer w.Close()
+		assert.Equal(t, uint64(3), w.LSN())
+		write(w, "key3")
+		assert.Equal(t, uint64(4), w.LSN())
+
+		pos, err := w.Checkpoint()
+		require.NoError(t, err)
+		require.NoError(t, w.Truncate(pos))
+
+		result, err := Restore(vfs.OS, cfg.ArchiveDirectory, t.TempDir(), RestoreTarget{})
+		require.NoError(t, err)
+		assert.Equal(t, 4, result.Entries)
+		assert.Equal(t, uint64(4), result.LastLSN)
+	})
+
+	t.Run("restart right after a rotation", func(t *testing.T) {
+		cfg := config.WALConfig{
+			Enabled:              true,
+			Durability:           config.DurabilityAlways,
+			DataDirectory:        t.TempDir(),
+			FlushingBatchSize:    1,
+			FlushingBatchTimeout: 10 * time.Millisecond,
+			MaxSegmentSizeBytes:  1,
+		}
+
+		// Every entry fills its segment, so the WAL is closed with an empty
+		// segment created for the next write
+		w, err := New(cfg, vfs.OS, testLogger())
+		require.NoError(t, err)
+		for i := 0; i < 2; i++ {
+			_, err := w.Write(entry.Entry{Operation: entry.OperationSet, Key: "key", Value: "value"})
+			require.NoError(t, err)
+		}
+		require.NoError(t, w.Close())
+
+		w, err = New(cfg, vfs.OS, testLogger())
+		require.NoError(t, err)
+		assert.Equal(t, uint64(2), w.LSN())
+		_, err = w.Write(entry.Entry{Operation: entry.OperationDelete, Key: "key"})
+		require.NoError(t, err)
+		assert.Equal(t, uint64(3), w.LSN())
+		require.NoError(t, w.Close())
+
+		entries, err := w.Recover()
+		require.NoError(t, err)
+		require.Len(t, entries, 3)
+		for i, e := range entries {
+			assert.Equal(t, uint64(i+1), e.LSN)
+		}
+	})
+
+	t.Run("numbering continues after segments without LSNs", func(t *testing.T) {
+		dir := t.TempDir()
+		writeSegment(t, dir, segment.FileName(1700000000000000000),
+			entry.Entry{Operation: entry.OperationSet, Key: "key1", Value: "value1"},
+			entry.Entry{Operation: entry.OperationSet, Key: "key2", Value: "value2"})
+
+		w, err := New(config.WALConfig{Enabled: true, DataDirectory: dir, FlushingBatchSize: 10}, vfs.OS, testLogger())
+		require.NoError(t, err)
+		defer w.Close()
+
+		assert.Equal(t, uint64(1700000000000000001), w.LSN())
+	})
+}
+
+func TestCrashRecovery(t *testing.T) {
+	cfg := config.WALConfig{
+		Enabled:              true,
+		Durability:           config.DurabilityGroup,
+		DataDirectory:        "/data/wal",
+		FlushingBatchSize:    1,
+		FlushingBatchTimeout: time.Hour,
+		MaxSegmentSizeBytes:  1 << 20,
+	}
+	segmentPath := filepath.Join(cfg.DataDirectory, segment.FileName(1))
+
+	write := func(t *testing.T, w *Service, i int) error {
+		t.Helper()
+		_, err := w.Write(entry.Entry{Operation: entry.OperationSet, Key: fmt.Sprintf("key%d", i), Value: "value"})
+		return err
+	}
+	size := func(t *testing.T, fsys vfs.FS) int64 {
+		t.Helper()
+		info, err := fsys.Stat(segmentPath)
+		require.NoError(t, err)
+		return info.Size()
+	}
+
+	// recoverKeys opens the WAL of a crashed file system and returns the keys
+	// it recovers. The WAL must accept new writes after the recovery.
+	recoverKeys := func(t *testing.T, fsys vfs.FS) []string {
+		t.Helper()
+
+		w, err := New(cfg, fsys, testLogger())
+		require.NoError(t, err)
+		defer w.Close()
+
+		entries, err := w.Recover()
+		require.NoError(t, err)
+		keys := make([]string, 0, len(entries))
+		for i, e := range entries {
+			assert.Equal(t, uint64(i+1), e.LSN)
+			keys = append(keys, e.Key)
+		}
+
+		require.NoError(t, write(t, w, 100))
+		assert.Equal(t, uint64(len(entries)+1), w.LSN())
+
+		return keys
+	}
+
+	t.Run("acknowledged writes survive a crash at any byte", func(t *testing.T) {
+		fsys := vfs.NewMemFS()
+		w, err := New(cfg, fsys, testLogger())
+		require.NoError(t, err)
+		defer w.Close()
+
+		for i := 0; i < 5; i++ {
+			require.NoError(t, write(t, w, i))
+		}
+		synced := size(t, fsys)
+
+		// The following writes reach the file but are never synced
+		fsys.SetFault(func(op vfs.Op, _ string) error {
+			if op == vfs.OpSync {
+				return syscall.EIO
+			}
+			return nil
+		})
+		for i := 5; i < 8; i++ {
+			err := write(t, w, i)
+			assert.ErrorIs(t, err, ErrSyncWAL)
+			assert.ErrorContains(t, err, "input/output error")
+		}
+		unsynced := size(t, fsys) - synced
+		require.Positive(t, unsynced)
+
+		for keep := int64(0); keep <= unsynced; keep++ {
+			keys := recoverKeys(t, fsys.Crash(keep))
+			require.GreaterOrEqual(t, len(keys), 5, "keep %d", keep)
+			require.LessOrEqual(t, len(keys), 8, "keep %d", keep)
+			for i, key := range keys {
+				assert.Equal(t, fmt.Sprintf("key%d", i), key)
+			}
+		}
+	})
+
+	t.Run("a full disk fails the write and leaves a recoverable log", func(t *testing.T) {
+		fsys := vfs.NewMemFS()
+		w, err := New(cfg, fsys, testLogger())
+		require.NoError(t, err)
+		defer w.Close()
+
+		for i := 0; i < 5; i++ {
+			require.NoError(t, write(t, w, i))
+		}
+		fsys.SetCapacity(size(t, fsys) + 10)
+
+		err = write(t, w, 5)
+		assert.ErrorIs(t, err, ErrSyncWAL)
+		assert.ErrorContains(t, err, "no space left on device")
+
+		// The partial record is cut off by the recovery
+		assert.Equal(t, []string{"key0", "key1", "key2", "key3", "key4"}, recoverKeys(t, fsys.Crash(1<<20)))
+	})
+}
+
+func TestFailedState(t *testing.T) {
+	newWAL := func(t *testing.T, fsys vfs.FS, durability config.DurabilityMode) *Service {
+		t.Helper()
+
+		w, err := New(config.WALConfig{
+			Enabled:              true,
+			Durability:           durability,
+			DataDirectory:        "/data/wal",
+			FlushingBatchSize:    1,
+			FlushingBatchTimeout: 10 * time.Millisecond,
+			MaxSegmentSizeBytes:  1 << 20,
+		}, fsys, testLogger())
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = w.Close() })
+
+		return w
+	}
+	write := func(w *Service, key string) error {
+		_, err := w.Write(entry.Entry{Operation: entry.OperationSet, Key: key, Value: "value"})
+		return err
+	}
+
+	t.Run("a full disk fails the writes until the WAL is resumed", func(t *testing.T) {
+		fsys := vfs.NewMemFS()
+		w := newWAL(t, fsys, config.DurabilityGroup)
+		require.NoError(t, write(w, "key1"))
+		require.NoError(t, write(w, "key2"))
+		require.NoError(t, w.Err())
+
+		info, err := fsys.Stat("/data/wal/wal-1.log")
+		require.NoError(t, err)
+		fsys.SetCapacity(info.Size() + 5)
+
+		assert.ErrorIs(t, write(w, "key3"), ErrSyncWAL)
+		assert.ErrorContains(t, w.Err(), "no space left on device")
+
+		// Once failed, the writes and checkpoints fail without touching the disk
+		fsys.SetCapacity(-1)
+		assert.ErrorIs(t, write(w, "key4"), ErrWALFailed)
+		_, err = w.Checkpoint()
+		assert.ErrorIs(t, err, ErrCheckpoint)
+
+		require.NoError(t, w.Resume())
+		require.NoError(t, w.Err())
+		assert.Equal(t, uint64(2), w.LSN())
+
+		// The partial record is cut off and its sequence number reused
+		require.NoError(t, write(w, "key5"))
+		entries, err := w.Recover()
+		require.NoError(t, err)
+		require.Len(t, entries, 3)
+		for i, key := range []string{"key1", "key2", "key5"} {
+			assert.Equal(t, uint64(i+1), entries[i].LSN)
+			assert.Equal(t, key, entries[i].Key)
+		}
+	})
+
+	t.Run("nothing synced to the segment", func(t *testing.T) {
+		fsys := vfs.NewMemFS()
+		w := newWAL(t, fsys, config.DurabilityAlways)
+		fsys.SetCapacity(5)
+
+		assert.Error(t, write(w, "key1"))
+		require.Error(t, w.Err())
+
+		fsys.SetCapacity(-1)
+		require.NoError(t, w.Resume())
+		require.NoError(t, write(w, "key2"))
+
+		entries, err := w.Recover()
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		assert.Equal(t, uint64(1), entries[0].LSN)
+	})
+
+	t.Run("a failed flush of acknowledged writes", func(t *testing.T) {
+		fsys := vfs.NewMemFS()
+		fsys.SetFault(func(op vfs.Op, _ string) error {
+			if op == vfs.OpSync {
+				return syscall.EIO
+			}
+			return nil
+		})
+		w, err := New(config.WALConfig{
+			Enabled:              true,
+			Durability:           config.DurabilityAsync,
+			DataDirectory:        "/data/wal",
+			FlushingBatchSize:    100,
+			FlushingBatchTimeout: 10 * time.Millisecond,
+			MaxSegmentSizeBytes:  1 << 20,
+		}, fsys, testLogger())
+		require.NoError(t, err)
+		defer w.Close()
+
+		// The error of the flush on the timer is not lost
+		require.NoError(t, write(w, "key1"))
+		require.Eventually(t, func() bool { return w.Err() != nil }, time.Second, time.Millisecond)
+		assert.ErrorIs(t, write(w, "key2"), ErrWALFailed)
+	})
+
+	t.Run("resume fails while the cause remains", func(t *testing.T) {
+		fsys := vfs.NewMemFS()
+		w := newWAL(t, fsys, config.DurabilityGroup)
+		fsys.SetFault(func(op vfs.Op, _ string) error {
+			if op == vfs.OpOpen {
+				return syscall.EIO
+			}
+			return nil
+		})
+
+		assert.Error(t, write(w, "key1"))
+		assert.ErrorIs(t, w.Resume(), ErrResume)
+		assert.Error(t, w.Err())
+
+		fsys.SetFault(nil)
+		require.NoError(t, w.Resume())
+		assert.NoError(t, write(w, "key2"))
+	})
+
+	t.Run("resume of a healthy WAL", func(t *testing.T) {
+		w := newWAL(t, vfs.NewMemFS(), config.DurabilityGroup)
+		require.NoError(t, write(w, "key1"))
+		require.NoError(t, w.Resume())
+		assert.Equal(t, uint64(1), w.LSN())
+	})
+}
+
+func TestSubscribe(t *testing.T) {
+	w, err := New(config.WALConfig{
+		Enabled:              true,
+		Durability:           config.DurabilityGroup,
+		DataDirectory:        "/data/wal",
+		FlushingBatchSize:    1,
+		FlushingBatchTimeout: 10 * time.Millisecond,
+		MaxSegmentSizeBytes:  1 << 20,
+	}, vfs.NewMemFS(), testLogger())
+	require.NoError(t, err)
+	defer w.Close()
+
+	write := func(key string) {
+		_, err := w.Write(entry.Entry{Operation: entry.OperationSet, Key: key, Value: "value"})
+		require.NoError(t, err)
+	}
+
+	synced, cancel := w.Subscribe()
+	assert.Equal(t, Synced{Position: segment.Position{SegmentID: 1}}, <-synced)
+
+	write("key1")
+	first := <-synced
+	assert.Equal(t, uint64(1), first.LSN)
+	assert.Positive(t, first.Position.Offset)
+
+	// A subscriber that does not keep up only sees the latest position
+	write("key2")
+	write("key3")
+	last := <-synced
+	assert.Equal(t, uint64(3), last.LSN)
+	assert.Equal(t, 3*first.Position.Offset, last.Position.Offset)
+	assert.Empty(t, synced)
+
+	cancel()
+	write("key4")
+	assert.Empty(t, synced)
+}
+
+func TestReopen(t *testing.T) {
+	replayed := func(t *testing.T, w *Service) []uint64 {
+		t.Helper()
+
+		var lsns []uint64
+		require.NoError(t, w.Replay(segment.Position{}, func(e *entry.Entry) error {
+			lsns = append(lsns, e.LSN)
+			return nil
+		}))
+
+		return lsns
+	}
+
+	t.Run("writes continue after the segments of another writer", func(t *testing.T) {
+		tw := setupWAL(t)
+		defer tw.cleanup()
+
+		// A replication stream received three entries and half of a fourth
+		path := writeSegment(t, tw.cfg.DataDirectory, segment.FileName(1),
+			entry.Entry{LSN: 1, Operation: entry.OperationSet, Key: "k1", Value: "v1"},
+			entry.Entry{LSN: 2, Operation: entry.OperationSet, Key: "k2", Value: "v2"},
+			entry.Entry{LSN: 3, Operation: entry.OperationDelete, Key: "k1"},
+		)
+		var torn bytes.Buffer
+		_, err := (&entry.Entry{LSN: 4, Operation: entry.OperationClear}).WriteTo(&torn)
+		require.NoError(t, err)
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o600)
+		require.NoError(t, err)
+		_, err = f.Write(torn.Bytes()[:torn.Len()/2])
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		require.NoError(t, tw.wal.Reopen())
+		assert.Equal(t, uint64(3), tw.wal.LSN())
+		assert.Equal(t, Synced{Position: segment.Position{SegmentID: 4}, LSN: 3}, tw.wal.Synced())
+
+		_, err = tw.wal.Write(entry.Entry{Operation: entry.OperationSet, Key: "k4", Value: "v4"})
+		require.NoError(t, err)
+		assert.Equal(t, uint64(4), tw.wal.LSN())
+		_, err = tw.wal.Checkpoint()
+		require.NoError(t, err)
+		assert.Equal(t, []uint64{1, 2, 3, 4}, replayed(t, tw.wal))
+	})
+
+	t.Run("pending writes are flushed first", func(t *testing.T) {
+		tw := setupWAL(t)
+		defer tw.cleanup()
+
+		_, err := tw.wal.Write(entry.Entry{Operation: entry.OperationSet, Key: "k1", Value: "v1"})
+		require.NoError(t, err)
+		require.NoError(t, tw.wal.Reopen())
+		assert.Equal(t, uint64(1), tw.wal.Synced().LSN)
+		assert.Equal(t, []uint64{1}, replayed(t, tw.wal))
+	})
+}